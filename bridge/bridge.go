@@ -0,0 +1,469 @@
+// Package bridge mirrors topics between two MQTT brokers, i.e: from an edge
+// broker on each site to a central broker.
+//
+// A [Bridge] keeps one [mqtt.Client] connected to each broker and forwards
+// PUBLISH packets matching its [Rule]s in one or both directions, remapping
+// topic prefixes on the way:
+//
+//	b, err := bridge.New(bridge.Config{
+//		Local:  bridge.Endpoint{Dial: dialEdge, Connect: edgeConnect},
+//		Remote: bridge.Endpoint{Dial: dialCentral, Connect: centralConnect},
+//		Rules: []bridge.Rule{
+//			{Pattern: "sensors/#", Direction: bridge.Out, LocalPrefix: "site1/", RemotePrefix: "central/site1/"},
+//			{Pattern: "cmd/#", Direction: bridge.In, LocalPrefix: "site1/", RemotePrefix: "central/site1/"},
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	return b.Run(ctx)
+//
+// Each side reconnects independently; messages forwarded to a side that is
+// disconnected are dropped as is expected of QoS0.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// Default reconnection delays of a Bridge.
+const (
+	DefaultReconnectDelay    = time.Second
+	DefaultMaxReconnectDelay = time.Minute
+)
+
+// DefaultConnectTimeout is the default time allowed to connect and subscribe to a broker.
+const DefaultConnectTimeout = 10 * time.Second
+
+// DefaultLoopWindow is the default time a forwarded message is expected to be echoed back within.
+const DefaultLoopWindow = 5 * time.Second
+
+// markerRing is the number of forwarded messages remembered per side to detect loops.
+const markerRing = 256
+
+var (
+	errNoRules         = errors.New("bridge: no rules configured")
+	errNilDial         = errors.New("bridge: nil Dial in endpoint")
+	errEmptyPattern    = errors.New("bridge: empty rule pattern")
+	errNoDirection     = errors.New("bridge: rule has no direction")
+	errNoClientID      = errors.New("bridge: endpoint client identifier must be set")
+	errPingTimeout     = errors.New("bridge: no PINGRESP received within keep alive")
+	errBridgeCancelled = errors.New("bridge: context cancelled")
+)
+
+// Direction is the direction in which a Rule forwards messages.
+type Direction uint8
+
+const (
+	// Out forwards messages from the local broker to the remote broker.
+	Out Direction = 1 << iota
+	// In forwards messages from the remote broker to the local broker.
+	In
+	// Both forwards messages in both directions.
+	Both = Out | In
+)
+
+// String returns "out", "in" or "both". Does not allocate memory.
+func (d Direction) String() string {
+	switch d {
+	case Out:
+		return "out"
+	case In:
+		return "in"
+	case Both:
+		return "both"
+	}
+	return "none"
+}
+
+// Rule selects the topics forwarded by a Bridge, following the bridge
+// configuration of the Mosquitto broker. The topic filter subscribed to on the
+// local broker is LocalPrefix+Pattern and on the remote broker RemotePrefix+Pattern.
+// Forwarded topics have the prefix of the source replaced by that of the destination.
+// Unlike Mosquitto there is no per-direction QoS: topics are subscribed to and
+// forwarded with QoS0 since [mqtt.Client] only publishes with QoS0.
+type Rule struct {
+	// Pattern is a topic filter which may contain wildcards, i.e: "sensors/#".
+	Pattern   string
+	Direction Direction
+	// LocalPrefix and RemotePrefix are prepended to Pattern on each broker,
+	// i.e: "site1/" and "central/site1/". Either may be empty.
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Validate returns an error if the rule is invalid.
+func (r Rule) Validate() error {
+	if r.Pattern == "" {
+		return errEmptyPattern
+	} else if r.Direction&Both == 0 || r.Direction&^Both != 0 {
+		return errNoDirection
+	}
+	return nil
+}
+
+// filter returns the topic filter of the rule on the source broker of d.
+func (r Rule) filter(d Direction) string {
+	if d == Out {
+		return r.LocalPrefix + r.Pattern
+	}
+	return r.RemotePrefix + r.Pattern
+}
+
+// remap returns topic, received from the source broker of d, with the prefix
+// of the destination broker.
+func (r Rule) remap(d Direction, topic string) string {
+	if d == Out {
+		return r.RemotePrefix + strings.TrimPrefix(topic, r.LocalPrefix)
+	}
+	return r.LocalPrefix + strings.TrimPrefix(topic, r.RemotePrefix)
+}
+
+// Endpoint configures the connection to one of the bridged brokers.
+type Endpoint struct {
+	// Dial opens a connection to the broker, i.e: with transport.Dial.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// Connect holds the contents of the CONNECT packet. The client identifier
+	// must be set. If KeepAlive is not zero the bridge pings the broker every
+	// half keep alive and reconnects if it does not respond.
+	Connect mqtt.VariablesConnect
+}
+
+// Config is used to configure a new Bridge.
+type Config struct {
+	Local  Endpoint
+	Remote Endpoint
+	Rules  []Rule
+	// ReconnectDelay is the delay before reconnecting after a connection fails,
+	// doubled after each failed attempt up to MaxReconnectDelay. If zero
+	// DefaultReconnectDelay and DefaultMaxReconnectDelay are used.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// ConnectTimeout bounds dialing, connecting and subscribing to a broker.
+	// If zero DefaultConnectTimeout is used.
+	ConnectTimeout time.Duration
+	// LoopWindow is how long the marker of a forwarded message is kept to
+	// recognize it when the destination broker sends it back to the bridge.
+	// If zero DefaultLoopWindow is used.
+	LoopWindow time.Duration
+	// Logger receives diagnostic messages from the bridge and its clients.
+	// If nil nothing is logged.
+	Logger mqtt.Logger
+}
+
+// Stats are the counters of messages handled by a Bridge in one direction.
+type Stats struct {
+	// Forwarded is the number of messages published to the destination broker.
+	Forwarded uint64
+	// Dropped is the number of messages not published because the destination
+	// broker was disconnected or publishing failed.
+	Dropped uint64
+	// Loops is the number of messages dropped because the bridge itself
+	// forwarded them to the source broker.
+	Loops uint64
+}
+
+// Bridge forwards messages between a local and a remote MQTT broker. It is safe
+// for concurrent use.
+//
+// MQTT 3.1.1 has no message properties to carry a marker, so the bridge keeps
+// the marker itself: a fingerprint of the topic and payload of every message it
+// forwards. Messages received from a broker with the marker of a message the
+// bridge just forwarded to it are its own echoed back by an overlapping
+// subscription and are dropped instead of forwarded again. Each marker is
+// removed by the first echo or after Config.LoopWindow, so identical messages
+// are still forwarded by brokers that do not echo them back.
+type Bridge struct {
+	cfg    Config
+	local  side
+	remote side
+}
+
+// side is the connection to one of the brokers.
+type side struct {
+	b      *Bridge
+	ep     Endpoint
+	client *mqtt.Client
+	// dir is the direction of messages received from this side.
+	dir     Direction
+	filters []mqtt.SubscribeRequest
+
+	forwarded atomic.Uint64
+	dropped   atomic.Uint64
+	loops     atomic.Uint64
+
+	mu sync.Mutex
+	// markers holds the markers of the messages forwarded to this side in a ring.
+	markers [markerRing]marker
+	next    int
+}
+
+// marker identifies a message forwarded to a side until it expires.
+type marker struct {
+	fp      uint64
+	expires time.Time
+}
+
+// New creates a new Bridge. Call [Bridge.Run] to start forwarding.
+func New(cfg Config) (*Bridge, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, errNoRules
+	} else if cfg.Local.Dial == nil || cfg.Remote.Dial == nil {
+		return nil, errNilDial
+	} else if len(cfg.Local.Connect.ClientID) == 0 || len(cfg.Remote.Connect.ClientID) == 0 {
+		return nil, errNoClientID
+	}
+	for _, r := range cfg.Rules {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = DefaultReconnectDelay
+	}
+	if cfg.MaxReconnectDelay < cfg.ReconnectDelay {
+		cfg.MaxReconnectDelay = DefaultMaxReconnectDelay
+		if cfg.MaxReconnectDelay < cfg.ReconnectDelay {
+			cfg.MaxReconnectDelay = cfg.ReconnectDelay
+		}
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	if cfg.LoopWindow <= 0 {
+		cfg.LoopWindow = DefaultLoopWindow
+	}
+	b := &Bridge{cfg: cfg}
+	b.local.init(b, cfg.Local, Out)
+	b.remote.init(b, cfg.Remote, In)
+	return b, nil
+}
+
+// Run connects to both brokers and forwards messages until ctx is cancelled.
+// Each broker is reconnected independently when its connection fails. Run
+// disconnects from both brokers before returning ctx.Err().
+func (b *Bridge) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); b.local.run(ctx) }()
+	go func() { defer wg.Done(); b.remote.run(ctx) }()
+	wg.Wait()
+	return ctx.Err()
+}
+
+// IsConnected returns whether the bridge is connected to the local and the remote broker.
+func (b *Bridge) IsConnected() (local, remote bool) {
+	return b.local.client.IsConnected(), b.remote.client.IsConnected()
+}
+
+// Stats returns the counters of messages received from the broker on the side
+// of the direction, which must be Out or In.
+func (b *Bridge) Stats(d Direction) Stats {
+	s := &b.local
+	if d == In {
+		s = &b.remote
+	}
+	return Stats{Forwarded: s.forwarded.Load(), Dropped: s.dropped.Load(), Loops: s.loops.Load()}
+}
+
+// peer returns the other side of s.
+func (b *Bridge) peer(s *side) *side {
+	if s == &b.local {
+		return &b.remote
+	}
+	return &b.local
+}
+
+func (b *Bridge) log(level mqtt.LogLevel, msg string, keyvals ...any) {
+	if b.cfg.Logger != nil {
+		b.cfg.Logger.Log(level, msg, keyvals...)
+	}
+}
+
+func (s *side) init(b *Bridge, ep Endpoint, dir Direction) {
+	s.b = b
+	s.ep = ep
+	s.dir = dir
+	s.client = mqtt.NewClient(mqtt.ClientConfig{OnPub: s.onPub, Logger: b.cfg.Logger})
+	for _, r := range b.cfg.Rules {
+		if r.Direction&dir != 0 {
+			s.filters = append(s.filters, mqtt.SubscribeRequest{TopicFilter: []byte(r.filter(dir)), QoS: mqtt.QoS0})
+		}
+	}
+}
+
+// run keeps the side connected until ctx is cancelled.
+func (s *side) run(ctx context.Context) {
+	delay := s.b.cfg.ReconnectDelay
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := s.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > s.b.cfg.MaxReconnectDelay {
+			delay = s.b.cfg.ReconnectDelay // Connection was up for a while.
+		}
+		s.b.log(mqtt.LevelWarn, "bridge connection failed", "client", string(s.ep.Connect.ClientID), "err", err, "retry", delay.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > s.b.cfg.MaxReconnectDelay {
+			delay = s.b.cfg.MaxReconnectDelay
+		}
+	}
+}
+
+// serve connects and subscribes to the broker and handles incoming packets until
+// the connection fails or ctx is cancelled.
+func (s *side) serve(ctx context.Context) error {
+	cctx, cancel := context.WithTimeout(ctx, s.b.cfg.ConnectTimeout)
+	defer cancel()
+	conn, err := s.ep.Dial(cctx)
+	if err != nil {
+		return err
+	}
+	deadline, _ := cctx.Deadline()
+	conn.SetDeadline(deadline) // Connect and Subscribe do not interrupt reads when ctx is done.
+	vc := s.ep.Connect
+	err = s.client.Connect(cctx, conn, &vc)
+	if err == nil {
+		err = s.client.Subscribe(cctx, mqtt.VariablesSubscribe{PacketIdentifier: 1, TopicFilters: s.filters})
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		if s.client.IsConnected() {
+			s.client.Disconnect(err)
+		}
+		conn.Close()
+		return err
+	}
+	s.b.log(mqtt.LevelInfo, "bridge connected", "client", string(vc.ClientID))
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.supervise(ctx, conn, done, time.Duration(vc.KeepAlive)*time.Second/2)
+	for s.client.IsConnected() {
+		s.client.HandleNext()
+	}
+	return s.client.Err()
+}
+
+// supervise pings the broker every interval and disconnects the client when the
+// broker does not respond or ctx is cancelled, which ends serve.
+func (s *side) supervise(ctx context.Context, conn net.Conn, done <-chan struct{}, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			s.disconnect(conn, errBridgeCancelled)
+			return
+		case <-tick:
+			if s.client.AwaitingPingresp() {
+				s.disconnect(conn, errPingTimeout)
+				return
+			}
+			s.client.StartPing()
+		}
+	}
+}
+
+// disconnect disconnects the client while serve is blocked reading from conn.
+func (s *side) disconnect(conn net.Conn, err error) {
+	conn.SetReadDeadline(time.Now()) // Unblock HandleNext so Disconnect can close conn.
+	s.client.Disconnect(err)
+}
+
+// onPub forwards a message received from the broker of s to its peer.
+func (s *side) onPub(hdr mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	topic := string(vp.TopicName)
+	if s.unmark(topic, payload) {
+		s.loops.Add(1)
+		return nil
+	}
+	rule, ok := s.match(topic)
+	if !ok {
+		return nil
+	}
+	dst := s.b.peer(s)
+	fwd := rule.remap(s.dir, topic)
+	flags, _ := mqtt.NewPublishFlags(mqtt.QoS0, false, hdr.Flags().Retain())
+	dst.mark(fwd, payload)
+	err = dst.client.PublishPayload(flags, mqtt.VariablesPublish{TopicName: []byte(fwd)}, payload)
+	if err != nil {
+		dst.unmark(fwd, payload)
+		s.dropped.Add(1)
+		s.b.log(mqtt.LevelDebug, "bridge dropped message", "topic", topic, "err", err)
+		return nil // Failure of the destination must not disconnect the source.
+	}
+	s.forwarded.Add(1)
+	return nil
+}
+
+// match returns the first rule forwarding topic from the broker of s.
+func (s *side) match(topic string) (Rule, bool) {
+	for _, r := range s.b.cfg.Rules {
+		if r.Direction&s.dir != 0 && mqtt.MatchTopic(r.filter(s.dir), topic) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// mark records the marker of a message forwarded to s.
+func (s *side) mark(topic string, payload []byte) {
+	fp := fingerprint(topic, payload)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markers[s.next] = marker{fp: fp, expires: time.Now().Add(s.b.cfg.LoopWindow)}
+	s.next = (s.next + 1) % markerRing
+}
+
+// unmark returns true and forgets the marker if the message was forwarded to s
+// and its marker has not expired.
+func (s *side) unmark(topic string, payload []byte) bool {
+	fp := fingerprint(topic, payload)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.markers {
+		if m.fp == fp && now.Before(m.expires) {
+			s.markers[i] = marker{}
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint returns the marker of a message. It is never zero.
+func fingerprint(topic string, payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return h.Sum64() | 1
+}
@@ -0,0 +1,225 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestBridge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	edge, central := &mqtttest.Broker{}, &mqtttest.Broker{}
+	defer edge.Close()
+	defer central.Close()
+	b, err := New(Config{
+		Local:  endpoint(edge, "bridge-edge"),
+		Remote: endpoint(central, "bridge-central"),
+		Rules: []Rule{
+			{Pattern: "sensors/#", Direction: Out, LocalPrefix: "site1/", RemotePrefix: "central/site1/"},
+			{Pattern: "cmd/#", Direction: In, LocalPrefix: "site1/", RemotePrefix: "central/site1/"},
+			{Pattern: "sync/#", Direction: Both},
+		},
+		ReconnectDelay: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- b.Run(runCtx) }()
+	waitSubscribed(t, &b.local)
+	waitSubscribed(t, &b.remote)
+
+	atCentral := observe(t, ctx, central, "central/site1/sensors/#", "sync/#")
+	atEdge := observe(t, ctx, edge, "site1/cmd/#")
+	edge.Publish("site1/sensors/temp", []byte("21"))
+	expect(t, atCentral, "central/site1/sensors/temp 21")
+	edge.Publish("site1/other", []byte("not forwarded"))
+	central.Publish("central/site1/cmd/reboot", []byte("now"))
+	expect(t, atEdge, "site1/cmd/reboot now")
+	// Message forwarded to central returns to the bridge through its own
+	// subscription to sync/# and is not forwarded back to the edge.
+	edge.Publish("sync/config", []byte("v2"))
+	expect(t, atCentral, "sync/config v2")
+	waitFor(t, func() bool { return b.Stats(In).Loops == 1 })
+	if out, in := b.Stats(Out), b.Stats(In); out.Forwarded != 2 || in.Forwarded != 1 || out.Loops != 0 {
+		t.Errorf("got stats out %+v in %+v", out, in)
+	}
+
+	// Central side reconnects on its own.
+	localSession := b.local.client.ConnectedAt()
+	central.DropConnections()
+	waitFor(t, func() bool { _, remote := b.IsConnected(); return !remote })
+	edge.Publish("site1/sensors/temp", []byte("lost"))
+	waitFor(t, func() bool { return b.Stats(Out).Dropped == 1 })
+	waitSubscribed(t, &b.remote)
+	if b.local.client.ConnectedAt() != localSession {
+		t.Error("local side reconnected after remote connection failed")
+	}
+	atCentral = observe(t, ctx, central, "central/site1/sensors/#")
+	edge.Publish("site1/sensors/temp", []byte("22"))
+	expect(t, atCentral, "central/site1/sensors/temp 22")
+
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v", err)
+	}
+	if local, remote := b.IsConnected(); local || remote {
+		t.Error("bridge connected after Run returned")
+	}
+}
+
+func TestBridgeNoEcho(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	edge, central := &mqtttest.Broker{}, &mqtttest.Broker{}
+	defer edge.Close()
+	defer central.Close()
+	edge.SetBehavior(mqtttest.Behavior{NoLocal: true})
+	central.SetBehavior(mqtttest.Behavior{NoLocal: true})
+	b, err := New(Config{
+		Local:      endpoint(edge, "bridge-edge"),
+		Remote:     endpoint(central, "bridge-central"),
+		Rules:      []Rule{{Pattern: "sync/#", Direction: Both}},
+		LoopWindow: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Run(ctx)
+	waitSubscribed(t, &b.local)
+	waitSubscribed(t, &b.remote)
+
+	atCentral := observe(t, ctx, central, "sync/#")
+	atEdge := observe(t, ctx, edge, "sync/#")
+	// Neither broker echoes forwarded messages back to the bridge.
+	for i := 0; i < 2; i++ {
+		edge.Publish("sync/config", []byte("v2"))
+		expect(t, atEdge, "sync/config v2")
+		expect(t, atCentral, "sync/config v2")
+	}
+	time.Sleep(100 * time.Millisecond) // Markers of unechoed messages expire.
+	central.Publish("sync/config", []byte("v2"))
+	expect(t, atCentral, "sync/config v2")
+	expect(t, atEdge, "sync/config v2")
+	waitFor(t, func() bool { return b.Stats(In).Forwarded == 1 })
+	if out, in := b.Stats(Out), b.Stats(In); out.Forwarded != 2 || out.Loops != 0 || in.Loops != 0 {
+		t.Errorf("got stats out %+v in %+v", out, in)
+	}
+}
+
+func TestNew(t *testing.T) {
+	ep := endpoint(&mqtttest.Broker{}, "bridge")
+	rules := []Rule{{Pattern: "a/#", Direction: Both}}
+	for _, test := range []struct {
+		cfg  Config
+		want error
+	}{
+		{cfg: Config{Local: ep, Remote: ep}, want: errNoRules},
+		{cfg: Config{Local: ep, Rules: rules}, want: errNilDial},
+		{cfg: Config{Local: ep, Remote: Endpoint{Dial: ep.Dial}, Rules: rules}, want: errNoClientID},
+		{cfg: Config{Local: ep, Remote: ep, Rules: []Rule{{Direction: Out}}}, want: errEmptyPattern},
+		{cfg: Config{Local: ep, Remote: ep, Rules: []Rule{{Pattern: "a"}}}, want: errNoDirection},
+		{cfg: Config{Local: ep, Remote: ep, Rules: rules}},
+	} {
+		_, err := New(test.cfg)
+		if err != test.want {
+			t.Errorf("got error %v, want %v", err, test.want)
+		}
+	}
+}
+
+func TestRuleRemap(t *testing.T) {
+	r := Rule{Pattern: "sensors/+/temp", Direction: Both, LocalPrefix: "site1/", RemotePrefix: "central/site1/"}
+	if got := r.filter(Out); got != "site1/sensors/+/temp" {
+		t.Errorf("local filter %q", got)
+	}
+	if got := r.filter(In); got != "central/site1/sensors/+/temp" {
+		t.Errorf("remote filter %q", got)
+	}
+	if got := r.remap(Out, "site1/sensors/a/temp"); got != "central/site1/sensors/a/temp" {
+		t.Errorf("remapped out %q", got)
+	}
+	if got := r.remap(In, "central/site1/sensors/a/temp"); got != "site1/sensors/a/temp" {
+		t.Errorf("remapped in %q", got)
+	}
+}
+
+func endpoint(b *mqtttest.Broker, clientID string) Endpoint {
+	ep := Endpoint{Dial: func(ctx context.Context) (net.Conn, error) { return b.Dial(), nil }}
+	ep.Connect.SetDefaultMQTT([]byte(clientID))
+	return ep
+}
+
+// observe subscribes a new client of b to filters and returns the received
+// messages formatted as "topic payload".
+func observe(t *testing.T, ctx context.Context, b *mqtttest.Broker, filters ...string) <-chan string {
+	t.Helper()
+	msgs := make(chan string, 16)
+	c := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			msgs <- string(vp.TopicName) + " " + string(payload)
+			return err
+		},
+	})
+	var vc mqtt.VariablesConnect
+	vc.SetDefaultMQTT([]byte("observer"))
+	vsub := mqtt.VariablesSubscribe{PacketIdentifier: 1}
+	for _, filter := range filters {
+		vsub.TopicFilters = append(vsub.TopicFilters, mqtt.SubscribeRequest{TopicFilter: []byte(filter)})
+	}
+	err := c.Connect(ctx, b.Dial(), &vc)
+	if err == nil {
+		err = c.Subscribe(ctx, vsub)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for c.IsConnected() {
+			c.HandleNext()
+		}
+	}()
+	t.Cleanup(func() {
+		if c.IsConnected() {
+			c.Disconnect(errors.New("done"))
+		}
+	})
+	return msgs
+}
+
+func expect(t *testing.T, msgs <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-msgs:
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not receive %q", want)
+	}
+}
+
+func waitSubscribed(t *testing.T, s *side) {
+	t.Helper()
+	// Subscribed topics are only reset on the next connection.
+	waitFor(t, func() bool { return s.client.IsConnected() && len(s.client.SubscribedTopics()) == len(s.filters) })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
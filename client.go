@@ -9,10 +9,6 @@ import (
 	"time"
 )
 
-var (
-	errDisconnected = errors.New("natiu-mqtt: disconnected")
-)
-
 // Client is a asynchronous MQTT v3.1.1 client implementation which is
 // safe for concurrent use.
 type Client struct {
@@ -32,6 +28,12 @@ type ClientConfig struct {
 	// OnPub is executed on every PUBLISH message received. Do not call
 	// HandleNext or other client methods from within this function.
 	OnPub func(pubHead Header, varPub VariablesPublish, r io.Reader) error
+	// Logger receives diagnostic messages from the client and its underlying Rx and Tx.
+	// If nil nothing is logged.
+	Logger Logger
+	// Tracer is set as the Tracer of the client's underlying Rx and Tx so every
+	// packet read and written by the client is traced. If nil tracing is disabled.
+	Tracer Tracer
 	// TODO: add a backoff algorithm callback here so clients can roll their own.
 }
 
@@ -47,9 +49,13 @@ func NewClient(cfg ClientConfig) *Client {
 	if cfg.Decoder == nil {
 		cfg.Decoder = DecoderNoAlloc{UserBuffer: make([]byte, 4*1024)}
 	}
-	c := &Client{cs: clientState{closeErr: errors.New("yet to connect")}}
+	c := &Client{cs: clientState{closeErr: ErrNotConnected, logger: cfg.Logger}}
 	c.rx.RxCallbacks, c.tx.TxCallbacks = c.cs.callbacks(onPub)
 	c.rx.userDecoder = cfg.Decoder
+	c.rx.Logger = cfg.Logger
+	c.tx.Logger = cfg.Logger
+	c.rx.Tracer = cfg.Tracer
+	c.tx.Tracer = cfg.Tracer
 	return c
 }
 
@@ -67,13 +73,13 @@ func (c *Client) HandleNext() error {
 			//  - We've read a malformed packet: n!=0
 			//  - We receive an error signalling end of data (EOF) or closing of network connection.
 			// We don't want to disconnect if we've read 0 bytes and get a timeout error (there may be more data in future)
-			c.cs.OnDisconnect(err)
 			c.txlock.Lock()
 			c.tx.WriteSimple(PacketDisconnect) // Try to write disconnect but don't hold your breath. This is probably useless.
 			c.txlock.Unlock()
+			c.rx.RxCallbacks.OnRxError(&c.rx, err) // Logs, disconnects and closes the network connection.
 		} else {
-			// Not a any of above cases. We stay connected and ignore error, but print it.
-			println("ignoring error", err.Error())
+			// Not a any of above cases. We stay connected and ignore error, but log it.
+			c.cs.log(LevelDebug, "ignoring error", "err", err)
 			err = nil
 		}
 	}
@@ -86,7 +92,7 @@ func (c *Client) readNextWrapped() (int, error) {
 	defer c.rxlock.Unlock()
 	if !c.IsConnected() && c.cs.lastTx.IsZero() {
 		// Client disconnected and not expecting to receive packets back.
-		return 0, errDisconnected
+		return 0, c.errDisconnected()
 	}
 	return c.rx.ReadNextPacket()
 }
@@ -101,7 +107,7 @@ func (c *Client) StartConnect(rwc io.ReadWriteCloser, vc *VariablesConnect) erro
 	c.tx.SetTxTransport(rwc)
 	c.rx.SetRxTransport(rwc)
 	if c.cs.IsConnected() {
-		return errors.New("already connected; disconnect before connecting")
+		return ErrAlreadyConnected
 	}
 	return c.tx.WriteConnect(vc)
 }
@@ -141,7 +147,7 @@ func (c *Client) Disconnect(userErr error) error {
 	c.txlock.Lock()
 	defer c.txlock.Unlock()
 	if !c.IsConnected() {
-		return errDisconnected
+		return c.errDisconnected()
 	}
 	c.cs.OnDisconnect(userErr)
 	err := c.tx.WriteSimple(PacketDisconnect)
@@ -163,18 +169,19 @@ func (c *Client) StartSubscribe(vsub VariablesSubscribe) error {
 	c.txlock.Lock()
 	defer c.txlock.Unlock()
 	if !c.IsConnected() {
-		return errDisconnected
+		return c.errDisconnected()
 	}
 	if c.AwaitingSuback() {
 		// TODO(soypat): Allow multiple subscriptions to be queued.
-		return errors.New("tried to subscribe while still awaiting suback")
+		return ErrAwaitingSuback
 	}
 	c.cs.pendingSubs = vsub.Copy()
 	return c.tx.WriteSubscribe(vsub)
 }
 
 // Subscribe writes a SUBSCRIBE packet over the network and waits for the server
-// to respond with a SUBACK packet or until the context ends.
+// to respond with a SUBACK packet or until the context ends. If the server
+// rejects any of the topic filters a *SubackError is returned.
 func (c *Client) Subscribe(ctx context.Context, vsub VariablesSubscribe) error {
 	session := c.ConnectedAt()
 	err := c.StartSubscribe(vsub)
@@ -185,12 +192,17 @@ func (c *Client) Subscribe(ctx context.Context, vsub VariablesSubscribe) error {
 	for c.cs.PendingSublen() != 0 && ctx.Err() == nil {
 		if c.ConnectedAt() != session {
 			// Prevent waiting on subscribes from previous connection or during disconnection.
-			return errDisconnected
+			return c.errDisconnected()
 		}
 		backoff.Miss()
 		c.HandleNext()
 	}
-	return ctx.Err()
+	if err := ctx.Err(); err != nil {
+		return err
+	} else if c.ConnectedAt() != session {
+		return c.errDisconnected()
+	}
+	return c.cs.SubackErr()
 }
 
 // SubscribedTopics returns list of topics the client successfully subscribed to.
@@ -209,14 +221,19 @@ func (c *Client) PublishPayload(flags PacketFlags, varPub VariablesPublish, payl
 	}
 	qos := flags.QoS()
 	if qos != QoS0 {
-		return errors.New("only supports QoS0")
+		return ErrUnsupportedQoS
 	}
 	c.txlock.Lock()
 	defer c.txlock.Unlock()
 	if !c.IsConnected() {
-		return errDisconnected
+		c.cs.PublishDropped()
+		return c.errDisconnected()
 	}
-	return c.tx.WritePublishPayload(newHeader(PacketPublish, flags, uint32(varPub.Size(qos)+len(payload))), varPub, payload)
+	err := c.tx.WritePublishPayload(newHeader(PacketPublish, flags, uint32(varPub.Size(qos)+len(payload))), varPub, payload)
+	if err != nil {
+		c.cs.PublishDropped()
+	}
+	return err
 }
 
 // Err returns error indicating the cause of client disconnection.
@@ -229,7 +246,7 @@ func (c *Client) StartPing() error {
 	c.txlock.Lock()
 	defer c.txlock.Unlock()
 	if !c.IsConnected() {
-		return errDisconnected
+		return c.errDisconnected()
 	}
 	err := c.tx.WriteSimple(PacketPingreq)
 	if err == nil {
@@ -255,7 +272,7 @@ func (c *Client) Ping(ctx context.Context) error {
 	for pingTime == c.cs.LastPingTime() && ctx.Err() == nil {
 		if c.ConnectedAt() != session {
 			// Prevent waiting on subscribes from previous connection or during disconnection.
-			return errDisconnected
+			return c.errDisconnected()
 		}
 		backoff.Miss()
 		c.HandleNext()
@@ -283,6 +300,14 @@ func (c *Client) LastRx() time.Time { return c.cs.LastRx() }
 // If Client is disconnected LastTx returns the zero value of time.Time.
 func (c *Client) LastTx() time.Time { return c.cs.LastTx() }
 
+// Metrics returns a snapshot of the client's packet counters and latency histograms.
+func (c *Client) Metrics() Metrics { return c.cs.Metrics() }
+
+// errDisconnected returns a *DisconnectedError with the cause of the last disconnection.
+func (c *Client) errDisconnected() error {
+	return &DisconnectedError{Cause: c.cs.Err()}
+}
+
 func newBackoff() exponentialBackoff {
 	return exponentialBackoff{
 		MaxWait: 500 * time.Millisecond,
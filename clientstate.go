@@ -1,7 +1,6 @@
 package mqtt
 
 import (
-	"errors"
 	"io"
 	"sync"
 	"time"
@@ -20,6 +19,13 @@ type clientState struct {
 	// closeErr stores the reason for disconnection.
 	closeErr    error
 	pendingSubs VariablesSubscribe
+	// subackErr stores the SUBACK rejections of the last subscription.
+	subackErr error
+	logger    Logger
+	// subSentAt is the time the pending SUBSCRIBE was written at.
+	subSentAt     time.Time
+	everConnected bool
+	metrics       Metrics
 }
 
 // onConnect is meant to be called on opening a new connection to delete
@@ -33,6 +39,11 @@ func (cs *clientState) onConnect(t time.Time) {
 	cs.lastRx = t
 	cs.connectedAt = t
 	cs.pendingSubs = VariablesSubscribe{}
+	cs.subackErr = nil
+	if cs.everConnected {
+		cs.metrics.Reconnects++
+	}
+	cs.everConnected = true
 }
 
 // onConnect is meant to be called on opening a new connection to delete
@@ -55,6 +66,7 @@ func (cs *clientState) onDisconnect(err error) {
 	cs.pendingPingreq = time.Time{}
 	cs.pendingPingresp = time.Time{}
 	cs.pendingSubs = VariablesSubscribe{}
+	cs.subSentAt = time.Time{}
 }
 
 // callbacks returns the Rx and Tx callbacks necessary for a clientState to function automatically.
@@ -66,31 +78,65 @@ func (cs *clientState) callbacks(onPub func(rx *Rx, varPub VariablesPublish, r i
 				cs.mu.Lock()
 				defer cs.mu.Unlock()
 				cs.lastRx = connTime
+				cs.metrics.countRx(r.LastReceivedHeader)
 				if cs.closeErr == nil {
-					return errors.New("connack received while connected")
+					return newProtocolError(PacketConnack, "", "CONNACK received while connected")
 				}
 				if vc.ReturnCode != 0 {
-					return vc.ReturnCode
+					return &ConnectError{ReturnCode: vc.ReturnCode}
 				}
 				cs.onConnect(connTime)
 				return nil
 			},
-			OnPub: onPub,
+			OnPub: func(rx *Rx, varPub VariablesPublish, r io.Reader) error {
+				start := time.Now()
+				var err error
+				if onPub != nil {
+					err = onPub(rx, varPub, r)
+				} else {
+					err = rx.exhaustReader(r)
+				}
+				end := time.Now()
+				cs.mu.Lock()
+				defer cs.mu.Unlock()
+				cs.metrics.countRx(rx.LastReceivedHeader)
+				if onPub != nil {
+					cs.metrics.OnPubDuration.Observe(end.Sub(start))
+				}
+				if onPub != nil && err != nil {
+					cs.metrics.PublishesDropped++
+				}
+				return err
+			},
 			OnSuback: func(r *Rx, vs VariablesSuback) error {
 				rxTime := time.Now()
 				cs.mu.Lock()
 				defer cs.mu.Unlock()
 				cs.lastRx = rxTime
+				cs.metrics.countRx(r.LastReceivedHeader)
+				if !cs.subSentAt.IsZero() {
+					cs.metrics.SubackLatency.Observe(rxTime.Sub(cs.subSentAt))
+					cs.subSentAt = time.Time{}
+				}
 				if len(vs.ReturnCodes) != len(cs.pendingSubs.TopicFilters) {
-					return errors.New("got mismatched number of return codes compared to pending client subscriptions")
+					return newProtocolError(PacketSuback, "MQTT-3.9.3-1", "got mismatched number of return codes compared to pending client subscriptions")
 				}
+				var rejected []string
 				for i, qos := range vs.ReturnCodes {
-					if qos != QoSSubfail {
-						if qos != cs.pendingSubs.TopicFilters[i].QoS {
-							return errors.New("QoS does not match requested QoS for topic")
-						}
-						cs.activeSubs = append(cs.activeSubs, string(cs.pendingSubs.TopicFilters[i].TopicFilter))
+					topic := string(cs.pendingSubs.TopicFilters[i].TopicFilter)
+					if qos == QoSSubfail {
+						rejected = append(rejected, topic)
+						continue
+					}
+					if qos > cs.pendingSubs.TopicFilters[i].QoS {
+						// The server may grant a lower QoS than requested.
+						return newProtocolError(PacketSuback, "", "granted QoS higher than requested QoS for topic")
 					}
+					cs.activeSubs = append(cs.activeSubs, topic)
+				}
+				cs.subackErr = nil
+				if len(rejected) > 0 {
+					cs.subackErr = &SubackError{PacketIdentifier: vs.PacketIdentifier, Rejected: rejected}
 				}
 				cs.pendingSubs.TopicFilters = cs.pendingSubs.TopicFilters[:0]
 				return nil
@@ -101,15 +147,19 @@ func (cs *clientState) callbacks(onPub func(rx *Rx, varPub VariablesPublish, r i
 				cs.mu.Lock()
 				defer cs.mu.Unlock()
 				cs.lastRx = rxTime
+				cs.metrics.countRx(rx.LastReceivedHeader)
 				switch tp {
 				case PacketDisconnect:
-					err = errDisconnected
+					err = errRxDisconnect
 				case PacketPingreq:
 					cs.pendingPingreq = rxTime
 				case PacketPingresp:
+					if !cs.pendingPingresp.IsZero() {
+						cs.metrics.PingRTT.Observe(rxTime.Sub(cs.pendingPingresp))
+					}
 					cs.pendingPingresp = time.Time{} // got the response, we can unflag.
 				default:
-					println("unexpected packet type: ", tp.String())
+					cs.log(LevelWarn, "unexpected packet type", "packet", tp.String())
 				}
 				if err != nil {
 					cs.onDisconnect(err)
@@ -117,20 +167,34 @@ func (cs *clientState) callbacks(onPub func(rx *Rx, varPub VariablesPublish, r i
 				return err
 			},
 			OnRxError: func(r *Rx, err error) {
-				cs.onDisconnect(err)
+				cs.log(LevelError, "disconnecting on error", "err", err)
+				cs.OnDisconnect(err)
+				r.CloseRx() // Close the network connection on malformed packets as per MQTT-4.8.0-1.
 			},
 		}, TxCallbacks{
 			OnTxError: func(tx *Tx, err error) {
 				cs.onDisconnect(err)
 			},
 			OnSuccessfulTx: func(tx *Tx) {
+				txTime := time.Now()
 				cs.mu.Lock()
 				defer cs.mu.Unlock()
-				cs.lastTx = time.Now()
+				cs.lastTx = txTime
+				cs.metrics.countTx(tx.LastSentHeader)
+				if tx.LastSentHeader.Type() == PacketSubscribe {
+					cs.subSentAt = txTime
+				}
 			},
 		}
 }
 
+// log logs a message if a logger is set. Not guarded by mutex.
+func (cs *clientState) log(level LogLevel, msg string, keyvals ...any) {
+	if cs.logger != nil {
+		cs.logger.Log(level, msg, keyvals...)
+	}
+}
+
 // IsConnected returns true if the client is currently connected.
 func (cs *clientState) IsConnected() bool {
 	cs.mu.Lock()
@@ -176,12 +240,12 @@ func (cs *clientState) awaitingSuback() bool {
 
 func (cs *clientState) RegisterSubscribe(vsub VariablesSubscribe) error {
 	if len(vsub.TopicFilters) == 0 {
-		return errors.New("need at least one topic to subscribe")
+		return errNoSubscribeFilters
 	}
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	if cs.awaitingSuback() {
-		return errors.New("tried to register subscribe while awaiting suback")
+		return ErrAwaitingSuback
 	}
 	cs.pendingSubs = vsub.Copy()
 	return nil
@@ -192,6 +256,27 @@ func (cs *clientState) LastPingTime() time.Time {
 	return cs.pendingPingresp
 }
 
+// SubackErr returns a *SubackError if the last SUBACK received rejected topic filters.
+func (cs *clientState) SubackErr() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.subackErr
+}
+
+// Metrics returns a snapshot of the client's metrics.
+func (cs *clientState) Metrics() Metrics {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.metrics
+}
+
+// PublishDropped counts a publish that failed to be written.
+func (cs *clientState) PublishDropped() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.metrics.PublishesDropped++
+}
+
 func (cs *clientState) PendingSublen() int {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
@@ -0,0 +1,299 @@
+// Command natiu-decode decodes a captured MQTT byte stream and prints its packets.
+//
+// Usage:
+//
+//	natiu-decode [-x] [-strict] [-n bytes] [file]
+//
+// The stream is read from file or from standard input if no file is given. With
+// -x the input is hex text as copied from a logic analyzer or serial console,
+// i.e: "10 17 00 04 4d 51" or "0x10,0x17". Whitespace, commas, colons, dashes
+// and 0x prefixes are ignored.
+//
+// Each packet is printed with its offset in the stream, fixed header flags,
+// variable header fields and a preview of the PUBLISH payload. If the stream
+// is malformed the offset where decoding failed is printed along with a hex dump
+// of the offending packet and natiu-decode exits with status 1.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "natiu-decode:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("natiu-decode", flag.ContinueOnError)
+	var (
+		hexInput = fs.Bool("x", false, "input is hex text instead of raw bytes")
+		strict   = fs.Bool("strict", false, "validate packets against MQTT v3.1.1 normative statements")
+		preview  = fs.Int("n", 64, "maximum number of payload `bytes` to print")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: natiu-decode [-x] [-strict] [-n bytes] [file]")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	switch fs.NArg() {
+	case 0:
+		data, err = io.ReadAll(stdin)
+	case 1:
+		if fs.Arg(0) == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(fs.Arg(0))
+		}
+	default:
+		return errors.New("expected at most one file argument")
+	}
+	if err != nil {
+		return err
+	}
+	if *hexInput {
+		data, err = decodeHex(string(data))
+		if err != nil {
+			return err
+		}
+	}
+	d := decoder{w: stdout, preview: *preview}
+	return d.decode(data, *strict)
+}
+
+// decoder prints the packets of a stream as they are decoded by Rx.
+type decoder struct {
+	w       io.Writer
+	preview int
+	// start is the offset in the stream of the packet being decoded.
+	start int
+}
+
+func (d *decoder) decode(data []byte, strict bool) error {
+	r := bytes.NewReader(data)
+	var rx mqtt.Rx
+	rx.SetRxTransport(io.NopCloser(r))
+	rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, len(data))})
+	rx.Strict = strict
+	rx.RxCallbacks = d.callbacks()
+	packets := 0
+	for r.Len() > 0 {
+		d.start = len(data) - r.Len()
+		_, err := rx.ReadNextPacket()
+		if err != nil {
+			failedAt := len(data) - r.Len()
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("stream ends mid-packet: %w", err)
+			}
+			hdr := rx.LastReceivedHeader
+			what := "fixed header"
+			if hdr.Type() != 0 {
+				what = hdr.Type().String()
+			}
+			fmt.Fprintf(d.w, "0x%04x malformed %s at offset %#x: %v\n", d.start, what, failedAt, err)
+			end := failedAt + 16
+			if hdr.Type() != 0 && d.start+hdr.Size()+int(hdr.RemainingLength) > end {
+				end = d.start + hdr.Size() + int(hdr.RemainingLength)
+			}
+			if end > len(data) {
+				end = len(data)
+			}
+			d.dump(data[d.start:end], failedAt-d.start)
+			return fmt.Errorf("decoding failed at offset %#x after %d packets", failedAt, packets)
+		}
+		packets++
+	}
+	return nil
+}
+
+func (d *decoder) callbacks() mqtt.RxCallbacks {
+	return mqtt.RxCallbacks{
+		OnConnect: func(rx *mqtt.Rx, vc *mqtt.VariablesConnect) error {
+			d.header(rx.LastReceivedHeader)
+			d.printf("protocol=%q level=%d clean=%v keepalive=%d client=%q", vc.Protocol, vc.ProtocolLevel, vc.CleanSession, vc.KeepAlive, vc.ClientID)
+			if vc.WillFlag() {
+				d.printf("will: topic=%q qos=%d retain=%v message=%s", vc.WillTopic, vc.WillQoS, vc.WillRetain, d.previewBytes(vc.WillMessage))
+			}
+			if len(vc.Username) != 0 {
+				d.printf("username=%q password=%d bytes", vc.Username, len(vc.Password))
+			}
+			return nil
+		},
+		OnConnack: func(rx *mqtt.Rx, vc mqtt.VariablesConnack) error {
+			d.header(rx.LastReceivedHeader)
+			d.printf("session_present=%v return_code=%d (%s)", vc.SessionPresent(), vc.ReturnCode, vc.ReturnCode)
+			return nil
+		},
+		OnPub: func(rx *mqtt.Rx, vp mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			hdr := rx.LastReceivedHeader
+			flags := hdr.Flags()
+			d.header(hdr)
+			if flags.QoS() != mqtt.QoS0 {
+				d.printf("topic=%q packet_id=%d", vp.TopicName, vp.PacketIdentifier)
+			} else {
+				d.printf("topic=%q", vp.TopicName)
+			}
+			d.printf("payload %d bytes: %s", len(payload), d.previewBytes(payload))
+			return nil
+		},
+		OnSub: func(rx *mqtt.Rx, vs mqtt.VariablesSubscribe) error {
+			d.header(rx.LastReceivedHeader)
+			d.printf("packet_id=%d", vs.PacketIdentifier)
+			for _, sub := range vs.TopicFilters {
+				d.printf("filter=%q qos=%d", sub.TopicFilter, sub.QoS)
+			}
+			return nil
+		},
+		OnSuback: func(rx *mqtt.Rx, vs mqtt.VariablesSuback) error {
+			d.header(rx.LastReceivedHeader)
+			codes := make([]string, len(vs.ReturnCodes))
+			for i, rc := range vs.ReturnCodes {
+				codes[i] = fmt.Sprintf("0x%02x", uint8(rc))
+			}
+			d.printf("packet_id=%d return_codes=[%s]", vs.PacketIdentifier, strings.Join(codes, " "))
+			return nil
+		},
+		OnUnsub: func(rx *mqtt.Rx, vu mqtt.VariablesUnsubscribe) error {
+			d.header(rx.LastReceivedHeader)
+			d.printf("packet_id=%d", vu.PacketIdentifier)
+			for _, topic := range vu.Topics {
+				d.printf("filter=%q", topic)
+			}
+			return nil
+		},
+		OnOther: func(rx *mqtt.Rx, packetIdentifier uint16) error {
+			hdr := rx.LastReceivedHeader
+			d.header(hdr)
+			if hdr.HasPacketIdentifier() {
+				d.printf("packet_id=%d", packetIdentifier)
+			}
+			return nil
+		},
+		OnRxError: func(*mqtt.Rx, error) {}, // Errors are reported by decode.
+	}
+}
+
+// header prints the first line of a packet with its offset and fixed header.
+func (d *decoder) header(hdr mqtt.Header) {
+	flags := hdr.Flags()
+	fmt.Fprintf(d.w, "0x%04x %s flags=%04b", d.start, hdr.Type(), uint8(flags))
+	if hdr.Type() == mqtt.PacketPublish {
+		fmt.Fprintf(d.w, " (qos=%d dup=%v retain=%v)", flags.QoS(), flags.Dup(), flags.Retain())
+	}
+	fmt.Fprintf(d.w, " remaining_length=%d\n", hdr.RemainingLength)
+}
+
+// printf prints an indented line of packet fields.
+func (d *decoder) printf(format string, args ...any) {
+	fmt.Fprintf(d.w, "\t"+format+"\n", args...)
+}
+
+// previewBytes returns b quoted if it is printable text or hex encoded otherwise,
+// truncated to the preview length.
+func (d *decoder) previewBytes(b []byte) string {
+	truncated := len(b) > d.preview
+	if truncated {
+		b = b[:d.preview]
+	}
+	var s string
+	if isPrintable(b) {
+		s = fmt.Sprintf("%q", b)
+	} else {
+		s = hex.EncodeToString(b)
+	}
+	if truncated {
+		s += "..."
+	}
+	return s
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// dump prints a hex dump of b, 16 bytes per line, marking the byte at offset mark.
+func (d *decoder) dump(b []byte, mark int) {
+	for i := 0; i < len(b); i += 16 {
+		line := b[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		fmt.Fprintf(d.w, "\t0x%04x ", d.start+i)
+		for j, c := range line {
+			sep := " "
+			if i+j == mark {
+				sep = ">"
+			}
+			fmt.Fprintf(d.w, "%s%02x", sep, c)
+		}
+		fmt.Fprintln(d.w)
+	}
+	if mark >= len(b) {
+		fmt.Fprintf(d.w, "\t0x%04x >(end of data)\n", d.start+mark)
+	}
+}
+
+// decodeHex decodes hex text ignoring whitespace and separators. Each token
+// between separators may start with a 0x prefix.
+func decodeHex(s string) ([]byte, error) {
+	digits := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		if isHexSeparator(s[i]) {
+			i++
+			continue
+		}
+		if strings.HasPrefix(s[i:], "0x") || strings.HasPrefix(s[i:], "0X") {
+			i += 2
+			if i == len(s) || isHexSeparator(s[i]) {
+				return nil, fmt.Errorf("0x prefix without hex digits at offset %d", i-2)
+			}
+		}
+		for ; i < len(s) && !isHexSeparator(s[i]); i++ {
+			c := s[i]
+			if !('0' <= c && c <= '9') && !('a' <= c && c <= 'f') && !('A' <= c && c <= 'F') {
+				return nil, fmt.Errorf("invalid hex character %q at offset %d", c, i)
+			}
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 != 0 {
+		return nil, errors.New("odd number of hex digits")
+	}
+	b := make([]byte, len(digits)/2)
+	_, err := hex.Decode(b, digits)
+	return b, err
+}
+
+func isHexSeparator(c byte) bool {
+	return unicode.IsSpace(rune(c)) || c == ',' || c == ':' || c == '-'
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestDecodeStream(t *testing.T) {
+	stream := encode(t,
+		func(tx *mqtt.Tx) error {
+			var vc mqtt.VariablesConnect
+			vc.SetDefaultMQTT([]byte("salamanca"))
+			return tx.WriteConnect(&vc)
+		},
+		func(tx *mqtt.Tx) error { return tx.WriteConnack(mqtt.VariablesConnack{}) },
+		func(tx *mqtt.Tx) error {
+			flags, _ := mqtt.NewPublishFlags(mqtt.QoS1, false, true)
+			vp := mqtt.VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 12}
+			payload := []byte("hello")
+			h, _ := mqtt.NewHeader(mqtt.PacketPublish, flags, uint32(vp.Size(mqtt.QoS1)+len(payload)))
+			return tx.WritePublishPayload(h, vp, payload)
+		},
+		func(tx *mqtt.Tx) error {
+			return tx.WriteSubscribe(mqtt.VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []mqtt.SubscribeRequest{{TopicFilter: []byte("a/#"), QoS: 1}}})
+		},
+		func(tx *mqtt.Tx) error {
+			return tx.WriteSuback(mqtt.VariablesSuback{PacketIdentifier: 1, ReturnCodes: []mqtt.QoSLevel{1, mqtt.QoSSubfail}})
+		},
+		func(tx *mqtt.Tx) error { return tx.WriteIdentified(mqtt.PacketPuback, 12) },
+		func(tx *mqtt.Tx) error { return tx.WriteSimple(mqtt.PacketDisconnect) },
+	)
+	// Decode stream as hex text with separators.
+	text := strings.ToUpper(hex.EncodeToString(stream))
+	text = strings.Join(strings.SplitAfter(text, "0"), ":")
+	var out bytes.Buffer
+	err := run([]string{"-x", "-strict"}, strings.NewReader(text), &out)
+	if err != nil {
+		t.Fatal(err, out.String())
+	}
+	for _, want := range []string{
+		`0x0000 CONNECT flags=0000`,
+		`client="salamanca"`,
+		`CONNACK flags=0000 remaining_length=2`,
+		`PUBLISH flags=0011 (qos=1 dup=false retain=true)`,
+		`topic="a/b" packet_id=12`,
+		`payload 5 bytes: "hello"`,
+		`filter="a/#" qos=1`,
+		`return_codes=[0x01 0x80]`,
+		`PUBACK flags=0000 remaining_length=2`,
+		`DISCONNECT`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	// PINGREQ followed by a SUBSCRIBE with reserved flags 0000.
+	stream := []byte{0xc0, 0x00, 0x80, 0x08, 0x00, 0x01, 0x00, 0x03, 'a', '/', 'b', 0x00}
+	var out bytes.Buffer
+	err := run(nil, bytes.NewReader(stream), &out)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "after 1 packets") {
+		t.Error("unexpected error", err)
+	}
+	if !strings.Contains(out.String(), "0x0002 malformed fixed header at offset 0x4") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	// Truncated stream.
+	out.Reset()
+	err = run(nil, bytes.NewReader(stream[:1]), &out)
+	if err == nil || !strings.Contains(out.String(), "stream ends mid-packet") {
+		t.Errorf("expected truncated stream error, got %v:\n%s", err, out.String())
+	}
+}
+
+func TestDecodeHex(t *testing.T) {
+	got, err := decodeHex("0x10,0X0a de:AD\n be-ef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0x10, 0x0a, 0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("got % x", got)
+	}
+	for _, bad := range []string{"abc", "zz", "00x1", "0x", "0x,10", "100x"} {
+		_, err = decodeHex(bad)
+		if err == nil {
+			t.Errorf("expected error decoding %q", bad)
+		}
+	}
+}
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func encode(t *testing.T, writes ...func(tx *mqtt.Tx) error) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var tx mqtt.Tx
+	tx.SetTxTransport(nopCloser{&buf})
+	for _, write := range writes {
+		err := write(&tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
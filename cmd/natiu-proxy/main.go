@@ -0,0 +1,88 @@
+// Command natiu-proxy is a transparent MQTT proxy that logs the packets
+// exchanged between clients and an upstream broker.
+//
+// Usage:
+//
+//	natiu-proxy -upstream host:port [-listen addr] [-hex] [rules]
+//
+// Every packet is decoded as it passes through the proxy and logged with a
+// timestamp, the client identifier taken from the CONNECT packet and the
+// direction, i.e:
+//
+//	2023/03/14 15:09:26.535897 salamanca c>b Received PUBLISH (d0, q0, r1, m0, 'a/b', ... (5 bytes))
+//
+// Packets may be rewritten or dropped by rules:
+//
+//	-strip-retain            clear the retain flag of PUBLISH packets.
+//	-qos0                    downgrade PUBLISH packets to QoS0. The proxy acknowledges
+//	                         downgraded packets to their sender in place of the receiver.
+//	-drop TYPE[:filter]      drop packets of TYPE, i.e: PINGREQ. PUBLISH packets may be
+//	                         selected by topic filter, i.e: PUBLISH:sensors/#. May be repeated.
+//
+// Dropped packets are not acknowledged. Rules apply to both directions.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func main() {
+	fs := flag.NewFlagSet("natiu-proxy", flag.ExitOnError)
+	var r rules
+	var (
+		listen   = fs.String("listen", ":1884", "address to listen on for clients")
+		upstream = fs.String("upstream", "", "upstream broker address, i.e: localhost:1883 (required)")
+		hexDump  = fs.Bool("hex", false, "log a hex dump of every packet")
+	)
+	fs.BoolVar(&r.stripRetain, "strip-retain", false, "clear the retain flag of PUBLISH packets")
+	fs.BoolVar(&r.qos0, "qos0", false, "downgrade PUBLISH packets to QoS0")
+	fs.Var(&r.drops, "drop", "drop packets of `TYPE[:filter]`, may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: natiu-proxy -upstream host:port [-listen addr] [-hex] [rules]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	if *upstream == "" {
+		fmt.Fprintln(os.Stderr, "natiu-proxy: missing upstream (-upstream)")
+		os.Exit(2)
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &proxy{
+		upstream: *upstream,
+		rules:    r,
+		hexDump:  *hexDump,
+		logger:   log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds),
+	}
+	p.logger.Printf("proxying %s to %s", l.Addr(), *upstream)
+	log.Fatal(p.serve(l))
+}
+
+// dropRules is a flag.Value collecting repeated -drop flags.
+type dropRules []dropRule
+
+func (d *dropRules) String() string { return fmt.Sprint(*d) }
+
+func (d *dropRules) Set(s string) error {
+	name, filter, _ := strings.Cut(s, ":")
+	for tp := mqtt.PacketConnect; tp <= mqtt.PacketDisconnect; tp++ {
+		if tp.String() == strings.ToUpper(name) {
+			if filter != "" && tp != mqtt.PacketPublish {
+				return errors.New("topic filter only supported for PUBLISH")
+			}
+			*d = append(*d, dropRule{tp: tp, filter: filter})
+			return nil
+		}
+	}
+	return errors.New("unknown packet type " + name)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestProxyRules(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	upstream, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var drops dropRules
+	err = drops.Set("publish:secret/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	p := &proxy{
+		upstream: upstream.Addr().String(),
+		rules:    rules{stripRetain: true, qos0: true, drops: drops},
+		logger:   log.New(&logs, "", log.LstdFlags),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go p.serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	c := &peer{t: t}
+	c.tx.SetTxTransport(conn)
+	c.rx.SetRxTransport(conn)
+	c.rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 1024)})
+
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	c.write(mqtt.Packet{Header: c.header(mqtt.PacketConnect, 0), Connect: varConn})
+	c.expect(mqtt.PacketConnack)
+	c.write(mqtt.Packet{
+		Header:    c.header(mqtt.PacketSubscribe, mqtt.PacketFlagsPubrelSubUnsub),
+		Subscribe: mqtt.VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []mqtt.SubscribeRequest{{TopicFilter: []byte("#")}}},
+	})
+	c.expect(mqtt.PacketSuback)
+
+	// QoS1 is acknowledged by proxy and delivered as QoS0 without retain.
+	c.publish(mqtt.QoS1, true, 7, "sensors/temp")
+	if pkt := c.expect(mqtt.PacketPuback); pkt.PacketIdentifier != 7 {
+		t.Errorf("PUBACK packet identifier %d, want 7", pkt.PacketIdentifier)
+	}
+	c.expectPublish("sensors/temp")
+
+	// Dropped PUBLISH is never delivered.
+	c.publish(mqtt.QoS0, false, 0, "secret/key")
+
+	// QoS2 flow is completed by proxy.
+	c.publish(mqtt.QoS2, false, 8, "sensors/hum")
+	if pkt := c.expect(mqtt.PacketPubrec); pkt.PacketIdentifier != 8 {
+		t.Errorf("PUBREC packet identifier %d, want 8", pkt.PacketIdentifier)
+	}
+	c.expectPublish("sensors/hum")
+	c.write(mqtt.Packet{Header: c.header(mqtt.PacketPubrel, mqtt.PacketFlagsPubrelSubUnsub), PacketIdentifier: 8})
+	if pkt := c.expect(mqtt.PacketPubcomp); pkt.PacketIdentifier != 8 {
+		t.Errorf("PUBCOMP packet identifier %d, want 8", pkt.PacketIdentifier)
+	}
+
+	got := logs.String()
+	for _, want := range []string{"salamanca c>b Received CONNECT", "salamanca b>c Received CONNACK", "salamanca c>b dropped PUBLISH", "salamanca c>b replied PUBCOMP to PUBREL"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestDropRules(t *testing.T) {
+	var d dropRules
+	for _, test := range []struct {
+		arg     string
+		wantErr bool
+	}{
+		{arg: "PINGREQ"},
+		{arg: "publish:a/+/c"},
+		{arg: "SUBSCRIBE:a/b", wantErr: true},
+		{arg: "NOTAPACKET", wantErr: true},
+	} {
+		err := d.Set(test.arg)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %v", test.arg, err, test.wantErr)
+		}
+	}
+	if got := d.String(); got != "[PINGREQ PUBLISH:a/+/c]" {
+		t.Errorf("got rules %s", got)
+	}
+}
+
+// peer is a raw MQTT connection used to exercise the proxy packet by packet.
+type peer struct {
+	t  *testing.T
+	tx mqtt.Tx
+	rx mqtt.Rx
+}
+
+func (p *peer) write(pkt mqtt.Packet) {
+	p.t.Helper()
+	err := p.tx.WritePacket(&pkt)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// header returns a fixed header. Remaining length is set by Tx.WritePacket.
+func (p *peer) header(tp mqtt.PacketType, flags mqtt.PacketFlags) mqtt.Header {
+	p.t.Helper()
+	hdr, err := mqtt.NewHeader(tp, flags, 0)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return hdr
+}
+
+func (p *peer) publish(qos mqtt.QoSLevel, retain bool, packetIdentifier uint16, topic string) {
+	p.t.Helper()
+	flags, err := mqtt.NewPublishFlags(qos, false, retain)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.write(mqtt.Packet{
+		Header:  p.header(mqtt.PacketPublish, flags),
+		Publish: mqtt.VariablesPublish{TopicName: []byte(topic), PacketIdentifier: packetIdentifier},
+		Payload: []byte("payload"),
+	})
+}
+
+func (p *peer) expect(tp mqtt.PacketType) mqtt.Packet {
+	p.t.Helper()
+	var pkt mqtt.Packet
+	_, err := p.rx.ReadPacket(&pkt)
+	if err != nil {
+		p.t.Fatalf("expecting %s: %v", tp, err)
+	}
+	if pkt.Header.Type() != tp {
+		p.t.Fatalf("got %s, expected %s", pkt.Header.Type(), tp)
+	}
+	return pkt
+}
+
+func (p *peer) expectPublish(topic string) {
+	p.t.Helper()
+	pkt := p.expect(mqtt.PacketPublish)
+	flags := pkt.Header.Flags()
+	if string(pkt.Publish.TopicName) != topic || flags.QoS() != mqtt.QoS0 || flags.Retain() {
+		p.t.Errorf("got PUBLISH topic=%q qos=%d retain=%v, want topic=%q qos=0 retain=false",
+			pkt.Publish.TopicName, flags.QoS(), flags.Retain(), topic)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
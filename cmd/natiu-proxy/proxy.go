@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// proxy forwards connections accepted on a listener to an upstream broker.
+type proxy struct {
+	upstream string
+	rules    rules
+	hexDump  bool
+	logger   *log.Logger
+}
+
+func (p *proxy) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+// handle proxies a single client connection until either end closes it.
+func (p *proxy) handle(client net.Conn) {
+	defer client.Close()
+	broker, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		p.logger.Printf("%s: dialing upstream: %v", client.RemoteAddr(), err)
+		return
+	}
+	defer broker.Close()
+	s := &session{
+		id:     client.RemoteAddr().String(),
+		tracer: mqtt.TextTracer{W: logWriter{p.logger}, HexDump: p.hexDump},
+	}
+	c := &endpoint{conn: client}
+	b := &endpoint{conn: broker}
+	errc := make(chan error, 2)
+	go func() { errc <- p.forward(s, clientToBroker, c, b) }()
+	go func() { errc <- p.forward(s, brokerToClient, b, c) }()
+	err = <-errc
+	// Unblock the other direction.
+	client.Close()
+	broker.Close()
+	<-errc
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		p.logger.Printf("%s: connection closed", s.clientID())
+	} else {
+		p.logger.Printf("%s: connection closed: %v", s.clientID(), err)
+	}
+}
+
+// forward reads packets from src, applies the proxy rules and writes them to dst.
+func (p *proxy) forward(s *session, dir direction, src, dst *endpoint) error {
+	var rx mqtt.Rx
+	rx.SetRxTransport(src.conn)
+	rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 64*1024)})
+	rx.Tracer = tracerFunc(func(_ mqtt.TraceDirection, hdr mqtt.Header, vars any, raw []byte) {
+		if vc, ok := vars.(*mqtt.VariablesConnect); ok && dir == clientToBroker {
+			// Set before tracing so the CONNECT itself is logged with the client identifier.
+			s.setClientID(string(vc.ClientID))
+		}
+		s.trace(dir, hdr, vars, raw)
+	})
+	// Packet identifiers of QoS2 PUBLISH packets downgraded to QoS0 whose PUBREL
+	// is answered by the proxy.
+	pendingRel := make(map[uint16]bool)
+	var pkt mqtt.Packet
+	for {
+		_, err := rx.ReadPacket(&pkt)
+		if err != nil {
+			return err
+		}
+		forward, reply := p.rules.apply(&pkt, pendingRel)
+		if reply != nil {
+			s.log(dir, "replied "+reply.Header.Type().String()+" to "+pkt.Header.Type().String())
+			err = src.write(reply)
+			if err != nil {
+				return err
+			}
+		}
+		if !forward {
+			if reply == nil {
+				s.log(dir, "dropped "+pkt.Header.Type().String())
+			}
+			continue
+		}
+		err = dst.write(&pkt)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// direction is the direction packets flow through the proxy.
+type direction uint8
+
+const (
+	clientToBroker direction = iota
+	brokerToClient
+)
+
+func (dir direction) String() string {
+	if dir == clientToBroker {
+		return "c>b"
+	}
+	return "b>c"
+}
+
+// endpoint is one end of a proxied connection. Packets are written to an endpoint
+// by the goroutine forwarding packets to it and by the goroutine reading from it
+// when the proxy acknowledges packets itself.
+type endpoint struct {
+	conn net.Conn
+	mu   sync.Mutex
+	tx   mqtt.Tx
+}
+
+func (e *endpoint) write(pkt *mqtt.Packet) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tx.SetTxTransport(e.conn)
+	return e.tx.WritePacket(pkt)
+}
+
+// session holds the state of a proxied connection shared by both directions.
+type session struct {
+	mu     sync.Mutex
+	id     string
+	tracer mqtt.TextTracer
+}
+
+func (s *session) setClientID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = id
+}
+
+func (s *session) clientID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+func (s *session) trace(dir direction, hdr mqtt.Header, vars any, raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tracer.Prefix = s.id + " " + dir.String() + " "
+	s.tracer.TracePacket(mqtt.TraceRx, hdr, vars, raw)
+}
+
+func (s *session) log(dir direction, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tracer.W.Write([]byte(s.id + " " + dir.String() + " " + msg + "\n"))
+}
+
+// tracerFunc adapts a function to the mqtt.Tracer interface.
+type tracerFunc func(dir mqtt.TraceDirection, hdr mqtt.Header, vars any, raw []byte)
+
+func (f tracerFunc) TracePacket(dir mqtt.TraceDirection, hdr mqtt.Header, vars any, raw []byte) {
+	f(dir, hdr, vars, raw)
+}
+
+// logWriter writes each call to Write as a log entry.
+type logWriter struct{ l *log.Logger }
+
+func (lw logWriter) Write(b []byte) (int, error) {
+	lw.l.Print(string(b))
+	return len(b), nil
+}
+
+// rules rewrite or drop packets passing through the proxy.
+type rules struct {
+	stripRetain bool
+	qos0        bool
+	drops       dropRules
+}
+
+// dropRule drops packets of a type. PUBLISH packets are dropped only if
+// their topic matches filter, if set.
+type dropRule struct {
+	tp     mqtt.PacketType
+	filter string
+}
+
+func (d dropRule) String() string {
+	if d.filter == "" {
+		return d.tp.String()
+	}
+	return d.tp.String() + ":" + d.filter
+}
+
+// apply applies the rules to pkt, possibly modifying it. It returns whether pkt
+// should be forwarded and a packet to send back to pkt's sender, if any.
+func (r *rules) apply(pkt *mqtt.Packet, pendingRel map[uint16]bool) (forward bool, reply *mqtt.Packet) {
+	tp := pkt.Header.Type()
+	for _, d := range r.drops {
+		if d.tp == tp && (d.filter == "" || mqtt.MatchTopic(d.filter, string(pkt.Publish.TopicName))) {
+			return false, nil
+		}
+	}
+	switch tp {
+	case mqtt.PacketPubrel:
+		if pendingRel[pkt.PacketIdentifier] {
+			// Complete QoS2 flow of a downgraded PUBLISH on behalf of receiver.
+			delete(pendingRel, pkt.PacketIdentifier)
+			return false, identified(mqtt.PacketPubcomp, pkt.PacketIdentifier)
+		}
+	case mqtt.PacketPublish:
+		flags := pkt.Header.Flags()
+		qos := flags.QoS()
+		retain := flags.Retain() && !r.stripRetain
+		if r.qos0 && qos != mqtt.QoS0 {
+			// Acknowledge on behalf of receiver since it won't acknowledge a QoS0 PUBLISH.
+			pi := pkt.Publish.PacketIdentifier
+			if qos == mqtt.QoS1 {
+				reply = identified(mqtt.PacketPuback, pi)
+			} else {
+				reply = identified(mqtt.PacketPubrec, pi)
+				pendingRel[pi] = true
+			}
+			qos = mqtt.QoS0
+			pkt.Publish.PacketIdentifier = 0
+		}
+		dup := flags.Dup() && qos != mqtt.QoS0
+		newFlags, err := mqtt.NewPublishFlags(qos, dup, retain)
+		if err == nil {
+			pkt.Header, err = mqtt.NewHeader(mqtt.PacketPublish, newFlags, pkt.Header.RemainingLength)
+		}
+		if err != nil {
+			return false, reply
+		}
+	}
+	return true, reply
+}
+
+func identified(tp mqtt.PacketType, packetIdentifier uint16) *mqtt.Packet {
+	h, _ := mqtt.NewHeader(tp, 0, 2)
+	return &mqtt.Packet{Header: h, PacketIdentifier: packetIdentifier}
+}
@@ -0,0 +1,234 @@
+// Command natiu-pub publishes MQTT messages from the command line.
+//
+// Usage:
+//
+//	natiu-pub -t topic [flags] (-m message | -f file | -s | -l)
+//
+// The payload is taken from the -m argument, the contents of the -f file, all
+// of standard input with -s, or each line of standard input as a separate
+// message with -l. With -l natiu-pub stays connected until standard input ends,
+// sending PINGREQs as required by the keepalive while it waits for lines.
+// Only QoS0 is supported. If the server refuses the connection natiu-pub exits with
+// the CONNACK return code (1 to 5) as its exit status. Other errors exit with status 6.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// exitFailure is the exit status of errors other than a refused connection.
+// It is one past the largest CONNACK return code.
+const exitFailure = 6
+
+// maxPayload is the largest payload that fits in a PUBLISH packet.
+const maxPayload = 256 * 1024 * 1024
+
+func main() {
+	err := run(os.Args[1:], os.Stdin)
+	if err == nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "natiu-pub:", err)
+	var rc mqtt.ConnectReturnCode
+	if errors.As(err, &rc) && rc != mqtt.ReturnCodeConnAccepted {
+		os.Exit(int(rc))
+	}
+	os.Exit(exitFailure)
+}
+
+func run(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("natiu-pub", flag.ContinueOnError)
+	var (
+		host      = fs.String("h", "localhost", "MQTT server host")
+		port      = fs.Int("p", 1883, "MQTT server port")
+		clientID  = fs.String("i", "natiu-pub-"+strconv.Itoa(os.Getpid()), "client identifier")
+		username  = fs.String("u", "", "username")
+		password  = fs.String("P", "", "password, requires -u")
+		topic     = fs.String("t", "", "topic to publish to (required)")
+		qos       = fs.Int("q", 0, "QoS level of published messages, the client currently only supports 0")
+		retain    = fs.Bool("r", false, "set the retain flag on published messages")
+		message   = fs.String("m", "", "publish `message` as the payload")
+		file      = fs.String("f", "", "publish the contents of `file` as the payload")
+		stdinAll  = fs.Bool("s", false, "publish all of standard input as the payload")
+		stdinLine = fs.Bool("l", false, "publish each line of standard input as a separate message")
+		keepAlive = fs.Int("k", 60, "keepalive in seconds sent in CONNECT")
+		timeout   = fs.Duration("timeout", 10*time.Second, "timeout for connecting")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: natiu-pub -t topic [flags] (-m message | -f file | -s | -l)")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *topic == "" {
+		return errors.New("missing topic (-t)")
+	}
+	if *password != "" && *username == "" {
+		return errors.New("password (-P) requires a username (-u)")
+	}
+	if *keepAlive < 0 || *keepAlive > 0xffff {
+		return errors.New("keepalive (-k) out of range 0..65535")
+	}
+	if *qos != 0 {
+		return errors.New("QoS (-q) must be 0, the client only supports publishing with QoS0")
+	}
+	sources := 0
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "m", "f", "s", "l":
+			sources++
+		}
+	})
+	if sources != 1 {
+		return errors.New("exactly one of -m, -f, -s or -l must be set")
+	}
+	flags, err := mqtt.NewPublishFlags(mqtt.QoSLevel(*qos), false, *retain)
+	if err != nil {
+		return err
+	}
+
+	var payload []byte
+	switch {
+	case *file != "":
+		payload, err = os.ReadFile(*file)
+	case *stdinAll:
+		payload, err = io.ReadAll(stdin)
+	default:
+		payload = []byte(*message)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(*host, strconv.Itoa(*port)), *timeout)
+	if err != nil {
+		return err
+	}
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	varConn := mqtt.VariablesConnect{
+		ClientID:      []byte(*clientID),
+		Protocol:      []byte(mqtt.DefaultProtocol),
+		ProtocolLevel: mqtt.DefaultProtocolLevel,
+		KeepAlive:     uint16(*keepAlive),
+		CleanSession:  true,
+		Username:      []byte(*username),
+		Password:      []byte(*password),
+	}
+	// The deadline unblocks reads waiting for a CONNACK that never arrives.
+	conn.SetDeadline(time.Now().Add(*timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	err = client.Connect(ctx, conn, &varConn)
+	cancel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	defer client.Disconnect(errors.New("natiu-pub done"))
+
+	varPub := mqtt.VariablesPublish{TopicName: []byte(*topic)}
+	publish := func(payload []byte) error {
+		varPub.PacketIdentifier++
+		if varPub.PacketIdentifier == 0 {
+			varPub.PacketIdentifier = 1
+		}
+		return client.PublishPayload(flags, varPub, payload)
+	}
+	if !*stdinLine {
+		return publish(payload)
+	}
+	return publishLines(client, conn, stdin, time.Duration(*keepAlive)*time.Second/2, publish)
+}
+
+// publishLines publishes each line of stdin as it is read. While waiting on
+// stdin it reads the connection to handle PINGRESPs and sends a PINGREQ when
+// nothing was sent for pingInterval, so the server does not close the connection
+// of a quiet publisher. A zero pingInterval disables pings.
+func publishLines(client *mqtt.Client, conn net.Conn, stdin io.Reader, pingInterval time.Duration, publish func([]byte) error) error {
+	stop := make(chan struct{})
+	lines := make(chan []byte)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdin)
+		scanner.Buffer(make([]byte, 4*1024), maxPayload)
+		for scanner.Scan() {
+			select {
+			case lines <- append([]byte(nil), scanner.Bytes()...):
+			case <-stop:
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+	readErr := make(chan error, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			err := client.HandleNext() // Read timeouts are ignored by the client.
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		// Unblock HandleNext so Disconnect can acquire the client's read lock.
+		conn.SetReadDeadline(time.Now())
+		<-readDone
+	}()
+
+	var ping <-chan time.Time
+	var pingTimer *time.Timer
+	if pingInterval > 0 {
+		pingTimer = time.NewTimer(pingInterval)
+		defer pingTimer.Stop()
+		ping = pingTimer.C
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return <-scanErr
+			}
+			if err := publish(line); err != nil {
+				return err
+			}
+		case <-ping:
+			if err := client.StartPing(); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return fmt.Errorf("connection lost: %w", err)
+		}
+		if pingTimer != nil {
+			if !pingTimer.Stop() {
+				select {
+				case <-pingTimer.C:
+				default:
+				}
+			}
+			pingTimer.Reset(time.Until(client.LastTx().Add(pingInterval)))
+		}
+	}
+}
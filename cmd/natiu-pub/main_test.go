@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestPublishLines(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	host, port := listen(t, &b)
+
+	received := make(chan string, 2)
+	sub := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, _ mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			received <- string(payload)
+			return err
+		},
+	})
+	conn := b.Dial()
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("sub"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := sub.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sub.Subscribe(ctx, mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte("natiu/pub")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = run([]string{"-h", host, "-p", port, "-t", "natiu/pub", "-l"}, strings.NewReader("first\nsecond\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(received) < 2 {
+		err = sub.HandleNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := <-received + "," + <-received; got != "first,second" {
+		t.Errorf("got messages %q", got)
+	}
+}
+
+func TestPublishLinesPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pinged := make(chan struct{}, 1)
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var rx mqtt.Rx
+		var tx mqtt.Tx
+		rx.SetRxTransport(conn)
+		rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 1500)})
+		tx.SetTxTransport(conn)
+		rx.RxCallbacks.OnConnect = func(*mqtt.Rx, *mqtt.VariablesConnect) error {
+			return tx.WriteConnack(mqtt.VariablesConnack{})
+		}
+		rx.RxCallbacks.OnOther = func(rx *mqtt.Rx, _ uint16) error {
+			if rx.LastReceivedHeader.Type() != mqtt.PacketPingreq {
+				return nil
+			}
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return tx.WriteSimple(mqtt.PacketPingresp)
+		}
+		rx.RxCallbacks.OnPub = func(_ *mqtt.Rx, _ mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			received <- string(payload)
+			return err
+		}
+		for err == nil {
+			_, err = rx.ReadNextPacket()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+
+	stdin, stdinW := io.Pipe()
+	go func() {
+		// Keep standard input open until the idle publisher pings the server.
+		select {
+		case <-pinged:
+			stdinW.Write([]byte("after ping\n"))
+		case <-time.After(5 * time.Second):
+		}
+		stdinW.Close()
+	}()
+	err = run([]string{"-h", addr.IP.String(), "-p", strconv.Itoa(addr.Port), "-t", "natiu/pub", "-k", "1", "-l"}, stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if got != "after ping" {
+			t.Errorf("got message %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ping sent or message received")
+	}
+}
+
+func TestPublishQoSRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+	err = run([]string{"-h", addr.IP.String(), "-p", strconv.Itoa(addr.Port), "-t", "natiu/pub", "-m", "x", "-q", "1"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "-q") {
+		t.Fatal("expected QoS error, got", err)
+	}
+	// Rejected before connecting.
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if conn, err := l.Accept(); err == nil {
+		conn.Close()
+		t.Error("connected with unsupported QoS")
+	}
+}
+
+func TestPublishRefused(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	b.SetBehavior(mqtttest.Behavior{ConnectReturnCode: mqtt.ReturnCodeBadUserCredentials})
+	host, port := listen(t, &b)
+	err := run([]string{"-h", host, "-p", port, "-t", "natiu/pub", "-m", "refused"}, nil)
+	var rc mqtt.ConnectReturnCode
+	if !errors.As(err, &rc) || rc != mqtt.ReturnCodeBadUserCredentials {
+		t.Fatal("expected bad credentials error, got", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"-m", "no topic"},
+		{"-t", "a", "-m", "two sources", "-s"},
+		{"-t", "a"},
+		{"-t", "a", "-m", "x", "-P", "no username"},
+		{"-t", "a", "-m", "x", "-q", "3"},
+	} {
+		err := run(args, nil)
+		if err == nil {
+			t.Errorf("expected error for args %q", args)
+		}
+	}
+}
+
+func listen(t *testing.T, b *mqtttest.Broker) (host, port string) {
+	t.Helper()
+	l, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), strconv.Itoa(addr.Port)
+}
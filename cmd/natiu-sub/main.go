@@ -0,0 +1,303 @@
+// Command natiu-sub subscribes to MQTT topic filters and prints received messages.
+//
+// Usage:
+//
+//	natiu-sub -t filter [-t filter...] [flags]
+//
+// Messages are printed one per line in the format selected with -F:
+//
+//	raw       the payload as is.
+//	hex       the payload hex encoded.
+//	json      a JSON object with the topic, qos, retain and dup fields and the payload base64 encoded.
+//	template  the Go text/template given with -T executed on a message with fields
+//	          Topic, QoS, Retain, Dup and Payload, i.e: '{{.Topic}} {{printf "%s" .Payload}}'.
+//
+// natiu-sub reconnects and resubscribes automatically if the connection is lost
+// after the first successful connection, including when the server does not
+// answer a PINGREQ before the next one is due. QoS2 is not supported since
+// the client does not take part in the QoS2 PUBLISH exchange. It exits after receiving the number of
+// messages given by -C or after the duration given by -W. If both are set and
+// fewer messages are received before the duration ends natiu-sub exits with an error.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+var errPingTimeout = errors.New("no PINGRESP received before next PINGREQ")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	if err == nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "natiu-sub:", err)
+	var rc mqtt.ConnectReturnCode
+	if errors.As(err, &rc) && rc != mqtt.ReturnCodeConnAccepted {
+		os.Exit(int(rc))
+	}
+	os.Exit(6) // One past the largest CONNACK return code, same as natiu-pub.
+}
+
+// message is the data printed for every received PUBLISH.
+type message struct {
+	Topic   string `json:"topic"`
+	QoS     uint8  `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Dup     bool   `json:"dup"`
+	Payload []byte `json:"payload"` // Base64 encoded by encoding/json.
+}
+
+// formatter writes a single message to w followed by a newline.
+type formatter func(w io.Writer, m *message) error
+
+func newFormatter(format, text string) (formatter, error) {
+	if text != "" && format != "template" {
+		return nil, errors.New("template (-T) requires -F template")
+	}
+	switch format {
+	case "raw":
+		return func(w io.Writer, m *message) error {
+			_, err := w.Write(append(m.Payload, '\n'))
+			return err
+		}, nil
+	case "hex":
+		return func(w io.Writer, m *message) error {
+			_, err := io.WriteString(w, hex.EncodeToString(m.Payload)+"\n")
+			return err
+		}, nil
+	case "json":
+		return func(w io.Writer, m *message) error {
+			return json.NewEncoder(w).Encode(m)
+		}, nil
+	case "template":
+		if text == "" {
+			return nil, errors.New("-F template requires a template (-T)")
+		}
+		tmpl, err := template.New("message").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return func(w io.Writer, m *message) error {
+			err := tmpl.Execute(w, m)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, "\n")
+			return err
+		}, nil
+	}
+	return nil, errors.New("unknown format " + strconv.Quote(format) + ", expected raw, hex, json or template")
+}
+
+// filters is a flag.Value collecting repeated -t flags.
+type filters []string
+
+func (f *filters) String() string { return fmt.Sprint(*f) }
+
+func (f *filters) Set(s string) error {
+	if s == "" {
+		return errors.New("empty topic filter")
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("natiu-sub", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var topics filters
+	fs.Var(&topics, "t", "topic `filter` to subscribe to, may be repeated (required)")
+	var (
+		host       = fs.String("h", "localhost", "MQTT server host")
+		port       = fs.Int("p", 1883, "MQTT server port")
+		clientID   = fs.String("i", "natiu-sub-"+strconv.Itoa(os.Getpid()), "client identifier")
+		username   = fs.String("u", "", "username")
+		password   = fs.String("P", "", "password, requires -u")
+		qos        = fs.Int("q", 0, "QoS level requested for subscriptions, 0 or 1")
+		format     = fs.String("F", "raw", "output format: raw, hex, json or template")
+		text       = fs.String("T", "", "Go text/template used to print messages with -F template")
+		count      = fs.Int("C", 0, "exit after receiving `count` messages, 0 means no limit")
+		wait       = fs.Duration("W", 0, "exit after `duration`, 0 means no limit")
+		keepAlive  = fs.Int("k", 60, "keepalive in seconds, PINGREQs are sent at half this interval")
+		timeout    = fs.Duration("timeout", 10*time.Second, "timeout for connecting and subscribing")
+		retryDelay = fs.Duration("R", time.Second, "delay between reconnection attempts")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: natiu-sub -t filter [-t filter...] [flags]")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(topics) == 0 {
+		return errors.New("missing topic filter (-t)")
+	}
+	if *password != "" && *username == "" {
+		return errors.New("password (-P) requires a username (-u)")
+	}
+	if *keepAlive < 0 || *keepAlive > 0xffff {
+		return errors.New("keepalive (-k) out of range 0..65535")
+	}
+	if *qos < 0 || *qos > 1 {
+		return errors.New("QoS (-q) must be 0 or 1")
+	}
+	if *count < 0 {
+		return errors.New("count (-C) must not be negative")
+	}
+	printMessage, err := newFormatter(*format, *text)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(stdout)
+	var (
+		received int
+		outErr   error
+	)
+	client := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(pubHead mqtt.Header, varPub mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			flags := pubHead.Flags()
+			m := message{
+				Topic:   string(varPub.TopicName),
+				QoS:     uint8(flags.QoS()),
+				Retain:  flags.Retain(),
+				Dup:     flags.Dup(),
+				Payload: payload,
+			}
+			if outErr == nil {
+				outErr = printMessage(out, &m)
+			}
+			if outErr == nil {
+				outErr = out.Flush()
+			}
+			received++
+			return nil
+		},
+	})
+	varConn := mqtt.VariablesConnect{
+		ClientID:      []byte(*clientID),
+		Protocol:      []byte(mqtt.DefaultProtocol),
+		ProtocolLevel: mqtt.DefaultProtocolLevel,
+		KeepAlive:     uint16(*keepAlive),
+		CleanSession:  true,
+		Username:      []byte(*username),
+		Password:      []byte(*password),
+	}
+	vsub := mqtt.VariablesSubscribe{}
+	for _, topic := range topics {
+		vsub.TopicFilters = append(vsub.TopicFilters, mqtt.SubscribeRequest{TopicFilter: []byte(topic), QoS: mqtt.QoSLevel(*qos)})
+	}
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	var conn net.Conn
+	connect := func() error {
+		var err error
+		conn, err = net.DialTimeout("tcp", addr, *timeout)
+		if err != nil {
+			return err
+		}
+		// The deadline unblocks reads waiting for a CONNACK or SUBACK that never arrives.
+		conn.SetDeadline(time.Now().Add(*timeout))
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		err = client.Connect(ctx, conn, &varConn)
+		if err == nil {
+			vsub.PacketIdentifier++
+			if vsub.PacketIdentifier == 0 {
+				vsub.PacketIdentifier = 1
+			}
+			err = client.Subscribe(ctx, vsub)
+		}
+		if err != nil {
+			if client.IsConnected() {
+				client.Disconnect(err)
+			}
+			conn.Close()
+			return err
+		}
+		conn.SetDeadline(time.Time{})
+		return nil
+	}
+
+	err = connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if client.IsConnected() {
+			client.Disconnect(errors.New("natiu-sub done"))
+		}
+	}()
+	var end time.Time
+	if *wait > 0 {
+		end = time.Now().Add(*wait)
+	}
+	pingInterval := time.Duration(*keepAlive) * time.Second / 2
+	for outErr == nil && (*count == 0 || received < *count) {
+		now := time.Now()
+		if !end.IsZero() && !now.Before(end) {
+			if *count != 0 {
+				return fmt.Errorf("timed out after receiving %d of %d messages", received, *count)
+			}
+			return nil
+		}
+		if !client.IsConnected() {
+			time.Sleep(*retryDelay)
+			err = connect()
+			if err != nil {
+				fmt.Fprintln(stderr, "natiu-sub: reconnect failed:", err)
+			}
+			continue
+		}
+		// Wake up to send pings and to check the exit duration.
+		wake := now.Add(time.Second)
+		if pingInterval > 0 {
+			nextPing := client.LastTx().Add(pingInterval)
+			if !nextPing.After(now) {
+				if client.AwaitingPingresp() {
+					// Half-open connection: reads would block until the OS notices.
+					fmt.Fprintln(stderr, "natiu-sub: connection lost:", errPingTimeout)
+					client.Disconnect(errPingTimeout)
+					conn.Close()
+					continue
+				}
+				if err := client.StartPing(); err != nil {
+					fmt.Fprintln(stderr, "natiu-sub: ping failed:", err)
+				}
+				nextPing = now.Add(pingInterval)
+			}
+			if nextPing.Before(wake) {
+				wake = nextPing
+			}
+		}
+		if !end.IsZero() && end.Before(wake) {
+			wake = end
+		}
+		conn.SetReadDeadline(wake)
+		err = client.HandleNext()
+		if err != nil {
+			fmt.Fprintln(stderr, "natiu-sub: connection lost:", err)
+			conn.Close()
+		}
+	}
+	return outErr
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestFormats(t *testing.T) {
+	m := message{Topic: "a/b", QoS: 1, Retain: true, Payload: []byte("hi")}
+	for _, test := range []struct {
+		format, text, want string
+	}{
+		{format: "raw", want: "hi\n"},
+		{format: "hex", want: "6869\n"},
+		{format: "json", want: `{"topic":"a/b","qos":1,"retain":true,"dup":false,"payload":"aGk="}` + "\n"},
+		{format: "template", text: `{{.Topic}} q{{.QoS}} {{printf "%s" .Payload}}`, want: "a/b q1 hi\n"},
+	} {
+		printMessage, err := newFormatter(test.format, test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = printMessage(&buf, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("format %s: got %q, want %q", test.format, buf.String(), test.want)
+		}
+	}
+	for _, bad := range [][2]string{{"xml", ""}, {"template", ""}, {"raw", "{{.Topic}}"}, {"template", "{{"}} {
+		_, err := newFormatter(bad[0], bad[1])
+		if err == nil {
+			t.Errorf("expected error for format %q with template %q", bad[0], bad[1])
+		}
+	}
+}
+
+func TestSubscribeReconnect(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	host, port := listen(t, &b)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- run([]string{"-h", host, "-p", port, "-t", "natiu/sub/+", "-t", "other", "-C", "2", "-R", "10ms", "-F", "template", "-T", "{{.Topic}}"}, pw, io.Discard)
+		pw.Close()
+	}()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	// QoS0 messages are published until received since the subscriber may not be subscribed yet.
+	publishUntilReceived(t, &b, "natiu/sub/first", lines)
+	if n := b.DropConnections(); n != 1 {
+		t.Fatalf("expected one connection to drop, got %d", n)
+	}
+	publishUntilReceived(t, &b, "natiu/sub/second", lines)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("natiu-sub did not exit after receiving 2 messages")
+	}
+}
+
+func TestSubscribeTimeout(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	host, port := listen(t, &b)
+	err := run([]string{"-h", host, "-p", port, "-t", "#", "-W", "50ms"}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal("expected no error on timeout without count, got", err)
+	}
+	err = run([]string{"-h", host, "-p", port, "-t", "#", "-W", "50ms", "-C", "1"}, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal("expected timeout error, got", err)
+	}
+}
+
+func TestSubscribePingTimeout(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	b.SetBehavior(mqtttest.Behavior{DropPingresp: true})
+	host, port := listen(t, &b)
+	var stderr bytes.Buffer
+	err := run([]string{"-h", host, "-p", port, "-t", "#", "-k", "1", "-R", "10ms", "-W", "1300ms"}, io.Discard, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), errPingTimeout.Error()) || strings.Contains(stderr.String(), "reconnect failed") {
+		t.Errorf("expected reconnection after ping timeout, got %q", stderr.String())
+	}
+}
+
+func TestSubscribeQoSRejected(t *testing.T) {
+	err := run([]string{"-t", "#", "-q", "2"}, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "-q") {
+		t.Error("expected QoS error, got", err)
+	}
+}
+
+func publishUntilReceived(t *testing.T, b *mqtttest.Broker, topic string, lines <-chan string) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		b.Publish(topic, nil)
+		select {
+		case line := <-lines:
+			if line != topic {
+				t.Fatalf("got %q, want %q", line, topic)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("message on", topic, "not received")
+		}
+	}
+}
+
+func listen(t *testing.T, b *mqtttest.Broker) (host, port string) {
+	t.Helper()
+	l, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), strconv.Itoa(addr.Port)
+}
@@ -0,0 +1,248 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// Client is implemented by adapters of client implementations under test. Each
+// method performs the corresponding MQTT operation over the transport passed to
+// Connect and blocks until the operation completes or fails. Methods must
+// return once the transport is closed.
+type Client interface {
+	// Connect sends a CONNECT packet over rwc and waits for the CONNACK.
+	Connect(ctx context.Context, rwc io.ReadWriteCloser) error
+	// Subscribe subscribes to a single topic filter and waits for the SUBACK.
+	Subscribe(ctx context.Context, topicFilter string, qos mqtt.QoSLevel) error
+	// Publish publishes a QoS0 message.
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Ping sends a PINGREQ and waits for the PINGRESP.
+	Ping(ctx context.Context) error
+	// Disconnect sends a DISCONNECT packet and closes the connection.
+	Disconnect() error
+}
+
+// RunClient checks client implementations returned by newClient against the
+// client clauses of the suite. newClient is called once per clause and the
+// client is connected to the suite over a net.Pipe.
+func RunClient(newClient func() Client, cfg Config) Report {
+	report := make(Report, 0, len(clientClauses))
+	for _, c := range clientClauses {
+		clientEnd, serverEnd := net.Pipe()
+		p := newPeer(serverEnd, cfg.timeout())
+		p.clientEnd = clientEnd
+		res := Result{ID: c.id, Description: c.desc}
+		res.Err = c.client(p, newClient())
+		p.close()
+		clientEnd.Close()
+		report = append(report, res)
+	}
+	return report
+}
+
+var clientClauses = []clause{
+	{
+		id:   "MQTT-3.1.0-1",
+		desc: "After a Network Connection is established by a Client to a Server, the first Packet sent from the Client to the Server MUST be a CONNECT Packet.",
+		client: func(p *peer, c Client) error {
+			// Strict decoding of the CONNECT also checks MQTT-3.1.2-3 and MQTT-3.1.2-22.
+			return p.accept(c)
+		},
+	},
+	{
+		id:   "MQTT-3.8.1-1",
+		desc: "Bits 3,2,1 and 0 of the fixed header of the SUBSCRIBE Control Packet are reserved and MUST be set to 0,0,1 and 0 respectively.",
+		client: func(p *peer, c Client) error {
+			sub, err := p.acceptSubscribe(c)
+			if err != nil {
+				return err
+			}
+			if flags := sub.Header.Flags(); flags != 0b0010 {
+				return fmt.Errorf("SUBSCRIBE flags %04b, expected 0010", flags)
+			}
+			return nil
+		},
+	},
+	{
+		id:   "MQTT-2.3.1-1",
+		desc: "SUBSCRIBE, UNSUBSCRIBE, and PUBLISH (in cases where QoS > 0) Control Packets MUST contain a non-zero 16-bit Packet Identifier.",
+		client: func(p *peer, c Client) error {
+			sub, err := p.acceptSubscribe(c)
+			if err != nil {
+				return err
+			}
+			if sub.Subscribe.PacketIdentifier == 0 {
+				return errors.New("SUBSCRIBE packet identifier is zero")
+			}
+			return nil
+		},
+	},
+	{
+		id:   "MQTT-3.3.1-2",
+		desc: "The DUP flag MUST be set to 0 for all QoS 0 messages.",
+		client: func(p *peer, c Client) error {
+			err := p.accept(c)
+			if err != nil {
+				return err
+			}
+			errc := run(p, func(ctx context.Context) error { return c.Publish(ctx, "conformance/dup", []byte("dup")) })
+			pub, err := p.expectType(mqtt.PacketPublish)
+			if err != nil {
+				return err
+			}
+			if flags := pub.Header.Flags(); flags.QoS() == mqtt.QoS0 && flags.Dup() {
+				return errors.New("DUP flag set on QoS0 PUBLISH")
+			}
+			return <-errc
+		},
+	},
+	{
+		id:   "MQTT-3.3.2-2",
+		desc: "The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters.",
+		client: func(p *peer, c Client) error {
+			err := p.accept(c)
+			if err != nil {
+				return err
+			}
+			// The client may refuse to publish or fail asynchronously, both are fine as long as
+			// the next packet received is the PINGREQ.
+			errc := run(p, func(ctx context.Context) error {
+				c.Publish(ctx, "conformance/#", []byte("wildcard"))
+				return c.Ping(ctx)
+			})
+			pkt, err := p.expect()
+			if err != nil {
+				return err
+			}
+			if tp := pkt.Header.Type(); tp != mqtt.PacketPingreq {
+				return fmt.Errorf("expected PINGREQ after refused PUBLISH, got %s with topic %q", tp, pkt.Publish.TopicName)
+			}
+			err = p.sendPacket(newPacket(mqtt.PacketPingresp, 0))
+			if err != nil {
+				return err
+			}
+			return <-errc
+		},
+	},
+	{
+		id:   "MQTT-2.2.2-2",
+		desc: "If invalid flags are received, the receiver MUST close the Network Connection.",
+		client: func(p *peer, c Client) error {
+			err := p.accept(c)
+			if err != nil {
+				return err
+			}
+			errc := run(p, c.Ping)
+			_, err = p.expectType(mqtt.PacketPingreq)
+			if err != nil {
+				return err
+			}
+			err = p.send(withFlags(encode(newPacket(mqtt.PacketPingresp, 0)), 0b0001))
+			if err != nil {
+				return err
+			}
+			err = p.expectClosed(mqtt.PacketDisconnect)
+			<-errc // Ping fails since the connection is closed.
+			return err
+		},
+	},
+	{
+		id:   "MQTT-3.14.4-1",
+		desc: "After sending a DISCONNECT Packet the Client MUST close the Network Connection and MUST NOT send any more Control Packets on that Network Connection.",
+		client: func(p *peer, c Client) error {
+			err := p.accept(c)
+			if err != nil {
+				return err
+			}
+			errc := run(p, func(context.Context) error { return c.Disconnect() })
+			_, err = p.expectType(mqtt.PacketDisconnect)
+			if err != nil {
+				return err
+			}
+			err = p.expectClosed()
+			if err != nil {
+				return err
+			}
+			return <-errc
+		},
+	},
+}
+
+// run calls fn in a separate goroutine with a context that expires after
+// twice the peer timeout. The returned channel receives fn's result or
+// a timeout error if fn does not return in time.
+func run(p *peer, fn func(ctx context.Context) error) <-chan error {
+	timeout := 2 * p.timeout
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		result <- fn(ctx)
+	}()
+	errc := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-result:
+			errc <- err
+		case <-time.After(timeout + p.timeout):
+			errc <- fmt.Errorf("client operation did not return: %w", errTimeout)
+		}
+	}()
+	return errc
+}
+
+// accept waits for the client's CONNECT and accepts the connection.
+func (p *peer) accept(c Client) error {
+	errc := run(p, func(ctx context.Context) error { return c.Connect(ctx, p.clientEnd) })
+	_, err := p.expectType(mqtt.PacketConnect)
+	if err != nil {
+		return err
+	}
+	err = p.sendPacket(newPacket(mqtt.PacketConnack, 0))
+	if err != nil {
+		return err
+	}
+	err = <-errc
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	return nil
+}
+
+// acceptSubscribe accepts the client's connection, makes it subscribe to a topic
+// filter and returns the SUBSCRIBE packet received.
+func (p *peer) acceptSubscribe(c Client) (mqtt.Packet, error) {
+	err := p.accept(c)
+	if err != nil {
+		return mqtt.Packet{}, err
+	}
+	errc := run(p, func(ctx context.Context) error { return c.Subscribe(ctx, "conformance/+", mqtt.QoS0) })
+	sub, err := p.expectType(mqtt.PacketSubscribe)
+	if err != nil {
+		return sub, err
+	}
+	ack := newPacket(mqtt.PacketSuback, 0)
+	ack.Suback = mqtt.VariablesSuback{
+		PacketIdentifier: sub.Subscribe.PacketIdentifier,
+		ReturnCodes:      make([]mqtt.QoSLevel, len(sub.Subscribe.TopicFilters)),
+	}
+	if ack.Suback.PacketIdentifier == 0 {
+		// Respond anyway so the client does not hang, SUBACK can't be encoded with a zero identifier.
+		ack.Suback.PacketIdentifier = 1
+	}
+	err = p.sendPacket(ack)
+	if err != nil {
+		return sub, err
+	}
+	err = <-errc
+	if err != nil {
+		return sub, fmt.Errorf("subscribe: %w", err)
+	}
+	return sub, nil
+}
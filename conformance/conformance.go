@@ -0,0 +1,287 @@
+// Package conformance checks MQTT v3.1.1 client and server implementations
+// against normative statements of the specification, i.e: MQTT-3.1.0-1.
+//
+// Each clause is checked by a scripted packet exchange over a fresh
+// io.ReadWriteCloser: [RunServer] plays the part of a client against a server
+// implementation and [RunClient] plays the part of a server against a client
+// implementation. Both return a [Report] listing which clauses passed.
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// Config configures a conformance run.
+type Config struct {
+	// Timeout is how long to wait for each expected packet or connection close.
+	// If zero a second is used.
+	Timeout time.Duration
+}
+
+func (cfg Config) timeout() time.Duration {
+	if cfg.Timeout <= 0 {
+		return time.Second
+	}
+	return cfg.Timeout
+}
+
+// Result is the outcome of checking a single clause.
+type Result struct {
+	// ID is the normative statement identifier, i.e: "MQTT-3.1.0-1".
+	ID string
+	// Description is the text of the normative statement.
+	Description string
+	// Err is the reason the clause failed. It is nil if the clause passed.
+	Err error
+}
+
+// Passed returns true if the implementation conforms to the clause.
+func (r Result) Passed() bool { return r.Err == nil }
+
+// String returns a single line summary of the result, i.e: "PASS MQTT-3.12.4-1".
+func (r Result) String() string {
+	if r.Err != nil {
+		return "FAIL " + r.ID + ": " + r.Err.Error()
+	}
+	return "PASS " + r.ID
+}
+
+// Report is the list of results of a conformance run in the order the clauses were checked.
+type Report []Result
+
+// Failed returns the results of clauses that did not pass.
+func (r Report) Failed() (failed Report) {
+	for _, res := range r {
+		if !res.Passed() {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// String returns the results separated by newlines.
+func (r Report) String() string {
+	var sb strings.Builder
+	for _, res := range r {
+		sb.WriteString(res.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// clause is a normative statement and the packet exchange that checks it.
+type clause struct {
+	id   string
+	desc string
+	// Exactly one of server or client is set.
+	server func(p *peer) error
+	client func(p *peer, c Client) error
+}
+
+var errTimeout = errors.New("timed out")
+
+// peer is the suite's end of a connection to the implementation under test.
+// Packets are read in a separate goroutine so that reads can time out on
+// transports without deadlines.
+type peer struct {
+	rwc     io.ReadWriteCloser
+	timeout time.Duration
+	// clientEnd is the end of the connection handed to the Client under test.
+	clientEnd io.ReadWriteCloser
+	rxc       chan rxResult
+	done      chan struct{}
+}
+
+type rxResult struct {
+	pkt mqtt.Packet
+	err error
+}
+
+func newPeer(rwc io.ReadWriteCloser, timeout time.Duration) *peer {
+	p := &peer{
+		rwc:     rwc,
+		timeout: timeout,
+		rxc:     make(chan rxResult),
+		done:    make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+func (p *peer) readLoop() {
+	var rx mqtt.Rx
+	rx.SetRxTransport(p.rwc)
+	rx.Strict = true
+	for {
+		var pkt mqtt.Packet
+		// Use a new buffer for each packet so strings outlive the next read.
+		rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 4*1024)})
+		_, err := rx.ReadPacket(&pkt)
+		select {
+		case p.rxc <- rxResult{pkt: pkt, err: err}:
+		case <-p.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *peer) close() {
+	close(p.done)
+	p.rwc.Close()
+}
+
+// send writes b to the implementation under test.
+func (p *peer) send(b []byte) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := p.rwc.Write(b)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(p.timeout):
+		return fmt.Errorf("writing %s: %w", mqtt.PacketType(b[0]>>4), errTimeout)
+	}
+}
+
+// sendViolation writes b, which violates the clause being checked, and waits
+// for the implementation to close the connection. Write errors are ignored
+// since the implementation may close the connection before reading all of b.
+func (p *peer) sendViolation(b []byte) error {
+	p.send(b)
+	return p.expectClosed()
+}
+
+// sendPacket encodes pkt and writes it to the implementation under test.
+func (p *peer) sendPacket(pkt mqtt.Packet) error {
+	return p.send(encode(pkt))
+}
+
+// expect waits for the next packet.
+func (p *peer) expect() (mqtt.Packet, error) {
+	select {
+	case res := <-p.rxc:
+		if res.err != nil {
+			return res.pkt, fmt.Errorf("reading packet: %w", res.err)
+		}
+		return res.pkt, nil
+	case <-time.After(p.timeout):
+		return mqtt.Packet{}, fmt.Errorf("waiting for packet: %w", errTimeout)
+	}
+}
+
+// expectType waits for the next packet and checks it is of type tp.
+func (p *peer) expectType(tp mqtt.PacketType) (mqtt.Packet, error) {
+	pkt, err := p.expect()
+	if err != nil {
+		return pkt, fmt.Errorf("expected %s: %w", tp, err)
+	}
+	if got := pkt.Header.Type(); got != tp {
+		return pkt, fmt.Errorf("expected %s, got %s", tp, got)
+	}
+	return pkt, nil
+}
+
+// expectClosed waits for the implementation to close the connection. Packets of
+// the allowed types may be received before the connection is closed.
+func (p *peer) expectClosed(allowed ...mqtt.PacketType) error {
+	for {
+		select {
+		case res := <-p.rxc:
+			if res.err != nil {
+				return nil
+			}
+			tp := res.pkt.Header.Type()
+			if !containsType(allowed, tp) {
+				return fmt.Errorf("expected connection to be closed, got %s", tp)
+			}
+		case <-time.After(p.timeout):
+			return fmt.Errorf("expected connection to be closed: %w", errTimeout)
+		}
+	}
+}
+
+func containsType(types []mqtt.PacketType, tp mqtt.PacketType) bool {
+	for _, t := range types {
+		if t == tp {
+			return true
+		}
+	}
+	return false
+}
+
+// nopCloser adds a no-op Close method to a writer.
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// encode returns the wire representation of pkt. It panics if pkt can't be encoded
+// since the suite only encodes packets it builds itself.
+func encode(pkt mqtt.Packet) []byte {
+	var buf bytes.Buffer
+	var tx mqtt.Tx
+	tx.SetTxTransport(nopCloser{&buf})
+	err := tx.WritePacket(&pkt)
+	if err != nil {
+		panic("conformance: encoding " + pkt.Header.Type().String() + ": " + err.Error())
+	}
+	return buf.Bytes()
+}
+
+func newPacket(tp mqtt.PacketType, flags mqtt.PacketFlags) mqtt.Packet {
+	h, err := mqtt.NewHeader(tp, flags, 0)
+	if err != nil {
+		panic(err)
+	}
+	return mqtt.Packet{Header: h}
+}
+
+func identified(tp mqtt.PacketType, packetIdentifier uint16) mqtt.Packet {
+	pkt := newPacket(tp, 0)
+	pkt.PacketIdentifier = packetIdentifier
+	return pkt
+}
+
+func publishPacket(qos mqtt.QoSLevel, topic string, packetIdentifier uint16, payload string) mqtt.Packet {
+	flags, err := mqtt.NewPublishFlags(qos, false, false)
+	if err != nil {
+		panic(err)
+	}
+	pkt := newPacket(mqtt.PacketPublish, flags)
+	pkt.Publish = mqtt.VariablesPublish{TopicName: []byte(topic), PacketIdentifier: packetIdentifier}
+	pkt.Payload = []byte(payload)
+	return pkt
+}
+
+func subscribePacket(packetIdentifier uint16, reqs ...mqtt.SubscribeRequest) mqtt.Packet {
+	pkt := newPacket(mqtt.PacketSubscribe, 0)
+	pkt.Subscribe = mqtt.VariablesSubscribe{PacketIdentifier: packetIdentifier, TopicFilters: reqs}
+	return pkt
+}
+
+func unsubscribePacket(packetIdentifier uint16, topics ...string) mqtt.Packet {
+	pkt := newPacket(mqtt.PacketUnsubscribe, 0)
+	pkt.Unsubscribe = mqtt.VariablesUnsubscribe{PacketIdentifier: packetIdentifier}
+	for _, topic := range topics {
+		pkt.Unsubscribe.Topics = append(pkt.Unsubscribe.Topics, []byte(topic))
+	}
+	return pkt
+}
+
+// withFlags returns a copy of the encoded packet b with the fixed header flags replaced.
+func withFlags(b []byte, flags byte) []byte {
+	b = append([]byte{}, b...)
+	b[0] = b[0]&0xf0 | flags&0x0f
+	return b
+}
@@ -0,0 +1,91 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestServerBroker(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	report := RunServer(func() (io.ReadWriteCloser, error) { return b.Dial(), nil }, Config{})
+	checkReport(t, report, len(serverClauses))
+}
+
+func TestClient(t *testing.T) {
+	report := RunClient(func() Client { return &client{c: mqtt.NewClient(mqtt.ClientConfig{})} }, Config{})
+	checkReport(t, report, len(clientClauses))
+}
+
+func TestReportFailures(t *testing.T) {
+	// A server that accepts connections and never responds fails clauses expecting a response.
+	report := RunServer(func() (io.ReadWriteCloser, error) {
+		c, s := net.Pipe()
+		go io.Copy(io.Discard, s)
+		return c, nil
+	}, Config{Timeout: 10 * time.Millisecond})
+	if len(report) != len(serverClauses) {
+		t.Fatalf("expected %d results, got %d", len(serverClauses), len(report))
+	}
+	failed := report.Failed()
+	if len(failed) != len(report) {
+		t.Errorf("expected all clauses to fail against mute server:\n%s", report)
+	}
+	for _, res := range failed {
+		if !errors.Is(res.Err, errTimeout) {
+			t.Errorf("%s: expected timeout, got %v", res.ID, res.Err)
+		}
+	}
+}
+
+func checkReport(t *testing.T, report Report, clauses int) {
+	t.Helper()
+	if len(report) != clauses {
+		t.Errorf("expected %d results, got %d", clauses, len(report))
+	}
+	for _, res := range report.Failed() {
+		t.Error(res)
+	}
+	if t.Failed() {
+		t.Log(report)
+	}
+}
+
+// client adapts *mqtt.Client to the Client interface.
+type client struct {
+	c      *mqtt.Client
+	nextPI uint16
+}
+
+func (c *client) Connect(ctx context.Context, rwc io.ReadWriteCloser) error {
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("conformance"))
+	return c.c.Connect(ctx, rwc, &varConn)
+}
+
+func (c *client) Subscribe(ctx context.Context, topicFilter string, qos mqtt.QoSLevel) error {
+	return c.c.Subscribe(ctx, mqtt.VariablesSubscribe{
+		PacketIdentifier: c.packetIdentifier(),
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte(topicFilter), QoS: qos}},
+	})
+}
+
+func (c *client) Publish(ctx context.Context, topic string, payload []byte) error {
+	return c.c.PublishPayload(0, mqtt.VariablesPublish{TopicName: []byte(topic), PacketIdentifier: c.packetIdentifier()}, payload)
+}
+
+func (c *client) Ping(ctx context.Context) error { return c.c.Ping(ctx) }
+
+func (c *client) Disconnect() error { return c.c.Disconnect(errors.New("conformance disconnect")) }
+
+func (c *client) packetIdentifier() uint16 {
+	c.nextPI++
+	return c.nextPI
+}
@@ -0,0 +1,467 @@
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// RunServer checks the server implementation reached through dial against the
+// server clauses of the suite. dial is called once per clause and must return a
+// new connection to the server, i.e: the client end of a net.Pipe served by the
+// implementation. The suite closes the returned connection after each clause.
+func RunServer(dial func() (io.ReadWriteCloser, error), cfg Config) Report {
+	report := make(Report, 0, len(serverClauses))
+	for _, c := range serverClauses {
+		res := Result{ID: c.id, Description: c.desc}
+		rwc, err := dial()
+		if err != nil {
+			res.Err = fmt.Errorf("dial: %w", err)
+		} else {
+			p := newPeer(rwc, cfg.timeout())
+			res.Err = c.server(p)
+			p.close()
+		}
+		report = append(report, res)
+	}
+	return report
+}
+
+var serverClauses = []clause{
+	{
+		id:   "MQTT-3.1.0-1",
+		desc: "After a Network Connection is established by a Client to a Server, the first Packet sent from the Client to the Server MUST be a CONNECT Packet.",
+		server: func(p *peer) error {
+			return p.sendViolation(encode(newPacket(mqtt.PacketPingreq, 0)))
+		},
+	},
+	{
+		id:   "MQTT-3.1.0-2",
+		desc: "The Server MUST process a second CONNECT Packet sent from a Client as a protocol violation and disconnect the Client.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			return p.sendViolation(encode(connectPacket()))
+		},
+	},
+	{
+		id:   "MQTT-3.1.2-2",
+		desc: "The Server MUST respond to the CONNECT Packet with a CONNACK return code 0x01 (unacceptable protocol level) and then disconnect the Client if the Protocol Level is not supported by the Server.",
+		server: func(p *peer) error {
+			pkt := connectPacket()
+			pkt.Connect.ProtocolLevel = 0xff
+			err := p.sendPacket(pkt)
+			if err != nil {
+				return err
+			}
+			ack, err := p.expectType(mqtt.PacketConnack)
+			if err != nil {
+				return err
+			}
+			if ack.Connack.ReturnCode != mqtt.ReturnCodeUnnaceptableProtocol {
+				return fmt.Errorf("expected CONNACK return code %d, got %d", mqtt.ReturnCodeUnnaceptableProtocol, ack.Connack.ReturnCode)
+			}
+			return p.expectClosed()
+		},
+	},
+	{
+		id:   "MQTT-3.1.2-3",
+		desc: "The Server MUST validate that the reserved flag in the CONNECT Control Packet is set to zero and disconnect the Client if it is not zero.",
+		server: func(p *peer) error {
+			return p.sendViolation(rawConnect(1<<1|1, "conformance"))
+		},
+	},
+	{
+		id:   "MQTT-3.1.2-22",
+		desc: "If the User Name Flag is set to 0, the Password Flag MUST be set to 0.",
+		server: func(p *peer) error {
+			return p.sendViolation(rawConnect(1<<6|1<<1, "conformance", "password"))
+		},
+	},
+	{
+		id:   "MQTT-3.2.0-1",
+		desc: "The first packet sent from the Server to the Client MUST be a CONNACK Packet.",
+		server: func(p *peer) error {
+			err := p.sendPacket(connectPacket())
+			if err != nil {
+				return err
+			}
+			_, err = p.expectType(mqtt.PacketConnack)
+			return err
+		},
+	},
+	{
+		id:   "MQTT-3.2.2-1",
+		desc: "If the Server accepts a connection with CleanSession set to 1, the Server MUST set Session Present to 0 in the CONNACK packet in addition to setting a zero return code in the CONNACK packet.",
+		server: func(p *peer) error {
+			err := p.sendPacket(connectPacket())
+			if err != nil {
+				return err
+			}
+			ack, err := p.expectType(mqtt.PacketConnack)
+			if err != nil {
+				return err
+			}
+			if ack.Connack.ReturnCode != mqtt.ReturnCodeConnAccepted || ack.Connack.SessionPresent() {
+				return fmt.Errorf("expected accepted CONNACK without session present, got return code %d and session present %v", ack.Connack.ReturnCode, ack.Connack.SessionPresent())
+			}
+			return nil
+		},
+	},
+	{
+		id:   "MQTT-2.2.2-2",
+		desc: "If invalid flags are received, the receiver MUST close the Network Connection.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			return p.sendViolation(withFlags(encode(newPacket(mqtt.PacketPingreq, 0)), 0b0001))
+		},
+	},
+	{
+		id:   "MQTT-3.3.2-2",
+		desc: "The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			return p.sendViolation(encode(publishPacket(mqtt.QoS0, "conformance/#", 0, "wildcard")))
+		},
+	},
+	{
+		id:   "MQTT-3.3.5-1",
+		desc: "The Server MUST deliver the message to the Client respecting the maximum QoS of all the matching subscriptions.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			granted, err := p.subscribe("conformance/deliver", mqtt.QoS0)
+			if err != nil {
+				return err
+			}
+			err = p.sendPacket(publishPacket(mqtt.QoS1, "conformance/deliver", 7, "hello"))
+			if err != nil {
+				return err
+			}
+			// PUBACK and the delivered PUBLISH may arrive in either order.
+			var pub mqtt.Packet
+			for i := 0; i < 2; i++ {
+				pkt, err := p.expect()
+				if err != nil {
+					return err
+				}
+				switch pkt.Header.Type() {
+				case mqtt.PacketPuback:
+				case mqtt.PacketPublish:
+					pub = pkt
+				default:
+					return fmt.Errorf("expected PUBACK or PUBLISH, got %s", pkt.Header.Type())
+				}
+			}
+			if pub.Header.Type() != mqtt.PacketPublish {
+				return fmt.Errorf("message not delivered")
+			}
+			if string(pub.Publish.TopicName) != "conformance/deliver" || string(pub.Payload) != "hello" {
+				return fmt.Errorf("delivered message %q on topic %q, expected %q on %q", pub.Payload, pub.Publish.TopicName, "hello", "conformance/deliver")
+			}
+			if qos := pub.Header.Flags().QoS(); qos > granted {
+				return fmt.Errorf("message delivered with QoS%d, subscription granted QoS%d", qos, granted)
+			}
+			return nil
+		},
+	},
+	{
+		id:   "MQTT-3.8.1-1",
+		desc: "Bits 3,2,1 and 0 of the fixed header of the SUBSCRIBE Control Packet are reserved and MUST be set to 0,0,1 and 0 respectively. The Server MUST treat any other value as malformed and close the Network Connection.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			pkt := subscribePacket(1, mqtt.SubscribeRequest{TopicFilter: []byte("conformance/#")})
+			return p.sendViolation(withFlags(encode(pkt), 0))
+		},
+	},
+	{
+		id:   "MQTT-3.8.3-3",
+		desc: "The payload of a SUBSCRIBE packet MUST contain at least one Topic Filter / QoS pair. A SUBSCRIBE packet with no payload is a protocol violation.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			// SUBSCRIBE with packet identifier 1 and no payload.
+			return p.sendViolation([]byte{byte(mqtt.PacketSubscribe)<<4 | 0b0010, 2, 0, 1})
+		},
+	},
+	{
+		id:   "MQTT-3.8.4-1",
+		desc: "When the Server receives a SUBSCRIBE Packet from a Client, the Server MUST respond with a SUBACK Packet.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			_, err = p.subscribe("conformance/suback", mqtt.QoS0)
+			return err
+		},
+	},
+	{
+		id:   "MQTT-3.8.4-2",
+		desc: "The SUBACK Packet MUST have the same Packet Identifier as the SUBSCRIBE Packet that it is acknowledging.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			err = p.sendPacket(subscribePacket(0xbeef, mqtt.SubscribeRequest{TopicFilter: []byte("conformance/suback")}))
+			if err != nil {
+				return err
+			}
+			ack, err := p.expectType(mqtt.PacketSuback)
+			if err != nil {
+				return err
+			}
+			if ack.Suback.PacketIdentifier != 0xbeef {
+				return fmt.Errorf("expected packet identifier %d, got %d", 0xbeef, ack.Suback.PacketIdentifier)
+			}
+			return nil
+		},
+	},
+	{
+		id:   "MQTT-3.8.4-5",
+		desc: "The SUBACK Packet sent by the Server to the Client MUST contain a return code for each Topic Filter/QoS pair. This return code MUST either show the maximum QoS that was granted for that Subscription or indicate that the subscription failed.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			reqs := []mqtt.SubscribeRequest{
+				{TopicFilter: []byte("conformance/0"), QoS: mqtt.QoS0},
+				{TopicFilter: []byte("conformance/1"), QoS: mqtt.QoS1},
+				{TopicFilter: []byte("conformance/2"), QoS: mqtt.QoS2},
+			}
+			err = p.sendPacket(subscribePacket(1, reqs...))
+			if err != nil {
+				return err
+			}
+			ack, err := p.expectType(mqtt.PacketSuback)
+			if err != nil {
+				return err
+			}
+			if len(ack.Suback.ReturnCodes) != len(reqs) {
+				return fmt.Errorf("expected %d return codes, got %d", len(reqs), len(ack.Suback.ReturnCodes))
+			}
+			for i, rc := range ack.Suback.ReturnCodes {
+				if rc != mqtt.QoSSubfail && rc > reqs[i].QoS {
+					return fmt.Errorf("return code %d granted QoS%d for QoS%d request", i, rc, reqs[i].QoS)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		id:   "MQTT-3.10.1-1",
+		desc: "Bits 3,2,1 and 0 of the fixed header of the UNSUBSCRIBE Control Packet are reserved and MUST be set to 0,0,1 and 0 respectively. The Server MUST treat any other value as malformed and close the Network Connection.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			return p.sendViolation(withFlags(encode(unsubscribePacket(1, "conformance/#")), 0))
+		},
+	},
+	{
+		id:   "MQTT-3.10.4-4",
+		desc: "The Server MUST respond to an UNSUBSCRIBE request by sending an UNSUBACK packet. The UNSUBACK Packet MUST have the same Packet Identifier as the UNSUBSCRIBE Packet.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			_, err = p.subscribe("conformance/unsub", mqtt.QoS0)
+			if err != nil {
+				return err
+			}
+			return p.unsubscribe(0xcafe, "conformance/unsub")
+		},
+	},
+	{
+		id:   "MQTT-3.10.4-5",
+		desc: "Even where no Topic Subscriptions are deleted, the Server MUST respond with an UNSUBACK.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			return p.unsubscribe(2, "conformance/never/subscribed")
+		},
+	},
+	{
+		id:   "MQTT-3.12.4-1",
+		desc: "The Server MUST send a PINGRESP Packet in response to a PINGREQ Packet.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			err = p.sendPacket(newPacket(mqtt.PacketPingreq, 0))
+			if err != nil {
+				return err
+			}
+			_, err = p.expectType(mqtt.PacketPingresp)
+			return err
+		},
+	},
+	{
+		id:   "MQTT-4.3.2-2",
+		desc: "In the QoS 1 delivery protocol, the Receiver MUST respond with a PUBACK Packet containing the Packet Identifier from the incoming PUBLISH Packet.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			err = p.sendPacket(publishPacket(mqtt.QoS1, "conformance/qos1", 0x1234, "qos1"))
+			if err != nil {
+				return err
+			}
+			return p.expectIdentified(mqtt.PacketPuback, 0x1234)
+		},
+	},
+	{
+		id:   "MQTT-4.3.3-2",
+		desc: "In the QoS 2 delivery protocol, the Receiver MUST respond with a PUBREC containing the Packet Identifier from the incoming PUBLISH Packet and MUST respond to a PUBREL packet by sending a PUBCOMP packet containing the same Packet Identifier as the PUBREL.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			err = p.sendPacket(publishPacket(mqtt.QoS2, "conformance/qos2", 0x4321, "qos2"))
+			if err != nil {
+				return err
+			}
+			err = p.expectIdentified(mqtt.PacketPubrec, 0x4321)
+			if err != nil {
+				return err
+			}
+			err = p.sendPacket(identified(mqtt.PacketPubrel, 0x4321))
+			if err != nil {
+				return err
+			}
+			return p.expectIdentified(mqtt.PacketPubcomp, 0x4321)
+		},
+	},
+	{
+		id:   "MQTT-4.7.2-1",
+		desc: "The Server MUST NOT match Topic Filters starting with a wildcard character (# or +) with Topic Names beginning with a $ character.",
+		server: func(p *peer) error {
+			err := p.connect()
+			if err != nil {
+				return err
+			}
+			_, err = p.subscribe("#", mqtt.QoS0)
+			if err != nil {
+				return err
+			}
+			// The second PUBLISH is delivered and marks the end of the exchange.
+			for _, topic := range []string{"$conformance/sys", "conformance/end"} {
+				err = p.sendPacket(publishPacket(mqtt.QoS0, topic, 0, topic))
+				if err != nil {
+					return err
+				}
+			}
+			pub, err := p.expectType(mqtt.PacketPublish)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(pub.Publish.TopicName, []byte("conformance/end")) {
+				return fmt.Errorf("filter \"#\" matched topic %q", pub.Publish.TopicName)
+			}
+			return nil
+		},
+	},
+}
+
+// connectPacket returns a CONNECT packet with CleanSession set.
+func connectPacket() mqtt.Packet {
+	pkt := newPacket(mqtt.PacketConnect, 0)
+	pkt.Connect.SetDefaultMQTT([]byte("conformance"))
+	pkt.Connect.CleanSession = true
+	return pkt
+}
+
+// rawConnect returns a CONNECT packet with the given flags and payload strings,
+// which may contradict the flags.
+func rawConnect(flags byte, payload ...string) []byte {
+	varHeader := []byte{0, 4, 'M', 'Q', 'T', 'T', 4, flags, 0, 60}
+	for _, s := range payload {
+		varHeader = append(varHeader, byte(len(s)>>8), byte(len(s)))
+		varHeader = append(varHeader, s...)
+	}
+	return append([]byte{byte(mqtt.PacketConnect) << 4, byte(len(varHeader))}, varHeader...)
+}
+
+// connect performs a CONNECT/CONNACK exchange and checks the connection is accepted.
+func (p *peer) connect() error {
+	err := p.sendPacket(connectPacket())
+	if err != nil {
+		return err
+	}
+	ack, err := p.expectType(mqtt.PacketConnack)
+	if err != nil {
+		return err
+	}
+	if ack.Connack.ReturnCode != mqtt.ReturnCodeConnAccepted {
+		return fmt.Errorf("connection refused: %w", ack.Connack.ReturnCode)
+	}
+	return nil
+}
+
+// subscribe performs a SUBSCRIBE/SUBACK exchange for a single topic filter and
+// returns the granted QoS.
+func (p *peer) subscribe(topicFilter string, qos mqtt.QoSLevel) (mqtt.QoSLevel, error) {
+	err := p.sendPacket(subscribePacket(1, mqtt.SubscribeRequest{TopicFilter: []byte(topicFilter), QoS: qos}))
+	if err != nil {
+		return 0, err
+	}
+	ack, err := p.expectType(mqtt.PacketSuback)
+	if err != nil {
+		return 0, err
+	}
+	if len(ack.Suback.ReturnCodes) != 1 {
+		return 0, fmt.Errorf("expected 1 SUBACK return code, got %d", len(ack.Suback.ReturnCodes))
+	}
+	granted := ack.Suback.ReturnCodes[0]
+	if granted == mqtt.QoSSubfail {
+		return granted, fmt.Errorf("subscription to %q failed", topicFilter)
+	}
+	return granted, nil
+}
+
+// unsubscribe performs an UNSUBSCRIBE/UNSUBACK exchange.
+func (p *peer) unsubscribe(packetIdentifier uint16, topics ...string) error {
+	err := p.sendPacket(unsubscribePacket(packetIdentifier, topics...))
+	if err != nil {
+		return err
+	}
+	return p.expectIdentified(mqtt.PacketUnsuback, packetIdentifier)
+}
+
+// expectIdentified waits for a packet of type tp with the given packet identifier.
+func (p *peer) expectIdentified(tp mqtt.PacketType, packetIdentifier uint16) error {
+	pkt, err := p.expectType(tp)
+	if err != nil {
+		return err
+	}
+	if pkt.PacketIdentifier != packetIdentifier {
+		return fmt.Errorf("expected %s packet identifier %d, got %d", tp, packetIdentifier, pkt.PacketIdentifier)
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package mqtt
 
 import (
-	"bytes"
 	"errors"
 	"io"
 )
@@ -36,7 +35,7 @@ func (d DecoderNoAlloc) DecodeConnect(r io.Reader) (varConn VariablesConnect, n
 	}
 	n++
 	if flags&1 != 0 { // [MQTT-3.1.2-3].
-		return VariablesConnect{}, n, errors.New("reserved bit set in CONNECT flag")
+		return VariablesConnect{}, n, newProtocolError(PacketConnect, "MQTT-3.1.2-3", "reserved bit set in CONNECT flag")
 	}
 	userNameFlag := flags&(1<<7) != 0
 	passwordFlag := flags&(1<<6) != 0
@@ -45,7 +44,7 @@ func (d DecoderNoAlloc) DecodeConnect(r io.Reader) (varConn VariablesConnect, n
 	willFlag := flags&(1<<2) != 0
 	varConn.CleanSession = flags&(1<<1) != 0
 	if passwordFlag && !userNameFlag {
-		return VariablesConnect{}, n, errors.New("username flag must be set to use password flag")
+		return VariablesConnect{}, n, newProtocolError(PacketConnect, "MQTT-3.1.2-22", "username flag must be set to use password flag")
 	}
 
 	varConn.KeepAlive, ngot, err = decodeUint16(r)
@@ -123,10 +122,10 @@ func (d DecoderNoAlloc) DecodeSubscribe(r io.Reader, remainingLen uint32) (varSu
 	for n < int(remainingLen) {
 		hotTopic, ngot, err := decodeMQTTString(r, payloadDst)
 		n += ngot
-		payloadDst = payloadDst[ngot:] //Advance buffer pointer to not overwrite.
 		if err != nil {
 			return VariablesSubscribe{}, n, err
 		}
+		payloadDst = payloadDst[len(hotTopic):] // Advance buffer pointer to not overwrite.
 		qos, err := decodeByte(r)
 		if err != nil {
 			return VariablesSubscribe{}, n, err
@@ -147,10 +146,10 @@ func (d DecoderNoAlloc) DecodeUnsubscribe(r io.Reader, remainingLength uint32) (
 	for n < int(remainingLength) {
 		coldTopic, ngot, err := decodeMQTTString(r, payloadDst)
 		n += ngot
-		payloadDst = payloadDst[ngot:] // Advance buffer pointer to not overwrite.
 		if err != nil {
 			return VariablesUnsubscribe{}, n, err
 		}
+		payloadDst = payloadDst[len(coldTopic):] // Advance buffer pointer to not overwrite.
 		varUnsub.Topics = append(varUnsub.Topics, coldTopic)
 	}
 	return varUnsub, n, nil
@@ -204,39 +203,27 @@ func decodeRemainingLength(r io.Reader) (value uint32, n int, err error) {
 		multiplier *= 128
 
 	}
-	return 0, n, errors.New("malformed remaining length")
+	return 0, n, ErrBadRemainingLen
 }
 
+// readFull reads exactly len(dst) bytes from src, tolerating short reads.
+// It returns io.ErrUnexpectedEOF if src ends before dst is filled.
 func readFull(src io.Reader, dst []byte) (int, error) {
-	n, err := src.Read(dst)
-	if err == nil && n != len(dst) {
-		var buffer [256]byte
-		// TODO(soypat): Avoid heavy heap allocation by implementing lightweight algorithm here.
-		i64, err := io.CopyBuffer(bytes.NewBuffer(dst[n:]), src, buffer[:])
-		i := int(i64)
-		if err != nil && errors.Is(err, io.EOF) && i == len(dst[n:]) {
-			err = nil
-		}
-		return n + i, err
-	}
-	return n, err
+	return io.ReadFull(src, dst)
 }
 
 // decodeMQTT unmarshals a string from r into buffer's start. The unmarshalled
 // string can be at most len(buffer). buffer must be at least of length 2.
 // decodeMQTTString only returns a non-nil string on a successful decode.
 func decodeMQTTString(r io.Reader, buffer []byte) ([]byte, int, error) {
-	if len(buffer) < 2 {
-		return nil, 0, ErrUserBufferFull
-	}
 	stringLength, n, err := decodeUint16(r)
 	if err != nil {
 		return nil, n, err
 	}
 	if stringLength == 0 {
-		return nil, n, errors.New("zero length MQTT string")
+		return nil, n, ErrEmptyString
 	}
-	if stringLength > uint16(len(buffer)) {
+	if int(stringLength) > len(buffer) {
 		return nil, n, ErrUserBufferFull // errors.New("buffer too small for string of length " + strconv.FormatUint(uint64(stringLength), 10))
 	}
 	ngot, err := readFull(r, buffer[:stringLength])
@@ -249,10 +236,7 @@ func decodeMQTTString(r io.Reader, buffer []byte) ([]byte, int, error) {
 
 func decodeByte(r io.Reader) (value byte, err error) {
 	var vbuf [1]byte
-	n, err := r.Read(vbuf[:])
-	if err != nil && errors.Is(err, io.EOF) && n == 1 {
-		err = nil // Byte was read successfully albeit with an EOF.
-	}
+	_, err = readFull(r, vbuf[:])
 	return vbuf[0], err
 }
 
@@ -3,7 +3,6 @@ package mqtt
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"io"
 	"math"
 )
@@ -12,7 +11,7 @@ import (
 // of 7 bytes, which is the max length header in MQTT v3.1.
 func (h Header) Encode(w io.Writer) (n int, err error) {
 	if h.RemainingLength > maxRemainingLengthValue {
-		return 0, errors.New("remaining length too large for MQTT v3.1.1 spec")
+		return 0, ErrBadRemainingLen
 	}
 	var headerBuf [5]byte
 	n = h.Put(headerBuf[:])
@@ -28,10 +27,10 @@ func (h Header) Put(buf []byte) int {
 func encodeMQTTString(w io.Writer, s []byte) (int, error) {
 	length := len(s)
 	if length == 0 {
-		return 0, errors.New("cannot encode MQTT string of length 0")
+		return 0, ErrEmptyString
 	}
 	if length > math.MaxUint16 {
-		return 0, errors.New("cannot encode MQTT string of length > MaxUint16 or length 0")
+		return 0, ErrStringTooLong
 	}
 	n, err := encodeUint16(w, uint16(len(s)))
 	if err != nil {
@@ -72,23 +71,25 @@ func encodeRemainingLength(remlen uint32, b []byte) (n int) {
 // encodeConnect encodes a CONNECT packet variable header over w given connVars. Does not encode
 // either the fixed header or the Packet Payload.
 func encodeConnect(w io.Writer, varConn *VariablesConnect) (n int, err error) {
-	// Begin encoding variable header buffer.
-	var varHeaderBuf [10]byte
-	// Set protocol name 'MQTT' and protocol level 4.
-	n += copy(varHeaderBuf[:], "\x00\x04MQTT\x04") // writes 7 bytes.
-	varHeaderBuf[n] = varConn.Flags()
-	varHeaderBuf[n+1] = byte(varConn.KeepAlive >> 8) // MSB
-	varHeaderBuf[n+2] = byte(varConn.KeepAlive)      // LSB
-	// n+=3 // We've written 10 bytes exactly if all went well up to here.
-	n, err = w.Write(varHeaderBuf[:])
-	if err == nil && n != 10 {
-		return n, errors.New("single write did not complete for encoding, use larger underlying buffer")
+	// Begin encoding variable header with protocol name, i.e: "MQTT".
+	protocol, level := varConn.protocol()
+	n, err = encodeMQTTString(w, protocol)
+	if err != nil {
+		return n, err
 	}
+	// Protocol level, connect flags and keepalive.
+	var varHeaderBuf [4]byte
+	varHeaderBuf[0] = level
+	varHeaderBuf[1] = varConn.Flags()
+	varHeaderBuf[2] = byte(varConn.KeepAlive >> 8) // MSB
+	varHeaderBuf[3] = byte(varConn.KeepAlive)      // LSB
+	ngot, err := writeFull(w, varHeaderBuf[:])
+	n += ngot
 	if err != nil {
 		return n, err
 	}
 	// Begin Encoding payload contents. First field is ClientID.
-	ngot, err := encodeMQTTString(w, varConn.ClientID)
+	ngot, err = encodeMQTTString(w, varConn.ClientID)
 	n += ngot
 	if err != nil {
 		return n, err
@@ -162,7 +163,7 @@ func encodeUint16(w io.Writer, value uint16) (n int, err error) {
 
 func encodeSubscribe(w io.Writer, varSub VariablesSubscribe) (n int, err error) {
 	if len(varSub.TopicFilters) == 0 {
-		return 0, errors.New("payload of SUBSCRIBE must contain at least one topic filter / QoS pair")
+		return 0, errNoSubscribeFilters
 	}
 	n, err = encodeUint16(w, varSub.PacketIdentifier)
 	if err != nil {
@@ -205,7 +206,7 @@ func encodeSuback(w io.Writer, varSuback VariablesSuback) (n int, err error) {
 
 func encodeUnsubscribe(w io.Writer, varUnsub VariablesUnsubscribe) (n int, err error) {
 	if len(varUnsub.Topics) == 0 {
-		return 0, errors.New("payload of UNSUBSCRIBE must contain at least one topic")
+		return 0, errNoUnsubscribeTopics
 	}
 	n, err = encodeUint16(w, varUnsub.PacketIdentifier)
 	if err != nil {
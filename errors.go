@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	errQoS0NoDup     = &ProtocolError{Packet: PacketPublish, Spec: "MQTT-3.3.1-2", Err: errors.New("DUP must be 0 for all QoS0")}
+	errEmptyTopic    = &ProtocolError{Packet: PacketPublish, Spec: "MQTT-4.7.3-1", Err: errors.New("empty topic name")}
+	errWildcardTopic = &ProtocolError{Packet: PacketPublish, Spec: "MQTT-3.3.2-2", Err: errors.New("wildcard in topic name")}
+	// errGotZeroPI is wrapped in a *ProtocolError by zeroPIError.
+	errGotZeroPI    = errors.New("packet identifier must be nonzero for packet type")
+	errRxDisconnect = errors.New("received DISCONNECT")
+
+	errNoSubscribeFilters  = &ProtocolError{Packet: PacketSubscribe, Spec: "MQTT-3.8.3-3", Err: errors.New("no topic filters")}
+	errNoUnsubscribeTopics = &ProtocolError{Packet: PacketUnsubscribe, Spec: "MQTT-3.10.3-2", Err: errors.New("no topic filters")}
+	errInvalidSubscribeQoS = &ProtocolError{Packet: PacketSubscribe, Spec: "MQTT-3.8.3-4", Err: errors.New("invalid requested QoS")}
+	errEmptyTopicFilter    = &ProtocolError{Packet: PacketSubscribe, Spec: "MQTT-4.7.3-1", Err: errors.New("empty topic filter")}
+	// errTopicExists is only returned by subscriptionsMap, which is not used by Rx, Tx or Client.
+	errTopicExists = errors.New("topic already exists in subscriptions")
+
+	// natiu-mqtt depends on user provided buffers for string and byte slice allocation.
+	// If a buffer is too small for the incoming strings or for marshalling a subscription topic
+	// then the implementation should return this error.
+	ErrUserBufferFull = errors.New("natiu-mqtt: user buffer full")
+	// ErrBadRemainingLen is passed to Rx's OnRxError after decoding a header with a
+	// remaining length that does not conform to MQTT v3.1.1 packet specifications.
+	// It is wrapped by a *ProtocolError indicating the offending packet type.
+	// Header.Encode returns it for remaining lengths that cannot be encoded.
+	ErrBadRemainingLen = errors.New("natiu-mqtt: MQTT v3.1.1 bad remaining length")
+	// ErrPacketTooLarge is returned by Rx when a received packet header announces a
+	// packet larger than Rx.MaxPacketSize and by Tx when attempting to write a packet
+	// larger than Tx.MaxPacketSize.
+	ErrPacketTooLarge = errors.New("natiu-mqtt: packet exceeds maximum packet size")
+	// ErrDisconnected is matched by a *DisconnectedError with errors.Is.
+	ErrDisconnected = errors.New("natiu-mqtt: disconnected")
+	// ErrNilTransport is returned by Rx and Tx when reading or writing before a transport is set.
+	ErrNilTransport = errors.New("natiu-mqtt: nil transport")
+	// ErrInvalidPacketType is returned when writing a packet type not supported by the
+	// called method and by NewHeader for packet types outside the 4 bit range.
+	ErrInvalidPacketType = errors.New("natiu-mqtt: invalid packet type")
+	// ErrInvalidPacketFlags is returned by NewHeader for packet flags outside the 4 bit range.
+	ErrInvalidPacketFlags = errors.New("natiu-mqtt: packet flags exceed 4 bit range")
+	// ErrNilPacket is returned by Rx.ReadPacket and Tx.WritePacket when passed a nil Packet.
+	ErrNilPacket = errors.New("natiu-mqtt: nil Packet")
+	// ErrEmptyString is returned when encoding or decoding a zero length MQTT string.
+	ErrEmptyString = errors.New("natiu-mqtt: zero length MQTT string")
+	// ErrStringTooLong is returned when encoding an MQTT string longer than 65535 bytes.
+	ErrStringTooLong = errors.New("natiu-mqtt: MQTT string exceeds 65535 bytes")
+	// ErrUnreadPayload is returned by Rx when OnPub returns without reading the whole PUBLISH payload.
+	ErrUnreadPayload = errors.New("natiu-mqtt: OnPub did not read complete payload")
+	// ErrAlreadyConnected is returned by Client when connecting while connected.
+	ErrAlreadyConnected = errors.New("natiu-mqtt: already connected; disconnect before connecting")
+	// ErrAwaitingSuback is returned by Client when subscribing while a previous SUBSCRIBE awaits its SUBACK.
+	ErrAwaitingSuback = errors.New("natiu-mqtt: awaiting SUBACK of previous SUBSCRIBE")
+	// ErrNotConnected is returned by Client.Err and is the Cause of the *DisconnectedError
+	// returned by Client operations before the Client has connected for the first time.
+	ErrNotConnected = errors.New("natiu-mqtt: yet to connect")
+	// ErrUnsupportedQoS is returned by Client when publishing with a QoS it does not support.
+	ErrUnsupportedQoS = errors.New("natiu-mqtt: unsupported QoS")
+)
+
+// ProtocolError is returned when a packet violates a normative statement of the
+// MQTT v3.1.1 specification. Spec is the identifier of the violated statement
+// i.e: "MQTT-3.3.2-2" and may be empty if the statement has no identifier.
+type ProtocolError struct {
+	// Packet is the type of the offending packet.
+	Packet PacketType
+	Spec   string
+	Err    error
+}
+
+// Error implements the error interface.
+func (pe *ProtocolError) Error() string {
+	s := "natiu-mqtt: " + pe.Packet.String() + ": " + pe.Err.Error()
+	if pe.Spec != "" {
+		s += " [" + pe.Spec + "]"
+	}
+	return s
+}
+
+// Unwrap returns the underlying reason for the protocol violation.
+func (pe *ProtocolError) Unwrap() error { return pe.Err }
+
+// newProtocolError is a shorthand for creating a ProtocolError.
+func newProtocolError(packet PacketType, spec, reason string) *ProtocolError {
+	return &ProtocolError{Packet: packet, Spec: spec, Err: errors.New(reason)}
+}
+
+// zeroPIError returns a *ProtocolError for a zero packet identifier in a packet
+// of type pt. It matches errGotZeroPI with errors.Is.
+func zeroPIError(pt PacketType) error {
+	return &ProtocolError{Packet: pt, Spec: "MQTT-2.3.1-1", Err: errGotZeroPI}
+}
+
+// ConnectError is returned when the server refuses a connection by responding
+// to a CONNECT packet with a non-zero CONNACK return code.
+type ConnectError struct {
+	ReturnCode ConnectReturnCode
+}
+
+// Error implements the error interface.
+func (ce *ConnectError) Error() string {
+	return "natiu-mqtt: connection refused: " + ce.ReturnCode.String()
+}
+
+// Unwrap returns the CONNACK return code, which itself implements the error interface.
+func (ce *ConnectError) Unwrap() error { return ce.ReturnCode }
+
+// SubackError is returned when the server responds to a SUBSCRIBE packet with
+// a SUBACK containing failure return codes (0x80).
+type SubackError struct {
+	PacketIdentifier uint16
+	// Rejected contains the topic filters the server rejected.
+	Rejected []string
+}
+
+// Error implements the error interface.
+func (se *SubackError) Error() string {
+	return "natiu-mqtt: SUBACK rejected topic filters: " + strings.Join(se.Rejected, ", ")
+}
+
+// DisconnectedError is returned when an operation requires a connection
+// that does not exist. Cause is the error that ended the last connection.
+type DisconnectedError struct {
+	Cause error
+}
+
+// Error implements the error interface.
+func (de *DisconnectedError) Error() string {
+	if de.Cause == nil {
+		return ErrDisconnected.Error()
+	}
+	return ErrDisconnected.Error() + ": " + de.Cause.Error()
+}
+
+// Unwrap returns the cause of disconnection.
+func (de *DisconnectedError) Unwrap() error { return de.Cause }
+
+// Is returns true if target is ErrDisconnected.
+func (de *DisconnectedError) Is(target error) bool { return target == ErrDisconnected }
@@ -0,0 +1,41 @@
+package mqtt
+
+// LogLevel is the importance of a log message. Values match those of the
+// standard library's log/slog package so conversion between them is direct.
+type LogLevel int8
+
+const (
+	// LevelDebug is for information useful when debugging natiu-mqtt, i.e: every packet sent and received.
+	LevelDebug LogLevel = -4
+	// LevelInfo is for events that are expected during normal operation and may be of interest to the user.
+	LevelInfo LogLevel = 0
+	// LevelWarn is for unexpected events that do not end the connection.
+	LevelWarn LogLevel = 4
+	// LevelError is for errors that end the connection.
+	LevelError LogLevel = 8
+)
+
+// String returns a pretty-string representation of l i.e: "WARN". Does not allocate memory.
+func (l LogLevel) String() (s string) {
+	switch l {
+	case LevelDebug:
+		s = "DEBUG"
+	case LevelInfo:
+		s = "INFO"
+	case LevelWarn:
+		s = "WARN"
+	case LevelError:
+		s = "ERROR"
+	default:
+		s = "undefined log level"
+	}
+	return s
+}
+
+// Logger is implemented by structured loggers. keyvals are alternating keys and values
+// where keys are strings i.e: Log(LevelWarn, "ignoring error", "err", err).
+// natiu-mqtt does not log if no Logger is set, so a nil Logger incurs no cost.
+// See the mqttslog package for an adapter to the log/slog package.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...any)
+}
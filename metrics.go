@@ -0,0 +1,91 @@
+package mqtt
+
+import "time"
+
+// LatencyBuckets are the inclusive upper bounds of the buckets of a Histogram.
+// Observations exceeding the last bound are counted in the last bucket of the Histogram.
+var LatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram is a latency histogram with fixed buckets given by LatencyBuckets.
+type Histogram struct {
+	// Counts holds the number of observations in each bucket. Counts[i] is the number
+	// of observations greater than LatencyBuckets[i-1] and less or equal to LatencyBuckets[i].
+	// The last element holds the number of observations greater than all LatencyBuckets.
+	Counts [len(LatencyBuckets) + 1]uint64
+	// Count is the total number of observations.
+	Count uint64
+	// Sum is the sum of all observations.
+	Sum time.Duration
+}
+
+// Observe adds a duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Mean returns the mean of all observations or zero if there are none.
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Metrics is a snapshot of a Client's counters and latency histograms. Counters
+// are cumulative over the lifetime of the Client and are not reset on reconnection.
+// Per-packet arrays are indexed by PacketType, i.e: m.PacketsSent[PacketPublish].
+type Metrics struct {
+	// PacketsSent counts packets successfully written to the transport.
+	PacketsSent [16]uint64
+	// BytesSent counts bytes of packets successfully written to the transport, including the fixed header.
+	BytesSent [16]uint64
+	// PacketsReceived counts packets successfully decoded.
+	PacketsReceived [16]uint64
+	// BytesReceived counts bytes of packets successfully decoded, including the fixed header.
+	BytesReceived [16]uint64
+	// PublishesDropped counts PUBLISH packets that were not delivered: received
+	// packets for which OnPub returned an error and publishes the Client failed to write.
+	// Packets received by a Client without an OnPub callback are discarded on
+	// purpose and not counted.
+	PublishesDropped uint64
+	// Reconnects counts successful connections following the first one.
+	Reconnects uint64
+	// PingRTT is the time between sending a PINGREQ and receiving the PINGRESP.
+	PingRTT Histogram
+	// SubackLatency is the time between sending a SUBSCRIBE and receiving the SUBACK.
+	SubackLatency Histogram
+	// OnPubDuration is the time spent in the OnPub callback.
+	OnPubDuration Histogram
+}
+
+func (m *Metrics) countTx(h Header) {
+	tp := h.Type()
+	m.PacketsSent[tp]++
+	m.BytesSent[tp] += uint64(h.Size()) + uint64(h.RemainingLength)
+}
+
+func (m *Metrics) countRx(h Header) {
+	tp := h.Type()
+	m.PacketsReceived[tp]++
+	m.BytesReceived[tp] += uint64(h.Size()) + uint64(h.RemainingLength)
+}
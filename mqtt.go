@@ -1,7 +1,7 @@
 package mqtt
 
 import (
-	"errors"
+	"bytes"
 	"io"
 	"strconv"
 )
@@ -26,20 +26,6 @@ type Decoder interface {
 
 const bugReportLink = "Please report bugs at https://github.com/soypat/natiu-mqtt/issues/new "
 
-var (
-	errQoS0NoDup  = errors.New("DUP must be 0 for all QoS0 [MQTT-3.3.1-2]")
-	errEmptyTopic = errors.New("empty topic")
-	errGotZeroPI  = errors.New("packet identifier must be nonzero for packet type")
-
-	// natiu-mqtt depends on user provided buffers for string and byte slice allocation.
-	// If a buffer is too small for the incoming strings or for marshalling a subscription topic
-	// then the implementation should return this error.
-	ErrUserBufferFull = errors.New("natiu-mqtt: user buffer full")
-	// ErrBadRemainingLen is passed to Rx's OnRxError after decoding a header with a
-	// remaining length that does not conform to MQTT v3.1.1 packet specifications.
-	ErrBadRemainingLen = errors.New("natiu-mqtt: MQTT v3.1.1 bad remaining length")
-)
-
 // Header represents the bytes preceding the payload in an MQTT packet.
 // This commonly called the Fixed Header, although this Header type also contains
 // PacketIdentifier, which is part of the Variable Header and may or may not be present
@@ -81,6 +67,31 @@ func (h Header) HasPacketIdentifier() bool {
 	return tp != 0 && tp < 15 && !noPI
 }
 
+// Packet is a tagged union of all MQTT v3.1.1 packets. The packet type in Header
+// determines which of the remaining fields hold meaningful data. Packet is useful for
+// generic code such as proxies and loggers which handle all packet types the same way.
+// See [Rx.ReadPacket] and [Tx.WritePacket].
+type Packet struct {
+	Header Header
+	// Connect is valid for CONNECT packets.
+	Connect VariablesConnect
+	// Connack is valid for CONNACK packets.
+	Connack VariablesConnack
+	// Publish is valid for PUBLISH packets. The Application Message is stored in Payload.
+	Publish VariablesPublish
+	// Subscribe is valid for SUBSCRIBE packets.
+	Subscribe VariablesSubscribe
+	// Suback is valid for SUBACK packets.
+	Suback VariablesSuback
+	// Unsubscribe is valid for UNSUBSCRIBE packets.
+	Unsubscribe VariablesUnsubscribe
+	// PacketIdentifier is valid for PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK packets.
+	// Packets with a packet identifier in their variable header store it in their Variables field.
+	PacketIdentifier uint16
+	// Payload contains the Application Message of a PUBLISH packet. It may be zero length.
+	Payload []byte
+}
+
 // PacketFlags represents the LSB 4 bits in the first byte in an MQTT fixed header.
 // PacketFlags takes on select values in range 1..15. PacketType and PacketFlags are present in all MQTT packets.
 type PacketFlags uint8
@@ -117,7 +128,7 @@ func (pf PacketFlags) String() string {
 // to create a malformed packet according to MQTT specification.
 func NewPublishFlags(qos QoSLevel, dup, retain bool) (PacketFlags, error) {
 	if qos > QoS2 {
-		return 0, errors.New("invalid QoS")
+		return 0, newProtocolError(PacketPublish, "MQTT-3.3.1-4", "invalid QoS")
 	}
 	if dup && qos == QoS0 {
 		return 0, errQoS0NoDup
@@ -134,10 +145,10 @@ func NewHeader(packetType PacketType, packetFlags PacketFlags, remainingLen uint
 		packetFlags = PacketFlags(ctlBit << 1)
 	}
 	if packetFlags > 15 {
-		return Header{}, errors.New("packet flags exceeds 4 bit range 0..15")
+		return Header{}, ErrInvalidPacketFlags
 	}
 	if packetType > 15 {
-		return Header{}, errors.New("packet type exceeds 4 bit range 0..15")
+		return Header{}, ErrInvalidPacketType
 	}
 	h := newHeader(packetType, packetFlags, remainingLen)
 	if err := h.Validate(); err != nil {
@@ -168,7 +179,7 @@ func (h Header) Validate() error {
 		dup := pflags.Dup()
 		qos := pflags.QoS()
 		if qos > QoS2 {
-			return errors.New("invalid QoS")
+			return newProtocolError(PacketPublish, "MQTT-3.3.1-4", "invalid QoS")
 		}
 		if dup && qos == QoS0 {
 			return errQoS0NoDup
@@ -191,15 +202,15 @@ func (h Header) String() string {
 // PacketType lists in definitions.go
 
 func (p PacketType) validateFlags(flag4bits PacketFlags) error {
-	onlyBit1Set := flag4bits&^(1<<1) == 0
+	onlyBit1Set := flag4bits == 0b0010
 	isControlPacket := p == PacketPubrel || p == PacketSubscribe || p == PacketUnsubscribe
 	if p == PacketPublish || (onlyBit1Set && isControlPacket) || (!isControlPacket && flag4bits == 0) {
 		return nil
 	}
 	if isControlPacket {
-		return errors.New("control packet bit not set (0b0010)")
+		return newProtocolError(p, "MQTT-2.2.2-2", "control packet bit not set (0b0010)")
 	}
-	return errors.New("expected 0b0000 flag for packet type")
+	return newProtocolError(p, "MQTT-2.2.2-2", "expected 0b0000 flag for packet type")
 }
 
 // String returns a string representation of the packet type, stylized with all caps
@@ -311,10 +322,27 @@ func (vc *VariablesConnect) Size() (sz int) {
 		// If will flag set then these two strings are obligatory but may be zero lengthed.
 		sz += len(vc.WillTopic) + len(vc.WillMessage) + 4
 	}
-	sz += len(vc.ClientID) + len(vc.Protocol) + 4
+	protocol, _ := vc.protocol()
+	sz += len(vc.ClientID) + len(protocol) + 4
 	return sz + 1 + 2 + 1 // Add Connect flags (1), Protocol level (1) and keepalive (2).
 }
 
+// defaultProtocol is DefaultProtocol encoded by CONNECT packets with no Protocol set.
+var defaultProtocol = []byte(DefaultProtocol)
+
+// protocol returns the protocol name and level encoded in the CONNECT packet.
+// Unset fields default to DefaultProtocol and DefaultProtocolLevel.
+func (vc *VariablesConnect) protocol() ([]byte, byte) {
+	protocol, level := vc.Protocol, vc.ProtocolLevel
+	if len(protocol) == 0 {
+		protocol = defaultProtocol
+	}
+	if level == 0 {
+		level = DefaultProtocolLevel
+	}
+	return protocol, level
+}
+
 // StringsLen returns length of all strings in variable header before being encoded.
 // StringsLen is useful to know how much of the user's buffer was consumed during decoding.
 func (vc *VariablesConnect) StringsLen() (n int) {
@@ -324,7 +352,7 @@ func (vc *VariablesConnect) StringsLen() (n int) {
 	if vc.WillFlag() {
 		n += len(vc.WillTopic) + len(vc.WillMessage)
 	}
-	return len(vc.ClientID) + len(vc.Protocol) + len(vc.Username)
+	return n + len(vc.ClientID) + len(vc.Protocol) + len(vc.Username)
 }
 
 // Flags returns the eighth CONNECT packet byte.
@@ -353,11 +381,14 @@ type VariablesPublish struct {
 	PacketIdentifier uint16
 }
 
+// Validate returns an error if the PUBLISH variable header is invalid: the topic
+// name is empty or contains wildcards (MQTT-3.3.2-2). The packet identifier is
+// not checked since it is only sent with QoS1 and QoS2, see [Tx.WritePublishPayload].
 func (vp VariablesPublish) Validate() error {
-	if vp.PacketIdentifier == 0 {
-		return errGotZeroPI
-	} else if len(vp.TopicName) == 0 {
+	if len(vp.TopicName) == 0 {
 		return errEmptyTopic
+	} else if bytes.IndexByte(vp.TopicName, '#') >= 0 || bytes.IndexByte(vp.TopicName, '+') >= 0 {
+		return errWildcardTopic
 	}
 	return nil
 }
@@ -420,11 +451,11 @@ type VariablesSuback struct {
 
 func (vs VariablesSuback) Validate() error {
 	if vs.PacketIdentifier == 0 {
-		return errGotZeroPI
+		return zeroPIError(PacketSuback)
 	}
 	for _, rc := range vs.ReturnCodes {
 		if !rc.IsValid() && rc != QoSSubfail {
-			return errors.New("invalid QoS")
+			return newProtocolError(PacketSuback, "MQTT-3.9.3-2", "invalid QoS")
 		}
 	}
 	return nil
@@ -495,7 +526,7 @@ func (vc VariablesConnack) SessionPresent() bool { return vc.AckFlags&1 != 0 }
 // validate provides early validation of CONNACK variables.
 func (vc VariablesConnack) validate() error {
 	if vc.AckFlags&^1 != 0 {
-		return errors.New("CONNACK Ack flag bits 7-1 must be set to 0")
+		return newProtocolError(PacketConnack, "", "CONNACK Ack flag bits 7-1 must be set to 0")
 	}
 	return nil
 }
@@ -533,14 +564,16 @@ func DecodeHeader(transp io.Reader) (Header, int, error) {
 		return Header{}, 0, err
 	}
 	n := 1
+	packetType := PacketType(firstByte >> 4)
 	rlen, ngot, err := decodeRemainingLength(transp)
 	n += ngot
-	if err != nil {
+	if err == ErrBadRemainingLen {
+		return Header{}, n, &ProtocolError{Packet: packetType, Err: err}
+	} else if err != nil {
 		return Header{}, n, err
 	}
-	packetType := PacketType(firstByte >> 4)
 	if packetType == 0 || packetType > PacketDisconnect {
-		return Header{}, n, errors.New("invalid packet type")
+		return Header{}, n, newProtocolError(packetType, "", "invalid packet type")
 	}
 	packetFlags := PacketFlags(firstByte & 0b1111)
 	if err := packetType.validateFlags(packetFlags); err != nil {
@@ -582,13 +615,13 @@ func (vc *VariablesConnect) SetDefaultMQTT(clientID []byte) {
 
 func (vs *VariablesSubscribe) Validate() error {
 	if len(vs.TopicFilters) == 0 {
-		return errors.New("no topic filters in VariablesSubscribe")
+		return errNoSubscribeFilters
 	}
 	for _, v := range vs.TopicFilters {
 		if !v.QoS.IsValid() {
-			return errors.New("invalid QoS in VariablesSubscribe")
+			return errInvalidSubscribeQoS
 		} else if len(v.TopicFilter) == 0 {
-			return errors.New("got empty topic filter in VariablesSubscribe")
+			return errEmptyTopicFilter
 		}
 	}
 	return nil
@@ -8,7 +8,10 @@ import (
 	"io"
 	"math"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -146,6 +149,334 @@ func FuzzRxTxReadNextPacket(f *testing.F) {
 	_ = testCases
 }
 
+func FuzzConnectRoundTrip(f *testing.F) {
+	f.Add([]byte("salamanca"), []byte("MQTT"), uint8(4), uint16(60), uint8(1), []byte("will/topic"), []byte("bye"), []byte("user"), []byte("pass"))
+	f.Add([]byte("a"), []byte("MQIsdp"), uint8(3), uint16(0), uint8(0xff), []byte(""), []byte(""), []byte(""), []byte("pass"))
+	f.Add([]byte("a"), []byte(""), uint8(0), uint16(0), uint8(0), []byte(""), []byte(""), []byte(""), []byte(""))
+	f.Fuzz(func(t *testing.T, clientID, protocol []byte, level uint8, keepAlive uint16, flags uint8, willTopic, willMessage, username, password []byte) {
+		if len(clientID) == 0 {
+			return // Zero length strings are not supported by decoders.
+		}
+		vc := VariablesConnect{
+			ClientID:      clientID,
+			Protocol:      protocol,
+			ProtocolLevel: level,
+			KeepAlive:     keepAlive,
+			CleanSession:  flags&1 != 0,
+			WillTopic:     willTopic,
+			WillMessage:   willMessage,
+			Username:      username,
+			Password:      password,
+		}
+		if vc.WillFlag() {
+			vc.WillQoS = QoSLevel(flags>>1) % 3
+			vc.WillRetain = flags&(1<<3) != 0
+		} else {
+			vc.WillTopic, vc.WillMessage = nil, nil
+		}
+		if len(vc.Username) == 0 {
+			vc.Username, vc.Password = nil, nil
+		} else if len(vc.Password) == 0 {
+			vc.Password = nil
+		}
+		stringsLen := len(vc.ClientID) + len(vc.Protocol) + len(vc.WillTopic) + len(vc.WillMessage) + len(vc.Username) + len(vc.Password)
+		if stringsLen > 1<<16 {
+			return
+		}
+		if vc.StringsLen() != stringsLen {
+			t.Errorf("StringsLen %d, want %d", vc.StringsLen(), stringsLen)
+		}
+		// Empty Protocol and zero ProtocolLevel are encoded with their defaults.
+		want := vc
+		want.Protocol, want.ProtocolLevel = vc.protocol()
+		stringsLen += len(want.Protocol) - len(vc.Protocol)
+		pkt := Packet{Header: newHeader(PacketConnect, 0, 0), Connect: vc}
+		for _, got := range fuzzRoundTrip(t, &pkt, vc.Size(), stringsLen) {
+			varEqual(t, &want, &got.Connect)
+		}
+	})
+}
+
+func FuzzPublishRoundTrip(f *testing.F) {
+	f.Add([]byte("a/b"), uint8(1), uint16(12), []byte("hello"))
+	f.Add([]byte("c"), uint8(0xff), uint16(0), []byte(""))
+	f.Fuzz(func(t *testing.T, topic []byte, flags uint8, packetIdentifier uint16, payload []byte) {
+		if len(topic) == 0 || len(topic) > 1<<16-1 {
+			return
+		}
+		qos := QoSLevel(flags) % 3
+		vp := VariablesPublish{TopicName: topic}
+		if qos != QoS0 {
+			vp.PacketIdentifier = packetIdentifier | 1
+		}
+		pflags, err := NewPublishFlags(qos, qos != QoS0 && flags&(1<<2) != 0, flags&(1<<3) != 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vp.StringsLen() != len(topic) {
+			t.Errorf("StringsLen %d, want %d", vp.StringsLen(), len(topic))
+		}
+		pkt := Packet{Header: newHeader(PacketPublish, pflags, 0), Publish: vp, Payload: payload}
+		for _, got := range fuzzRoundTrip(t, &pkt, vp.Size(qos), len(topic)) {
+			varEqual(t, vp, got.Publish)
+			if got.Header.Flags() != pflags {
+				t.Errorf("flags mismatch %v != %v", got.Header.Flags(), pflags)
+			}
+			if !bytes.Equal(got.Payload, payload) {
+				t.Error("payload mismatch")
+			}
+		}
+	})
+}
+
+func FuzzSubscribeRoundTrip(f *testing.F) {
+	f.Add(uint16(1), []byte("a/b\x00c/#\x00+"), []byte{0, 1, 2})
+	f.Fuzz(func(t *testing.T, packetIdentifier uint16, filters []byte, qos []byte) {
+		vs := VariablesSubscribe{PacketIdentifier: packetIdentifier | 1}
+		stringsLen := 0
+		for i, filter := range bytes.Split(filters, []byte{0}) {
+			if len(filter) == 0 || len(filter) > 1<<16-1 {
+				return
+			}
+			var q QoSLevel
+			if i < len(qos) {
+				q = QoSLevel(qos[i]) % 3
+			}
+			vs.TopicFilters = append(vs.TopicFilters, SubscribeRequest{TopicFilter: filter, QoS: q})
+			stringsLen += len(filter)
+		}
+		if vs.Size() > maxRemainingLengthValue {
+			return
+		}
+		if vs.StringsLen() != stringsLen {
+			t.Errorf("StringsLen %d, want %d", vs.StringsLen(), stringsLen)
+		}
+		pkt := Packet{Header: newHeader(PacketSubscribe, 0, 0), Subscribe: vs}
+		for _, got := range fuzzRoundTrip(t, &pkt, vs.Size(), stringsLen) {
+			varEqual(t, vs, got.Subscribe)
+		}
+	})
+}
+
+func FuzzUnsubscribeRoundTrip(f *testing.F) {
+	f.Add(uint16(1), []byte("a/b\x00c/#\x00+"))
+	f.Fuzz(func(t *testing.T, packetIdentifier uint16, topics []byte) {
+		vu := VariablesUnsubscribe{PacketIdentifier: packetIdentifier | 1}
+		stringsLen := 0
+		for _, topic := range bytes.Split(topics, []byte{0}) {
+			if len(topic) == 0 || len(topic) > 1<<16-1 {
+				return
+			}
+			vu.Topics = append(vu.Topics, topic)
+			stringsLen += len(topic)
+		}
+		if vu.Size() > maxRemainingLengthValue {
+			return
+		}
+		if vu.StringsLen() != stringsLen {
+			t.Errorf("StringsLen %d, want %d", vu.StringsLen(), stringsLen)
+		}
+		pkt := Packet{Header: newHeader(PacketUnsubscribe, 0, 0), Unsubscribe: vu}
+		for _, got := range fuzzRoundTrip(t, &pkt, vu.Size(), stringsLen) {
+			varEqual(t, vu, got.Unsubscribe)
+		}
+	})
+}
+
+func FuzzSubackRoundTrip(f *testing.F) {
+	f.Add(uint16(1), []byte{0, 1, 2, 0x80})
+	f.Fuzz(func(t *testing.T, packetIdentifier uint16, returnCodes []byte) {
+		vs := VariablesSuback{PacketIdentifier: packetIdentifier | 1}
+		for _, rc := range returnCodes {
+			qos := QoSLevel(rc) % 4
+			if qos == 3 {
+				qos = QoSSubfail
+			}
+			vs.ReturnCodes = append(vs.ReturnCodes, qos)
+		}
+		if vs.Size() > maxRemainingLengthValue {
+			return
+		}
+		pkt := Packet{Header: newHeader(PacketSuback, 0, 0), Suback: vs}
+		for _, got := range fuzzRoundTrip(t, &pkt, vs.Size(), 0) {
+			varEqual(t, vs, got.Suback)
+		}
+	})
+}
+
+func FuzzConnackRoundTrip(f *testing.F) {
+	f.Add(true, uint8(0))
+	f.Add(false, uint8(5))
+	f.Fuzz(func(t *testing.T, sessionPresent bool, returnCode uint8) {
+		vc := VariablesConnack{ReturnCode: ConnectReturnCode(returnCode % 6)}
+		if sessionPresent && vc.ReturnCode == ReturnCodeConnAccepted {
+			vc.AckFlags = 1
+		}
+		pkt := Packet{Header: newHeader(PacketConnack, 0, 0), Connack: vc}
+		for _, got := range fuzzRoundTrip(t, &pkt, vc.Size(), 0) {
+			varEqual(t, vc, got.Connack)
+		}
+	})
+}
+
+// fuzzRoundTrip encodes pkt with Tx, checks the encoded size against varSize, the size
+// of the variable header and payload, and decodes the packet back with Rx using
+// a DecoderNoAlloc with a buffer of exactly stringsLen bytes and an allocating decoder.
+func fuzzRoundTrip(t *testing.T, pkt *Packet, varSize, stringsLen int) []Packet {
+	t.Helper()
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(nopCloser{&buf})
+	err := tx.WritePacket(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := tx.LastSentHeader
+	if int(hdr.RemainingLength) != varSize+len(pkt.Payload) {
+		t.Errorf("remaining length %d, want %d", hdr.RemainingLength, varSize+len(pkt.Payload))
+	}
+	if buf.Len() != hdr.Size()+int(hdr.RemainingLength) {
+		t.Fatalf("wrote %d bytes, header says %d", buf.Len(), hdr.Size()+int(hdr.RemainingLength))
+	}
+	encoded := buf.Bytes()
+	var got []Packet
+	for _, decoder := range []Decoder{DecoderNoAlloc{make([]byte, stringsLen)}, decoderAlloc{}} {
+		var rx Rx
+		rx.SetDecoder(decoder)
+		rx.SetRxTransport(io.NopCloser(bytes.NewReader(encoded)))
+		var p Packet
+		n, err := rx.ReadPacket(&p)
+		if err != nil {
+			t.Fatalf("%T: %v", decoder, err)
+		}
+		if n != len(encoded) {
+			t.Errorf("%T: read %d bytes, wrote %d", decoder, n, len(encoded))
+		}
+		if p.Header != hdr {
+			t.Errorf("%T: header mismatch %v != %v", decoder, p.Header, hdr)
+		}
+		got = append(got, p)
+	}
+	return got
+}
+
+// decoderAlloc is a Decoder that allocates a new slice for every decoded string.
+// It does not share code with DecoderNoAlloc so round-trips check the encoders
+// against an independent implementation of the decoding rules.
+type decoderAlloc struct{}
+
+func (decoderAlloc) DecodeConnect(r io.Reader) (vc VariablesConnect, n int, err error) {
+	ar := allocReader{r: r}
+	vc.Protocol = ar.string()
+	vc.ProtocolLevel = ar.byte()
+	flags := ar.byte()
+	if ar.err != nil {
+		return VariablesConnect{}, ar.n, ar.err
+	}
+	hasUser, hasPass, hasWill := flags&0x80 != 0, flags&0x40 != 0, flags&0x04 != 0
+	if flags&0x01 != 0 || (hasPass && !hasUser) {
+		return VariablesConnect{}, ar.n, errors.New("decoderAlloc: bad CONNECT flags")
+	}
+	vc.WillRetain = flags&0x20 != 0
+	vc.WillQoS = QoSLevel(flags>>3) & 3
+	vc.CleanSession = flags&0x02 != 0
+	vc.KeepAlive = ar.uint16()
+	vc.ClientID = ar.string()
+	if hasWill {
+		vc.WillTopic = ar.string()
+		vc.WillMessage = ar.string()
+	}
+	if hasUser {
+		vc.Username = ar.string()
+	}
+	if hasPass {
+		vc.Password = ar.string()
+	}
+	if ar.err != nil {
+		return VariablesConnect{}, ar.n, ar.err
+	}
+	return vc, ar.n, nil
+}
+
+func (decoderAlloc) DecodePublish(r io.Reader, qos QoSLevel) (vp VariablesPublish, n int, err error) {
+	ar := allocReader{r: r}
+	vp.TopicName = ar.string()
+	if qos != QoS0 {
+		vp.PacketIdentifier = ar.uint16()
+	}
+	if ar.err != nil {
+		return VariablesPublish{}, ar.n, ar.err
+	}
+	return vp, ar.n, nil
+}
+
+func (decoderAlloc) DecodeSubscribe(r io.Reader, remainingLen uint32) (vs VariablesSubscribe, n int, err error) {
+	ar := allocReader{r: r}
+	vs.PacketIdentifier = ar.uint16()
+	for ar.err == nil && ar.n < int(remainingLen) {
+		filter := ar.string()
+		vs.TopicFilters = append(vs.TopicFilters, SubscribeRequest{TopicFilter: filter, QoS: QoSLevel(ar.byte())})
+	}
+	if ar.err != nil {
+		return VariablesSubscribe{}, ar.n, ar.err
+	}
+	return vs, ar.n, nil
+}
+
+func (decoderAlloc) DecodeUnsubscribe(r io.Reader, remainingLen uint32) (vu VariablesUnsubscribe, n int, err error) {
+	ar := allocReader{r: r}
+	vu.PacketIdentifier = ar.uint16()
+	for ar.err == nil && ar.n < int(remainingLen) {
+		vu.Topics = append(vu.Topics, ar.string())
+	}
+	if ar.err != nil {
+		return VariablesUnsubscribe{}, ar.n, ar.err
+	}
+	return vu, ar.n, nil
+}
+
+// allocReader reads big endian integers and length prefixed strings, counting
+// bytes read and keeping the first error. Reads after an error are no-ops.
+type allocReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func (ar *allocReader) read(b []byte) []byte {
+	if ar.err != nil {
+		return nil
+	}
+	n, err := io.ReadFull(ar.r, b)
+	ar.n += n
+	ar.err = err
+	return b
+}
+
+func (ar *allocReader) byte() byte {
+	b := ar.read(make([]byte, 1))
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (ar *allocReader) uint16() uint16 {
+	b := ar.read(make([]byte, 2))
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func (ar *allocReader) string() []byte {
+	length := ar.uint16()
+	if ar.err == nil && length == 0 {
+		ar.err = ErrEmptyString
+	}
+	return ar.read(make([]byte, length))
+}
+
 func TestHeaderLoopback(t *testing.T) {
 	pubQoS0flag, err := NewPublishFlags(QoS0, false, true)
 	if err != nil {
@@ -216,6 +547,694 @@ func TestRxTxBadPacketRxErrors(t *testing.T) {
 	}
 }
 
+func TestRxStrict(t *testing.T) {
+	var connect VariablesConnect
+	connect.SetDefaultMQTT([]byte("salamanca"))
+	for _, test := range []struct {
+		spec  string
+		write func(tx *Tx) error
+	}{
+		{"MQTT-1.5.3-1", func(tx *Tx) error {
+			return tx.WritePublishPayload(newHeader(PacketPublish, 0, 0), VariablesPublish{TopicName: []byte("a/\xff")}, nil)
+		}},
+		{"MQTT-1.5.3-2", func(tx *Tx) error {
+			return tx.WritePublishPayload(newHeader(PacketPublish, 0, 0), VariablesPublish{TopicName: []byte("a\x00b")}, nil)
+		}},
+		{"MQTT-3.3.2-2", func(tx *Tx) error {
+			return tx.WritePublishPayload(newHeader(PacketPublish, 0, 0), VariablesPublish{TopicName: []byte("a/+")}, nil)
+		}},
+		{"MQTT-2.3.1-1", func(tx *Tx) error {
+			_, err := tx.txTrp.Write([]byte("\x32\x05\x00\x01a\x00\x00")) // Tx rejects zero packet identifiers.
+			return err
+		}},
+		{"MQTT-3.1.2-3", func(tx *Tx) error {
+			_, err := tx.txTrp.Write([]byte("\x10\x0f\x00\x04MQTT\x04\x03\x00\x3c\x00\x03abc"))
+			return err
+		}},
+		{"MQTT-3.1.2-22", func(tx *Tx) error {
+			_, err := tx.txTrp.Write([]byte("\x10\x13\x00\x04MQTT\x04\x42\x00\x3c\x00\x03abc\x00\x02pw"))
+			return err
+		}},
+		{"MQTT-3.1.0-2", func(tx *Tx) error {
+			tx.WriteConnect(&connect)
+			return tx.WriteConnect(&connect)
+		}},
+		{"MQTT-3.8.3-3", func(tx *Tx) error {
+			_, err := tx.txTrp.Write([]byte("\x82\x02\x00\x01"))
+			return err
+		}},
+		{"MQTT-3.8.3-4", func(tx *Tx) error {
+			return tx.WriteSubscribe(VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: 3}}})
+		}},
+		{"MQTT-4.7.1-2", func(tx *Tx) error {
+			return tx.WriteSubscribe(VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/#/b")}}})
+		}},
+		{"MQTT-4.7.1-3", func(tx *Tx) error {
+			return tx.WriteUnsubscribe(VariablesUnsubscribe{PacketIdentifier: 1, Topics: [][]byte{[]byte("a+/b")}})
+		}},
+	} {
+		buf := newLoopbackTransport()
+		rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rxtx.RxCallbacks.OnRxError = func(r *Rx, err error) {}
+		if err := test.write(&rxtx.Tx); err != nil {
+			t.Fatal(test.spec, err)
+		}
+		rxtx.Strict = true
+		for err == nil && buf.rw.Len() > 0 {
+			_, err = rxtx.ReadNextPacket()
+		}
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected ProtocolError, got %v", test.spec, err)
+			continue
+		}
+		if perr.Spec != test.spec {
+			t.Errorf("expected violation of %s, got %v", test.spec, perr)
+		}
+	}
+
+	// Violations a custom Decoder does not reject.
+	clientID := VariablesConnect{Protocol: []byte("MQTT"), ProtocolLevel: 4, KeepAlive: 60, ClientID: []byte("abc")}
+	withPassword := clientID
+	withPassword.Password = []byte("pw")
+	for _, test := range []struct {
+		spec    string
+		raw     string
+		decoder fixedDecoder
+		target  error
+	}{
+		{spec: "MQTT-3.1.2-3", raw: "\x10\x0f\x00\x04MQTT\x04\x03\x00\x3c\x00\x03abc", decoder: fixedDecoder{n: 15, vc: clientID}},
+		{spec: "MQTT-3.1.2-22", raw: "\x10\x13\x00\x04MQTT\x04\x42\x00\x3c\x00\x03abc\x00\x02pw", decoder: fixedDecoder{n: 19, vc: withPassword}},
+		{spec: "MQTT-4.7.3-1", raw: "\x82\x05\x00\x01\x00\x00\x00", decoder: fixedDecoder{n: 5, vs: VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{}}}}, target: errEmptyTopicFilter},
+	} {
+		var rx Rx
+		rx.SetRxTransport(io.NopCloser(strings.NewReader(test.raw)))
+		rx.SetDecoder(test.decoder)
+		rx.RxCallbacks.OnRxError = func(r *Rx, err error) {}
+		rx.Strict = true
+		_, err := rx.ReadNextPacket()
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Spec != test.spec {
+			t.Errorf("custom decoder: expected violation of %s, got %v", test.spec, err)
+		}
+		if test.target != nil && !errors.Is(err, test.target) {
+			t.Errorf("custom decoder: got %v, want %v", err, test.target)
+		}
+	}
+}
+
+// fixedDecoder reads n bytes and returns fixed variable headers without
+// validating them.
+type fixedDecoder struct {
+	n  int
+	vc VariablesConnect
+	vs VariablesSubscribe
+}
+
+func (d fixedDecoder) DecodeConnect(r io.Reader) (VariablesConnect, int, error) {
+	n, err := io.ReadFull(r, make([]byte, d.n))
+	return d.vc, n, err
+}
+
+func (d fixedDecoder) DecodeSubscribe(r io.Reader, _ uint32) (VariablesSubscribe, int, error) {
+	n, err := io.ReadFull(r, make([]byte, d.n))
+	return d.vs, n, err
+}
+
+func (fixedDecoder) DecodePublish(io.Reader, QoSLevel) (VariablesPublish, int, error) {
+	return VariablesPublish{}, 0, errors.New("fixedDecoder: PUBLISH not supported")
+}
+
+func (fixedDecoder) DecodeUnsubscribe(io.Reader, uint32) (VariablesUnsubscribe, int, error) {
+	return VariablesUnsubscribe{}, 0, errors.New("fixedDecoder: UNSUBSCRIBE not supported")
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	const maxSize = 32
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	varPub := VariablesPublish{TopicName: []byte("a/b")}
+	payload := make([]byte, maxSize)
+	rxtx.Tx.MaxPacketSize = maxSize
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, 0, 0), varPub, payload)
+	if err != ErrPacketTooLarge {
+		t.Fatal("expected ErrPacketTooLarge from Tx, got", err)
+	}
+	if buf.rw.Len() != 0 {
+		t.Fatal("Tx wrote bytes of packet exceeding MaxPacketSize")
+	}
+	rxtx.Tx.MaxPacketSize = 0
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, 0, 0), varPub, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := buf.rw.Len()
+	rxtx.Rx.MaxPacketSize = maxSize
+	rxtx.RxCallbacks.OnRxError = func(r *Rx, err error) {}
+	rxtx.RxCallbacks.OnPub = func(rx *Rx, varPub VariablesPublish, r io.Reader) error {
+		t.Error("OnPub called for packet exceeding MaxPacketSize")
+		return nil
+	}
+	n, err := rxtx.ReadNextPacket()
+	if err != ErrPacketTooLarge {
+		t.Fatal("expected ErrPacketTooLarge from Rx, got", err)
+	}
+	if n != rxtx.LastReceivedHeader.Size() || buf.rw.Len() != written-n {
+		t.Errorf("expected Rx to only read the fixed header, read %d bytes", n)
+	}
+}
+
+func TestReadPacketLargeRemainingLength(t *testing.T) {
+	const payload = "short"
+	var buf bytes.Buffer
+	hdr := newHeader(PacketPublish, 0, maxRemainingLengthValue)
+	hdr.Encode(&buf)
+	encodeMQTTString(&buf, []byte("a"))
+	buf.WriteString(payload)
+	var rx Rx
+	rx.SetRxTransport(io.NopCloser(&buf))
+	rx.SetDecoder(DecoderNoAlloc{make([]byte, 32)})
+	rx.RxCallbacks.OnRxError = func(r *Rx, err error) {}
+	var pkt Packet
+	_, err := rx.ReadPacket(&pkt)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	if string(pkt.Payload) != payload {
+		t.Errorf("expected partial payload %q, got %q", payload, pkt.Payload)
+	}
+	if cap(pkt.Payload) > 2*payloadChunkSize {
+		t.Errorf("payload buffer allocated %d bytes for %d received", cap(pkt.Payload), len(payload))
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	client := NewClient(ClientConfig{})
+	err := client.PublishPayload(0, VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 1}, nil)
+	if !errors.Is(err, ErrDisconnected) {
+		t.Error("expected ErrDisconnected, got", err)
+	}
+
+	// Server refuses connection.
+	conn, server := net.Pipe()
+	srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+	go func() {
+		srv.ReadNextPacket()
+		srv.WriteConnack(VariablesConnack{ReturnCode: ReturnCodeBadUserCredentials})
+	}()
+	err = client.Connect(ctx, conn, &varConn)
+	var connErr *ConnectError
+	if !errors.As(err, &connErr) || connErr.ReturnCode != ReturnCodeBadUserCredentials {
+		t.Fatal("expected ConnectError with bad credentials, got", err)
+	}
+	var rc ConnectReturnCode
+	if !errors.As(err, &rc) || rc != ReturnCodeBadUserCredentials {
+		t.Error("expected ConnectError to unwrap to ConnectReturnCode")
+	}
+
+	// Server accepts connection and rejects one of two topic filters.
+	conn, server = net.Pipe()
+	srv, _ = NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+	go func() {
+		_, err := srv.ReadNextPacket()
+		srv.WriteConnack(VariablesConnack{})
+		srv.RxCallbacks.OnSub = func(r *Rx, vs VariablesSubscribe) error {
+			return srv.WriteSuback(VariablesSuback{PacketIdentifier: vs.PacketIdentifier, ReturnCodes: []QoSLevel{QoS0, QoSSubfail}})
+		}
+		for err == nil {
+			_, err = srv.ReadNextPacket() // Read until client disconnects.
+		}
+	}()
+	err = client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe(ctx, VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{
+		{TopicFilter: []byte("accepted")}, {TopicFilter: []byte("rejected")},
+	}})
+	var subErr *SubackError
+	if !errors.As(err, &subErr) || len(subErr.Rejected) != 1 || subErr.Rejected[0] != "rejected" {
+		t.Fatal("expected SubackError with rejected topic, got", err)
+	}
+	if topics := client.SubscribedTopics(); len(topics) != 1 || topics[0] != "accepted" {
+		t.Error("expected accepted topic to be subscribed, got", topics)
+	}
+	userErr := errors.New("user disconnect")
+	client.Disconnect(userErr)
+	err = client.Ping(ctx)
+	var discErr *DisconnectedError
+	if !errors.As(err, &discErr) || discErr.Cause != userErr {
+		t.Error("expected DisconnectedError with user cause, got", err)
+	}
+
+	// Malformed remaining length.
+	_, _, err = DecodeHeader(bytes.NewReader([]byte("\x30\xff\xff\xff\xff")))
+	var perr *ProtocolError
+	if !errors.As(err, &perr) || perr.Packet != PacketPublish || !errors.Is(err, ErrBadRemainingLen) {
+		t.Error("expected ProtocolError wrapping ErrBadRemainingLen, got", err)
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	var rx Rx
+	var tx Tx
+	var buf bytes.Buffer
+	for _, test := range []struct {
+		desc   string
+		err    error
+		target error
+		packet PacketType // Expect a *ProtocolError for this packet type if nonzero.
+	}{
+		{desc: "rx nil transport", err: second(rx.ReadNextPacket()), target: ErrNilTransport},
+		{desc: "tx nil transport", err: tx.WriteSimple(PacketPingreq), target: ErrNilTransport},
+		{desc: "header remaining length", err: second(Header{RemainingLength: maxRemainingLengthValue + 1}.Encode(&buf)), target: ErrBadRemainingLen},
+		{desc: "encode empty string", err: second(encodeMQTTString(&buf, nil)), target: ErrEmptyString},
+		{desc: "encode long string", err: second(encodeMQTTString(&buf, make([]byte, math.MaxUint16+1))), target: ErrStringTooLong},
+		{desc: "decode empty string", err: third(decodeMQTTString(bytes.NewReader([]byte{0, 0}), make([]byte, 8))), target: ErrEmptyString},
+		{desc: "empty SUBSCRIBE", err: second(encodeSubscribe(&buf, VariablesSubscribe{PacketIdentifier: 1})), packet: PacketSubscribe},
+		{desc: "empty UNSUBSCRIBE", err: second(encodeUnsubscribe(&buf, VariablesUnsubscribe{PacketIdentifier: 1})), packet: PacketUnsubscribe},
+		{desc: "header flags", err: headerErr(NewHeader(PacketPublish, 16, 0)), target: ErrInvalidPacketFlags},
+		{desc: "header type", err: headerErr(NewHeader(16, 0, 0)), target: ErrInvalidPacketType},
+		{desc: "read nil packet", err: second(rx.ReadPacket(nil)), target: ErrNilPacket},
+		{desc: "write nil packet", err: tx.WritePacket(nil), target: ErrNilPacket},
+		{desc: "SUBSCRIBE invalid QoS", err: (&VariablesSubscribe{TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a"), QoS: 3}}}).Validate(), packet: PacketSubscribe},
+		{desc: "PUBLISH empty topic", err: VariablesPublish{PacketIdentifier: 1}.Validate(), packet: PacketPublish},
+		{desc: "SUBSCRIBE empty filter", err: (&VariablesSubscribe{TopicFilters: []SubscribeRequest{{}}}).Validate(), packet: PacketSubscribe},
+		{desc: "malformed multi-level wildcard", err: matchErr(subscriptionsMap{}.Match("a#", nil)), packet: PacketSubscribe},
+		{desc: "malformed single-level wildcard", err: matchErr(subscriptionsMap{}.Match("a/b+", nil)), packet: PacketSubscribe},
+		{desc: "multi-level wildcard not last", err: matchErr(subscriptionsMap{}.Match("#/a", nil)), packet: PacketSubscribe},
+		{desc: "shared without filter", err: matchErr(subscriptionsMap{}.Match("$share/g", nil)), packet: PacketSubscribe},
+		{desc: "subscription exists", err: subscriptionsMap{"a": {}}.Subscribe([]byte("a")), target: errTopicExists},
+		{desc: "client QoS1 publish", err: NewClient(ClientConfig{}).PublishPayload(PacketFlagsPubrelSubUnsub, VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 1}, nil), target: ErrUnsupportedQoS},
+	} {
+		if test.target != nil && !errors.Is(test.err, test.target) {
+			t.Errorf("%s: got %v, want %v", test.desc, test.err, test.target)
+		}
+		var perr *ProtocolError
+		if test.packet != 0 && (!errors.As(test.err, &perr) || perr.Packet != test.packet) {
+			t.Errorf("%s: got %v, want ProtocolError for %s", test.desc, test.err, test.packet)
+		}
+	}
+
+	tx.SetTxTransport(nopCloser{&buf})
+	if err := tx.WriteSimple(PacketPuback); !errors.Is(err, ErrInvalidPacketType) {
+		t.Error("WriteSimple(PUBACK):", err)
+	}
+	if err := tx.WriteIdentified(PacketPingreq, 1); !errors.Is(err, ErrInvalidPacketType) {
+		t.Error("WriteIdentified(PINGREQ):", err)
+	}
+	var perr *ProtocolError
+	if err := tx.WriteIdentified(PacketPuback, 0); !errors.As(err, &perr) || perr.Spec != "MQTT-2.3.1-1" || perr.Packet != PacketPuback {
+		t.Error("WriteIdentified(PUBACK, 0):", err)
+	}
+	varPub := VariablesPublish{TopicName: []byte("a")}
+	if err := varPub.Validate(); err != nil {
+		t.Error("QoS0 PUBLISH without packet identifier:", err)
+	}
+	qos1, _ := NewPublishFlags(QoS1, false, false)
+	if err := tx.WritePublishPayload(newHeader(PacketPublish, qos1, 0), varPub, nil); !errors.Is(err, errGotZeroPI) {
+		t.Error("WritePublishPayload(QoS1, 0):", err)
+	}
+	if err := NewClient(ClientConfig{}).Err(); err != ErrNotConnected {
+		t.Error("expected ErrNotConnected before connecting, got", err)
+	}
+
+	// OnPub returning without reading payload.
+	buf.Reset()
+	tx.WritePublishPayload(newHeader(PacketPublish, 0, 0), VariablesPublish{TopicName: []byte("a")}, []byte("payload"))
+	rx.SetRxTransport(io.NopCloser(&buf))
+	rx.userDecoder = DecoderNoAlloc{make([]byte, 32)}
+	rx.RxCallbacks.OnPub = func(rx *Rx, vp VariablesPublish, r io.Reader) error { return nil }
+	if _, err := rx.ReadNextPacket(); !errors.Is(err, ErrUnreadPayload) {
+		t.Error("expected ErrUnreadPayload, got", err)
+	}
+}
+
+func second(_ int, err error) error { return err }
+
+func third(_ []byte, _ int, err error) error { return err }
+
+func headerErr(_ Header, err error) error { return err }
+
+func matchErr(_ [][]byte, err error) error { return err }
+
+func TestClientClosesTransportOnMalformedPacket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	client := NewClient(ClientConfig{})
+	conn, server := net.Pipe()
+	srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+	serverErr := make(chan error, 1)
+	go func() {
+		srv.ReadNextPacket()
+		srv.WriteConnack(VariablesConnack{})
+		server.Write([]byte("\x30\xff\xff\xff\xff")) // Malformed remaining length.
+		var err error
+		for err == nil {
+			_, err = srv.ReadNextPacket()
+		}
+		serverErr <- err
+	}()
+	err := client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.HandleNext()
+	if !errors.Is(err, ErrBadRemainingLen) || client.IsConnected() {
+		t.Fatal("expected disconnect on malformed packet, got", err)
+	}
+	// Network connection is closed as per MQTT-4.8.0-1 so the server sees it end.
+	select {
+	case err = <-serverErr:
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Error("server got", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("client did not close transport")
+	}
+	if _, err := conn.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Error("expected closed transport, got", err)
+	}
+}
+
+func TestClientLogger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	logger := &testLogger{}
+	client := NewClient(ClientConfig{Logger: logger})
+	conn, server := net.Pipe()
+	srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+	malformed := make(chan struct{})
+	go func() {
+		_, err := srv.ReadNextPacket()
+		srv.WriteConnack(VariablesConnack{})
+		<-malformed
+		server.Write([]byte("\x30\xff\xff\xff\xff"))
+		for err == nil {
+			_, err = srv.ReadNextPacket()
+		}
+	}()
+	err := client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read timeouts are expected and only logged for debugging.
+	conn.SetReadDeadline(time.Now())
+	if err := client.HandleNext(); err != nil || !client.IsConnected() {
+		t.Fatal("expected timeout to be ignored, got", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	close(malformed)
+	client.HandleNext()
+
+	// Tx shares the client's Logger.
+	client.tx.SetTxTransport(nopCloser{shortWriter{}})
+	client.tx.WriteSimple(PacketPingreq)
+
+	want := []string{"DEBUG ignoring error", "DEBUG rx failed", "ERROR disconnecting on error", "ERROR tx failed"}
+	if got := logger.entries(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got log entries %q, want %q", got, want)
+	}
+}
+
+func TestClientTracer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	var out bytes.Buffer
+	client := NewClient(ClientConfig{Tracer: &TextTracer{W: &out}})
+	conn, server := net.Pipe()
+	srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+	go func() {
+		srv.ReadNextPacket()
+		srv.WriteConnack(VariablesConnack{})
+	}()
+	err := client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Sending CONNECT (c1, k60, u0, p0, w0, 'salamanca')\nReceived CONNACK (0)\n"
+	if got := out.String(); got != want {
+		t.Errorf("got trace %q, want %q", got, want)
+	}
+}
+
+func TestTextTracerConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	var out bytes.Buffer
+	tt := &TextTracer{W: writerFunc(func(b []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Write(b)
+	})}
+	const n = 100
+	var wg sync.WaitGroup
+	for _, dir := range []TraceDirection{TraceRx, TraceTx} {
+		dir := dir
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				tt.TracePacket(dir, newHeader(PacketPuback, 0, 2), uint16(i), nil)
+			}
+		}()
+	}
+	wg.Wait()
+	if lines := strings.Count(out.String(), "\n"); lines != 2*n {
+		t.Errorf("got %d trace lines, want %d", lines, 2*n)
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (wf writerFunc) Write(b []byte) (int, error) { return wf(b) }
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (tl *testLogger) Log(level LogLevel, msg string, keyvals ...any) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.logs = append(tl.logs, level.String()+" "+msg)
+}
+
+func (tl *testLogger) entries() []string {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return append([]string(nil), tl.logs...)
+}
+
+// shortWriter writes a single byte of every call to Write before failing.
+type shortWriter struct{}
+
+func (shortWriter) Write(b []byte) (int, error) { return 1, io.ErrShortWrite }
+
+func TestClientMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	client := NewClient(ClientConfig{})
+	for i := 0; i < 2; i++ {
+		conn, server := net.Pipe()
+		srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+		srv.RxCallbacks.OnOther = func(rx *Rx, _ uint16) error {
+			if rx.LastReceivedHeader.Type() == PacketPingreq {
+				return srv.WriteSimple(PacketPingresp)
+			}
+			return nil
+		}
+		srv.RxCallbacks.OnSub = func(r *Rx, vs VariablesSubscribe) error {
+			return srv.WriteSuback(VariablesSuback{PacketIdentifier: vs.PacketIdentifier, ReturnCodes: []QoSLevel{QoS0}})
+		}
+		go func() {
+			_, err := srv.ReadNextPacket()
+			srv.WriteConnack(VariablesConnack{})
+			for err == nil {
+				_, err = srv.ReadNextPacket()
+			}
+		}()
+		err := client.Connect(ctx, conn, &varConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Ping(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Subscribe(ctx, VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a")}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Disconnect(errors.New("done"))
+	}
+	client.PublishPayload(0, VariablesPublish{TopicName: []byte("a"), PacketIdentifier: 1}, nil) // Dropped since disconnected.
+
+	m := client.Metrics()
+	for _, c := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"CONNECT sent", m.PacketsSent[PacketConnect], 2},
+		{"CONNECT bytes", m.BytesSent[PacketConnect], 2 * uint64(2+varConn.Size())},
+		{"PINGREQ sent", m.PacketsSent[PacketPingreq], 2},
+		{"SUBSCRIBE sent", m.PacketsSent[PacketSubscribe], 2},
+		{"DISCONNECT sent", m.PacketsSent[PacketDisconnect], 2},
+		{"CONNACK received", m.PacketsReceived[PacketConnack], 2},
+		{"CONNACK bytes", m.BytesReceived[PacketConnack], 2 * 4},
+		{"PINGRESP received", m.PacketsReceived[PacketPingresp], 2},
+		{"SUBACK received", m.PacketsReceived[PacketSuback], 2},
+		{"reconnects", m.Reconnects, 1},
+		{"dropped", m.PublishesDropped, 1},
+		{"ping RTT count", m.PingRTT.Count, 2},
+		{"suback latency count", m.SubackLatency.Count, 2},
+		{"onpub count", m.OnPubDuration.Count, 0},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestClientMetricsPublishesDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	errHandler := errors.New("handler failed")
+	for _, test := range []struct {
+		desc        string
+		onPub       func(Header, VariablesPublish, io.Reader) error
+		wantDropped uint64
+	}{
+		{desc: "no OnPub"},
+		{desc: "OnPub ok", onPub: func(_ Header, _ VariablesPublish, r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}},
+		{desc: "OnPub error", onPub: func(_ Header, _ VariablesPublish, r io.Reader) error {
+			io.Copy(io.Discard, r)
+			return errHandler
+		}, wantDropped: 1},
+	} {
+		client := NewClient(ClientConfig{OnPub: test.onPub})
+		conn, server := net.Pipe()
+		srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+		go func() {
+			_, err := srv.ReadNextPacket()
+			srv.WriteConnack(VariablesConnack{})
+			srv.WritePublishPayload(newHeader(PacketPublish, 0, 0), VariablesPublish{TopicName: []byte("a")}, []byte("payload"))
+			for err == nil {
+				_, err = srv.ReadNextPacket()
+			}
+		}()
+		err := client.Connect(ctx, conn, &varConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.HandleNext()
+		if test.wantDropped == 0 && err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		m := client.Metrics()
+		if m.PacketsReceived[PacketPublish] != 1 || m.PublishesDropped != test.wantDropped {
+			t.Errorf("%s: got %d PUBLISH received and %d dropped, want 1 and %d", test.desc, m.PacketsReceived[PacketPublish], m.PublishesDropped, test.wantDropped)
+		}
+		client.Disconnect(errors.New("done"))
+	}
+}
+
+func TestClientSubackLowerQoS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	client := NewClient(ClientConfig{})
+	conn, server := net.Pipe()
+	defer server.Close()
+	srv, _ := NewRxTx(server, DecoderNoAlloc{make([]byte, 1500)})
+	go func() {
+		srv.ReadNextPacket()
+		srv.WriteConnack(VariablesConnack{})
+		srv.ReadNextPacket()
+		srv.WriteSuback(VariablesSuback{PacketIdentifier: 1, ReturnCodes: []QoSLevel{QoS0}}) // Downgraded.
+	}()
+	err := client.Connect(ctx, conn, &varConn)
+	if err == nil {
+		err = client.Subscribe(ctx, VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/#"), QoS: QoS1}}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := client.SubscribedTopics(); len(topics) != 1 || topics[0] != "a/#" {
+		t.Errorf("got subscribed topics %q", topics)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	h.Observe(0)
+	h.Observe(LatencyBuckets[0])
+	h.Observe(LatencyBuckets[0] + 1)
+	h.Observe(time.Hour)
+	if h.Counts[0] != 2 || h.Counts[1] != 1 || h.Counts[len(LatencyBuckets)] != 1 || h.Count != 4 {
+		t.Errorf("unexpected histogram counts %v", h.Counts)
+	}
+	if h.Sum != 2*LatencyBuckets[0]+1+time.Hour {
+		t.Errorf("unexpected histogram sum %v", h.Sum)
+	}
+}
+
+func TestRxShortReads(t *testing.T) {
+	var buf bytes.Buffer
+	var tx Tx
+	tx.SetTxTransport(nopCloser{&buf})
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	varConn.Username = []byte("ñandutí")
+	varConn.Password = []byte("mbarete")
+	err := tx.WriteConnect(&varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := buf.Len()
+	rx := Rx{RxCallbacks: RxCallbacks{OnConnect: func(_ *Rx, vc *VariablesConnect) error {
+		varEqual(t, &varConn, vc)
+		return nil
+	}}}
+	rx.SetDecoder(DecoderNoAlloc{make([]byte, 1500)})
+	rx.SetRxTransport(io.NopCloser(iotest.OneByteReader(&buf)))
+	n, err := rx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != written {
+		t.Errorf("read %d bytes, wrote %d", n, written)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
 func TestHasPacketIdentifer(t *testing.T) {
 	const (
 		qos0Flag = PacketFlags(QoS0 << 1)
@@ -371,6 +1390,55 @@ func TestHeaderEncodeDecodeLoopback(t *testing.T) {
 	}
 }
 
+func TestHeaderReservedFlags(t *testing.T) {
+	for _, test := range []struct {
+		tp      PacketType
+		flags   byte
+		wantErr bool
+	}{
+		{PacketSubscribe, 0b0010, false},
+		{PacketSubscribe, 0b0000, true},
+		{PacketSubscribe, 0b0011, true},
+		{PacketUnsubscribe, 0b0000, true},
+		{PacketUnsubscribe, 0b1010, true},
+		{PacketPubrel, 0b0010, false},
+		{PacketPubrel, 0b0110, true},
+		{PacketPuback, 0b0000, false},
+		{PacketPuback, 0b0010, true},
+	} {
+		_, _, err := DecodeHeader(bytes.NewReader([]byte{byte(test.tp)<<4 | test.flags, 0}))
+		var perr *ProtocolError
+		if test.wantErr != (err != nil) || err != nil && (!errors.As(err, &perr) || perr.Spec != "MQTT-2.2.2-2") {
+			t.Errorf("%s flags %04b: got error %v", test.tp, test.flags, err)
+		}
+	}
+}
+
+func TestVariablesPublishValidate(t *testing.T) {
+	for _, test := range []struct {
+		topic   string
+		wantErr error
+	}{
+		{"a/b", nil},
+		{"$SYS/uptime", nil},
+		{"", errEmptyTopic},
+		{"a/+", errWildcardTopic},
+		{"a/#", errWildcardTopic},
+		{"a#", errWildcardTopic},
+	} {
+		err := VariablesPublish{TopicName: []byte(test.topic), PacketIdentifier: 1}.Validate()
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("topic %q: got %v, want %v", test.topic, err, test.wantErr)
+		}
+	}
+	client := NewClient(ClientConfig{})
+	err := client.PublishPayload(0, VariablesPublish{TopicName: []byte("a/+"), PacketIdentifier: 1}, nil)
+	var perr *ProtocolError
+	if !errors.As(err, &perr) || perr.Spec != "MQTT-3.3.2-2" {
+		t.Errorf("publishing to wildcard topic: got %v", err)
+	}
+}
+
 func TestVariablesConnectSize(t *testing.T) {
 	var varConn VariablesConnect
 	varConn.SetDefaultMQTT([]byte("salamanca"))
@@ -808,6 +1876,256 @@ func TestRxTxLoopback(t *testing.T) {
 	}
 }
 
+func TestPacketLoopback(t *testing.T) {
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubflags, err := NewPublishFlags(QoS1, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	for _, test := range []Packet{
+		{Header: newHeader(PacketConnect, 0, 0), Connect: varConn},
+		{Header: newHeader(PacketConnack, 0, 0), Connack: VariablesConnack{ReturnCode: ReturnCodeBadUserCredentials}},
+		{Header: newHeader(PacketPublish, pubflags, 0), Publish: VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 12}, Payload: []byte("hello")},
+		{Header: newHeader(PacketSubscribe, 0, 0), Subscribe: VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/#"), QoS: QoS1}}}},
+		{Header: newHeader(PacketSuback, 0, 0), Suback: VariablesSuback{PacketIdentifier: 1, ReturnCodes: []QoSLevel{QoS1, QoSSubfail}}},
+		{Header: newHeader(PacketUnsubscribe, 0, 0), Unsubscribe: VariablesUnsubscribe{PacketIdentifier: 2, Topics: [][]byte{[]byte("a/#")}}},
+		{Header: newHeader(PacketPubrel, 0, 0), PacketIdentifier: 3232},
+		{Header: newHeader(PacketPingresp, 0, 0)},
+	} {
+		tp := test.Header.Type()
+		err = rxtx.WritePacket(&test)
+		if err != nil {
+			t.Fatal(tp.String(), err)
+		}
+		written := buf.rw.Len()
+		var got Packet
+		n, err := rxtx.ReadPacket(&got)
+		if err != nil {
+			t.Fatal(tp.String(), err)
+		}
+		if n != written {
+			t.Errorf("%s: read %d bytes, wrote %d", tp, n, written)
+		}
+		if got.Header != rxtx.LastReceivedHeader || got.Header.Type() != tp {
+			t.Errorf("%s: header mismatch, got %s", tp, got.Header)
+		}
+		switch tp {
+		case PacketConnect:
+			varEqual(t, &test.Connect, &got.Connect)
+		case PacketConnack:
+			varEqual(t, test.Connack, got.Connack)
+		case PacketPublish:
+			varEqual(t, test.Publish, got.Publish)
+			if !bytes.Equal(test.Payload, got.Payload) {
+				t.Errorf("payload mismatch: %q != %q", test.Payload, got.Payload)
+			}
+		case PacketSubscribe:
+			varEqual(t, test.Subscribe, got.Subscribe)
+		case PacketSuback:
+			varEqual(t, test.Suback, got.Suback)
+		case PacketUnsubscribe:
+			varEqual(t, test.Unsubscribe, got.Unsubscribe)
+		default:
+			if got.PacketIdentifier != test.PacketIdentifier {
+				t.Errorf("%s: packet identifier mismatch %d != %d", tp, got.PacketIdentifier, test.PacketIdentifier)
+			}
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	buf := newLoopbackTransport()
+	rxtx, err := NewRxTx(buf, DecoderNoAlloc{make([]byte, 1500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rxOut, txOut bytes.Buffer
+	rxtx.Rx.Tracer = &TextTracer{W: &rxOut}
+	rxtx.Tx.Tracer = &TextTracer{W: &txOut}
+	pubflags, err := NewPublishFlags(QoS1, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var varConn VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	for _, test := range []struct {
+		pkt    Packet
+		expect string
+	}{
+		{pkt: Packet{Header: newHeader(PacketConnect, 0, 0), Connect: varConn}, expect: "CONNECT (c1, k60, u0, p0, w0, 'salamanca')"},
+		{pkt: Packet{Header: newHeader(PacketConnack, 0, 0)}, expect: "CONNACK (0)"},
+		{pkt: Packet{Header: newHeader(PacketPublish, pubflags, 0), Publish: VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 12}, Payload: []byte("hello")}, expect: "PUBLISH (d0, q1, r0, m12, 'a/b', ... (5 bytes))"},
+		{pkt: Packet{Header: newHeader(PacketSubscribe, 0, 0), Subscribe: VariablesSubscribe{PacketIdentifier: 1, TopicFilters: []SubscribeRequest{{TopicFilter: []byte("a/#"), QoS: QoS1}}}}, expect: "SUBSCRIBE (Mid: 1, Topic: a/#, QoS: 1)"},
+		{pkt: Packet{Header: newHeader(PacketSuback, 0, 0), Suback: VariablesSuback{PacketIdentifier: 1, ReturnCodes: []QoSLevel{QoS1, QoSSubfail}}}, expect: "SUBACK (Mid: 1, Return codes: 1, 128)"},
+		{pkt: Packet{Header: newHeader(PacketUnsubscribe, 0, 0), Unsubscribe: VariablesUnsubscribe{PacketIdentifier: 2, Topics: [][]byte{[]byte("a/#")}}}, expect: "UNSUBSCRIBE (Mid: 2, Topic: a/#)"},
+		{pkt: Packet{Header: newHeader(PacketPuback, 0, 0), PacketIdentifier: 12}, expect: "PUBACK (m12)"},
+		{pkt: Packet{Header: newHeader(PacketPingreq, 0, 0)}, expect: "PINGREQ"},
+	} {
+		rxOut.Reset()
+		txOut.Reset()
+		err = rxtx.WritePacket(&test.pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rxtx.ReadNextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := txOut.String(); got != "Sending "+test.expect+"\n" {
+			t.Errorf("tx trace: got %q, want %q", got, "Sending "+test.expect)
+		}
+		if got := rxOut.String(); got != "Received "+test.expect+"\n" {
+			t.Errorf("rx trace: got %q, want %q", got, "Received "+test.expect)
+		}
+	}
+
+	// Raw bytes traced on both ends must match.
+	var rxRaw, txRaw []byte
+	rxtx.Rx.Tracer = tracerFunc(func(_ TraceDirection, _ Header, _ any, raw []byte) { rxRaw = append(rxRaw[:0], raw...) })
+	rxtx.Tx.Tracer = tracerFunc(func(_ TraceDirection, _ Header, _ any, raw []byte) { txRaw = append(txRaw[:0], raw...) })
+	err = rxtx.WritePublishPayload(newHeader(PacketPublish, pubflags, 0), VariablesPublish{TopicName: []byte("a/b"), PacketIdentifier: 12}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rxtx.ReadNextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txRaw) == 0 || !bytes.Equal(rxRaw, txRaw) {
+		t.Errorf("raw trace mismatch: rx %q, tx %q", rxRaw, txRaw)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	for _, test := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a", "a/b", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"+/b", "/b", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"a/#", "a/$b", true},
+		{"$share/g/a", "a", false}, // Shared prefix must be removed first.
+	} {
+		if got := MatchTopic(test.filter, test.topic); got != test.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestParseSharedFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter  string
+		want    SharedFilter
+		shared  bool
+		wantErr bool
+	}{
+		{filter: "jobs/#"},
+		{filter: "$SYS/uptime"},
+		{filter: "$share/workers/jobs/#", want: SharedFilter{ShareName: "workers", Filter: "jobs/#"}, shared: true},
+		{filter: "$share/g/+/temp", want: SharedFilter{ShareName: "g", Filter: "+/temp"}, shared: true},
+		{filter: "$share/workers", shared: true, wantErr: true},
+		{filter: "$share/workers/", shared: true, wantErr: true},
+		{filter: "$share//jobs", shared: true, wantErr: true},
+		{filter: "$share/+/jobs", shared: true, wantErr: true},
+		{filter: "$share/workers/jobs#", shared: true, wantErr: true},
+	} {
+		sf, shared, err := ParseSharedFilter(test.filter)
+		if sf != test.want || shared != test.shared || (err != nil) != test.wantErr {
+			t.Errorf("ParseSharedFilter(%q) = %+v, %v, %v", test.filter, sf, shared, err)
+		}
+		if err == nil && shared && sf.String() != test.filter {
+			t.Errorf("%q String() = %q", test.filter, sf.String())
+		}
+	}
+	sm := subscriptionsMap{"jobs/1": {}, "other/1": {}}
+	matched, err := sm.Match("$share/workers/jobs/#", make([]byte, 64))
+	if err != nil || len(matched) != 1 || string(matched[0]) != "jobs/1" {
+		t.Errorf("shared filter matched %q: %v", matched, err)
+	}
+}
+
+func TestSharedGroups(t *testing.T) {
+	const filter = "$share/workers/jobs/#"
+	var sg SharedGroups
+	for _, id := range []string{"w1", "w2", "w3"} {
+		if err := sg.Subscribe(filter, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sg.Subscribe("jobs/#", "w1"); err != errNotShared {
+		t.Errorf("got %v subscribing to non shared filter", err)
+	}
+	pick := func(topic string) string {
+		picked := sg.Pick(topic, nil)
+		return strings.Join(picked, ",")
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, pick("jobs/1"))
+	}
+	if strings.Join(got, " ") != "w1 w2 w3 w1" {
+		t.Errorf("round robin picked %q", got)
+	}
+	if p := pick("other/1"); p != "" {
+		t.Errorf("picked %q for non matching topic", p)
+	}
+	// Remaining members keep their turn after w2 leaves.
+	sg.Remove("w2")
+	if got := pick("jobs/1") + " " + pick("jobs/1"); got != "w3 w1" {
+		t.Errorf("after remove picked %q", got)
+	}
+	if ok, _ := sg.Unsubscribe(filter, "w2"); ok {
+		t.Error("unsubscribed removed member")
+	}
+
+	// Least in flight skips members with unfinished messages.
+	sg = SharedGroups{Strategy: ShareLeastInFlight}
+	sg.Subscribe(filter, "w1")
+	sg.Subscribe(filter, "w2")
+	got = got[:0]
+	for i := 0; i < 3; i++ {
+		got = append(got, pick("jobs/1"))
+	}
+	sg.Done("w2")
+	got = append(got, pick("jobs/1"), pick("jobs/1"))
+	if strings.Join(got, " ") != "w1 w2 w1 w2 w2" {
+		t.Errorf("least in flight picked %q", got)
+	}
+	if n := sg.InFlight("w1"); n != 2 {
+		t.Errorf("w1 in flight %d", n)
+	}
+	sg.Remove("w1")
+	sg.Remove("w2")
+	if p := pick("jobs/1"); p != "" || sg.Members(filter) != nil {
+		t.Errorf("picked %q from empty group", p)
+	}
+}
+
+type tracerFunc func(dir TraceDirection, hdr Header, vars any, raw []byte)
+
+func (f tracerFunc) TracePacket(dir TraceDirection, hdr Header, vars any, raw []byte) {
+	f(dir, hdr, vars, raw)
+}
+
 func newLoopbackTransport() *testTransport {
 	var _buf bytes.Buffer
 	// buf := bufio.NewReadWriter(bufio.NewReader(&_buf), bufio.NewWriter(&_buf))
@@ -856,6 +2174,9 @@ func varEqual(t *testing.T, a, b any) {
 		if va.WillQoS != veebee.WillQoS {
 			t.Error("willQoS mismatch")
 		}
+		if va.WillRetain != veebee.WillRetain {
+			t.Error("will retain mismatch")
+		}
 		if !bytes.Equal(va.ClientID, veebee.ClientID) {
 			t.Error("client id mismatch")
 		}
@@ -895,6 +2216,9 @@ func varEqual(t *testing.T, a, b any) {
 		if va.PacketIdentifier != vb.PacketIdentifier {
 			t.Error("SUBACK packet identifier mismatch")
 		}
+		if len(va.ReturnCodes) != len(vb.ReturnCodes) {
+			t.Fatal("SUBACK return code length mismatch", len(va.ReturnCodes), len(vb.ReturnCodes))
+		}
 		for i, rca := range va.ReturnCodes {
 			rcb := vb.ReturnCodes[i]
 			if rca != rcb {
@@ -907,6 +2231,9 @@ func varEqual(t *testing.T, a, b any) {
 		if va.PacketIdentifier != vb.PacketIdentifier {
 			t.Error("SUBSCRIBE packet identifier mismatch")
 		}
+		if len(va.TopicFilters) != len(vb.TopicFilters) {
+			t.Fatal("SUBSCRIBE topic filter length mismatch", len(va.TopicFilters), len(vb.TopicFilters))
+		}
 		for i, hotopicA := range va.TopicFilters {
 			hotTopicB := vb.TopicFilters[i]
 			if hotopicA.QoS != hotTopicB.QoS {
@@ -922,6 +2249,9 @@ func varEqual(t *testing.T, a, b any) {
 		if va.PacketIdentifier != vb.PacketIdentifier {
 			t.Error("UNSUBSCRIBE packet identifier mismatch", va.PacketIdentifier, vb.PacketIdentifier)
 		}
+		if len(va.Topics) != len(vb.Topics) {
+			t.Fatal("UNSUBSCRIBE topic length mismatch", len(va.Topics), len(vb.Topics))
+		}
 		for i, coldtopicA := range va.Topics {
 			coldTopicB := vb.Topics[i]
 			if !bytes.Equal(coldtopicA, coldTopicB) {
@@ -0,0 +1,237 @@
+// Package mqttprom exports natiu-mqtt Client metrics in the Prometheus text
+// exposition format. It does not depend on the Prometheus client libraries.
+package mqttprom
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// ContentType is the Content-Type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Source is a source of metrics such as *mqtt.Client.
+type Source interface {
+	Metrics() mqtt.Metrics
+}
+
+var _ Source = (*mqtt.Client)(nil)
+
+// Exporter writes the metrics of registered sources in the Prometheus text
+// exposition format. It implements http.Handler so it can be served directly on
+// a /metrics endpoint. The zero value is ready for use and safe for concurrent use.
+type Exporter struct {
+	mu      sync.Mutex
+	targets []target
+}
+
+type target struct {
+	src Source
+	// labels are the preformatted labels of the source's samples, i.e: `client_id="salamanca",`.
+	labels string
+}
+
+// Register adds src to the exporter. labels are alternating label names and values
+// that distinguish src's samples from other sources' samples, i.e:
+//
+//	exp.Register(client, "client_id", "salamanca")
+func (e *Exporter) Register(src Source, labels ...string) error {
+	if src == nil {
+		return errors.New("nil Source")
+	}
+	if len(labels)%2 != 0 {
+		return errors.New("odd number of label arguments")
+	}
+	var b []byte
+	for i := 0; i < len(labels); i += 2 {
+		if !validLabelName(labels[i]) {
+			return errors.New("invalid label name " + strconv.Quote(labels[i]))
+		}
+		b = appendLabel(b, labels[i], labels[i+1])
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.targets = append(e.targets, target{src: src, labels: string(b)})
+	return nil
+}
+
+// Unregister removes all registrations of src from the exporter.
+func (e *Exporter) Unregister(src Source) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	targets := e.targets[:0]
+	for _, t := range e.targets {
+		if t.src != src {
+			targets = append(targets, t)
+		}
+	}
+	e.targets = targets
+}
+
+// WriteTo writes the metrics of all registered sources to w.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.Lock()
+	snaps := make([]snapshot, len(e.targets))
+	for i, t := range e.targets {
+		snaps[i] = snapshot{m: t.src.Metrics(), labels: t.labels}
+	}
+	e.mu.Unlock()
+	n, err := w.Write(appendMetrics(nil, snaps))
+	return int64(n), err
+}
+
+// ServeHTTP implements http.Handler by writing the metrics of all registered sources.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	e.WriteTo(w)
+}
+
+type snapshot struct {
+	m      mqtt.Metrics
+	labels string
+}
+
+type counterDesc struct {
+	name, help string
+	get        func(*mqtt.Metrics) *[16]uint64
+}
+
+type histogramDesc struct {
+	name, help string
+	get        func(*mqtt.Metrics) *mqtt.Histogram
+}
+
+var packetCounters = [...]counterDesc{
+	{name: "natiu_mqtt_packets_sent_total", help: "Packets successfully written to the transport.", get: func(m *mqtt.Metrics) *[16]uint64 { return &m.PacketsSent }},
+	{name: "natiu_mqtt_bytes_sent_total", help: "Bytes of packets successfully written to the transport.", get: func(m *mqtt.Metrics) *[16]uint64 { return &m.BytesSent }},
+	{name: "natiu_mqtt_packets_received_total", help: "Packets successfully decoded.", get: func(m *mqtt.Metrics) *[16]uint64 { return &m.PacketsReceived }},
+	{name: "natiu_mqtt_bytes_received_total", help: "Bytes of packets successfully decoded.", get: func(m *mqtt.Metrics) *[16]uint64 { return &m.BytesReceived }},
+}
+
+var histograms = [...]histogramDesc{
+	{name: "natiu_mqtt_ping_rtt_seconds", help: "Time between sending a PINGREQ and receiving the PINGRESP.", get: func(m *mqtt.Metrics) *mqtt.Histogram { return &m.PingRTT }},
+	{name: "natiu_mqtt_suback_latency_seconds", help: "Time between sending a SUBSCRIBE and receiving the SUBACK.", get: func(m *mqtt.Metrics) *mqtt.Histogram { return &m.SubackLatency }},
+	{name: "natiu_mqtt_onpub_duration_seconds", help: "Time spent in the OnPub callback.", get: func(m *mqtt.Metrics) *mqtt.Histogram { return &m.OnPubDuration }},
+}
+
+func appendMetrics(b []byte, snaps []snapshot) []byte {
+	for _, desc := range packetCounters {
+		b = appendHeader(b, desc.name, desc.help, "counter")
+		for i := range snaps {
+			counts := desc.get(&snaps[i].m)
+			for tp := mqtt.PacketConnect; tp <= mqtt.PacketDisconnect; tp++ {
+				b = appendName(b, desc.name, snaps[i].labels)
+				b = appendLabel(b, "packet", tp.String())
+				b = appendUint(closeLabels(b), counts[tp])
+			}
+		}
+	}
+
+	const dropped, reconnects = "natiu_mqtt_publishes_dropped_total", "natiu_mqtt_reconnects_total"
+	b = appendHeader(b, dropped, "PUBLISH packets received and not delivered or failed to be sent.", "counter")
+	for i := range snaps {
+		b = appendName(b, dropped, snaps[i].labels)
+		b = appendUint(closeLabels(b), snaps[i].m.PublishesDropped)
+	}
+	b = appendHeader(b, reconnects, "Successful connections following the first one.", "counter")
+	for i := range snaps {
+		b = appendName(b, reconnects, snaps[i].labels)
+		b = appendUint(closeLabels(b), snaps[i].m.Reconnects)
+	}
+
+	for _, desc := range histograms {
+		b = appendHeader(b, desc.name, desc.help, "histogram")
+		bucket, sum, count := desc.name+"_bucket", desc.name+"_sum", desc.name+"_count"
+		for i := range snaps {
+			h := desc.get(&snaps[i].m)
+			var cumulative uint64
+			for j, bound := range mqtt.LatencyBuckets {
+				cumulative += h.Counts[j]
+				b = appendName(b, bucket, snaps[i].labels)
+				b = appendLabel(b, "le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))
+				b = appendUint(closeLabels(b), cumulative)
+			}
+			b = appendName(b, bucket, snaps[i].labels)
+			b = appendLabel(b, "le", "+Inf")
+			b = appendUint(closeLabels(b), h.Count)
+
+			b = appendName(b, sum, snaps[i].labels)
+			b = strconv.AppendFloat(closeLabels(b), h.Sum.Seconds(), 'g', -1, 64)
+			b = append(b, '\n')
+			b = appendName(b, count, snaps[i].labels)
+			b = appendUint(closeLabels(b), h.Count)
+		}
+	}
+	return b
+}
+
+func appendHeader(b []byte, name, help, typ string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, typ...)
+	return append(b, '\n')
+}
+
+// appendName appends the metric name and opens its label set with the source's labels.
+func appendName(b []byte, name, labels string) []byte {
+	b = append(b, name...)
+	b = append(b, '{')
+	return append(b, labels...)
+}
+
+// closeLabels closes a label set opened by appendName.
+func closeLabels(b []byte) []byte {
+	if b[len(b)-1] == '{' {
+		b[len(b)-1] = ' ' // No labels.
+		return b
+	}
+	b[len(b)-1] = '}' // Replace trailing comma.
+	return append(b, ' ')
+}
+
+func appendUint(b []byte, v uint64) []byte {
+	b = strconv.AppendUint(b, v, 10)
+	return append(b, '\n')
+}
+
+// appendLabel appends name="value", with value escaped.
+func appendLabel(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, '=', '"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			b = append(b, `\\`...)
+		case '"':
+			b = append(b, `\"`...)
+		case '\n':
+			b = append(b, `\n`...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"', ',')
+}
+
+func validLabelName(name string) bool {
+	if name == "" || name == "le" || name == "packet" || (len(name) >= 2 && name[:2] == "__") {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package mqttprom
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+type source mqtt.Metrics
+
+func (s *source) Metrics() mqtt.Metrics { return mqtt.Metrics(*s) }
+
+func TestExporter(t *testing.T) {
+	var m mqtt.Metrics
+	m.PacketsSent[mqtt.PacketPublish] = 3
+	m.BytesReceived[mqtt.PacketConnack] = 4
+	m.Reconnects = 2
+	m.PingRTT.Observe(2 * time.Millisecond)
+	m.PingRTT.Observe(time.Hour)
+	src := source(m)
+
+	var exp Exporter
+	if err := exp.Register(&src, "le", "x"); err == nil {
+		t.Error("expected error registering reserved label name")
+	}
+	if err := exp.Register(&src, "client_id"); err == nil {
+		t.Error("expected error registering odd label arguments")
+	}
+	if err := exp.Register(&src, "client_id", `sala"manca`); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	exp.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("got content type %q", ct)
+	}
+	got := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE natiu_mqtt_packets_sent_total counter\n",
+		`natiu_mqtt_packets_sent_total{client_id="sala\"manca",packet="PUBLISH"} 3` + "\n",
+		`natiu_mqtt_packets_sent_total{client_id="sala\"manca",packet="CONNECT"} 0` + "\n",
+		`natiu_mqtt_bytes_received_total{client_id="sala\"manca",packet="CONNACK"} 4` + "\n",
+		`natiu_mqtt_reconnects_total{client_id="sala\"manca"} 2` + "\n",
+		"# TYPE natiu_mqtt_ping_rtt_seconds histogram\n",
+		`natiu_mqtt_ping_rtt_seconds_bucket{client_id="sala\"manca",le="0.001"} 0` + "\n",
+		`natiu_mqtt_ping_rtt_seconds_bucket{client_id="sala\"manca",le="0.0025"} 1` + "\n",
+		`natiu_mqtt_ping_rtt_seconds_bucket{client_id="sala\"manca",le="10"} 1` + "\n",
+		`natiu_mqtt_ping_rtt_seconds_bucket{client_id="sala\"manca",le="+Inf"} 2` + "\n",
+		`natiu_mqtt_ping_rtt_seconds_sum{client_id="sala\"manca"} 3600.002` + "\n",
+		`natiu_mqtt_ping_rtt_seconds_count{client_id="sala\"manca"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in output:\n%s", want, got)
+		}
+	}
+
+	// Unlabeled source.
+	exp.Unregister(&src)
+	exp.Register(&src)
+	var buf bytes.Buffer
+	exp.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "natiu_mqtt_reconnects_total 2\n") {
+		t.Errorf("missing unlabeled sample in output:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "client_id") {
+		t.Error("unregistered source still exported")
+	}
+}
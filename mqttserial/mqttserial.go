@@ -0,0 +1,386 @@
+// Package mqttserial carries MQTT packets over serial links such as UART or
+// RS-485 which have no framing or error detection of their own.
+//
+// Every MQTT packet is sent in its own frame followed by a CRC-16/CCITT-FALSE
+// checksum and delimited with COBS (Consistent Overhead Byte Stuffing) or SLIP
+// (RFC 1055) framing. Corrupted frames are discarded by the receiver, which
+// resynchronizes at the next frame delimiter, so line noise costs the packet it hits
+// instead of the whole stream. A [Conn] is used as the transport of [mqtt.Rx] and [mqtt.Tx]:
+//
+//	conn := mqttserial.New(uart, mqttserial.Config{Framing: mqttserial.COBS})
+//	rxtx.SetRxTransport(conn)
+//	rxtx.SetTxTransport(conn)
+package mqttserial
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Framing selects how frames are delimited on the wire.
+type Framing uint8
+
+const (
+	// COBS encodes frames with Consistent Overhead Byte Stuffing and delimits
+	// them with a zero byte. Overhead is at most one byte every 254 bytes.
+	COBS Framing = iota
+	// SLIP delimits frames with 0xC0 and escapes 0xC0 and 0xDB bytes as per
+	// RFC 1055. Overhead depends on the data and is up to 100%.
+	SLIP
+)
+
+// String returns the name of the framing. Does not allocate memory.
+func (f Framing) String() string {
+	switch f {
+	case COBS:
+		return "COBS"
+	case SLIP:
+		return "SLIP"
+	}
+	return "unknown framing"
+}
+
+// SLIP special bytes as defined by RFC 1055.
+const (
+	slipEnd    = 0xc0
+	slipEsc    = 0xdb
+	slipEscEnd = 0xdc
+	slipEscEsc = 0xdd
+)
+
+// DefaultMaxFrameSize is the default limit on the size of sent and received frames.
+const DefaultMaxFrameSize = 4096
+
+// crcSize is the size of the CRC appended to each frame.
+const crcSize = 2
+
+var (
+	errCRC          = errors.New("mqttserial: CRC mismatch")
+	errCOBS         = errors.New("mqttserial: invalid COBS encoding")
+	errSLIP         = errors.New("mqttserial: invalid SLIP escape")
+	errShortFrame   = errors.New("mqttserial: frame too short")
+	errFrameTooLong = errors.New("mqttserial: frame exceeds MaxFrameSize")
+	errBadHeader    = errors.New("mqttserial: written bytes are not an MQTT packet")
+)
+
+// Config configures a [Conn].
+type Config struct {
+	Framing Framing
+	// MaxFrameSize limits the size of sent and received MQTT packets. Longer
+	// received frames are discarded and writing a longer packet returns an
+	// error. If zero DefaultMaxFrameSize is used.
+	MaxFrameSize int
+	// OnDiscard is called with the reason a received frame was discarded. It may be nil.
+	OnDiscard func(err error)
+}
+
+// Conn frames MQTT packets over a serial link. Write buffers bytes until they
+// form a complete MQTT packet and then sends the packet in a single frame. Read
+// returns the contents of valid frames. Read and Write may be called concurrently.
+type Conn struct {
+	rw        io.ReadWriter
+	br        *bufio.Reader
+	framing   Framing
+	maxFrame  int
+	onDiscard func(error)
+	discarded atomic.Uint64
+
+	// Read state.
+	frame   []byte // Decoded frame being read.
+	pending []byte // Unread bytes of frame.
+
+	wmu  sync.Mutex
+	wbuf []byte // Bytes of the MQTT packet being written.
+	skip int    // Unwritten bytes of a packet rejected for exceeding maxFrame.
+	raw  []byte // Packet and CRC of frame being written.
+	enc  []byte // Encoded frame.
+}
+
+// New returns a Conn framing MQTT packets over rw. If rw implements
+// io.Closer it is closed by Conn.Close.
+func New(rw io.ReadWriter, cfg Config) *Conn {
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = DefaultMaxFrameSize
+	}
+	return &Conn{
+		rw:        rw,
+		br:        bufio.NewReader(rw),
+		framing:   cfg.Framing,
+		maxFrame:  cfg.MaxFrameSize,
+		onDiscard: cfg.OnDiscard,
+	}
+}
+
+// Discarded returns the number of received frames discarded due to corruption.
+func (c *Conn) Discarded() uint64 { return c.discarded.Load() }
+
+// Read reads bytes of received MQTT packets.
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads frames until a valid one is found and stores its contents in pending.
+func (c *Conn) readFrame() error {
+	delim := byte(0)
+	if c.framing == SLIP {
+		delim = slipEnd
+	}
+	for {
+		raw, err := c.br.ReadSlice(delim)
+		tooLong := false
+		// Frames longer than bufio's buffer are read in chunks.
+		c.frame = append(c.frame[:0], raw...)
+		for err == bufio.ErrBufferFull {
+			raw, err = c.br.ReadSlice(delim)
+			if !tooLong {
+				c.frame = append(c.frame, raw...)
+				tooLong = len(c.frame) > 2*c.maxFrame+crcSize+2 // Worst case SLIP encoding.
+			}
+		}
+		if err != nil {
+			if err == io.EOF && len(c.frame) != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		encoded := c.frame[:len(c.frame)-1] // Strip delimiter.
+		if len(encoded) == 0 {
+			continue // Delimiter sent before frame or idle line.
+		}
+		var data []byte
+		if tooLong {
+			err = errFrameTooLong
+		} else if c.framing == SLIP {
+			data, err = slipDecode(encoded)
+		} else {
+			data, err = cobsDecode(encoded)
+		}
+		if err == nil {
+			data, err = checkCRC(data)
+		}
+		if err == nil && len(data) > c.maxFrame {
+			err = errFrameTooLong
+		}
+		if err != nil {
+			c.discarded.Add(1)
+			if c.onDiscard != nil {
+				c.onDiscard(err)
+			}
+			continue
+		}
+		c.pending = data
+		return nil
+	}
+}
+
+// Write buffers b and sends a frame for every complete MQTT packet buffered.
+// Packets longer than MaxFrameSize are not sent and the remaining bytes of such
+// a packet passed to later calls are discarded. On error n is the number of
+// bytes of b sent before the error and the buffered bytes are discarded.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.skip > 0 {
+		n = len(b)
+		if n > c.skip {
+			n = c.skip
+		}
+		c.skip -= n
+		b = b[n:]
+	}
+	buffered := len(c.wbuf) // Bytes from previous calls.
+	c.wbuf = append(c.wbuf, b...)
+	sent := 0
+	for {
+		size, err := packetSize(c.wbuf[sent:])
+		if err == nil && size > c.maxFrame {
+			err = errFrameTooLong
+			if unwritten := size - len(c.wbuf[sent:]); unwritten > 0 {
+				c.skip = unwritten
+			}
+		}
+		if err == nil && size != 0 && size <= len(c.wbuf[sent:]) {
+			err = c.writeFrame(c.wbuf[sent : sent+size])
+			if err == nil {
+				sent += size
+				continue
+			}
+		}
+		if err != nil {
+			c.wbuf = c.wbuf[:0]
+			if sent > buffered {
+				n += sent - buffered
+			}
+			return n, err
+		}
+		// Wait for rest of packet.
+		c.wbuf = c.wbuf[:copy(c.wbuf, c.wbuf[sent:])]
+		return n + len(b), nil
+	}
+}
+
+// writeFrame encodes data and its CRC and writes them as a single frame.
+func (c *Conn) writeFrame(data []byte) error {
+	crc := crc16(data)
+	c.raw = append(append(c.raw[:0], data...), byte(crc>>8), byte(crc))
+	// A delimiter is also sent before the frame so bytes received
+	// before it due to line noise are discarded as a separate frame.
+	if c.framing == SLIP {
+		c.enc = append(c.enc[:0], slipEnd)
+		c.enc = slipEncode(c.enc, c.raw)
+		c.enc = append(c.enc, slipEnd)
+	} else {
+		c.enc = append(c.enc[:0], 0)
+		c.enc = cobsEncode(c.enc, c.raw)
+		c.enc = append(c.enc, 0)
+	}
+	_, err := c.rw.Write(c.enc)
+	return err
+}
+
+// Close closes the underlying transport if it implements io.Closer.
+func (c *Conn) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// packetSize returns the size of the MQTT packet at the start of b or zero
+// if b does not contain the complete fixed header yet.
+func packetSize(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, nil
+	}
+	var remaining, multiplier int = 0, 1
+	for i := 1; i < len(b); i++ {
+		if i > 4 {
+			return 0, errBadHeader // Remaining length is at most 4 bytes long.
+		}
+		remaining += int(b[i]&0x7f) * multiplier
+		multiplier *= 128
+		if b[i]&0x80 == 0 {
+			return 1 + i + remaining, nil
+		}
+	}
+	return 0, nil
+}
+
+// checkCRC verifies the CRC at the end of frame and returns the data before it.
+func checkCRC(frame []byte) ([]byte, error) {
+	if len(frame) <= crcSize {
+		return nil, errShortFrame
+	}
+	data := frame[:len(frame)-crcSize]
+	got := uint16(frame[len(data)])<<8 | uint16(frame[len(data)+1])
+	if got != crc16(data) {
+		return nil, errCRC
+	}
+	return data, nil
+}
+
+// crc16 returns the CRC-16/CCITT-FALSE of b: polynomial 0x1021, initial value 0xFFFF.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// cobsEncode appends the COBS encoding of data to dst without the trailing delimiter.
+func cobsEncode(dst, data []byte) []byte {
+	codeIdx := len(dst)
+	dst = append(dst, 0) // Placeholder for first code byte.
+	code := byte(1)
+	for i, b := range data {
+		if b != 0 {
+			dst = append(dst, b)
+			code++
+		}
+		if b == 0 || (code == 0xff && i != len(data)-1) {
+			dst[codeIdx] = code
+			codeIdx = len(dst)
+			dst = append(dst, 0)
+			code = 1
+		}
+	}
+	dst[codeIdx] = code
+	return dst
+}
+
+// cobsDecode decodes a COBS encoded frame without delimiter in place.
+func cobsDecode(b []byte) ([]byte, error) {
+	n := 0
+	for i := 0; i < len(b); {
+		code := int(b[i])
+		if code == 0 || i+code > len(b) {
+			return nil, errCOBS
+		}
+		n += copy(b[n:], b[i+1:i+code])
+		i += code
+		if code != 0xff && i < len(b) {
+			b[n] = 0
+			n++
+		}
+	}
+	return b[:n], nil
+}
+
+// slipEncode appends the SLIP encoding of data to dst without delimiters.
+func slipEncode(dst, data []byte) []byte {
+	for _, b := range data {
+		switch b {
+		case slipEnd:
+			dst = append(dst, slipEsc, slipEscEnd)
+		case slipEsc:
+			dst = append(dst, slipEsc, slipEscEsc)
+		default:
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
+
+// slipDecode decodes a SLIP encoded frame without delimiter in place.
+func slipDecode(b []byte) ([]byte, error) {
+	n := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c == slipEsc {
+			i++
+			if i == len(b) {
+				return nil, errSLIP
+			}
+			switch b[i] {
+			case slipEscEnd:
+				c = slipEnd
+			case slipEscEsc:
+				c = slipEsc
+			default:
+				return nil, errSLIP
+			}
+		}
+		b[n] = c
+		n++
+	}
+	return b[:n], nil
+}
@@ -0,0 +1,234 @@
+package mqttserial
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestCOBS(t *testing.T) {
+	seq := func(start, end int) []byte {
+		var b []byte
+		for i := start; i <= end; i++ {
+			b = append(b, byte(i))
+		}
+		return b
+	}
+	// Examples from https://en.wikipedia.org/wiki/Consistent_Overhead_Byte_Stuffing
+	for _, test := range []struct {
+		data, encoded []byte
+	}{
+		{data: []byte{0x00}, encoded: []byte{0x01, 0x01}},
+		{data: []byte{0x00, 0x00}, encoded: []byte{0x01, 0x01, 0x01}},
+		{data: []byte{0x00, 0x11, 0x00}, encoded: []byte{0x01, 0x02, 0x11, 0x01}},
+		{data: []byte{0x11, 0x22, 0x00, 0x33}, encoded: []byte{0x03, 0x11, 0x22, 0x02, 0x33}},
+		{data: []byte{0x11, 0x22, 0x33, 0x44}, encoded: []byte{0x05, 0x11, 0x22, 0x33, 0x44}},
+		{data: []byte{0x11, 0x00, 0x00, 0x00}, encoded: []byte{0x02, 0x11, 0x01, 0x01, 0x01}},
+		{data: seq(0x01, 0xfe), encoded: append([]byte{0xff}, seq(0x01, 0xfe)...)},
+		{data: seq(0x00, 0xfe), encoded: append([]byte{0x01, 0xff}, seq(0x01, 0xfe)...)},
+		{data: seq(0x01, 0xff), encoded: append(append([]byte{0xff}, seq(0x01, 0xfe)...), 0x02, 0xff)},
+	} {
+		got := cobsEncode(nil, test.data)
+		if !bytes.Equal(got, test.encoded) {
+			t.Errorf("cobsEncode(%x) = %x, want %x", test.data, got, test.encoded)
+		}
+		decoded, err := cobsDecode(got)
+		if err != nil || !bytes.Equal(decoded, test.data) {
+			t.Errorf("cobsDecode(%x) = %x, %v, want %x", test.encoded, decoded, err, test.data)
+		}
+	}
+	_, err := cobsDecode([]byte{0x05, 0x11})
+	if err == nil {
+		t.Error("expected error decoding truncated block")
+	}
+}
+
+func TestSLIP(t *testing.T) {
+	data := []byte{0x01, slipEnd, 0x02, slipEsc, 0x03}
+	encoded := slipEncode(nil, data)
+	want := []byte{0x01, slipEsc, slipEscEnd, 0x02, slipEsc, slipEscEsc, 0x03}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("slipEncode = %x, want %x", encoded, want)
+	}
+	decoded, err := slipDecode(encoded)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("slipDecode = %x, %v, want %x", decoded, err, data)
+	}
+	for _, bad := range [][]byte{{0x01, slipEsc}, {slipEsc, 0x01}} {
+		_, err = slipDecode(bad)
+		if err == nil {
+			t.Errorf("expected error decoding %x", bad)
+		}
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	// Check value of CRC-16/CCITT-FALSE.
+	if got := crc16([]byte("123456789")); got != 0x29b1 {
+		t.Errorf("got CRC %#04x, want 0x29b1", got)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	for _, framing := range []Framing{COBS, SLIP} {
+		// Two pipes form a full duplex serial link.
+		ar, bw := io.Pipe()
+		br, aw := io.Pipe()
+		a := New(duplex{ar, aw}, Config{Framing: framing})
+		b := New(duplex{br, bw}, Config{Framing: framing})
+
+		var varConn mqtt.VariablesConnect
+		varConn.SetDefaultMQTT([]byte("rs485-node"))
+		// Payload contains bytes special to both framings.
+		payload := []byte{0x00, slipEnd, slipEsc, 0x00, 0x7e}
+		go func() {
+			var tx mqtt.Tx
+			tx.SetTxTransport(a)
+			err := tx.WriteConnect(&varConn)
+			if err == nil {
+				hdr, _ := mqtt.NewHeader(mqtt.PacketPublish, 0, 0)
+				err = tx.WritePacket(&mqtt.Packet{Header: hdr, Publish: mqtt.VariablesPublish{TopicName: []byte("a/b")}, Payload: payload})
+			}
+			if err != nil {
+				aw.CloseWithError(err)
+			}
+		}()
+
+		var rx mqtt.Rx
+		rx.SetRxTransport(b)
+		rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 64)})
+		var pkt mqtt.Packet
+		_, err := rx.ReadPacket(&pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", framing, err)
+		}
+		if string(pkt.Connect.ClientID) != "rs485-node" {
+			t.Errorf("%s: got client identifier %q", framing, pkt.Connect.ClientID)
+		}
+		_, err = rx.ReadPacket(&pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", framing, err)
+		}
+		if string(pkt.Publish.TopicName) != "a/b" || !bytes.Equal(pkt.Payload, payload) {
+			t.Errorf("%s: got PUBLISH %q with payload %x", framing, pkt.Publish.TopicName, pkt.Payload)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestResynchronize(t *testing.T) {
+	for _, framing := range []Framing{COBS, SLIP} {
+		var link bytes.Buffer
+		tx := New(duplex{nil, &link}, Config{Framing: framing})
+		link.Write([]byte{0x13, 0x37, 0x10}) // Line noise before first frame.
+		pingreq := []byte{0xc0, 0x00}
+		pingresp := []byte{0xd0, 0x00}
+		// Writes split across packet boundaries are framed per packet.
+		_, err := tx.Write(append(pingreq, pingresp[0]))
+		if err == nil {
+			_, err = tx.Write(pingresp[1:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Corrupt the PINGREQ frame which starts after the noise and a delimiter.
+		stream := link.Bytes()
+		stream[5] ^= 0x01
+
+		var discards []error
+		rx := New(duplex{bytes.NewReader(stream), nil}, Config{
+			Framing:   framing,
+			OnDiscard: func(err error) { discards = append(discards, err) },
+		})
+		got, err := io.ReadAll(rx)
+		if err != nil {
+			t.Fatalf("%s: %v", framing, err)
+		}
+		if !bytes.Equal(got, pingresp) {
+			t.Errorf("%s: got %x, want %x", framing, got, pingresp)
+		}
+		if rx.Discarded() != 2 || len(discards) != 2 {
+			t.Errorf("%s: got %d discarded frames %v, want noise and corrupted frame", framing, rx.Discarded(), discards)
+		}
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	var link bytes.Buffer
+	tx := New(duplex{nil, &link}, Config{})
+	publish := append([]byte{0x30, 100, 0, 1, 'a'}, make([]byte, 97)...)
+	_, err := tx.Write(append(publish, 0xc0, 0x00))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx := New(duplex{&link, nil}, Config{MaxFrameSize: 64})
+	got, err := io.ReadAll(rx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0xc0, 0x00}) || rx.Discarded() != 1 {
+		t.Errorf("got %x with %d discarded frames", got, rx.Discarded())
+	}
+
+	_, err = tx.Write([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})
+	if !errors.Is(err, errBadHeader) {
+		t.Errorf("got error %v writing invalid remaining length", err)
+	}
+
+	// Oversized packets are not sent, including bytes written after the header.
+	link.Reset()
+	tx = New(duplex{nil, &link}, Config{MaxFrameSize: 64})
+	n, err := tx.Write(append([]byte{0xc0, 0x00}, publish[:5]...))
+	if n != 2 || !errors.Is(err, errFrameTooLong) {
+		t.Errorf("Write oversized packet = %d, %v", n, err)
+	}
+	n, err = tx.Write(append(publish[5:], 0xe0, 0x00))
+	if n != len(publish)-5+2 || err != nil {
+		t.Errorf("Write rest of oversized packet = %d, %v", n, err)
+	}
+	rx = New(duplex{&link, nil}, Config{})
+	got, err = io.ReadAll(rx)
+	if err != nil || !bytes.Equal(got, []byte{0xc0, 0x00, 0xe0, 0x00}) || rx.Discarded() != 0 {
+		t.Errorf("got %x, %v with %d discarded frames", got, err, rx.Discarded())
+	}
+}
+
+func TestWritePartial(t *testing.T) {
+	tx := New(duplex{nil, &failWriter{n: 1}}, Config{})
+	// Last byte of the first packet buffered by a previous call.
+	n, err := tx.Write([]byte{0xc0})
+	if n != 1 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	n, err = tx.Write([]byte{0x00, 0xd0, 0x00, 0xe0})
+	if n != 1 || err != errWrite {
+		t.Errorf("Write = %d, %v, want 1 byte sent before error", n, err)
+	}
+	if len(tx.wbuf) != 0 {
+		t.Errorf("kept %x buffered after error", tx.wbuf)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+// failWriter fails after n successful writes.
+type failWriter struct {
+	n int
+}
+
+func (fw *failWriter) Write(b []byte) (int, error) {
+	if fw.n == 0 {
+		return 0, errWrite
+	}
+	fw.n--
+	return len(b), nil
+}
+
+type duplex struct {
+	io.Reader
+	io.Writer
+}
@@ -0,0 +1,160 @@
+package mqttsession
+
+import (
+	"io"
+	"time"
+)
+
+// Clock is the source of time of a Manager. Tests can provide a fake Clock to
+// drive keep alive timers and session expiry without sleeping.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f after d elapses and returns a function that stops the
+	// timer, which reports whether it stopped the timer before f was called.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// Link is a client connection attached to a Manager with Attach.
+type Link struct {
+	m         *Manager
+	clientID  string
+	conn      io.Closer
+	keepAlive time.Duration
+	// Fields below are guarded by m.mu.
+	lastRx  time.Time
+	stop    func() bool
+	expired bool
+	// takenOver is set by Connect when another connection resumes the session.
+	takenOver bool
+}
+
+// Attach registers conn as the connection of clientID after Connect started
+// its session and the CONNECT is accepted. If clientID already has an attached
+// connection it is closed as per MQTT-3.1.4-2. Its Link stopped affecting the
+// session when Connect took the session over. If keepAlive, the
+// CONNECT Keep Alive in seconds, is nonzero conn is closed when no packets are
+// received for one and a half times keepAlive as per MQTT-3.1.2-24.
+//
+// The server must call Touch on every packet received from conn and Close when
+// conn is closed for any reason.
+func (m *Manager) Attach(clientID string, keepAlive uint16, conn io.Closer) *Link {
+	l := &Link{
+		m:         m,
+		clientID:  clientID,
+		conn:      conn,
+		keepAlive: time.Duration(keepAlive) * time.Second * 3 / 2,
+	}
+	m.mu.Lock()
+	old := m.links[clientID]
+	if old != nil {
+		old.stopTimer()
+	}
+	m.links[clientID] = l
+	l.lastRx = m.cfg.Clock.Now()
+	if l.keepAlive > 0 {
+		l.stop = m.cfg.Clock.AfterFunc(l.keepAlive, l.checkKeepAlive)
+	}
+	m.mu.Unlock()
+	if old != nil {
+		old.conn.Close() // Session takeover.
+	}
+	return l
+}
+
+// Touch records a packet received from the connection, resetting the keep alive timer.
+func (l *Link) Touch() {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	l.lastRx = l.m.cfg.Clock.Now()
+}
+
+// Expired reports whether the connection was closed due to the keep alive timer expiring.
+func (l *Link) Expired() bool {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	return l.expired
+}
+
+// Close detaches the connection from the Manager and disconnects the session
+// as Manager.Disconnect does. It returns false without affecting the session if
+// the connection was already detached or taken over by another connection
+// with the same client identifier. Close does not close the connection.
+func (l *Link) Close() (current bool, err error) {
+	l.m.storeMu.Lock()
+	defer l.m.storeMu.Unlock()
+	l.m.mu.Lock()
+	l.stopTimer()
+	current = l.m.links[l.clientID] == l
+	if current {
+		delete(l.m.links, l.clientID)
+	}
+	current = current && !l.takenOver
+	l.m.mu.Unlock()
+	if !current {
+		return false, nil
+	}
+	return true, l.m.disconnect(l.clientID)
+}
+
+// Delivered reports messages returned by Manager.Connect as delivered to the
+// connection as Manager.Delivered does. It does nothing if the connection was
+// detached or taken over, in which case the messages are returned again by the
+// next Connect.
+func (l *Link) Delivered(n int) error {
+	l.m.storeMu.Lock()
+	defer l.m.storeMu.Unlock()
+	l.m.mu.Lock()
+	current := l.m.links[l.clientID] == l && !l.takenOver
+	l.m.mu.Unlock()
+	if !current {
+		return nil
+	}
+	return l.m.delivered(l.clientID, n)
+}
+
+// checkKeepAlive closes the connection if the keep alive elapsed since the
+// last packet was received or rearms the timer for the remaining time.
+func (l *Link) checkKeepAlive() {
+	l.m.mu.Lock()
+	if l.m.links[l.clientID] != l || l.stop == nil {
+		l.m.mu.Unlock()
+		return // Detached or taken over.
+	}
+	remaining := l.keepAlive - l.m.cfg.Clock.Now().Sub(l.lastRx)
+	if remaining > 0 {
+		l.stop = l.m.cfg.Clock.AfterFunc(remaining, l.checkKeepAlive)
+		l.m.mu.Unlock()
+		return
+	}
+	l.stop = nil
+	l.expired = true
+	l.m.mu.Unlock()
+	l.conn.Close()
+}
+
+// takeOver stops the connection attached for clientID from affecting its
+// session, which was resumed by another connection.
+func (m *Manager) takeOver(clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.links[clientID]; l != nil {
+		l.stopTimer()
+		l.takenOver = true
+	}
+}
+
+// stopTimer stops the keep alive timer. l.m.mu must be held.
+func (l *Link) stopTimer() {
+	if l.stop != nil {
+		l.stop()
+		l.stop = nil
+	}
+}
@@ -0,0 +1,222 @@
+package mqttsession
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestLinkKeepAlive(t *testing.T) {
+	clock := newFakeClock()
+	m := NewManager(Config{Clock: clock})
+	conn := &fakeConn{}
+	m.Connect("sensor", false)
+	l := m.Attach("sensor", 10, conn)
+
+	clock.Advance(14 * time.Second)
+	l.Touch() // Keep alive restarts on every packet.
+	clock.Advance(14 * time.Second)
+	if conn.isClosed() || l.Expired() {
+		t.Fatal("connection closed before keep alive elapsed")
+	}
+	clock.Advance(time.Second)
+	if !conn.isClosed() || !l.Expired() {
+		t.Fatal("connection not closed after 1.5 times keep alive")
+	}
+	if current, err := l.Close(); !current || err != nil {
+		t.Errorf("Close = %v, %v", current, err)
+	}
+	if n, _ := m.Publish("x", nil, mqtt.QoS0); n != 0 || m.online["sensor"] {
+		t.Error("session still online after expired link closed")
+	}
+
+	// Zero keep alive disables the timer.
+	conn = &fakeConn{}
+	l = m.Attach("idle", 0, conn)
+	clock.Advance(24 * time.Hour)
+	if conn.isClosed() {
+		t.Error("connection closed with keep alive disabled")
+	}
+	l.Close()
+}
+
+func TestLinkTakeover(t *testing.T) {
+	clock := newFakeClock()
+	m := NewManager(Config{Clock: clock})
+	oldConn, newConn := &fakeConn{}, &fakeConn{}
+	m.Connect("sensor", false)
+	m.Subscribe("sensor", Subscription{Filter: "x", QoS: mqtt.QoS1})
+	old := m.Attach("sensor", 10, oldConn)
+
+	// Second CONNECT with the same client identifier closes the old connection.
+	_, present, _ := m.Connect("sensor", false)
+	if !present {
+		t.Error("session not present on takeover")
+	}
+	if oldConn.isClosed() {
+		t.Fatal("old connection closed before new connection attached")
+	}
+	l := m.Attach("sensor", 10, newConn)
+	if !oldConn.isClosed() || newConn.isClosed() {
+		t.Fatal("old connection not closed on takeover")
+	}
+	// Old connection teardown does not disconnect the new session.
+	if current, _ := old.Close(); current {
+		t.Error("taken over link is current")
+	}
+	if n, _ := m.Publish("x", nil, mqtt.QoS1); n != 0 {
+		t.Errorf("queued %d messages for connected session", n)
+	}
+	clock.Advance(15 * time.Second)
+	if old.Expired() || !newConn.isClosed() || !l.Expired() {
+		t.Error("keep alive of new connection not enforced")
+	}
+	if current, _ := l.Close(); !current {
+		t.Error("link not current")
+	}
+	if n, _ := m.Publish("x", nil, mqtt.QoS1); n != 1 {
+		t.Errorf("queued %d messages after disconnect, want 1", n)
+	}
+
+	// Old connection closed before the new one is attached does not disconnect the session.
+	s, _, _ := m.Connect("sensor", false)
+	old = m.Attach("sensor", 0, oldConn)
+	m.Connect("sensor", false)
+	if current, _ := old.Close(); current {
+		t.Error("taken over link is current")
+	}
+	l = m.Attach("sensor", 0, newConn)
+	if n, _ := m.Publish("x", nil, mqtt.QoS1); n != 0 {
+		t.Errorf("queued %d messages for connected session", n)
+	}
+
+	// Only the current connection removes delivered messages.
+	old.Delivered(len(s.Queue))
+	if s, _, _ := m.Connect("sensor", false); len(s.Queue) != 1 {
+		t.Errorf("taken over link removed delivered messages: %+v", s.Queue)
+	}
+	l = m.Attach("sensor", 0, newConn)
+	l.Delivered(1)
+	if s, _, _ := m.Connect("sensor", false); len(s.Queue) != 0 {
+		t.Errorf("delivered messages still queued: %+v", s.Queue)
+	}
+}
+
+func TestLinkTouchDuringPublish(t *testing.T) {
+	store := &blockingStore{appending: make(chan struct{}), release: make(chan struct{})}
+	m := NewManager(Config{Store: store})
+	m.Connect("offline", false)
+	m.Subscribe("offline", Subscription{Filter: "x", QoS: mqtt.QoS1})
+	m.Disconnect("offline")
+	m.Connect("sensor", false)
+	l := m.Attach("sensor", 10, &fakeConn{})
+	defer l.Close()
+
+	go m.Publish("x", nil, mqtt.QoS1)
+	<-store.appending
+	touched := make(chan struct{})
+	go func() {
+		l.Touch()
+		close(touched)
+	}()
+	select {
+	case <-touched:
+	case <-time.After(time.Second):
+		t.Error("Touch blocked by Publish appending to store")
+	}
+	close(store.release)
+}
+
+// blockingStore blocks Append until release is closed.
+type blockingStore struct {
+	MemoryStore
+	appending chan struct{}
+	release   chan struct{}
+}
+
+func (bs *blockingStore) Append(clientID string, msg Message) error {
+	bs.appending <- struct{}{}
+	<-bs.release
+	return bs.MemoryStore.Append(clientID, msg)
+}
+
+// fakeClock is a Clock whose timers fire when Advance moves time past their deadline.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when    time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		wasActive := !timer.stopped
+		timer.stopped = true
+		return wasActive
+	}
+}
+
+// Advance moves time forward by d calling due timers in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.when.After(end) && (next == nil || timer.when.Before(next.when)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.stopped = true
+		c.now = next.when
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type fakeConn struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
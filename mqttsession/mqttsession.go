@@ -0,0 +1,394 @@
+// Package mqttsession keeps the session state of MQTT v3.1.1 clients that
+// connect with CleanSession set to false so servers built on natiu-mqtt can
+// restore it when the client reconnects. A session holds the client's
+// subscriptions and the messages matching them published while the client was
+// disconnected.
+//
+// Sessions are persisted through the Store interface, implemented in memory by
+// MemoryStore and on disk by FileStore. A Manager implements the session rules
+// of the specification on top of a Store: servers call Connect when accepting
+// a CONNECT, Delivered once the queued messages returned by Connect are
+// delivered, Subscribe and Unsubscribe on SUBSCRIBE and UNSUBSCRIBE, Disconnect
+// when the connection ends and Publish for every message they route.
+//
+// Servers that call Attach for every accepted connection also get keep alive
+// enforcement and session takeover from the Manager.
+package mqttsession
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// DefaultMaxQueued is the limit of queued messages per session used when Config.MaxQueued is zero.
+const DefaultMaxQueued = 1000
+
+// Subscription is a topic filter of a session and its granted QoS.
+type Subscription struct {
+	Filter string
+	QoS    mqtt.QoSLevel
+}
+
+// Message is a message queued for a disconnected client.
+type Message struct {
+	Topic   string
+	Payload []byte
+	// QoS is the QoS the message is delivered with, which is the lower of
+	// the published QoS and the QoS granted to the matching subscription.
+	QoS mqtt.QoSLevel
+}
+
+// Session is the state of a client with a persistent session.
+type Session struct {
+	ClientID      string
+	Subscriptions []Subscription
+	// Queue holds messages published while the client was disconnected, oldest first.
+	Queue []Message
+	// Dropped counts messages not queued because the queue was full. Messages
+	// dropped while the client is disconnected are counted in memory and
+	// stored when the client reconnects.
+	Dropped uint64
+	// Disconnected is the time the client disconnected. It is zero while the client is connected.
+	Disconnected time.Time
+}
+
+func (s Session) clone() Session {
+	s.Subscriptions = append([]Subscription(nil), s.Subscriptions...)
+	queue := s.Queue
+	s.Queue = nil
+	for _, msg := range queue {
+		msg.Payload = append([]byte(nil), msg.Payload...)
+		s.Queue = append(s.Queue, msg)
+	}
+	return s
+}
+
+// Config configures a Manager.
+type Config struct {
+	// Store persists sessions. Defaults to a new MemoryStore.
+	Store Store
+	// MaxQueued limits the number of messages queued per session. Messages
+	// published while the queue is full are dropped. Defaults to DefaultMaxQueued.
+	MaxQueued int
+	// Expiry is the time after which the session of a client that has not
+	// reconnected is discarded. Zero means sessions never expire.
+	Expiry time.Duration
+	// QueueQoS0 also queues messages delivered with QoS0, which the
+	// specification allows but does not require.
+	QueueQoS0 bool
+	// Clock drives session expiry and keep alive timers. Defaults to the system clock.
+	Clock Clock
+}
+
+// Manager keeps persistent sessions in a Store. It is safe for concurrent use.
+type Manager struct {
+	cfg Config
+
+	// storeMu serializes access to the Store and guards the fields below up to
+	// mu, so Store writes which sync to disk do not block Link.Touch.
+	storeMu sync.Mutex
+	loaded  bool
+	// online are the client identifiers of connected clients with persistent sessions.
+	online map[string]bool
+	// offline are the disconnected clients with persistent sessions.
+	offline map[string]*offlineSession
+
+	// mu guards links and is acquired after storeMu.
+	mu sync.Mutex
+	// links are the attached connections by client identifier.
+	links map[string]*Link
+}
+
+// offlineSession is the state of a disconnected client kept so Publish can
+// queue messages without loading the session from the Store.
+type offlineSession struct {
+	subs   []Subscription
+	queued int
+	// dropped counts messages dropped since the session was last saved.
+	dropped uint64
+}
+
+var errEmptyClientID = errors.New("persistent session requires a client identifier")
+
+// NewManager returns a Manager configured with cfg.
+func NewManager(cfg Config) *Manager {
+	if cfg.Store == nil {
+		cfg.Store = &MemoryStore{}
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = DefaultMaxQueued
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+	return &Manager{
+		cfg:     cfg,
+		online:  make(map[string]bool),
+		offline: make(map[string]*offlineSession),
+		links:   make(map[string]*Link),
+	}
+}
+
+// Connect starts the session of a client accepted with the given CleanSession
+// flag and returns it along with the Session Present flag of the CONNACK.
+// With cleanSession any stored session is discarded and the state of the new
+// session is not kept after the client disconnects. Otherwise the stored
+// session is resumed: the server must restore its subscriptions and deliver
+// its queued messages. Queued messages stay in the store until reported with
+// Delivered so they are returned again by the next Connect if the connection
+// fails before delivering them. A connection attached for clientID stops
+// affecting the session once Connect succeeds.
+func (m *Manager) Connect(clientID string, cleanSession bool) (s Session, present bool, err error) {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	if err := m.load(); err != nil {
+		return Session{}, false, err
+	}
+	off := m.offline[clientID]
+	delete(m.offline, clientID)
+	if cleanSession {
+		delete(m.online, clientID)
+		if err := m.cfg.Store.Delete(clientID); err != nil {
+			return Session{}, false, err
+		}
+		m.takeOver(clientID)
+		return Session{ClientID: clientID}, false, nil
+	} else if clientID == "" {
+		return Session{}, false, errEmptyClientID // MQTT-3.1.3-7.
+	}
+	s, err = m.cfg.Store.Load(clientID)
+	switch {
+	case errors.Is(err, ErrNoSession) || err == nil && m.expired(s):
+		s = Session{ClientID: clientID}
+	case err != nil:
+		return Session{}, false, err
+	default:
+		present = true
+		if off != nil {
+			s.Dropped += off.dropped
+		}
+	}
+	s.Disconnected = time.Time{}
+	if err := m.cfg.Store.Save(s); err != nil {
+		return Session{}, false, err
+	}
+	m.online[clientID] = true
+	m.takeOver(clientID)
+	return s, present, nil
+}
+
+// Delivered removes the first n messages from the queue of the session of
+// clientID once the server delivered them, i.e: wrote them with QoS0 or
+// received their acknowledgement with QoS1 and QoS2. Servers that attached the
+// connection should call Link.Delivered instead.
+func (m *Manager) Delivered(clientID string, n int) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	return m.delivered(clientID, n)
+}
+
+// delivered implements Delivered. m.storeMu must be held.
+func (m *Manager) delivered(clientID string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	s, err := m.cfg.Store.Load(clientID)
+	if errors.Is(err, ErrNoSession) {
+		return nil // Clean session.
+	} else if err != nil {
+		return err
+	}
+	if n > len(s.Queue) {
+		n = len(s.Queue)
+	}
+	s.Queue = s.Queue[n:]
+	if off := m.offline[clientID]; off != nil {
+		off.queued = len(s.Queue)
+	}
+	return m.cfg.Store.Save(s)
+}
+
+// Subscribe adds subscriptions to the session of a connected client, replacing
+// the granted QoS of existing subscriptions with the same filter. It does
+// nothing for clients without a persistent session.
+func (m *Manager) Subscribe(clientID string, subs ...Subscription) error {
+	return m.update(clientID, func(s *Session) {
+		for _, sub := range subs {
+			i := s.index(sub.Filter)
+			if i < 0 {
+				s.Subscriptions = append(s.Subscriptions, sub)
+			} else {
+				s.Subscriptions[i].QoS = sub.QoS
+			}
+		}
+	})
+}
+
+// Unsubscribe removes subscriptions from the session of a connected client.
+// It does nothing for clients without a persistent session.
+func (m *Manager) Unsubscribe(clientID string, filters ...string) error {
+	return m.update(clientID, func(s *Session) {
+		for _, filter := range filters {
+			if i := s.index(filter); i >= 0 {
+				s.Subscriptions = append(s.Subscriptions[:i], s.Subscriptions[i+1:]...)
+			}
+		}
+	})
+}
+
+// Disconnect ends the connection of a client. A persistent session starts
+// queueing messages and expires if the client does not reconnect within Config.Expiry.
+// Servers that attached the connection should call Link.Close instead.
+func (m *Manager) Disconnect(clientID string) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	return m.disconnect(clientID)
+}
+
+// disconnect implements Disconnect. m.storeMu must be held.
+func (m *Manager) disconnect(clientID string) error {
+	if !m.online[clientID] {
+		return nil
+	}
+	delete(m.online, clientID)
+	s, err := m.cfg.Store.Load(clientID)
+	if err != nil {
+		return err
+	}
+	s.Disconnected = m.cfg.Clock.Now()
+	m.offline[clientID] = &offlineSession{subs: s.Subscriptions, queued: len(s.Queue)}
+	return m.cfg.Store.Save(s)
+}
+
+// Publish queues a message published with the given QoS for disconnected
+// clients with a matching subscription and returns the number of sessions it
+// was queued for. Messages delivered with QoS0 are only queued if
+// Config.QueueQoS0 is set. Shared subscriptions are not queued for. Queueing
+// a message appends it to the stored queue without rewriting the session.
+func (m *Manager) Publish(topic string, payload []byte, qos mqtt.QoSLevel) (queued int, err error) {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	if err := m.load(); err != nil {
+		return 0, err
+	}
+	for clientID, off := range m.offline {
+		matched := false
+		var granted mqtt.QoSLevel
+		for _, sub := range off.subs {
+			if mqtt.MatchTopic(sub.Filter, topic) {
+				matched = true
+				if sub.QoS > granted {
+					granted = sub.QoS
+				}
+			}
+		}
+		if qos < granted {
+			granted = qos
+		}
+		if !matched || granted == mqtt.QoS0 && !m.cfg.QueueQoS0 {
+			continue
+		}
+		if off.queued >= m.cfg.MaxQueued {
+			off.dropped++
+			continue
+		}
+		appendErr := m.cfg.Store.Append(clientID, Message{Topic: topic, Payload: payload, QoS: granted})
+		if appendErr != nil {
+			if err == nil {
+				err = appendErr
+			}
+			continue
+		}
+		off.queued++
+		queued++
+	}
+	return queued, err
+}
+
+// Expire discards sessions of clients disconnected for longer than
+// Config.Expiry and returns their client identifiers. Servers should call it
+// periodically; expired sessions are also discarded when their client reconnects.
+func (m *Manager) Expire() (expired []string, err error) {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	for clientID := range m.offline {
+		s, err := m.cfg.Store.Load(clientID)
+		if err != nil && !errors.Is(err, ErrNoSession) {
+			return expired, err
+		}
+		if err == nil && !m.expired(s) {
+			continue
+		}
+		if err := m.cfg.Store.Delete(clientID); err != nil {
+			return expired, err
+		}
+		delete(m.offline, clientID)
+		expired = append(expired, clientID)
+	}
+	return expired, nil
+}
+
+// load indexes the subscriptions of stored sessions on first use so sessions
+// persisted by a previous server process queue messages. m.storeMu must be held.
+func (m *Manager) load() error {
+	if m.loaded {
+		return nil
+	}
+	clientIDs, err := m.cfg.Store.ClientIDs()
+	if err != nil {
+		return err
+	}
+	now := m.cfg.Clock.Now()
+	for _, clientID := range clientIDs {
+		s, err := m.cfg.Store.Load(clientID)
+		if errors.Is(err, ErrNoSession) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if s.Disconnected.IsZero() {
+			// Server stopped while client was connected.
+			s.Disconnected = now
+			if err := m.cfg.Store.Save(s); err != nil {
+				return err
+			}
+		}
+		m.offline[clientID] = &offlineSession{subs: s.Subscriptions, queued: len(s.Queue)}
+	}
+	m.loaded = true
+	return nil
+}
+
+// update modifies the stored session of a connected client with a persistent session.
+func (m *Manager) update(clientID string, fn func(s *Session)) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	if !m.online[clientID] {
+		return nil
+	}
+	s, err := m.cfg.Store.Load(clientID)
+	if err != nil {
+		return err
+	}
+	fn(&s)
+	return m.cfg.Store.Save(s)
+}
+
+func (m *Manager) expired(s Session) bool {
+	return m.cfg.Expiry > 0 && !s.Disconnected.IsZero() && m.cfg.Clock.Now().Sub(s.Disconnected) > m.cfg.Expiry
+}
+
+func (s *Session) index(filter string) int {
+	for i, sub := range s.Subscriptions {
+		if sub.Filter == filter {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,145 @@
+package mqttsession
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestManager(t *testing.T) {
+	clock := newFakeClock()
+	store := &countingStore{}
+	m := NewManager(Config{Store: store, MaxQueued: 2, Expiry: time.Hour, Clock: clock})
+
+	s, present, err := m.Connect("sensor", false)
+	if err != nil || present || len(s.Subscriptions) != 0 {
+		t.Fatalf("first Connect = %+v, %v, %v", s, present, err)
+	}
+	err = m.Subscribe("sensor", Subscription{Filter: "jobs/#", QoS: mqtt.QoS1}, Subscription{Filter: "cfg/+", QoS: mqtt.QoS0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := m.Publish("jobs/1", []byte("online"), mqtt.QoS1); n != 0 {
+		t.Errorf("queued %d messages for connected client", n)
+	}
+	if err := m.Disconnect("sensor"); err != nil {
+		t.Fatal(err)
+	}
+
+	saves := store.saves
+	for _, pub := range []struct {
+		topic  string
+		qos    mqtt.QoSLevel
+		queued int
+	}{
+		{"jobs/1", mqtt.QoS1, 1},
+		{"jobs/2", mqtt.QoS0, 0},   // QoS0 not queued by default.
+		{"cfg/rate", mqtt.QoS1, 0}, // Subscription granted QoS0.
+		{"other", mqtt.QoS2, 0},
+		{"jobs/3", mqtt.QoS2, 1}, // Delivered with granted QoS1.
+		{"jobs/4", mqtt.QoS1, 0}, // Queue full.
+	} {
+		n, err := m.Publish(pub.topic, []byte(pub.topic), pub.qos)
+		if err != nil || n != pub.queued {
+			t.Errorf("Publish(%q) queued %d, want %d: %v", pub.topic, n, pub.queued, err)
+		}
+	}
+	if store.saves != saves {
+		t.Errorf("Publish saved session %d times, want appended messages only", store.saves-saves)
+	}
+
+	s, present, err = m.Connect("sensor", false)
+	if err != nil || !present {
+		t.Fatalf("resumed Connect = %v, %v", present, err)
+	}
+	if len(s.Subscriptions) != 2 || s.Dropped != 1 || len(s.Queue) != 2 ||
+		s.Queue[0].Topic != "jobs/1" || string(s.Queue[0].Payload) != "jobs/1" ||
+		s.Queue[1].Topic != "jobs/3" || s.Queue[1].QoS != mqtt.QoS1 {
+		t.Errorf("resumed session %+v", s)
+	}
+	// Queue is kept until delivered in case the connection fails.
+	if stored, _ := store.Load("sensor"); len(stored.Queue) != 2 || !stored.Disconnected.IsZero() {
+		t.Errorf("stored session after resume %+v", stored)
+	}
+	if err := m.Delivered("sensor", 1); err != nil {
+		t.Fatal(err)
+	}
+	m.Disconnect("sensor")
+	s, _, err = m.Connect("sensor", false)
+	if err != nil || len(s.Queue) != 1 || s.Queue[0].Topic != "jobs/3" || s.Dropped != 1 {
+		t.Fatalf("Connect after partial delivery = %+v, %v", s, err)
+	}
+	m.Delivered("sensor", 1)
+	if stored, _ := store.Load("sensor"); len(stored.Queue) != 0 {
+		t.Errorf("stored queue after delivery %+v", stored.Queue)
+	}
+	if err := m.Unsubscribe("sensor", "jobs/#"); err != nil {
+		t.Fatal(err)
+	}
+	m.Disconnect("sensor")
+	if n, _ := m.Publish("jobs/5", nil, mqtt.QoS1); n != 0 {
+		t.Errorf("queued %d messages after unsubscribe", n)
+	}
+
+	// Clean session discards stored state.
+	s, present, err = m.Connect("sensor", true)
+	if err != nil || present || len(s.Subscriptions) != 0 {
+		t.Errorf("clean Connect = %+v, %v, %v", s, present, err)
+	}
+	m.Subscribe("sensor", Subscription{Filter: "jobs/#", QoS: mqtt.QoS1})
+	m.Disconnect("sensor")
+	if ids, _ := store.ClientIDs(); len(ids) != 0 {
+		t.Errorf("clean session stored: %q", ids)
+	}
+	if _, _, err := m.Connect("", false); err != errEmptyClientID {
+		t.Errorf("got %v connecting persistent session without client identifier", err)
+	}
+}
+
+func TestManagerExpire(t *testing.T) {
+	clock := newFakeClock()
+	store := &MemoryStore{}
+	m := NewManager(Config{Store: store, Expiry: time.Hour, Clock: clock})
+	for _, clientID := range []string{"a", "b"} {
+		m.Connect(clientID, false)
+		m.Subscribe(clientID, Subscription{Filter: "x", QoS: mqtt.QoS1})
+	}
+	m.Disconnect("a")
+	clock.Advance(30 * time.Minute)
+	m.Disconnect("b")
+	clock.Advance(31 * time.Minute)
+	expired, err := m.Expire()
+	if err != nil || len(expired) != 1 || expired[0] != "a" {
+		t.Errorf("Expire = %q, %v", expired, err)
+	}
+	if n, _ := m.Publish("x", nil, mqtt.QoS1); n != 1 {
+		t.Errorf("queued for %d sessions, want 1", n)
+	}
+	clock.Advance(time.Hour)
+	// Expired session is discarded on reconnect even if Expire was not called.
+	if _, present, _ := m.Connect("b", false); present {
+		t.Error("expired session present")
+	}
+
+	// Sessions of a previous server process are indexed on first use.
+	m = NewManager(Config{Store: store, Clock: clock})
+	if n, _ := m.Publish("x", nil, mqtt.QoS1); n != 0 {
+		t.Errorf("queued for %d sessions without subscriptions", n)
+	}
+	m.Subscribe("b", Subscription{Filter: "x", QoS: mqtt.QoS1}) // Not connected on this manager.
+	if s, _ := store.Load("b"); len(s.Subscriptions) != 0 {
+		t.Errorf("subscribed disconnected client %+v", s)
+	}
+}
+
+// countingStore counts calls to Save.
+type countingStore struct {
+	MemoryStore
+	saves int
+}
+
+func (cs *countingStore) Save(s Session) error {
+	cs.saves++
+	return cs.MemoryStore.Save(s)
+}
@@ -0,0 +1,340 @@
+package mqttsession
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNoSession is returned by Store.Load when there is no session stored for a client identifier.
+var ErrNoSession = errors.New("no session stored for client identifier")
+
+// Store persists sessions by client identifier. Implementations must be safe for
+// concurrent use and must not retain the slices of sessions passed to Save or
+// returned by Load.
+type Store interface {
+	// Load returns the session of clientID or ErrNoSession.
+	Load(clientID string) (Session, error)
+	// Save stores s, replacing the session with the same client identifier.
+	Save(s Session) error
+	// Append adds msg to the end of the queue of the stored session of clientID
+	// or returns ErrNoSession. It should not take time proportional to the
+	// length of the queue since it is called for every message queued.
+	Append(clientID string, msg Message) error
+	// Delete removes the session of clientID. Deleting a missing session is not an error.
+	Delete(clientID string) error
+	// ClientIDs returns the client identifiers of all stored sessions.
+	ClientIDs() ([]string, error)
+}
+
+var (
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*FileStore)(nil)
+)
+
+// MemoryStore keeps sessions in memory. Sessions are lost when the process exits.
+// The zero value is ready for use.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// Load implements Store.
+func (ms *MemoryStore) Load(clientID string) (Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.sessions[clientID]
+	if !ok {
+		return Session{}, ErrNoSession
+	}
+	return s.clone(), nil
+}
+
+// Save implements Store.
+func (ms *MemoryStore) Save(s Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.sessions == nil {
+		ms.sessions = make(map[string]Session)
+	}
+	ms.sessions[s.ClientID] = s.clone()
+	return nil
+}
+
+// Append implements Store.
+func (ms *MemoryStore) Append(clientID string, msg Message) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.sessions[clientID]
+	if !ok {
+		return ErrNoSession
+	}
+	msg.Payload = append([]byte(nil), msg.Payload...)
+	s.Queue = append(s.Queue, msg)
+	ms.sessions[clientID] = s
+	return nil
+}
+
+// Delete implements Store.
+func (ms *MemoryStore) Delete(clientID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, clientID)
+	return nil
+}
+
+// ClientIDs implements Store.
+func (ms *MemoryStore) ClientIDs() ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	clientIDs := make([]string, 0, len(ms.sessions))
+	for clientID := range ms.sessions {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+	return clientIDs, nil
+}
+
+// FileStore keeps each session as a JSON file in a directory so sessions
+// survive server restarts. The queue of a session is kept in a separate file
+// with a JSON encoded message per line so Append only writes the appended
+// message. File names are the hex encoded client identifier so any client
+// identifier is a valid file name. Files are synced to disk before Save and
+// Append return.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+const (
+	fileExt  = ".json"
+	queueExt = ".queue"
+)
+
+// NewFileStore returns a FileStore keeping sessions in dir, which is created if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Load implements Store.
+func (st *FileStore) Load(clientID string) (Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := os.ReadFile(st.path(clientID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Session{}, ErrNoSession
+	} else if err != nil {
+		return Session{}, err
+	}
+	var s Session
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return Session{}, err
+	}
+	b, err = os.ReadFile(st.queuePath(clientID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Session{}, err
+	}
+	s.Queue = nil
+	for len(b) > 0 {
+		line, rest, complete := bytes.Cut(b, []byte{'\n'})
+		if !complete {
+			break // Message not completely written before a crash.
+		}
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return Session{}, err
+		}
+		s.Queue = append(s.Queue, msg)
+		b = rest
+	}
+	return s, nil
+}
+
+// Save implements Store. The session and queue files are each replaced
+// atomically so a crash during Save leaves the previous version intact.
+func (st *FileStore) Save(s Session) error {
+	var queue []byte
+	for _, msg := range s.Queue {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		queue = append(append(queue, b...), '\n')
+	}
+	s.Queue = nil
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(queue) == 0 {
+		err = removeFile(st.queuePath(s.ClientID))
+	} else {
+		err = st.writeFile(st.queuePath(s.ClientID), queue)
+	}
+	if err == nil {
+		err = st.writeFile(st.path(s.ClientID), b)
+	}
+	if err == nil {
+		err = st.syncDir()
+	}
+	return err
+}
+
+// Append implements Store. Only msg is written to the queue file of the session.
+func (st *FileStore) Append(clientID string, msg Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, err := os.Stat(st.path(clientID)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNoSession
+	} else if err != nil {
+		return err
+	}
+	_, err = os.Stat(st.queuePath(clientID))
+	created := errors.Is(err, fs.ErrNotExist)
+	f, err := os.OpenFile(st.queuePath(clientID), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	end, err := dropTornLine(f)
+	if err == nil {
+		_, err = f.WriteAt(append(b, '\n'), end)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && created {
+		err = st.syncDir()
+	}
+	return err
+}
+
+// dropTornLine truncates a message not completely appended to the queue file f
+// before a crash so the next message is not written onto it. It returns the
+// size of f.
+func dropTornLine(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	size := info.Size()
+	var last [1]byte
+	_, err = f.ReadAt(last[:], size-1)
+	if err != nil || last[0] == '\n' {
+		return size, err
+	}
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	size = int64(bytes.LastIndexByte(b, '\n') + 1)
+	return size, f.Truncate(size)
+}
+
+// Delete implements Store.
+func (st *FileStore) Delete(clientID string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	err := removeFile(st.queuePath(clientID))
+	if err == nil {
+		err = removeFile(st.path(clientID))
+	}
+	return err
+}
+
+// ClientIDs implements Store.
+func (st *FileStore) ClientIDs() ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return nil, err
+	}
+	var clientIDs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		clientID, err := hex.DecodeString(strings.TrimSuffix(name, fileExt))
+		if err != nil {
+			continue // Not a session file.
+		}
+		clientIDs = append(clientIDs, string(clientID))
+	}
+	return clientIDs, nil
+}
+
+func (st *FileStore) path(clientID string) string {
+	return filepath.Join(st.dir, hex.EncodeToString([]byte(clientID))+fileExt)
+}
+
+func (st *FileStore) queuePath(clientID string) string {
+	return filepath.Join(st.dir, hex.EncodeToString([]byte(clientID))+queueExt)
+}
+
+// writeFile atomically replaces the file at path with data synced to disk.
+// The directory must be synced for the rename to be durable.
+func (st *FileStore) writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(st.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// syncDir syncs the directory so renamed and created files survive a crash.
+func (st *FileStore) syncDir() error {
+	d, err := os.Open(st.dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeFile removes the file at path. Removing a missing file is not an error.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package mqttsession
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestStores(t *testing.T) {
+	fstore, err := NewFileStore(filepath.Join(t.TempDir(), "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": &MemoryStore{}, "file": fstore} {
+		if _, err := store.Load("a/b"); err != ErrNoSession {
+			t.Errorf("%s: got %v loading missing session", name, err)
+		}
+		s := Session{
+			ClientID:      "a/b",
+			Subscriptions: []Subscription{{Filter: "x/#", QoS: mqtt.QoS1}},
+			Queue:         []Message{{Topic: "x/1", Payload: []byte("hello"), QoS: mqtt.QoS1}},
+			Dropped:       3,
+			Disconnected:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if err := store.Save(s); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		s.Queue[0].Payload[0] = 'j' // Store must not retain slices.
+		payload := []byte("world")
+		if err := store.Append("a/b", Message{Topic: "x/2", Payload: payload}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		payload[0] = 'j'
+		got, err := store.Load("a/b")
+		if err != nil || got.ClientID != "a/b" || got.Dropped != 3 || !got.Disconnected.Equal(s.Disconnected) ||
+			len(got.Subscriptions) != 1 || got.Subscriptions[0] != s.Subscriptions[0] ||
+			len(got.Queue) != 2 || string(got.Queue[0].Payload) != "hello" || got.Queue[0].QoS != mqtt.QoS1 ||
+			got.Queue[1].Topic != "x/2" || string(got.Queue[1].Payload) != "world" {
+			t.Errorf("%s: loaded %+v, %v", name, got, err)
+		}
+		if err := store.Append("missing", Message{Topic: "x"}); err != ErrNoSession {
+			t.Errorf("%s: got %v appending to missing session", name, err)
+		}
+		store.Save(Session{ClientID: "c"})
+		if ids, err := store.ClientIDs(); err != nil || len(ids) != 2 || ids[0] != "a/b" && ids[1] != "a/b" {
+			t.Errorf("%s: ClientIDs = %q, %v", name, ids, err)
+		}
+		if err := store.Delete("a/b"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := store.Delete("a/b"); err != nil {
+			t.Errorf("%s: deleting missing session: %v", name, err)
+		}
+		if ids, _ := store.ClientIDs(); len(ids) != 1 || ids[0] != "c" {
+			t.Errorf("%s: ClientIDs after delete %q", name, ids)
+		}
+	}
+
+	// A message not completely appended before a crash is ignored.
+	f, _ := os.OpenFile(fstore.queuePath("c"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	f.WriteString(`{"Topic":"x/1"}` + "\n" + `{"Topic":"x/`)
+	f.Close()
+	if s, err := fstore.Load("c"); err != nil || len(s.Queue) != 1 || s.Queue[0].Topic != "x/1" {
+		t.Errorf("loaded %+v, %v with partially appended message", s, err)
+	}
+	// and truncated by the next Append.
+	if err := fstore.Append("c", Message{Topic: "x/2"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := fstore.Load("c"); err != nil || len(s.Queue) != 2 || s.Queue[0].Topic != "x/1" || s.Queue[1].Topic != "x/2" {
+		t.Errorf("loaded %+v, %v after appending to partially appended message", s, err)
+	}
+
+	// Files other than sessions are ignored.
+	os.WriteFile(filepath.Join(fstore.dir, "notes.txt"), nil, 0o644)
+	if ids, _ := fstore.ClientIDs(); len(ids) != 1 {
+		t.Errorf("ClientIDs with foreign files %q", ids)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build go1.21
+
+// Package mqttslog adapts the standard library's log/slog package to the
+// natiu-mqtt Logger interface. It lives in its own package so that the
+// base mqtt package does not depend on log/slog.
+package mqttslog
+
+import (
+	"context"
+	"log/slog"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+var _ mqtt.Logger = (*Logger)(nil)
+
+// Logger implements the mqtt.Logger interface by logging to a *slog.Logger.
+type Logger struct {
+	l *slog.Logger
+}
+
+// New returns a mqtt.Logger that logs to l. If l is nil slog.Default is used.
+func New(l *slog.Logger) *Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &Logger{l: l}
+}
+
+// Log implements the mqtt.Logger interface. mqtt log levels map directly to slog levels.
+func (lg *Logger) Log(level mqtt.LogLevel, msg string, keyvals ...any) {
+	lg.l.Log(context.Background(), slog.Level(level), msg, keyvals...)
+}
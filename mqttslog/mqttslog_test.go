@@ -0,0 +1,29 @@
+//go:build go1.21
+
+package mqttslog_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqttslog"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	logger := mqttslog.New(slog.New(h))
+	logger.Log(mqtt.LevelDebug, "filtered out")
+	logger.Log(mqtt.LevelWarn, "ignoring error", "err", errors.New("timeout"))
+	got := buf.String()
+	if strings.Contains(got, "filtered out") {
+		t.Error("debug message not filtered:", got)
+	}
+	if !strings.Contains(got, "level=WARN") || !strings.Contains(got, `msg="ignoring error"`) || !strings.Contains(got, "err=timeout") {
+		t.Error("unexpected log output:", got)
+	}
+}
@@ -0,0 +1,100 @@
+package mqttsn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// brokerDecoderSize is the size of the buffer topic names received from the broker are decoded into.
+const brokerDecoderSize = 4 * 1024
+
+var errNoConnack = errors.New("mqttsn: broker did not respond to CONNECT with CONNACK")
+
+// brokerConn is an MQTT connection of the gateway to the broker. It uses Rx and
+// Tx directly since mqtt.Client only publishes with QoS0, while the gateway
+// forwards PUBLISH from clients with their QoS and relays the broker's
+// acknowledgements. Methods writing to the broker are safe for concurrent use.
+type brokerConn struct {
+	conn net.Conn
+	// rx is only used by dialBroker and then by the reader of the connection.
+	rx   mqtt.Rx
+	txmu sync.Mutex
+	tx   mqtt.Tx
+}
+
+// dialBroker sends the CONNECT over conn and waits for the CONNACK. A refused
+// connection returns a *mqtt.ConnectError. conn is closed on error.
+func dialBroker(ctx context.Context, conn net.Conn, vc *mqtt.VariablesConnect, logger mqtt.Logger) (*brokerConn, error) {
+	bc := &brokerConn{conn: conn}
+	bc.rx.SetRxTransport(conn)
+	bc.rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, brokerDecoderSize)})
+	bc.rx.Logger = logger
+	bc.tx.SetTxTransport(conn)
+	bc.tx.Logger = logger
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline) // Reads are not interrupted when ctx is done.
+	err := bc.tx.WriteConnect(vc)
+	var pkt mqtt.Packet
+	if err == nil {
+		_, err = bc.rx.ReadPacket(&pkt)
+	}
+	switch {
+	case err != nil:
+	case pkt.Header.Type() != mqtt.PacketConnack:
+		err = errNoConnack
+	case pkt.Connack.ReturnCode != mqtt.ReturnCodeConnAccepted:
+		err = &mqtt.ConnectError{ReturnCode: pkt.Connack.ReturnCode}
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// publish sends a PUBLISH to the broker. The packet identifier is only sent with QoS1 and QoS2.
+func (bc *brokerConn) publish(qos mqtt.QoSLevel, dup, retain bool, vp mqtt.VariablesPublish, payload []byte) error {
+	flags, err := mqtt.NewPublishFlags(qos, dup, retain)
+	if err != nil {
+		return err
+	}
+	if err = vp.Validate(); err != nil {
+		return err
+	}
+	hdr, err := mqtt.NewHeader(mqtt.PacketPublish, flags, uint32(vp.Size(qos)+len(payload)))
+	if err != nil {
+		return err
+	}
+	bc.txmu.Lock()
+	defer bc.txmu.Unlock()
+	return bc.tx.WritePublishPayload(hdr, vp, payload)
+}
+
+// identified sends a PUBACK, PUBREC, PUBREL or PUBCOMP to the broker.
+func (bc *brokerConn) identified(packetType mqtt.PacketType, packetIdentifier uint16) error {
+	bc.txmu.Lock()
+	defer bc.txmu.Unlock()
+	return bc.tx.WriteIdentified(packetType, packetIdentifier)
+}
+
+func (bc *brokerConn) subscribe(vsub mqtt.VariablesSubscribe) error {
+	bc.txmu.Lock()
+	defer bc.txmu.Unlock()
+	return bc.tx.WriteSubscribe(vsub)
+}
+
+// disconnect sends a DISCONNECT to the broker and closes the connection so the
+// broker discards the Will.
+func (bc *brokerConn) disconnect() {
+	bc.txmu.Lock()
+	bc.tx.WriteSimple(mqtt.PacketDisconnect) // Connection closed regardless.
+	bc.txmu.Unlock()
+	bc.conn.Close()
+}
@@ -0,0 +1,634 @@
+package mqttsn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// Default retransmission parameters as suggested in MQTT-SN v1.2 section 6.13.
+const (
+	// DefaultRetryInterval is the time between retransmissions, Tretry.
+	DefaultRetryInterval = 10 * time.Second
+	// DefaultMaxRetries is the number of retransmissions before giving up, Nretry.
+	DefaultMaxRetries = 3
+)
+
+// DefaultBufferSize is the default size of the datagram receive buffer.
+const DefaultBufferSize = 1500
+
+var (
+	errNotConnected    = errors.New("mqttsn: client not connected")
+	errNotAsleep       = errors.New("mqttsn: client not asleep")
+	errNoResponse      = errors.New("mqttsn: gateway did not respond, client disconnected")
+	errGatewayClosed   = errors.New("mqttsn: gateway sent DISCONNECT")
+	errQoS2Unsupported = errors.New("mqttsn: client does not support publishing with QoS2")
+	errWildcardTopic   = errors.New("mqttsn: can't publish to a topic name with wildcards")
+	errMinus1Topic     = errors.New("mqttsn: QoS -1 requires a predefined or short topic")
+)
+
+// Topic references an MQTT-SN topic. Normal topics are referenced by Name and
+// registered topic ID, predefined topics by ID and short topics by their two
+// byte Name.
+type Topic struct {
+	Type TopicIDType
+	// ID is the topic ID of normal and predefined topics.
+	ID uint16
+	// Name is the topic name of normal and short topics.
+	Name string
+}
+
+// id returns the value of the topic ID field for t.
+func (t Topic) id() (uint16, error) {
+	if t.Type == TopicShort {
+		return ShortTopic(t.Name)
+	}
+	return t.ID, nil
+}
+
+// Will is the Will topic and message published by the gateway if the client
+// is disconnected unexpectedly.
+type Will struct {
+	Topic   string
+	Message []byte
+	QoS     QoSLevel
+	Retain  bool
+}
+
+// ConnectOptions are the contents of the CONNECT message and the Will of a client.
+type ConnectOptions struct {
+	// ClientID identifies the client to the gateway, 1 to 23 bytes long.
+	ClientID string
+	// KeepAlive is the keep alive duration in seconds.
+	KeepAlive    uint16
+	CleanSession bool
+	// Will is sent to the gateway during the connection if not nil.
+	Will *Will
+}
+
+// ClientConfig is used to configure a new Client.
+type ClientConfig struct {
+	// OnPub is executed on every PUBLISH received. topic is the topic name
+	// resolved from the topic ID, or nil if unknown. Byte slices are only valid
+	// during the call. Do not call Client methods from within this function.
+	OnPub func(topic []byte, msg *Message) error
+	// PredefinedTopics maps predefined topic IDs to topic names to resolve the topic
+	// of received PUBLISH messages.
+	PredefinedTopics map[uint16]string
+	// RetryInterval is the time waited for a response before retransmitting a
+	// request. If zero DefaultRetryInterval is used.
+	RetryInterval time.Duration
+	// MaxRetries is the number of retransmissions before the gateway is considered
+	// lost and the client disconnected. If zero DefaultMaxRetries is used.
+	MaxRetries int
+	// BufferSize is the size of the datagram receive buffer. Larger datagrams are
+	// truncated. If zero DefaultBufferSize is used.
+	BufferSize int
+}
+
+// clientState is the state of a client as described in MQTT-SN v1.2 section 6.14.
+type clientState uint8
+
+const (
+	stateDisconnected clientState = iota
+	stateActive
+	stateAsleep
+	stateAwake
+)
+
+// awaiting holds the response expected for the request in flight.
+type awaiting struct {
+	typ   MessageType
+	msgID uint16
+	done  bool
+	// resp holds the fields of the response without byte slices.
+	resp Message
+}
+
+// Client is an MQTT-SN v1.2 client over a datagram transport such as UDP.
+// Requests are retransmitted until a response is received or the retries are
+// exhausted, as is required on lossy links. It supports publishing with QoS -1,
+// 0 and 1 and receiving with QoS 0, 1 and 2.
+//
+// Client is not safe for concurrent use. Methods that wait for a response call
+// HandleNext to process incoming messages, which should otherwise be called in
+// a loop while connected to receive PUBLISH messages.
+type Client struct {
+	cfg   ClientConfig
+	conn  net.PacketConn
+	gw    net.Addr
+	state clientState
+	opts  ConnectOptions
+	err   error
+
+	rbuf   []byte
+	wbuf   []byte
+	msgID  uint16
+	await  awaiting
+	short  [2]byte
+	lastRx time.Time
+	lastTx time.Time
+
+	// topics maps registered topic IDs to names and names to IDs.
+	topics   map[uint16]string
+	topicIDs map[string]uint16
+	// pendingRel holds message IDs of QoS2 PUBLISH received and not yet released.
+	pendingRel map[uint16]bool
+}
+
+// NewClient creates a new MQTT-SN client.
+func NewClient(cfg ClientConfig) *Client {
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+	return &Client{
+		cfg:        cfg,
+		rbuf:       make([]byte, cfg.BufferSize),
+		err:        errors.New("yet to connect"),
+		topics:     make(map[uint16]string),
+		topicIDs:   make(map[string]uint16),
+		pendingRel: make(map[uint16]bool),
+	}
+}
+
+// Connect sends a CONNECT message to the gateway over conn and waits for the
+// CONNACK. If opts has a Will it is sent when requested by the gateway.
+// conn is not closed by the client.
+func (c *Client) Connect(ctx context.Context, conn net.PacketConn, gateway net.Addr, opts *ConnectOptions) error {
+	flags := Flags(0)
+	if opts.CleanSession {
+		flags |= FlagCleanSession
+	}
+	if opts.Will != nil {
+		flags |= FlagWill
+	}
+	c.conn = conn
+	c.gw = gateway
+	c.opts = *opts
+	if opts.CleanSession {
+		c.clearTopics()
+	}
+	resp, err := c.request(ctx, &Message{
+		Type:     MsgConnect,
+		Flags:    flags,
+		Duration: opts.KeepAlive,
+		ClientID: []byte(opts.ClientID),
+	}, MsgConnack)
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != ReturnCodeAccepted {
+		return &RejectedError{Type: MsgConnack, ReturnCode: resp.ReturnCode}
+	}
+	c.state = stateActive
+	c.err = nil
+	return nil
+}
+
+// IsConnected returns true if the client is in the active state.
+func (c *Client) IsConnected() bool { return c.state == stateActive }
+
+// IsAsleep returns true if the client is in the asleep state, see [Client.Sleep].
+func (c *Client) IsAsleep() bool { return c.state == stateAsleep || c.state == stateAwake }
+
+// Err returns the cause of the last disconnection.
+func (c *Client) Err() error { return c.err }
+
+// LastRx returns the time the last message was received from the gateway.
+func (c *Client) LastRx() time.Time { return c.lastRx }
+
+// LastTx returns the time the last message was sent to the gateway.
+func (c *Client) LastTx() time.Time { return c.lastTx }
+
+// Register requests a topic ID for topic name and returns it. The topic is
+// registered for the duration of the session and used by Publish.
+func (c *Client) Register(ctx context.Context, name string) (uint16, error) {
+	if !c.IsConnected() {
+		return 0, errNotConnected
+	}
+	resp, err := c.request(ctx, &Message{
+		Type:      MsgRegister,
+		MessageID: c.nextMessageID(),
+		TopicName: []byte(name),
+	}, MsgRegack)
+	if err != nil {
+		return 0, err
+	}
+	if resp.ReturnCode != ReturnCodeAccepted {
+		return 0, &RejectedError{Type: MsgRegack, ReturnCode: resp.ReturnCode}
+	}
+	c.setTopic(resp.TopicID, name)
+	return resp.TopicID, nil
+}
+
+// Publish publishes data to topic. Normal topics without an ID are registered
+// first. QoS0 returns after sending the message, QoS1 waits for the PUBACK.
+func (c *Client) Publish(ctx context.Context, topic Topic, qos QoSLevel, retain bool, data []byte) error {
+	if qos == QoSMinus1 {
+		if c.conn == nil {
+			return errNotConnected
+		}
+		return PublishMinus1(c.conn, c.gw, topic, retain, data)
+	} else if qos == QoS2 {
+		return errQoS2Unsupported
+	}
+	if !c.IsConnected() {
+		return errNotConnected
+	}
+	if topic.Type == TopicNormal && topic.ID == 0 {
+		if hasWildcards(topic.Name) {
+			return errWildcardTopic
+		}
+		id, ok := c.topicIDs[topic.Name]
+		if !ok {
+			var err error
+			id, err = c.Register(ctx, topic.Name)
+			if err != nil {
+				return err
+			}
+		}
+		topic.ID = id
+	}
+	m, err := newPublish(topic, qos, retain, data)
+	if err != nil {
+		return err
+	}
+	if qos == QoS0 {
+		return c.send(&m)
+	}
+	m.MessageID = c.nextMessageID()
+	resp, err := c.request(ctx, &m, MsgPuback)
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != ReturnCodeAccepted {
+		if resp.ReturnCode == ReturnCodeInvalidTopicID && topic.Type == TopicNormal {
+			c.deleteTopic(topic.ID) // Must register again as per section 6.10.
+		}
+		return &RejectedError{Type: MsgPuback, ReturnCode: resp.ReturnCode}
+	}
+	return nil
+}
+
+// PublishMinus1 publishes data with QoS -1 to a predefined or short topic on
+// the gateway at addr without a connection. The gateway does not acknowledge it.
+func PublishMinus1(conn net.PacketConn, addr net.Addr, topic Topic, retain bool, data []byte) error {
+	if topic.Type == TopicNormal {
+		return errMinus1Topic
+	}
+	m, err := newPublish(topic, QoSMinus1, retain, data)
+	if err != nil {
+		return err
+	}
+	b, err := m.Append(nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(b, addr)
+	return err
+}
+
+func newPublish(topic Topic, qos QoSLevel, retain bool, data []byte) (Message, error) {
+	flags, err := NewFlags(qos, topic.Type)
+	if err != nil {
+		return Message{}, err
+	}
+	if retain {
+		flags |= FlagRetain
+	}
+	id, err := topic.id()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgPublish, Flags: flags, TopicID: id, Data: data}, nil
+}
+
+// Subscribe subscribes to topic with the requested QoS. Normal topic names may
+// contain wildcards. It returns the QoS granted by the gateway and the topic ID
+// assigned to normal topic names without wildcards, which is zero otherwise.
+func (c *Client) Subscribe(ctx context.Context, topic Topic, qos QoSLevel) (topicID uint16, granted QoSLevel, err error) {
+	if !c.IsConnected() {
+		return 0, 0, errNotConnected
+	}
+	m, err := c.topicMessage(MsgSubscribe, topic, qos)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := c.request(ctx, &m, MsgSuback)
+	if err != nil {
+		return 0, 0, err
+	}
+	if resp.ReturnCode != ReturnCodeAccepted {
+		return 0, 0, &RejectedError{Type: MsgSuback, ReturnCode: resp.ReturnCode}
+	}
+	if topic.Type == TopicNormal && resp.TopicID != 0 {
+		c.setTopic(resp.TopicID, topic.Name)
+	}
+	return resp.TopicID, resp.Flags.QoS(), nil
+}
+
+// Unsubscribe cancels the subscription to topic.
+func (c *Client) Unsubscribe(ctx context.Context, topic Topic) error {
+	if !c.IsConnected() {
+		return errNotConnected
+	}
+	m, err := c.topicMessage(MsgUnsubscribe, topic, QoS0)
+	if err != nil {
+		return err
+	}
+	_, err = c.request(ctx, &m, MsgUnsuback)
+	return err
+}
+
+// topicMessage returns a SUBSCRIBE or UNSUBSCRIBE message for topic.
+func (c *Client) topicMessage(tp MessageType, topic Topic, qos QoSLevel) (Message, error) {
+	flags, err := NewFlags(qos, topic.Type)
+	if err != nil {
+		return Message{}, err
+	}
+	m := Message{Type: tp, Flags: flags, MessageID: c.nextMessageID()}
+	if topic.Type == TopicNormal {
+		m.TopicName = []byte(topic.Name)
+	} else {
+		m.TopicID, err = topic.id()
+	}
+	return m, err
+}
+
+// Ping sends a PINGREQ to the gateway and waits for the PINGRESP.
+func (c *Client) Ping(ctx context.Context) error {
+	if !c.IsConnected() {
+		return errNotConnected
+	}
+	_, err := c.request(ctx, &Message{Type: MsgPingreq}, MsgPingresp)
+	return err
+}
+
+// Sleep informs the gateway the client goes to sleep for duration seconds.
+// The gateway buffers messages for the client until it wakes up with [Client.Awake]
+// or connects again. The client must call Awake or Connect before duration ends.
+func (c *Client) Sleep(ctx context.Context, duration uint16) error {
+	if !c.IsConnected() {
+		return errNotConnected
+	}
+	if duration == 0 {
+		return errors.New("mqttsn: zero sleep duration")
+	}
+	_, err := c.request(ctx, &Message{Type: MsgDisconnect, Duration: duration}, MsgDisconnect)
+	if err != nil {
+		return err
+	}
+	c.state = stateAsleep
+	return nil
+}
+
+// Awake wakes up a sleeping client to receive the messages buffered by the
+// gateway, which are passed to OnPub. It returns when the gateway sends PINGRESP
+// after which the client is asleep again.
+func (c *Client) Awake(ctx context.Context) error {
+	if !c.IsAsleep() {
+		return errNotAsleep
+	}
+	c.state = stateAwake
+	_, err := c.request(ctx, &Message{Type: MsgPingreq, ClientID: []byte(c.opts.ClientID)}, MsgPingresp)
+	if c.state == stateAwake {
+		c.state = stateAsleep
+	}
+	return err
+}
+
+// Disconnect sends a DISCONNECT to the gateway and waits for its DISCONNECT
+// response. The client is disconnected even if the gateway does not respond.
+// The transport is not closed.
+func (c *Client) Disconnect(ctx context.Context) error {
+	if c.state == stateDisconnected {
+		return errNotConnected
+	}
+	_, err := c.request(ctx, &Message{Type: MsgDisconnect}, MsgDisconnect)
+	c.disconnect(errors.New("disconnected by client"))
+	return err
+}
+
+// HandleNext reads and handles the next datagram from the gateway. Datagrams
+// from other addresses and malformed messages are ignored. It returns the
+// transport error, i.e. when the read deadline expires, the error returned by OnPub
+// or an error if the gateway disconnects the client.
+func (c *Client) HandleNext() error {
+	if c.conn == nil {
+		return errNotConnected
+	}
+	n, addr, err := c.conn.ReadFrom(c.rbuf)
+	if err != nil {
+		return err
+	}
+	if addr.String() != c.gw.String() {
+		return nil
+	}
+	var m Message
+	err = m.Decode(c.rbuf[:n])
+	if err != nil {
+		return nil // Ignore malformed datagrams, the link is lossy.
+	}
+	c.lastRx = time.Now()
+	return c.handle(&m)
+}
+
+func (c *Client) handle(m *Message) error {
+	if c.await.matches(m) {
+		c.await.done = true
+		c.await.resp = Message{
+			Type:       m.Type,
+			Flags:      m.Flags,
+			Duration:   m.Duration,
+			TopicID:    m.TopicID,
+			MessageID:  m.MessageID,
+			ReturnCode: m.ReturnCode,
+		}
+		return nil
+	}
+	switch m.Type {
+	case MsgPublish:
+		return c.handlePublish(m)
+	case MsgPubrel:
+		delete(c.pendingRel, m.MessageID)
+		return c.send(&Message{Type: MsgPubcomp, MessageID: m.MessageID})
+	case MsgRegister:
+		c.setTopic(m.TopicID, string(m.TopicName))
+		return c.send(&Message{Type: MsgRegack, TopicID: m.TopicID, MessageID: m.MessageID})
+	case MsgPingreq:
+		return c.send(&Message{Type: MsgPingresp})
+	case MsgWillTopicReq:
+		will := Message{Type: MsgWillTopic}
+		if w := c.opts.Will; w != nil {
+			will.Flags, _ = NewFlags(w.QoS, TopicNormal)
+			if w.Retain {
+				will.Flags |= FlagRetain
+			}
+			will.TopicName = []byte(w.Topic)
+		}
+		return c.send(&will)
+	case MsgWillMsgReq:
+		var data []byte
+		if c.opts.Will != nil {
+			data = c.opts.Will.Message
+		}
+		return c.send(&Message{Type: MsgWillMsg, Data: data})
+	case MsgDisconnect:
+		c.disconnect(errGatewayClosed)
+		return errGatewayClosed
+	}
+	return nil
+}
+
+func (c *Client) handlePublish(m *Message) error {
+	var topic []byte
+	switch m.Flags.TopicIDType() {
+	case TopicNormal:
+		name, ok := c.topics[m.TopicID]
+		if !ok {
+			// Reject so gateway registers the topic as per section 6.10.
+			return c.send(&Message{Type: MsgPuback, TopicID: m.TopicID, MessageID: m.MessageID, ReturnCode: ReturnCodeInvalidTopicID})
+		}
+		topic = []byte(name)
+	case TopicPredefined:
+		if name, ok := c.cfg.PredefinedTopics[m.TopicID]; ok {
+			topic = []byte(name)
+		}
+	case TopicShort:
+		c.short = [2]byte{byte(m.TopicID >> 8), byte(m.TopicID)}
+		topic = c.short[:]
+	}
+	qos := m.Flags.QoS()
+	duplicate := qos == QoS2 && c.pendingRel[m.MessageID]
+	if c.cfg.OnPub != nil && !duplicate {
+		err := c.cfg.OnPub(topic, m)
+		if err != nil {
+			return err
+		}
+	}
+	switch qos {
+	case QoS1:
+		return c.send(&Message{Type: MsgPuback, TopicID: m.TopicID, MessageID: m.MessageID})
+	case QoS2:
+		c.pendingRel[m.MessageID] = true
+		return c.send(&Message{Type: MsgPubrec, MessageID: m.MessageID})
+	}
+	return nil
+}
+
+// matches reports whether m is the response awaited.
+func (a *awaiting) matches(m *Message) bool {
+	if a.done || a.typ != m.Type {
+		return false
+	}
+	switch m.Type {
+	case MsgRegack, MsgPuback, MsgSuback, MsgUnsuback:
+		return m.MessageID == a.msgID
+	}
+	return true
+}
+
+// request sends m and handles incoming messages until a message of type resp
+// is received, retransmitting m every RetryInterval. If no response arrives
+// after MaxRetries retransmissions the client is disconnected.
+func (c *Client) request(ctx context.Context, m *Message, resp MessageType) (Message, error) {
+	c.await = awaiting{typ: resp, msgID: m.MessageID}
+	defer c.conn.SetReadDeadline(time.Time{})
+	for retries := 0; ; retries++ {
+		err := c.send(m)
+		if err != nil {
+			return Message{}, err
+		}
+		deadline := time.Now().Add(c.cfg.RetryInterval)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		c.conn.SetReadDeadline(deadline)
+		for !c.await.done {
+			err = c.HandleNext()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			} else if err != nil {
+				return Message{}, err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if c.await.done {
+			return c.await.resp, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+		if retries == c.cfg.MaxRetries {
+			c.disconnect(errNoResponse)
+			return Message{}, errNoResponse
+		}
+		if m.Type == MsgPublish || m.Type == MsgSubscribe {
+			m.Flags |= FlagDup
+		}
+	}
+}
+
+func (c *Client) send(m *Message) error {
+	var err error
+	c.wbuf, err = m.Append(c.wbuf[:0])
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteTo(c.wbuf, c.gw)
+	if err == nil {
+		c.lastTx = time.Now()
+	}
+	return err
+}
+
+func (c *Client) disconnect(err error) {
+	c.state = stateDisconnected
+	c.err = err
+}
+
+func (c *Client) nextMessageID() uint16 {
+	c.msgID++
+	if c.msgID == 0 {
+		c.msgID = 1
+	}
+	return c.msgID
+}
+
+func (c *Client) setTopic(id uint16, name string) {
+	if old, ok := c.topics[id]; ok {
+		delete(c.topicIDs, old)
+	}
+	c.topics[id] = name
+	c.topicIDs[name] = id
+}
+
+func (c *Client) deleteTopic(id uint16) {
+	delete(c.topicIDs, c.topics[id])
+	delete(c.topics, id)
+}
+
+func (c *Client) clearTopics() {
+	for id := range c.topics {
+		c.deleteTopic(id)
+	}
+}
+
+func hasWildcards(topic string) bool {
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '+' || topic[i] == '#' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+// Package mqttsn implements MQTT-SN v1.2, MQTT for Sensor Networks, for
+// battery powered devices on lossy datagram links such as UDP over 6LoWPAN or ZigBee.
+//
+// MQTT-SN replaces topic names with 2 byte topic IDs registered with REGISTER
+// or known in advance (predefined), or with 2 character short topic names.
+// Clients may sleep while the gateway buffers their messages.
+//
+// [Message] encodes and decodes all messages without allocating. [Client]
+// connects to a gateway over any [net.PacketConn] and [Gateway] bridges clients
+// onto an MQTT broker.
+package mqttsn
+
+import "strconv"
+
+// ProtocolID is the protocol identifier of MQTT-SN v1.2 sent in CONNECT.
+const ProtocolID = 0x01
+
+// MessageType identifies an MQTT-SN message. It is the second field of the
+// message header after the length.
+type MessageType uint8
+
+const (
+	// MsgAdvertise (ADVERTISE) is broadcast periodically by gateways to advertise their presence.
+	MsgAdvertise MessageType = 0x00
+	// MsgSearchGW (SEARCHGW) is broadcast by clients searching for a gateway.
+	MsgSearchGW MessageType = 0x01
+	// MsgGWInfo (GWINFO) is the response to a SEARCHGW sent by gateways or other clients.
+	MsgGWInfo MessageType = 0x02
+	// MsgConnect (CONNECT) is sent by a client to set up a connection with a gateway.
+	MsgConnect MessageType = 0x04
+	// MsgConnack (CONNACK) is the response of a gateway to CONNECT.
+	MsgConnack MessageType = 0x05
+	// MsgWillTopicReq (WILLTOPICREQ) is sent by the gateway to request the Will topic of a connecting client.
+	MsgWillTopicReq MessageType = 0x06
+	// MsgWillTopic (WILLTOPIC) is the response to WILLTOPICREQ.
+	MsgWillTopic MessageType = 0x07
+	// MsgWillMsgReq (WILLMSGREQ) is sent by the gateway to request the Will message of a connecting client.
+	MsgWillMsgReq MessageType = 0x08
+	// MsgWillMsg (WILLMSG) is the response to WILLMSGREQ.
+	MsgWillMsg MessageType = 0x09
+	// MsgRegister (REGISTER) is sent by a client to request a topic ID for a topic name, or by
+	// a gateway to inform a client of the topic ID of a PUBLISH it is about to send.
+	MsgRegister MessageType = 0x0a
+	// MsgRegack (REGACK) is the response to REGISTER.
+	MsgRegack MessageType = 0x0b
+	// MsgPublish (PUBLISH) carries an application message. The topic is referenced by topic ID or short topic name.
+	MsgPublish MessageType = 0x0c
+	// MsgPuback (PUBACK) is the response to PUBLISH with QoS1 or to a PUBLISH rejected due to an invalid topic ID.
+	MsgPuback MessageType = 0x0d
+	// MsgPubcomp (PUBCOMP) is the fourth message of the QoS2 exchange.
+	MsgPubcomp MessageType = 0x0e
+	// MsgPubrec (PUBREC) is the second message of the QoS2 exchange.
+	MsgPubrec MessageType = 0x0f
+	// MsgPubrel (PUBREL) is the third message of the QoS2 exchange.
+	MsgPubrel MessageType = 0x10
+	// MsgSubscribe (SUBSCRIBE) is sent by a client to subscribe to a topic name, predefined topic ID or short topic name.
+	MsgSubscribe MessageType = 0x12
+	// MsgSuback (SUBACK) is the response to SUBSCRIBE.
+	MsgSuback MessageType = 0x13
+	// MsgUnsubscribe (UNSUBSCRIBE) is sent by a client to cancel a subscription.
+	MsgUnsubscribe MessageType = 0x14
+	// MsgUnsuback (UNSUBACK) is the response to UNSUBSCRIBE.
+	MsgUnsuback MessageType = 0x15
+	// MsgPingreq (PINGREQ) is a keep alive request. Sleeping clients send PINGREQ with their
+	// client ID to wake up and receive buffered messages.
+	MsgPingreq MessageType = 0x16
+	// MsgPingresp (PINGRESP) is the response to PINGREQ.
+	MsgPingresp MessageType = 0x17
+	// MsgDisconnect (DISCONNECT) ends a connection. A client DISCONNECT with a duration puts the client to sleep.
+	MsgDisconnect MessageType = 0x18
+	// MsgWillTopicUpd (WILLTOPICUPD) is sent by a client to update its Will topic.
+	MsgWillTopicUpd MessageType = 0x1a
+	// MsgWillTopicResp (WILLTOPICRESP) is the response to WILLTOPICUPD.
+	MsgWillTopicResp MessageType = 0x1b
+	// MsgWillMsgUpd (WILLMSGUPD) is sent by a client to update its Will message.
+	MsgWillMsgUpd MessageType = 0x1c
+	// MsgWillMsgResp (WILLMSGRESP) is the response to WILLMSGUPD.
+	MsgWillMsgResp MessageType = 0x1d
+)
+
+// String returns the message type name in capitals as in the MQTT-SN specification.
+// Does not allocate memory.
+func (mt MessageType) String() string {
+	switch mt {
+	case MsgAdvertise:
+		return "ADVERTISE"
+	case MsgSearchGW:
+		return "SEARCHGW"
+	case MsgGWInfo:
+		return "GWINFO"
+	case MsgConnect:
+		return "CONNECT"
+	case MsgConnack:
+		return "CONNACK"
+	case MsgWillTopicReq:
+		return "WILLTOPICREQ"
+	case MsgWillTopic:
+		return "WILLTOPIC"
+	case MsgWillMsgReq:
+		return "WILLMSGREQ"
+	case MsgWillMsg:
+		return "WILLMSG"
+	case MsgRegister:
+		return "REGISTER"
+	case MsgRegack:
+		return "REGACK"
+	case MsgPublish:
+		return "PUBLISH"
+	case MsgPuback:
+		return "PUBACK"
+	case MsgPubcomp:
+		return "PUBCOMP"
+	case MsgPubrec:
+		return "PUBREC"
+	case MsgPubrel:
+		return "PUBREL"
+	case MsgSubscribe:
+		return "SUBSCRIBE"
+	case MsgSuback:
+		return "SUBACK"
+	case MsgUnsubscribe:
+		return "UNSUBSCRIBE"
+	case MsgUnsuback:
+		return "UNSUBACK"
+	case MsgPingreq:
+		return "PINGREQ"
+	case MsgPingresp:
+		return "PINGRESP"
+	case MsgDisconnect:
+		return "DISCONNECT"
+	case MsgWillTopicUpd:
+		return "WILLTOPICUPD"
+	case MsgWillTopicResp:
+		return "WILLTOPICRESP"
+	case MsgWillMsgUpd:
+		return "WILLMSGUPD"
+	case MsgWillMsgResp:
+		return "WILLMSGRESP"
+	}
+	return "UNKNOWN"
+}
+
+// IsValid returns true if mt is a message type defined by MQTT-SN v1.2.
+// The encapsulated message type 0xfe used by forwarders is not supported.
+func (mt MessageType) IsValid() bool {
+	// 0x03, 0x11 and 0x19 are reserved.
+	return mt <= MsgWillMsgResp && mt != 0x03 && mt != 0x11 && mt != 0x19
+}
+
+// QoSLevel is the quality of service of a PUBLISH or subscription. MQTT-SN
+// adds QoS -1 to the levels of MQTT with which clients publish to predefined or
+// short topics without connecting to the gateway.
+type QoSLevel int8
+
+const (
+	// QoS0 is at most once delivery.
+	QoS0 QoSLevel = 0
+	// QoS1 is at least once delivery. PUBLISH is acknowledged with PUBACK.
+	QoS1 QoSLevel = 1
+	// QoS2 is exactly once delivery with the PUBREC, PUBREL and PUBCOMP exchange.
+	QoS2 QoSLevel = 2
+	// QoSMinus1 publishes without a connection. Also known as QoS3.
+	QoSMinus1 QoSLevel = -1
+)
+
+// IsValid returns true if qos is one of -1, 0, 1 or 2.
+func (qos QoSLevel) IsValid() bool { return qos >= QoSMinus1 && qos <= QoS2 }
+
+// TopicIDType indicates how a topic is referenced in PUBLISH, SUBSCRIBE and UNSUBSCRIBE.
+type TopicIDType uint8
+
+const (
+	// TopicNormal is a topic ID registered with REGISTER or SUBACK. SUBSCRIBE and
+	// UNSUBSCRIBE carry a topic name instead.
+	TopicNormal TopicIDType = 0b00
+	// TopicPredefined is a topic ID known in advance by client and gateway.
+	TopicPredefined TopicIDType = 0b01
+	// TopicShort is a topic name of exactly two characters carried in the topic ID field.
+	TopicShort TopicIDType = 0b10
+)
+
+// String returns a human readable name of the topic ID type. Does not allocate memory.
+func (tt TopicIDType) String() string {
+	switch tt {
+	case TopicNormal:
+		return "normal"
+	case TopicPredefined:
+		return "predefined"
+	case TopicShort:
+		return "short"
+	}
+	return "reserved"
+}
+
+// Flags is the flags field of CONNECT, WILLTOPIC, PUBLISH, SUBSCRIBE, SUBACK and UNSUBSCRIBE messages.
+type Flags uint8
+
+const (
+	// FlagDup is set when a PUBLISH or SUBSCRIBE is retransmitted.
+	FlagDup Flags = 0x80
+	// FlagRetain is the retain flag of PUBLISH and WILLTOPIC.
+	FlagRetain Flags = 0x10
+	// FlagWill is set in CONNECT when the client wishes to set a Will topic and message.
+	FlagWill Flags = 0x08
+	// FlagCleanSession is the clean session flag of CONNECT.
+	FlagCleanSession Flags = 0x04
+
+	flagsQoSMask  Flags = 0x60
+	flagsTopicIDs Flags = 0x03
+)
+
+// NewFlags returns flags with the given QoS and topic ID type set.
+func NewFlags(qos QoSLevel, topicType TopicIDType) (Flags, error) {
+	if !qos.IsValid() {
+		return 0, errInvalidQoS
+	}
+	if topicType > TopicShort {
+		return 0, errInvalidTopicIDType
+	}
+	return Flags(qos&0b11)<<5 | Flags(topicType), nil
+}
+
+// QoS returns the QoS level of the flags. Does not allocate memory.
+func (f Flags) QoS() QoSLevel {
+	qos := QoSLevel(f&flagsQoSMask) >> 5
+	if qos == 0b11 {
+		return QoSMinus1
+	}
+	return qos
+}
+
+// TopicIDType returns the type of the topic ID referenced in the message.
+func (f Flags) TopicIDType() TopicIDType { return TopicIDType(f & flagsTopicIDs) }
+
+// Dup returns true if the DUP flag is set.
+func (f Flags) Dup() bool { return f&FlagDup != 0 }
+
+// Retain returns true if the retain flag is set.
+func (f Flags) Retain() bool { return f&FlagRetain != 0 }
+
+// Will returns true if the Will flag is set.
+func (f Flags) Will() bool { return f&FlagWill != 0 }
+
+// CleanSession returns true if the clean session flag is set.
+func (f Flags) CleanSession() bool { return f&FlagCleanSession != 0 }
+
+// ReturnCode is the return code of CONNACK, REGACK, PUBACK, SUBACK, WILLTOPICRESP
+// and WILLMSGRESP messages. ReturnCode implements the error interface.
+type ReturnCode uint8
+
+const (
+	// ReturnCodeAccepted indicates the request was accepted.
+	ReturnCodeAccepted ReturnCode = iota
+	// ReturnCodeCongestion indicates the request was rejected due to congestion
+	// and may be retried later.
+	ReturnCodeCongestion
+	// ReturnCodeInvalidTopicID indicates the topic ID is not registered or predefined.
+	ReturnCodeInvalidTopicID
+	// ReturnCodeNotSupported indicates the request is not supported by the receiver.
+	ReturnCodeNotSupported
+)
+
+// String returns a human readable description of the return code. Does not allocate memory.
+func (rc ReturnCode) String() string {
+	switch rc {
+	case ReturnCodeAccepted:
+		return "accepted"
+	case ReturnCodeCongestion:
+		return "rejected: congestion"
+	case ReturnCodeInvalidTopicID:
+		return "rejected: invalid topic ID"
+	case ReturnCodeNotSupported:
+		return "rejected: not supported"
+	}
+	return "rejected: reserved return code"
+}
+
+// Error implements the error interface.
+func (rc ReturnCode) Error() string { return rc.String() }
+
+// RejectedError is returned by the Client when the gateway rejects a request.
+type RejectedError struct {
+	// Type is the type of the response message, i.e. CONNACK.
+	Type       MessageType
+	ReturnCode ReturnCode
+}
+
+// Error implements the error interface.
+func (re *RejectedError) Error() string {
+	return "mqttsn: " + re.Type.String() + " " + re.ReturnCode.String() + " (" + strconv.Itoa(int(re.ReturnCode)) + ")"
+}
+
+// Unwrap returns the ReturnCode so it can be checked with errors.Is.
+func (re *RejectedError) Unwrap() error { return re.ReturnCode }
+
+// ShortTopic returns the topic ID of a short topic name, which must be exactly
+// two bytes long, i.e: "t1".
+func ShortTopic(name string) (uint16, error) {
+	if len(name) != 2 {
+		return 0, errShortTopicLen
+	}
+	return uint16(name[0])<<8 | uint16(name[1]), nil
+}
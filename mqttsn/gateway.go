@@ -0,0 +1,954 @@
+package mqttsn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+// DefaultMaxBuffered is the default number of messages a Gateway buffers for a sleeping client.
+const DefaultMaxBuffered = 64
+
+var (
+	errSessionReplaced = errors.New("mqttsn: client connected again")
+	errGatewayStopped  = errors.New("mqttsn: gateway stopped")
+)
+
+// GatewayConfig is used to configure a new Gateway.
+type GatewayConfig struct {
+	// Dial opens a connection to the MQTT broker. It is called once for every
+	// client that connects to the gateway and must not be nil.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// GatewayID is sent in GWINFO responses to SEARCHGW.
+	GatewayID uint8
+	// ClientID is the client identifier of the broker connection of the gateway
+	// itself, over which QoS -1 PUBLISH are forwarded. If empty "mqttsn-gateway-"
+	// followed by GatewayID is used.
+	ClientID string
+	// PredefinedTopics maps predefined topic IDs known to clients to topic names.
+	PredefinedTopics map[uint16]string
+	// MaxBuffered is the number of PUBLISH messages buffered for a sleeping
+	// client after which the oldest are dropped. If zero DefaultMaxBuffered is used.
+	MaxBuffered int
+	// ConnectTimeout bounds dialing and connecting to the broker. If zero
+	// DefaultRetryInterval is used.
+	ConnectTimeout time.Duration
+	// BufferSize is the size of the datagram receive buffer. Larger datagrams are
+	// truncated. If zero DefaultBufferSize is used.
+	BufferSize int
+	// Logger receives diagnostic messages from the gateway and the broker connections.
+	// If nil nothing is logged.
+	Logger mqtt.Logger
+}
+
+// Gateway is a transparent MQTT-SN v1.2 gateway. Every client that connects is
+// bridged onto the broker over its own MQTT 3.1.1 connection.
+// REGISTER, PUBLISH and SUBSCRIBE are translated into MQTT packets with full
+// topic names, and PUBLISH packets from the broker are sent to the client with
+// a topic ID, registering the topic with the client first if needed. Messages
+// for sleeping clients are buffered until they wake up.
+//
+// PUBLISH from clients are forwarded to the broker with their QoS and are only
+// acknowledged to the client once the broker acknowledges them: PUBACK follows
+// the broker's PUBACK, and PUBREC and PUBCOMP of QoS2 follow the broker's PUBREC
+// and PUBCOMP. Subscriptions are made and granted with QoS0. UNSUBSCRIBE
+// stops the delivery of matching messages to the client but the broker
+// subscription remains until the client disconnects. QoS -1 PUBLISH to
+// predefined and short topics from clients without a connection are forwarded
+// with QoS0 over the gateway's own broker connection, which is dialed on the
+// first QoS -1 PUBLISH and identified by GatewayConfig.ClientID.
+//
+// Keep alive of clients is supervised by the gateway, which closes the broker
+// connection without a DISCONNECT when a client is lost so the broker publishes
+// its Will. Keep alive is disabled on broker connections so sleeping clients
+// keep their session.
+type Gateway struct {
+	cfg  GatewayConfig
+	conn net.PacketConn
+	wbuf []byte
+
+	mu sync.Mutex
+	// sessions maps client addresses to sessions.
+	sessions map[string]*session
+
+	// minus1mu guards the broker connection used to forward QoS -1 PUBLISH.
+	minus1mu sync.Mutex
+	minus1   *brokerConn
+	stopped  bool
+}
+
+// NewGateway creates a new MQTT-SN gateway. Call [Gateway.Serve] to start it.
+func NewGateway(cfg GatewayConfig) *Gateway {
+	if cfg.Dial == nil {
+		panic("mqttsn: nil Dial in GatewayConfig")
+	}
+	if cfg.MaxBuffered <= 0 {
+		cfg.MaxBuffered = DefaultMaxBuffered
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = DefaultRetryInterval
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "mqttsn-gateway-" + strconv.Itoa(int(cfg.GatewayID))
+	}
+	return &Gateway{cfg: cfg, sessions: make(map[string]*session)}
+}
+
+// Serve serves MQTT-SN clients on conn until reading from conn fails, i.e: after
+// conn is closed, and returns the read error. The broker connections of all
+// clients are disconnected before Serve returns. Serve must be called once.
+func (g *Gateway) Serve(conn net.PacketConn) error {
+	g.conn = conn
+	buf := make([]byte, g.cfg.BufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			g.stop()
+			return err
+		}
+		var m Message
+		err = m.Decode(buf[:n])
+		if err != nil {
+			g.log(mqtt.LevelDebug, "ignoring malformed datagram", "addr", addr.String(), "err", err)
+			continue
+		}
+		g.handle(addr, &m)
+	}
+}
+
+// Clients returns the client identifiers of clients connected or asleep.
+func (g *Gateway) Clients() (clientIDs []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, s := range g.sessions {
+		clientIDs = append(clientIDs, s.clientID)
+	}
+	return clientIDs
+}
+
+// handle handles a message received by Serve. m is only valid during the call.
+func (g *Gateway) handle(addr net.Addr, m *Message) {
+	switch m.Type {
+	case MsgAdvertise, MsgGWInfo:
+		return // Sent by other gateways.
+	case MsgSearchGW:
+		g.reply(addr, &Message{Type: MsgGWInfo, GatewayID: g.cfg.GatewayID})
+		return
+	case MsgConnect:
+		g.connect(addr, m)
+		return
+	}
+	g.mu.Lock()
+	s := g.sessions[addr.String()]
+	if s == nil && m.Type == MsgPingreq && len(m.ClientID) != 0 {
+		// Sleeping client woke up with a new address.
+		s = g.rebind(addr, string(m.ClientID))
+	}
+	g.mu.Unlock()
+	if s != nil {
+		s.handle(addr, m)
+		return
+	}
+	if m.Type == MsgPublish && m.Flags.QoS() == QoSMinus1 {
+		g.publishMinus1(addr, m)
+		return
+	}
+	// Unknown client, possibly after its session expired. It must connect again.
+	g.reply(addr, &Message{Type: MsgDisconnect})
+}
+
+// connect handles a CONNECT, which either resumes the session of a client that
+// slept or lost the CONNACK, or starts a new session.
+func (g *Gateway) connect(addr net.Addr, m *Message) {
+	clientID := string(m.ClientID)
+	g.mu.Lock()
+	s := g.sessions[addr.String()]
+	if s == nil || s.clientID != clientID {
+		s = g.rebind(addr, clientID)
+	}
+	g.mu.Unlock()
+	if s != nil {
+		if s.resume(addr, m) {
+			return
+		}
+		g.remove(s)
+		s.close(true, errSessionReplaced)
+	}
+
+	s = newSession(g, addr, clientID)
+	g.mu.Lock()
+	old := g.sessions[s.key]
+	g.sessions[s.key] = s
+	g.mu.Unlock()
+	if old != nil {
+		// Another client had the address.
+		old.close(true, errSessionReplaced)
+	}
+	s.connect(m)
+}
+
+// rebind returns the session of clientID moved to addr or nil if there is none.
+// g.mu must be held.
+func (g *Gateway) rebind(addr net.Addr, clientID string) *session {
+	for key, s := range g.sessions {
+		if s.clientID == clientID {
+			delete(g.sessions, key)
+			s.key = addr.String()
+			g.sessions[s.key] = s
+			return s
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) remove(s *session) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sessions[s.key] == s {
+		delete(g.sessions, s.key)
+	}
+}
+
+// stop disconnects all sessions and the broker connection of the gateway.
+func (g *Gateway) stop() {
+	g.mu.Lock()
+	sessions := g.sessions
+	g.sessions = make(map[string]*session)
+	g.mu.Unlock()
+	for _, s := range sessions {
+		s.close(true, errGatewayStopped)
+	}
+	g.minus1mu.Lock()
+	defer g.minus1mu.Unlock()
+	g.stopped = true
+	if g.minus1 != nil {
+		g.minus1.disconnect()
+		g.minus1 = nil
+	}
+}
+
+// publishMinus1 forwards a QoS -1 PUBLISH from a client without a session.
+// Only predefined and short topics can be published to with QoS -1.
+func (g *Gateway) publishMinus1(addr net.Addr, m *Message) {
+	var topic string
+	switch m.Flags.TopicIDType() {
+	case TopicPredefined:
+		topic = g.cfg.PredefinedTopics[m.TopicID]
+	case TopicShort:
+		topic = string([]byte{byte(m.TopicID >> 8), byte(m.TopicID)})
+	}
+	if topic == "" {
+		g.log(mqtt.LevelInfo, "dropping QoS -1 PUBLISH to unknown topic", "addr", addr.String(), "topicID", m.TopicID)
+		return
+	}
+	// Dialing the broker must not block Serve.
+	go g.forwardMinus1(topic, m.Flags.Retain(), append([]byte(nil), m.Data...))
+}
+
+// forwardMinus1 publishes a QoS -1 PUBLISH to the broker with QoS0, dialing
+// the broker connection of the gateway if not connected.
+func (g *Gateway) forwardMinus1(topic string, retain bool, data []byte) {
+	g.minus1mu.Lock()
+	defer g.minus1mu.Unlock()
+	if g.stopped {
+		return
+	}
+	if g.minus1 == nil {
+		bc, err := g.dialMinus1()
+		if err != nil {
+			g.log(mqtt.LevelError, "broker connection failed, dropping QoS -1 PUBLISH", "clientID", g.cfg.ClientID, "topic", topic, "err", err)
+			return
+		}
+		g.minus1 = bc
+		go g.drainMinus1(bc)
+	}
+	err := g.minus1.publish(mqtt.QoS0, false, retain, mqtt.VariablesPublish{TopicName: []byte(topic)}, data)
+	if err != nil {
+		g.log(mqtt.LevelWarn, "failed to forward QoS -1 PUBLISH", "topic", topic, "err", err)
+	}
+}
+
+func (g *Gateway) dialMinus1() (*brokerConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.cfg.ConnectTimeout)
+	defer cancel()
+	conn, err := g.cfg.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var vc mqtt.VariablesConnect
+	vc.SetDefaultMQTT([]byte(g.cfg.ClientID))
+	vc.KeepAlive = 0 // The connection is idle between QoS -1 PUBLISH.
+	return dialBroker(ctx, conn, &vc, g.cfg.Logger)
+}
+
+// drainMinus1 reads from the broker connection of the gateway, which is not
+// subscribed to any topic, until it ends so the next QoS -1 PUBLISH dials again.
+func (g *Gateway) drainMinus1(bc *brokerConn) {
+	var pkt mqtt.Packet
+	var err error
+	for err == nil {
+		_, err = bc.rx.ReadPacket(&pkt)
+	}
+	bc.conn.Close()
+	g.minus1mu.Lock()
+	defer g.minus1mu.Unlock()
+	if g.minus1 == bc {
+		g.log(mqtt.LevelWarn, "broker connection lost", "clientID", g.cfg.ClientID, "err", err)
+		g.minus1 = nil
+	}
+}
+
+// reply sends m to a client without a session. Only called from Serve.
+func (g *Gateway) reply(addr net.Addr, m *Message) {
+	var err error
+	g.wbuf, err = m.Append(g.wbuf[:0])
+	if err == nil {
+		_, err = g.conn.WriteTo(g.wbuf, addr)
+	}
+	if err != nil {
+		g.log(mqtt.LevelWarn, "failed to send", "addr", addr.String(), "msg", m.Type.String(), "err", err)
+	}
+}
+
+func (g *Gateway) log(level mqtt.LogLevel, msg string, keyvals ...any) {
+	if g.cfg.Logger != nil {
+		g.cfg.Logger.Log(level, msg, keyvals...)
+	}
+}
+
+// buffered is a PUBLISH from the broker held for a sleeping client.
+type buffered struct {
+	topic  string
+	data   []byte
+	retain bool
+}
+
+// pendingSub is a SUBSCRIBE forwarded to the broker awaiting its SUBACK.
+type pendingSub struct {
+	filter string
+	suback Message
+}
+
+// session bridges a single MQTT-SN client onto its broker connection.
+type session struct {
+	gw       *Gateway
+	clientID string
+	// key is the address of the client in Gateway.sessions. Guarded by gw.mu.
+	key string
+
+	mu        sync.Mutex
+	addr      net.Addr
+	state     clientState
+	keepAlive uint16
+	sleep     uint16
+	deadline  time.Time
+	timer     *time.Timer
+	wbuf      []byte
+	msgID     uint16
+	// closed is set when the session ends, possibly before connecting.
+	closed bool
+
+	// connecting is set from CONNECT until the broker connection is established.
+	connecting bool
+	// willReq is the Will request awaiting its response during CONNECT.
+	willReq MessageType
+	vc      mqtt.VariablesConnect
+	broker  *brokerConn
+
+	topics      map[uint16]string
+	topicIDs    map[string]uint16
+	lastTopicID uint16
+	// subs holds the topic filters the client is subscribed to.
+	subs       []string
+	pendingSub *pendingSub
+	// pendingPub maps message IDs of QoS1 and QoS2 PUBLISH forwarded to the broker
+	// and not yet acknowledged by it to their topic IDs. Message IDs of the client
+	// are used as packet identifiers of the broker connection.
+	pendingPub map[uint16]uint16
+	// pendingRel holds message IDs of QoS2 PUBLISH received by the broker and not
+	// yet completed.
+	pendingRel map[uint16]bool
+	// brokerRel holds packet identifiers of QoS2 PUBLISH from the broker not yet released.
+	brokerRel map[uint16]bool
+	buffered  []buffered
+}
+
+func newSession(g *Gateway, addr net.Addr, clientID string) *session {
+	return &session{
+		gw:         g,
+		clientID:   clientID,
+		key:        addr.String(),
+		addr:       addr,
+		topics:     make(map[uint16]string),
+		topicIDs:   make(map[string]uint16),
+		pendingPub: make(map[uint16]uint16),
+		pendingRel: make(map[uint16]bool),
+		brokerRel:  make(map[uint16]bool),
+	}
+}
+
+// resume handles a CONNECT for an existing session. It returns false if the
+// session must be replaced by a new one.
+func (s *session) resume(addr net.Addr, m *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr = addr
+	if s.connecting {
+		// CONNECT retransmitted, the client may have lost the Will request.
+		if s.willReq != 0 {
+			s.send(&Message{Type: s.willReq})
+		}
+		return true
+	}
+	if s.broker == nil || m.Flags.CleanSession() || m.Flags.Will() {
+		return false
+	}
+	s.keepAlive = m.Duration
+	s.state = stateActive
+	s.send(&Message{Type: MsgConnack, ReturnCode: ReturnCodeAccepted})
+	s.flush()
+	s.resetTimer()
+	return true
+}
+
+// connect starts a new session with the first CONNECT received.
+func (s *session) connect(m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connecting = true
+	s.keepAlive = m.Duration
+	s.vc = mqtt.VariablesConnect{}
+	s.vc.SetDefaultMQTT([]byte(s.clientID))
+	s.vc.CleanSession = m.Flags.CleanSession()
+	s.vc.KeepAlive = 0 // Client keep alive is supervised by the gateway.
+	if m.Flags.Will() {
+		s.willReq = MsgWillTopicReq
+		s.send(&Message{Type: MsgWillTopicReq})
+		return
+	}
+	go s.dial()
+}
+
+// dial connects to the broker and sends the CONNACK to the client.
+func (s *session) dial() {
+	cfg := &s.gw.cfg
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	s.mu.Lock()
+	vc := s.vc
+	s.mu.Unlock()
+
+	conn, err := cfg.Dial(ctx)
+	var bc *brokerConn
+	if err == nil {
+		bc, err = dialBroker(ctx, conn, &vc, cfg.Logger)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connecting = false
+	if s.closed {
+		// Session ended while connecting.
+		if err == nil {
+			go bc.disconnect()
+		}
+		return
+	}
+	if err != nil {
+		s.gw.log(mqtt.LevelError, "broker connection failed", "clientID", s.clientID, "err", err)
+		rc := ReturnCodeCongestion
+		var connErr *mqtt.ConnectError
+		if errors.As(err, &connErr) {
+			rc = ReturnCodeNotSupported // Broker rejected the client.
+		}
+		s.send(&Message{Type: MsgConnack, ReturnCode: rc})
+		s.gw.remove(s)
+		s.closed = true
+		return
+	}
+	s.broker = bc
+	s.state = stateActive
+	s.send(&Message{Type: MsgConnack, ReturnCode: ReturnCodeAccepted})
+	s.resetTimer()
+	go s.readLoop(bc)
+}
+
+// readLoop handles packets from the broker until the connection ends.
+func (s *session) readLoop(bc *brokerConn) {
+	var pkt mqtt.Packet
+	for {
+		_, err := bc.rx.ReadPacket(&pkt)
+		s.mu.Lock()
+		current := s.broker == bc // Otherwise the session was closed by the gateway.
+		lost := current && err != nil
+		if lost {
+			s.gw.log(mqtt.LevelError, "broker connection lost", "clientID", s.clientID, "err", err)
+			s.send(&Message{Type: MsgDisconnect})
+			s.gw.remove(s)
+			s.detach()
+			bc.conn.Close()
+		} else if current {
+			s.handleBroker(&pkt)
+		}
+		s.mu.Unlock()
+		if !current || lost {
+			return
+		}
+	}
+}
+
+// handleBroker handles a packet from the broker. s.mu must be held.
+func (s *session) handleBroker(pkt *mqtt.Packet) {
+	pi := pkt.PacketIdentifier
+	switch pkt.Header.Type() {
+	case mqtt.PacketPublish:
+		s.onPub(pkt)
+	case mqtt.PacketPuback:
+		if topicID, ok := s.pendingPub[pi]; ok {
+			delete(s.pendingPub, pi)
+			s.send(&Message{Type: MsgPuback, TopicID: topicID, MessageID: pi})
+		}
+	case mqtt.PacketPubrec:
+		if _, ok := s.pendingPub[pi]; ok || s.pendingRel[pi] {
+			delete(s.pendingPub, pi)
+			s.pendingRel[pi] = true
+			s.send(&Message{Type: MsgPubrec, MessageID: pi})
+		}
+	case mqtt.PacketPubcomp:
+		if s.pendingRel[pi] {
+			delete(s.pendingRel, pi)
+			s.send(&Message{Type: MsgPubcomp, MessageID: pi})
+		}
+	case mqtt.PacketPubrel:
+		delete(s.brokerRel, pi)
+		s.ackBroker(mqtt.PacketPubcomp, pi)
+	case mqtt.PacketSuback:
+		s.completeSubscribe(pkt.Suback)
+	}
+}
+
+// ackBroker acknowledges a packet from the broker. s.mu must be held.
+func (s *session) ackBroker(packetType mqtt.PacketType, packetIdentifier uint16) {
+	err := s.broker.identified(packetType, packetIdentifier)
+	if err != nil {
+		s.gw.log(mqtt.LevelWarn, "failed to send to broker", "clientID", s.clientID, "packet", packetType.String(), "err", err)
+	}
+}
+
+// onPub sends a PUBLISH from the broker to the client, or buffers it if the
+// client is asleep. PUBLISH with QoS1 and QoS2 are acknowledged to the broker
+// once sent or buffered, though subscriptions are granted QoS0. s.mu must be held.
+func (s *session) onPub(pkt *mqtt.Packet) {
+	flags := pkt.Header.Flags()
+	pi := pkt.Publish.PacketIdentifier
+	switch flags.QoS() {
+	case mqtt.QoS1:
+		defer s.ackBroker(mqtt.PacketPuback, pi)
+	case mqtt.QoS2:
+		defer s.ackBroker(mqtt.PacketPubrec, pi)
+		if s.brokerRel[pi] {
+			return // Duplicate of a PUBLISH not yet released.
+		}
+		s.brokerRel[pi] = true
+	}
+	topic := string(pkt.Publish.TopicName)
+	if !s.subscribed(topic) {
+		return // Unsubscribed, see Gateway documentation.
+	}
+	switch s.state {
+	case stateActive, stateAwake:
+		s.publish(topic, pkt.Payload, flags.Retain())
+	case stateAsleep:
+		if len(s.buffered) == s.gw.cfg.MaxBuffered {
+			s.gw.log(mqtt.LevelWarn, "buffer full, dropping oldest message", "clientID", s.clientID)
+			s.buffered = append(s.buffered[:0], s.buffered[1:]...)
+		}
+		data := append([]byte(nil), pkt.Payload...) // pkt.Payload is reused by readLoop.
+		s.buffered = append(s.buffered, buffered{topic: topic, data: data, retain: flags.Retain()})
+	}
+}
+
+// handle handles a message from the client.
+func (s *session) handle(addr net.Addr, m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr = addr
+	if s.closed {
+		s.send(&Message{Type: MsgDisconnect})
+		return
+	}
+	s.resetTimer()
+	switch m.Type {
+	case MsgWillTopic:
+		if s.willReq != MsgWillTopicReq {
+			return
+		}
+		if len(m.TopicName) == 0 {
+			// Empty WILLTOPIC means no Will.
+			s.willReq = 0
+			go s.dial()
+			return
+		}
+		s.vc.WillTopic = append([]byte(nil), m.TopicName...)
+		qos := m.Flags.QoS()
+		if qos == QoSMinus1 {
+			qos = QoS0
+		}
+		s.vc.WillQoS = mqtt.QoSLevel(qos)
+		s.vc.WillRetain = m.Flags.Retain()
+		s.willReq = MsgWillMsgReq
+		s.send(&Message{Type: MsgWillMsgReq})
+	case MsgWillMsg:
+		if s.willReq != MsgWillMsgReq {
+			return
+		}
+		s.vc.WillMessage = append([]byte(nil), m.Data...)
+		s.willReq = 0
+		go s.dial()
+	}
+	if s.broker == nil {
+		return // Still connecting.
+	}
+
+	switch m.Type {
+	case MsgRegister:
+		id := s.topicID(string(m.TopicName))
+		s.send(&Message{Type: MsgRegack, TopicID: id, MessageID: m.MessageID})
+	case MsgPublish:
+		s.handlePublish(m)
+	case MsgPubrel:
+		if !s.pendingRel[m.MessageID] {
+			s.send(&Message{Type: MsgPubcomp, MessageID: m.MessageID}) // Already completed.
+			return
+		}
+		// PUBCOMP is sent to the client once the broker responds.
+		s.ackBroker(mqtt.PacketPubrel, m.MessageID)
+	case MsgSubscribe:
+		s.handleSubscribe(m)
+	case MsgUnsubscribe:
+		filter, ok := s.topicName(m.Flags.TopicIDType(), m.TopicID)
+		if m.Flags.TopicIDType() == TopicNormal {
+			filter, ok = string(m.TopicName), true
+		}
+		if ok {
+			s.unsubscribe(filter)
+		}
+		s.send(&Message{Type: MsgUnsuback, MessageID: m.MessageID})
+	case MsgPingreq:
+		if len(m.ClientID) != 0 && s.state == stateAsleep {
+			// Sleeping client awake to receive buffered messages.
+			s.state = stateAwake
+			s.flush()
+			s.state = stateAsleep
+		}
+		s.send(&Message{Type: MsgPingresp})
+	case MsgDisconnect:
+		s.send(&Message{Type: MsgDisconnect})
+		if m.Duration != 0 {
+			s.state = stateAsleep
+			s.sleep = m.Duration
+			s.resetTimer()
+			return
+		}
+		s.gw.remove(s)
+		go s.detach().disconnect()
+	case MsgWillTopicUpd:
+		s.send(&Message{Type: MsgWillTopicResp, ReturnCode: ReturnCodeNotSupported})
+	case MsgWillMsgUpd:
+		s.send(&Message{Type: MsgWillMsgResp, ReturnCode: ReturnCodeNotSupported})
+	}
+}
+
+// handlePublish forwards a PUBLISH from the client to the broker with its QoS.
+// QoS1 and QoS2 PUBLISH are acknowledged to the client by handleBroker.
+func (s *session) handlePublish(m *Message) {
+	qos := m.Flags.QoS()
+	topic, ok := s.topicName(m.Flags.TopicIDType(), m.TopicID)
+	if !ok {
+		s.send(&Message{Type: MsgPuback, TopicID: m.TopicID, MessageID: m.MessageID, ReturnCode: ReturnCodeInvalidTopicID})
+		return
+	}
+	if qos == QoS2 && s.pendingRel[m.MessageID] {
+		s.send(&Message{Type: MsgPubrec, MessageID: m.MessageID}) // Already received by broker.
+		return
+	}
+	mqttQoS := mqtt.QoS0
+	if qos == QoS1 || qos == QoS2 {
+		mqttQoS = mqtt.QoSLevel(qos)
+	}
+	vp := mqtt.VariablesPublish{TopicName: []byte(topic), PacketIdentifier: m.MessageID}
+	err := s.broker.publish(mqttQoS, m.Flags.Dup(), m.Flags.Retain(), vp, m.Data)
+	if err != nil {
+		s.gw.log(mqtt.LevelWarn, "failed to forward PUBLISH", "clientID", s.clientID, "topic", topic, "err", err)
+		if mqttQoS != mqtt.QoS0 {
+			s.send(&Message{Type: MsgPuback, TopicID: m.TopicID, MessageID: m.MessageID, ReturnCode: ReturnCodeCongestion})
+		}
+		return
+	}
+	if mqttQoS != mqtt.QoS0 {
+		s.pendingPub[m.MessageID] = m.TopicID
+	}
+}
+
+func (s *session) handleSubscribe(m *Message) {
+	suback := Message{Type: MsgSuback, MessageID: m.MessageID}
+	var filter string
+	switch m.Flags.TopicIDType() {
+	case TopicNormal:
+		filter = string(m.TopicName)
+		if !hasWildcards(filter) {
+			suback.TopicID = s.topicID(filter)
+		}
+	case TopicPredefined:
+		var ok bool
+		filter, ok = s.gw.cfg.PredefinedTopics[m.TopicID]
+		if !ok {
+			suback.ReturnCode = ReturnCodeInvalidTopicID
+			s.send(&suback)
+			return
+		}
+		suback.TopicID = m.TopicID
+	case TopicShort:
+		filter, _ = s.topicName(TopicShort, m.TopicID)
+	default:
+		suback.ReturnCode = ReturnCodeNotSupported
+		s.send(&suback)
+		return
+	}
+	if s.hasSub(filter) {
+		s.send(&suback)
+		return
+	}
+	if s.pendingSub != nil {
+		if s.pendingSub.suback.MessageID != m.MessageID {
+			suback.ReturnCode = ReturnCodeCongestion // Subscriptions are forwarded one at a time.
+			s.send(&suback)
+		}
+		return
+	}
+	err := s.broker.subscribe(mqtt.VariablesSubscribe{
+		PacketIdentifier: m.MessageID,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte(filter), QoS: mqtt.QoS0}},
+	})
+	if err != nil {
+		s.gw.log(mqtt.LevelWarn, "failed to forward SUBSCRIBE", "clientID", s.clientID, "filter", filter, "err", err)
+		suback.ReturnCode = ReturnCodeCongestion
+		s.send(&suback)
+		return
+	}
+	s.pendingSub = &pendingSub{filter: filter, suback: suback}
+}
+
+// completeSubscribe sends the SUBACK of the pending subscription once the broker
+// responded. s.mu must be held.
+func (s *session) completeSubscribe(vs mqtt.VariablesSuback) {
+	p := s.pendingSub
+	if p == nil || vs.PacketIdentifier != p.suback.MessageID {
+		return
+	}
+	s.pendingSub = nil
+	if len(vs.ReturnCodes) == 1 && vs.ReturnCodes[0] != mqtt.QoSSubfail {
+		s.subs = append(s.subs, p.filter)
+	} else {
+		p.suback.TopicID = 0
+		p.suback.ReturnCode = ReturnCodeNotSupported
+	}
+	s.send(&p.suback)
+}
+
+// hasSub returns true if filter is one of the subscriptions of the client.
+func (s *session) hasSub(filter string) bool {
+	for _, sub := range s.subs {
+		if sub == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed returns true if topic matches a subscription of the client.
+func (s *session) subscribed(topic string) bool {
+	for _, sub := range s.subs {
+		if mqtt.MatchTopic(sub, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) unsubscribe(filter string) {
+	subs := s.subs[:0]
+	for _, sub := range s.subs {
+		if sub != filter {
+			subs = append(subs, sub)
+		}
+	}
+	s.subs = subs
+}
+
+// topicName returns the topic name referenced by a topic ID.
+func (s *session) topicName(tp TopicIDType, id uint16) (string, bool) {
+	switch tp {
+	case TopicNormal:
+		name, ok := s.topics[id]
+		return name, ok
+	case TopicPredefined:
+		name, ok := s.gw.cfg.PredefinedTopics[id]
+		return name, ok
+	case TopicShort:
+		return string([]byte{byte(id >> 8), byte(id)}), true
+	}
+	return "", false
+}
+
+// topicID returns the topic ID registered for name, assigning a new one if needed.
+func (s *session) topicID(name string) uint16 {
+	if id, ok := s.topicIDs[name]; ok {
+		return id
+	}
+	s.lastTopicID++
+	if s.lastTopicID == 0 {
+		s.lastTopicID = 1
+	}
+	s.topics[s.lastTopicID] = name
+	s.topicIDs[name] = s.lastTopicID
+	return s.lastTopicID
+}
+
+// publish sends a PUBLISH from the broker to the client. Topics without a topic
+// ID known to the client are registered first. The gateway does not wait for
+// the REGACK as datagrams to a client are usually received in order; if the
+// REGISTER is lost the client rejects the PUBLISH and the message is lost as
+// is expected of QoS0.
+func (s *session) publish(topic string, data []byte, retain bool) {
+	m := Message{Type: MsgPublish, Data: data}
+	id, registered := s.topicIDs[topic]
+	predefined := false
+	if !registered {
+		for predefID, name := range s.gw.cfg.PredefinedTopics {
+			if name == topic {
+				id, predefined = predefID, true
+				break
+			}
+		}
+	}
+	switch {
+	case registered:
+		m.TopicID = id
+	case len(topic) == 2:
+		m.Flags = Flags(TopicShort)
+		m.TopicID, _ = ShortTopic(topic)
+	case predefined:
+		m.Flags = Flags(TopicPredefined)
+		m.TopicID = id
+	default:
+		m.TopicID = s.topicID(topic)
+		s.send(&Message{Type: MsgRegister, TopicID: m.TopicID, MessageID: s.nextMessageID(), TopicName: []byte(topic)})
+	}
+	if retain {
+		m.Flags |= FlagRetain
+	}
+	s.send(&m)
+}
+
+// flush sends the messages buffered while the client was asleep.
+func (s *session) flush() {
+	for i, b := range s.buffered {
+		s.publish(b.topic, b.data, b.retain)
+		s.buffered[i] = buffered{}
+	}
+	s.buffered = s.buffered[:0]
+}
+
+// resetTimer restarts the timer which ends the session when the client is lost,
+// after 1.5 times the keep alive or sleep duration as MQTT does.
+func (s *session) resetTimer() {
+	d := time.Duration(s.keepAlive) * time.Second
+	if s.state == stateAsleep {
+		d = time.Duration(s.sleep) * time.Second
+	}
+	if d == 0 {
+		s.deadline = time.Time{}
+		return
+	}
+	d += d / 2
+	s.deadline = time.Now().Add(d)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(d, s.expire)
+	} else {
+		s.timer.Reset(d)
+	}
+}
+
+// expire ends the session if the client is lost. The broker connection is
+// closed abruptly so the broker publishes the Will.
+func (s *session) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deadline.IsZero() || time.Now().Before(s.deadline) || s.broker == nil {
+		return // Timer reset while expire was being called.
+	}
+	s.gw.log(mqtt.LevelInfo, "client lost", "clientID", s.clientID)
+	s.gw.remove(s)
+	s.detach().conn.Close()
+}
+
+// close ends the session. If graceful the broker connection is disconnected,
+// otherwise it is closed so the broker publishes the Will.
+func (s *session) close(graceful bool, reason error) {
+	s.mu.Lock()
+	bc := s.detach()
+	s.mu.Unlock()
+	if bc == nil {
+		return
+	}
+	s.gw.log(mqtt.LevelDebug, "closing session", "clientID", s.clientID, "reason", reason)
+	if graceful {
+		bc.disconnect()
+	} else {
+		bc.conn.Close()
+	}
+}
+
+// detach ends the session and returns its broker connection. s.mu must be held.
+func (s *session) detach() *brokerConn {
+	bc := s.broker
+	s.broker = nil
+	s.state = stateDisconnected
+	s.closed = true
+	s.pendingSub = nil
+	s.buffered = nil
+	s.deadline = time.Time{}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	return bc
+}
+
+// send sends m to the client. s.mu must be held.
+func (s *session) send(m *Message) {
+	var err error
+	s.wbuf, err = m.Append(s.wbuf[:0])
+	if err == nil {
+		_, err = s.gw.conn.WriteTo(s.wbuf, s.addr)
+	}
+	if err != nil {
+		s.gw.log(mqtt.LevelWarn, "failed to send", "clientID", s.clientID, "msg", m.Type.String(), "err", err)
+	}
+}
+
+func (s *session) nextMessageID() uint16 {
+	s.msgID++
+	if s.msgID == 0 {
+		s.msgID = 1
+	}
+	return s.msgID
+}
@@ -0,0 +1,325 @@
+package mqttsn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := &mqtttest.Broker{}
+	defer broker.Close()
+	gw, gwAddr := startGateway(t, broker)
+
+	expectObserved := observe(ctx, t, broker)
+
+	conn := listenUDP(t)
+	var received []string
+	client := NewClient(ClientConfig{
+		OnPub: func(topic []byte, msg *Message) error {
+			received = append(received, string(topic)+" "+string(msg.Data))
+			return nil
+		},
+		PredefinedTopics: map[uint16]string{1: "alarms"},
+		RetryInterval:    time.Second,
+	})
+	receive := func(want ...string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		defer conn.SetReadDeadline(time.Time{})
+		for len(received) < len(want) {
+			err := client.HandleNext()
+			if err != nil {
+				t.Fatalf("got %q, want %q: %v", received, want, err)
+			}
+		}
+		if strings.Join(received, ",") != strings.Join(want, ",") {
+			t.Errorf("got %q, want %q", received, want)
+		}
+		received = received[:0]
+	}
+
+	err := client.Connect(ctx, conn, gwAddr, &ConnectOptions{
+		ClientID:  "node-1",
+		KeepAlive: 30,
+		Will:      &Will{Topic: "nodes/1", Message: []byte("lost")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := brokerClients(broker); got != "node-1,observer" {
+		t.Fatalf("broker clients %q", got)
+	}
+
+	err = client.Publish(ctx, Topic{Name: "sensors/temp"}, QoS1, false, []byte("21.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectObserved("sensors/temp 21.5")
+	err = client.Publish(ctx, Topic{Type: TopicPredefined, ID: 1}, QoS0, false, []byte("fire"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectObserved("alarms fire")
+	err = client.Publish(ctx, Topic{Type: TopicPredefined, ID: 2}, QoS1, false, []byte("?"))
+	if !errors.Is(err, ReturnCodeInvalidTopicID) {
+		t.Errorf("got %v publishing to unknown predefined topic", err)
+	}
+
+	id, granted, err := client.Subscribe(ctx, Topic{Name: "cmd/led"}, QoS1)
+	if err != nil || id == 0 || granted != QoS0 {
+		t.Fatalf("Subscribe = %d, %d, %v", id, granted, err)
+	}
+	id, _, err = client.Subscribe(ctx, Topic{Name: "cfg/#"}, QoS0)
+	if err != nil || id != 0 {
+		t.Fatalf("wildcard Subscribe = %d, %v", id, err)
+	}
+	broker.Publish("cmd/led", []byte("on"))
+	broker.Publish("cfg/rate", []byte("10")) // Registered by gateway before publishing.
+	receive("cmd/led on", "cfg/rate 10")
+
+	err = client.Sleep(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("cmd/led", []byte("off"))
+	broker.Publish("cmd/led", []byte("blink"))
+	waitFor(t, func() bool {
+		s := gw.session("node-1")
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.buffered) == 2
+	})
+	err = client.Awake(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive("cmd/led off", "cmd/led blink")
+	err = client.Connect(ctx, conn, gwAddr, &ConnectOptions{ClientID: "node-1", KeepAlive: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Unsubscribe(ctx, Topic{Name: "cmd/led"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("cmd/led", []byte("ignored"))
+	broker.Publish("cfg/rate", []byte("20"))
+	receive("cfg/rate 20")
+
+	err = client.Disconnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return brokerClients(broker) == "observer" })
+	if len(gw.Clients()) != 0 {
+		t.Errorf("gateway clients %q after disconnect", gw.Clients())
+	}
+}
+
+func TestGatewayPublishQoS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := &mqtttest.Broker{}
+	defer broker.Close()
+	gw, gwAddr := startGateway(t, broker)
+	expectObserved := observe(ctx, t, broker)
+
+	// QoS -1 to predefined and short topics without a connection.
+	conn := listenUDP(t)
+	err := PublishMinus1(conn, gwAddr, Topic{Type: TopicPredefined, ID: 1}, false, []byte("smoke"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectObserved("alarms smoke")
+	err = PublishMinus1(conn, gwAddr, Topic{Type: TopicShort, Name: "t1"}, false, []byte("22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectObserved("t1 22")
+	if got := brokerClients(broker); got != "mqttsn-gateway-7,observer" {
+		t.Errorf("broker clients %q", got)
+	}
+
+	// QoS2 handshake is relayed to the broker.
+	exchange := func(send, want Message) {
+		t.Helper()
+		b, _ := send.Append(nil)
+		_, err := conn.WriteTo(b, gwAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 64)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", want.Type, err)
+		}
+		var got Message
+		err = got.Decode(buf[:n])
+		if err != nil || got.Type != want.Type || got.MessageID != want.MessageID || got.ReturnCode != want.ReturnCode {
+			t.Fatalf("got %s (msgID %d, %v), want %s (msgID %d)", got.Type, got.MessageID, err, want.Type, want.MessageID)
+		}
+	}
+	exchange(Message{Type: MsgConnect, Flags: FlagCleanSession, Duration: 30, ClientID: []byte("node-3")},
+		Message{Type: MsgConnack})
+	pub, err := newPublish(Topic{Type: TopicPredefined, ID: 1}, QoS2, false, []byte("flood"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.MessageID = 9
+	exchange(pub, Message{Type: MsgPubrec, MessageID: 9})
+	expectObserved("alarms flood")
+	s := gw.session("node-3")
+	s.mu.Lock()
+	pending := len(s.pendingPub) == 0 && s.pendingRel[9]
+	s.mu.Unlock()
+	if !pending {
+		t.Error("PUBREC sent before the broker received the PUBLISH")
+	}
+	exchange(Message{Type: MsgPubrel, MessageID: 9}, Message{Type: MsgPubcomp, MessageID: 9})
+	exchange(Message{Type: MsgPubrel, MessageID: 9}, Message{Type: MsgPubcomp, MessageID: 9}) // Retransmitted.
+}
+
+func TestGatewayKeepAlive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := &mqtttest.Broker{}
+	defer broker.Close()
+	gw, gwAddr := startGateway(t, broker)
+
+	client := NewClient(ClientConfig{RetryInterval: time.Second})
+	err := client.Connect(ctx, listenUDP(t), gwAddr, &ConnectOptions{ClientID: "node-2", KeepAlive: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Client is lost after 1.5 times the keep alive without messages.
+	waitFor(t, func() bool { return len(gw.Clients()) == 0 && len(broker.Clients()) == 0 })
+	err = client.Ping(ctx)
+	if !errors.Is(err, errGatewayClosed) {
+		t.Errorf("got %v pinging after session expired", err)
+	}
+}
+
+func TestGatewaySearch(t *testing.T) {
+	_, gwAddr := startGateway(t, &mqtttest.Broker{})
+	conn := listenUDP(t)
+	b, _ := (&Message{Type: MsgSearchGW, Radius: 1}).Append(nil)
+	_, err := conn.WriteTo(b, gwAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Message
+	err = m.Decode(buf[:n])
+	if err != nil || m.Type != MsgGWInfo || m.GatewayID != 7 {
+		t.Errorf("got %s from gateway %d: %v", m.Type, m.GatewayID, err)
+	}
+}
+
+// observe connects a client subscribed to all topics to broker and returns a
+// function which expects the next message the broker routes to be want.
+func observe(ctx context.Context, t *testing.T, broker *mqtttest.Broker) (expectObserved func(want string)) {
+	t.Helper()
+	observed := make(chan string, 10)
+	observer := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			observed <- string(vp.TopicName) + " " + string(data)
+			return err
+		},
+	})
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("observer"))
+	err := observer.Connect(ctx, broker.Dial(), &varConn)
+	if err == nil {
+		err = observer.Subscribe(ctx, mqtt.VariablesSubscribe{
+			PacketIdentifier: 1,
+			TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte("#"), QoS: mqtt.QoS0}},
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for observer.IsConnected() {
+			observer.HandleNext()
+		}
+	}()
+	t.Cleanup(func() { observer.Disconnect(errors.New("done")) })
+	return func(want string) {
+		t.Helper()
+		select {
+		case got := <-observed:
+			if got != want {
+				t.Errorf("broker got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("broker did not receive %q", want)
+		}
+	}
+}
+
+// startGateway serves a gateway to broker on a UDP socket until the test ends.
+func startGateway(t *testing.T, broker *mqtttest.Broker) (*Gateway, net.Addr) {
+	t.Helper()
+	gw := NewGateway(GatewayConfig{
+		Dial:             func(ctx context.Context) (net.Conn, error) { return broker.Dial(), nil },
+		GatewayID:        7,
+		PredefinedTopics: map[uint16]string{1: "alarms"},
+	})
+	conn := listenUDP(t)
+	done := make(chan error)
+	go func() { done <- gw.Serve(conn) }()
+	t.Cleanup(func() {
+		conn.Close()
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+	return gw, conn.LocalAddr()
+}
+
+// session returns the session of clientID.
+func (g *Gateway) session(clientID string) *session {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, s := range g.sessions {
+		if s.clientID == clientID {
+			return s
+		}
+	}
+	return nil
+}
+
+func brokerClients(b *mqtttest.Broker) string {
+	clients := b.Clients()
+	sort.Strings(clients)
+	return strings.Join(clients, ",")
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
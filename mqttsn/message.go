@@ -0,0 +1,362 @@
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxMessageSize is the largest MQTT-SN message as limited by the 3 byte length field.
+const MaxMessageSize = 0xffff
+
+// maxClientIDLen is the maximum length of a client ID as per MQTT-SN v1.2 section 5.3.1.
+const maxClientIDLen = 23
+
+var (
+	errInvalidQoS         = errors.New("mqttsn: invalid QoS")
+	errInvalidTopicIDType = errors.New("mqttsn: invalid topic ID type")
+	errShortTopicLen      = errors.New("mqttsn: short topic name must be 2 bytes long")
+	errMessageTooLong     = errors.New("mqttsn: message exceeds 65535 bytes")
+	errShortMessage       = errors.New("mqttsn: message shorter than its fields")
+	errLengthMismatch     = errors.New("mqttsn: length field does not match datagram length")
+	errUnknownType        = errors.New("mqttsn: unknown or unsupported message type")
+	errProtocolID         = errors.New("mqttsn: unsupported protocol ID")
+	errClientIDLen        = errors.New("mqttsn: client ID must be 1 to 23 bytes long")
+	errEmptyTopicName     = errors.New("mqttsn: empty topic name")
+)
+
+// Message is a tagged union of all MQTT-SN v1.2 messages except the forwarder
+// encapsulation. Type determines which of the remaining fields are encoded
+// and decoded, as noted in the documentation of each field.
+//
+// Decoded byte slices point into the datagram passed to Decode so decoding does
+// not allocate. They are invalidated when the datagram buffer is reused.
+type Message struct {
+	Type MessageType
+	// Flags of CONNECT, WILLTOPIC, WILLTOPICUPD, PUBLISH, SUBSCRIBE, SUBACK and UNSUBSCRIBE.
+	Flags Flags
+	// GatewayID of ADVERTISE and GWINFO.
+	GatewayID uint8
+	// Radius of SEARCHGW.
+	Radius uint8
+	// Duration in seconds of ADVERTISE, CONNECT (keep alive) and DISCONNECT (sleep).
+	// A DISCONNECT with zero Duration is encoded without the duration field.
+	Duration uint16
+	// ClientID of CONNECT and PINGREQ. A PINGREQ with a client ID is sent by
+	// sleeping clients to receive buffered messages.
+	ClientID []byte
+	// TopicID of REGISTER, REGACK, PUBLISH, PUBACK and SUBACK, and of SUBSCRIBE
+	// and UNSUBSCRIBE with predefined or short topic ID types.
+	TopicID uint16
+	// MessageID of REGISTER, REGACK, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP,
+	// SUBSCRIBE, SUBACK, UNSUBSCRIBE and UNSUBACK.
+	MessageID uint16
+	// ReturnCode of CONNACK, REGACK, PUBACK, SUBACK, WILLTOPICRESP and WILLMSGRESP.
+	ReturnCode ReturnCode
+	// TopicName of REGISTER, WILLTOPIC and WILLTOPICUPD, and of SUBSCRIBE and
+	// UNSUBSCRIBE with normal topic ID type. A WILLTOPIC with empty topic name
+	// is encoded without flags and deletes the Will.
+	TopicName []byte
+	// Data of PUBLISH, WILLMSG and WILLMSGUPD, and the gateway address of GWINFO.
+	Data []byte
+}
+
+// Size returns the size of m once encoded, including the length field.
+func (m *Message) Size() int {
+	n := m.bodySize() + 1 // Type.
+	if n+1 > 0xff {
+		return n + 3
+	}
+	return n + 1
+}
+
+// bodySize returns the size of the fields after the message type.
+func (m *Message) bodySize() int {
+	switch m.Type {
+	case MsgAdvertise:
+		return 3
+	case MsgSearchGW, MsgConnack, MsgWillTopicResp, MsgWillMsgResp:
+		return 1
+	case MsgGWInfo:
+		return 1 + len(m.Data)
+	case MsgConnect:
+		return 4 + len(m.ClientID)
+	case MsgWillTopic:
+		if len(m.TopicName) == 0 && m.Flags == 0 {
+			return 0
+		}
+		return 1 + len(m.TopicName)
+	case MsgWillTopicUpd:
+		return 1 + len(m.TopicName)
+	case MsgWillMsg, MsgWillMsgUpd:
+		return len(m.Data)
+	case MsgRegister:
+		return 4 + len(m.TopicName)
+	case MsgRegack, MsgPuback:
+		return 5
+	case MsgPublish:
+		return 5 + len(m.Data)
+	case MsgPubrec, MsgPubrel, MsgPubcomp, MsgUnsuback:
+		return 2
+	case MsgSubscribe, MsgUnsubscribe:
+		if m.Flags.TopicIDType() == TopicNormal {
+			return 3 + len(m.TopicName)
+		}
+		return 5
+	case MsgSuback:
+		return 6
+	case MsgPingreq:
+		return len(m.ClientID)
+	case MsgDisconnect:
+		if m.Duration != 0 {
+			return 2
+		}
+	}
+	return 0 // WILLTOPICREQ, WILLMSGREQ, PINGRESP, DISCONNECT without duration.
+}
+
+// Validate returns an error if m can't be encoded or is not a valid MQTT-SN message.
+func (m *Message) Validate() error {
+	if !m.Type.IsValid() {
+		return errUnknownType
+	}
+	if m.Size() > MaxMessageSize {
+		return errMessageTooLong
+	}
+	switch m.Type {
+	case MsgConnect:
+		if len(m.ClientID) == 0 || len(m.ClientID) > maxClientIDLen {
+			return errClientIDLen
+		}
+	case MsgPingreq:
+		if len(m.ClientID) > maxClientIDLen {
+			return errClientIDLen
+		}
+	case MsgRegister:
+		if len(m.TopicName) == 0 {
+			return errEmptyTopicName
+		}
+	case MsgPublish, MsgSubscribe, MsgUnsubscribe:
+		tt := m.Flags.TopicIDType()
+		if tt > TopicShort {
+			return errInvalidTopicIDType
+		}
+		if m.Type != MsgPublish && tt == TopicNormal && len(m.TopicName) == 0 {
+			return errEmptyTopicName
+		}
+	}
+	return nil
+}
+
+// Append appends the encoded message to dst and returns the extended buffer.
+func (m *Message) Append(dst []byte) ([]byte, error) {
+	err := m.Validate()
+	if err != nil {
+		return dst, err
+	}
+	size := m.Size()
+	if size > 0xff {
+		dst = append(dst, 0x01, byte(size>>8), byte(size))
+	} else {
+		dst = append(dst, byte(size))
+	}
+	dst = append(dst, byte(m.Type))
+	switch m.Type {
+	case MsgAdvertise:
+		dst = append(dst, m.GatewayID)
+		dst = appendUint16(dst, m.Duration)
+	case MsgSearchGW:
+		dst = append(dst, m.Radius)
+	case MsgGWInfo:
+		dst = append(dst, m.GatewayID)
+		dst = append(dst, m.Data...)
+	case MsgConnect:
+		dst = append(dst, byte(m.Flags), ProtocolID)
+		dst = appendUint16(dst, m.Duration)
+		dst = append(dst, m.ClientID...)
+	case MsgConnack, MsgWillTopicResp, MsgWillMsgResp:
+		dst = append(dst, byte(m.ReturnCode))
+	case MsgWillTopic, MsgWillTopicUpd:
+		if m.bodySize() != 0 {
+			dst = append(dst, byte(m.Flags))
+			dst = append(dst, m.TopicName...)
+		}
+	case MsgWillMsg, MsgWillMsgUpd:
+		dst = append(dst, m.Data...)
+	case MsgRegister:
+		dst = appendUint16(dst, m.TopicID)
+		dst = appendUint16(dst, m.MessageID)
+		dst = append(dst, m.TopicName...)
+	case MsgRegack, MsgPuback:
+		dst = appendUint16(dst, m.TopicID)
+		dst = appendUint16(dst, m.MessageID)
+		dst = append(dst, byte(m.ReturnCode))
+	case MsgPublish:
+		dst = append(dst, byte(m.Flags))
+		dst = appendUint16(dst, m.TopicID)
+		dst = appendUint16(dst, m.MessageID)
+		dst = append(dst, m.Data...)
+	case MsgPubrec, MsgPubrel, MsgPubcomp, MsgUnsuback:
+		dst = appendUint16(dst, m.MessageID)
+	case MsgSubscribe, MsgUnsubscribe:
+		dst = append(dst, byte(m.Flags))
+		dst = appendUint16(dst, m.MessageID)
+		if m.Flags.TopicIDType() == TopicNormal {
+			dst = append(dst, m.TopicName...)
+		} else {
+			dst = appendUint16(dst, m.TopicID)
+		}
+	case MsgSuback:
+		dst = append(dst, byte(m.Flags))
+		dst = appendUint16(dst, m.TopicID)
+		dst = appendUint16(dst, m.MessageID)
+		dst = append(dst, byte(m.ReturnCode))
+	case MsgPingreq:
+		dst = append(dst, m.ClientID...)
+	case MsgDisconnect:
+		if m.Duration != 0 {
+			dst = appendUint16(dst, m.Duration)
+		}
+	}
+	return dst, nil
+}
+
+// Decode decodes the message in datagram b into m. b must contain exactly one
+// message. Byte slices of m point into b. Decode does not allocate memory.
+func (m *Message) Decode(b []byte) error {
+	*m = Message{}
+	if len(b) < 2 {
+		return errShortMessage
+	}
+	length := int(b[0])
+	hdr := 1
+	if length == 0x01 {
+		if len(b) < 4 {
+			return errShortMessage
+		}
+		length = int(binary.BigEndian.Uint16(b[1:3]))
+		hdr = 3
+	}
+	if length != len(b) || length < hdr+1 {
+		return errLengthMismatch
+	}
+	m.Type = MessageType(b[hdr])
+	body := b[hdr+1:]
+	// minSize is the least amount of bytes of the body for the message type.
+	minSize := 0
+	switch m.Type {
+	case MsgAdvertise:
+		minSize = 3
+	case MsgSearchGW, MsgGWInfo, MsgConnack, MsgWillTopicResp, MsgWillMsgResp, MsgWillTopicUpd:
+		minSize = 1
+	case MsgConnect:
+		minSize = 4
+	case MsgRegister:
+		minSize = 5
+	case MsgRegack, MsgPuback, MsgPublish:
+		minSize = 5
+	case MsgPubrec, MsgPubrel, MsgPubcomp, MsgUnsuback:
+		minSize = 2
+	case MsgSubscribe, MsgUnsubscribe:
+		minSize = 3
+	case MsgSuback:
+		minSize = 6
+	case MsgWillTopicReq, MsgWillMsgReq, MsgPingresp, MsgWillTopic, MsgWillMsg, MsgWillMsgUpd, MsgPingreq, MsgDisconnect:
+	default:
+		return errUnknownType
+	}
+	if len(body) < minSize {
+		return errShortMessage
+	}
+	switch m.Type {
+	case MsgAdvertise:
+		m.GatewayID = body[0]
+		m.Duration = binary.BigEndian.Uint16(body[1:])
+		body = body[3:]
+	case MsgSearchGW:
+		m.Radius = body[0]
+		body = body[1:]
+	case MsgGWInfo:
+		m.GatewayID = body[0]
+		m.Data = body[1:]
+		body = nil
+	case MsgConnect:
+		m.Flags = Flags(body[0])
+		if body[1] != ProtocolID {
+			return errProtocolID
+		}
+		m.Duration = binary.BigEndian.Uint16(body[2:])
+		m.ClientID = body[4:]
+		if len(m.ClientID) > maxClientIDLen {
+			return errClientIDLen
+		}
+		body = nil
+	case MsgConnack, MsgWillTopicResp, MsgWillMsgResp:
+		m.ReturnCode = ReturnCode(body[0])
+		body = body[1:]
+	case MsgWillTopic, MsgWillTopicUpd:
+		if len(body) != 0 {
+			m.Flags = Flags(body[0])
+			m.TopicName = body[1:]
+		}
+		body = nil
+	case MsgWillMsg, MsgWillMsgUpd:
+		m.Data = body
+		body = nil
+	case MsgRegister:
+		m.TopicID = binary.BigEndian.Uint16(body)
+		m.MessageID = binary.BigEndian.Uint16(body[2:])
+		m.TopicName = body[4:]
+		body = nil
+	case MsgRegack, MsgPuback:
+		m.TopicID = binary.BigEndian.Uint16(body)
+		m.MessageID = binary.BigEndian.Uint16(body[2:])
+		m.ReturnCode = ReturnCode(body[4])
+		body = body[5:]
+	case MsgPublish:
+		m.Flags = Flags(body[0])
+		m.TopicID = binary.BigEndian.Uint16(body[1:])
+		m.MessageID = binary.BigEndian.Uint16(body[3:])
+		m.Data = body[5:]
+		body = nil
+	case MsgPubrec, MsgPubrel, MsgPubcomp, MsgUnsuback:
+		m.MessageID = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	case MsgSubscribe, MsgUnsubscribe:
+		m.Flags = Flags(body[0])
+		m.MessageID = binary.BigEndian.Uint16(body[1:])
+		if m.Flags.TopicIDType() == TopicNormal {
+			m.TopicName = body[3:]
+			body = nil
+		} else {
+			if len(body) != 5 {
+				return errShortMessage
+			}
+			m.TopicID = binary.BigEndian.Uint16(body[3:])
+			body = body[5:]
+		}
+	case MsgSuback:
+		m.Flags = Flags(body[0])
+		m.TopicID = binary.BigEndian.Uint16(body[1:])
+		m.MessageID = binary.BigEndian.Uint16(body[3:])
+		m.ReturnCode = ReturnCode(body[5])
+		body = body[6:]
+	case MsgPingreq:
+		if len(body) > 0 {
+			m.ClientID = body
+		}
+		body = nil
+	case MsgDisconnect:
+		if len(body) >= 2 {
+			m.Duration = binary.BigEndian.Uint16(body)
+			body = body[2:]
+		}
+	}
+	if len(body) != 0 {
+		return errLengthMismatch
+	}
+	return m.Validate()
+}
+
+func appendUint16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
@@ -0,0 +1,433 @@
+package mqttsn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	qos1, _ := NewFlags(QoS1, TopicNormal)
+	short, _ := NewFlags(QoS0, TopicShort)
+	predefined, _ := NewFlags(QoSMinus1, TopicPredefined)
+	shortID, _ := ShortTopic("t1")
+	for _, m := range []Message{
+		{Type: MsgAdvertise, GatewayID: 1, Duration: 900},
+		{Type: MsgSearchGW, Radius: 2},
+		{Type: MsgGWInfo, GatewayID: 3, Data: []byte{192, 168, 0, 1}},
+		{Type: MsgConnect, Flags: FlagCleanSession | FlagWill, Duration: 60, ClientID: []byte("node-1")},
+		{Type: MsgConnack, ReturnCode: ReturnCodeCongestion},
+		{Type: MsgWillTopicReq},
+		{Type: MsgWillTopic, Flags: qos1 | FlagRetain, TopicName: []byte("nodes/1/status")},
+		{Type: MsgWillTopic},
+		{Type: MsgWillMsgReq},
+		{Type: MsgWillMsg, Data: []byte("offline")},
+		{Type: MsgRegister, TopicID: 0, MessageID: 7, TopicName: []byte("sensors/temp")},
+		{Type: MsgRegack, TopicID: 5, MessageID: 7, ReturnCode: ReturnCodeAccepted},
+		{Type: MsgPublish, Flags: qos1 | FlagDup, TopicID: 5, MessageID: 8, Data: []byte{0x00, 0x19}},
+		{Type: MsgPublish, Flags: short, TopicID: shortID, Data: []byte("on")},
+		{Type: MsgPublish, Flags: predefined, TopicID: 42, Data: bytes.Repeat([]byte("x"), 300)},
+		{Type: MsgPuback, TopicID: 5, MessageID: 8, ReturnCode: ReturnCodeInvalidTopicID},
+		{Type: MsgPubrec, MessageID: 9},
+		{Type: MsgPubrel, MessageID: 9},
+		{Type: MsgPubcomp, MessageID: 9},
+		{Type: MsgSubscribe, Flags: qos1, MessageID: 10, TopicName: []byte("cmd/#")},
+		{Type: MsgSubscribe, Flags: short, MessageID: 11, TopicID: shortID},
+		{Type: MsgSuback, Flags: qos1, TopicID: 6, MessageID: 10},
+		{Type: MsgUnsubscribe, Flags: predefined &^ flagsQoSMask, MessageID: 12, TopicID: 42},
+		{Type: MsgUnsuback, MessageID: 12},
+		{Type: MsgPingreq},
+		{Type: MsgPingreq, ClientID: []byte("node-1")},
+		{Type: MsgPingresp},
+		{Type: MsgDisconnect},
+		{Type: MsgDisconnect, Duration: 3600},
+		{Type: MsgWillTopicUpd, Flags: qos1, TopicName: []byte("nodes/1/lost")},
+		{Type: MsgWillTopicResp},
+		{Type: MsgWillMsgUpd, Data: []byte("lost")},
+		{Type: MsgWillMsgResp, ReturnCode: ReturnCodeNotSupported},
+	} {
+		b, err := m.Append(nil)
+		if err != nil {
+			t.Errorf("%s: %v", m.Type, err)
+			continue
+		}
+		if len(b) != m.Size() {
+			t.Errorf("%s: encoded %d bytes, Size returned %d", m.Type, len(b), m.Size())
+		}
+		var got Message
+		err = got.Decode(b)
+		if err != nil {
+			t.Errorf("%s: decoding %x: %v", m.Type, b, err)
+			continue
+		}
+		if !messageEqual(&m, &got) {
+			t.Errorf("%s: round trip mismatch\n got %+v\nwant %+v", m.Type, got, m)
+		}
+	}
+}
+
+func TestMessageEncoding(t *testing.T) {
+	// PUBLISH QoS1 to topic ID 1, message ID 2, as in section 5.4.12.
+	m := Message{Type: MsgPublish, Flags: 0x20, TopicID: 1, MessageID: 2, Data: []byte("hi")}
+	b, _ := m.Append(nil)
+	if want := []byte{9, 0x0c, 0x20, 0, 1, 0, 2, 'h', 'i'}; !bytes.Equal(b, want) {
+		t.Errorf("got %x, want %x", b, want)
+	}
+	// Messages longer than 255 bytes use the 3 byte length field.
+	m.Data = make([]byte, 300)
+	b, _ = m.Append(nil)
+	if b[0] != 0x01 || int(b[1])<<8|int(b[2]) != len(b) || b[3] != byte(MsgPublish) {
+		t.Errorf("bad long header % x", b[:4])
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, errShortMessage},
+		{"length mismatch", []byte{3, byte(MsgPingresp)}, errLengthMismatch},
+		{"trailing bytes", []byte{4, byte(MsgPubrec), 0, 1, 2}, errLengthMismatch},
+		{"short body", []byte{3, byte(MsgPubrec), 0}, errShortMessage},
+		{"unknown type", []byte{2, 0x11}, errUnknownType},
+		{"encapsulated type", []byte{2, 0xfe}, errUnknownType},
+		{"protocol id", []byte{7, byte(MsgConnect), 0, 2, 0, 60, 'a'}, errProtocolID},
+		{"empty client id", []byte{6, byte(MsgConnect), 0, 1, 0, 60}, errClientIDLen},
+		{"topic id type", []byte{7, byte(MsgPublish), 0x03, 0, 1, 0, 0}, errInvalidTopicIDType},
+		{"subscribe short topic length", []byte{6, byte(MsgSubscribe), 0x02, 0, 1, 't'}, errShortMessage},
+	} {
+		var m Message
+		err := m.Decode(test.b)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestMessageTypeIsValid(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		mt := MessageType(i)
+		if mt.IsValid() != (mt.String() != "UNKNOWN") {
+			t.Errorf("%#x (%s) IsValid = %v", i, mt, mt.IsValid())
+		}
+		err := (&Message{Type: mt}).Validate()
+		if mt.IsValid() == errors.Is(err, errUnknownType) {
+			t.Errorf("%#x (%s) Validate = %v", i, mt, err)
+		}
+	}
+}
+
+func TestDecodeNoAlloc(t *testing.T) {
+	m := Message{Type: MsgPublish, Flags: 0x20, TopicID: 1, MessageID: 2, Data: []byte("payload")}
+	b, _ := m.Append(nil)
+	var got Message
+	allocs := testing.AllocsPerRun(100, func() {
+		got.Decode(b)
+	})
+	if allocs != 0 {
+		t.Errorf("Decode allocated %v times", allocs)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, qos := range []QoSLevel{QoSMinus1, QoS0, QoS1, QoS2} {
+		f, err := NewFlags(qos, TopicShort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.QoS() != qos || f.TopicIDType() != TopicShort {
+			t.Errorf("NewFlags(%d, short) = %08b: QoS %d type %s", qos, f, f.QoS(), f.TopicIDType())
+		}
+	}
+	if f, _ := NewFlags(QoSMinus1, TopicNormal); f != 0x60 {
+		t.Errorf("QoS -1 flags = %#x, want 0x60", uint8(f))
+	}
+	if _, err := NewFlags(3, TopicNormal); err == nil {
+		t.Error("expected error for QoS 3")
+	}
+	if _, err := ShortTopic("abc"); err == nil {
+		t.Error("expected error for 3 byte short topic")
+	}
+}
+
+func TestClient(t *testing.T) {
+	gw := newGateway(t)
+	received := make(chan string, 4)
+	client := NewClient(ClientConfig{
+		RetryInterval:    50 * time.Millisecond,
+		PredefinedTopics: map[uint16]string{42: "config/interval"},
+		OnPub: func(topic []byte, msg *Message) error {
+			received <- fmt.Sprintf("%s:%s:q%d", topic, msg.Data, msg.Flags.QoS())
+			return nil
+		},
+	})
+	conn := listenUDP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go gw.run(func() {
+		// Connection with Will.
+		connect := gw.expect(MsgConnect)
+		if string(connect.ClientID) != "node-1" || !connect.Flags.Will() || !connect.Flags.CleanSession() || connect.Duration != 30 {
+			gw.errorf("unexpected CONNECT %+v", connect)
+		}
+		gw.send(&Message{Type: MsgWillTopicReq})
+		if will := gw.expect(MsgWillTopic); string(will.TopicName) != "nodes/1" || will.Flags.QoS() != QoS1 || !will.Flags.Retain() {
+			gw.errorf("unexpected WILLTOPIC %+v", will)
+		}
+		gw.send(&Message{Type: MsgWillMsgReq})
+		if will := gw.expect(MsgWillMsg); string(will.Data) != "lost" {
+			gw.errorf("unexpected WILLMSG %q", will.Data)
+		}
+		gw.send(&Message{Type: MsgConnack})
+
+		// Publish QoS1 to normal topic registers it first. First PUBLISH is lost.
+		reg := gw.expect(MsgRegister)
+		gw.send(&Message{Type: MsgRegack, TopicID: 5, MessageID: reg.MessageID})
+		pub := gw.expect(MsgPublish)
+		if pub.Flags.Dup() {
+			gw.errorf("first PUBLISH has DUP set")
+		}
+		pub = gw.expect(MsgPublish)
+		if !pub.Flags.Dup() || pub.TopicID != 5 || string(pub.Data) != "21.5" {
+			gw.errorf("unexpected retransmitted PUBLISH %+v", pub)
+		}
+		gw.send(&Message{Type: MsgPuback, TopicID: 5, MessageID: pub.MessageID})
+
+		// Subscribe assigns a topic ID, then gateway publishes to it during a ping.
+		sub := gw.expect(MsgSubscribe)
+		gw.send(&Message{Type: MsgSuback, Flags: 0x20, TopicID: 6, MessageID: sub.MessageID})
+		gw.expect(MsgPingreq)
+		gw.send(&Message{Type: MsgPublish, Flags: 0x20, TopicID: 6, MessageID: 100, Data: []byte("on")})
+		if ack := gw.expect(MsgPuback); ack.MessageID != 100 || ack.ReturnCode != ReturnCodeAccepted {
+			gw.errorf("unexpected PUBACK %+v", ack)
+		}
+		// Gateway registers a topic of a wildcard subscription before publishing QoS2 to it.
+		gw.send(&Message{Type: MsgRegister, TopicID: 7, MessageID: 101, TopicName: []byte("cmd/reset")})
+		gw.expect(MsgRegack)
+		gw.send(&Message{Type: MsgPublish, Flags: 0x40, TopicID: 7, MessageID: 102, Data: []byte("now")})
+		gw.expect(MsgPubrec)
+		gw.send(&Message{Type: MsgPubrel, MessageID: 102})
+		gw.expect(MsgPubcomp)
+		// Unknown topic ID is rejected.
+		gw.send(&Message{Type: MsgPublish, Flags: 0x20, TopicID: 99, MessageID: 103})
+		if ack := gw.expect(MsgPuback); ack.ReturnCode != ReturnCodeInvalidTopicID {
+			gw.errorf("got PUBACK %s for unknown topic ID", ack.ReturnCode)
+		}
+		gw.send(&Message{Type: MsgPingresp})
+
+		// Sleep and wake up to receive buffered messages.
+		if d := gw.expect(MsgDisconnect); d.Duration != 60 {
+			gw.errorf("got sleep duration %d", d.Duration)
+		}
+		gw.send(&Message{Type: MsgDisconnect})
+		if ping := gw.expect(MsgPingreq); string(ping.ClientID) != "node-1" {
+			gw.errorf("got PINGREQ client ID %q", ping.ClientID)
+		}
+		shortID, _ := ShortTopic("t1")
+		gw.send(&Message{Type: MsgPublish, Flags: 0x02, TopicID: shortID, Data: []byte("buffered")})
+		gw.send(&Message{Type: MsgPublish, Flags: 0x01, TopicID: 42, Data: []byte("10s")})
+		gw.send(&Message{Type: MsgPingresp})
+
+		gw.expect(MsgDisconnect)
+		gw.send(&Message{Type: MsgDisconnect})
+	})
+
+	err := client.Connect(ctx, conn, gw.addr(), &ConnectOptions{
+		ClientID:     "node-1",
+		KeepAlive:    30,
+		CleanSession: true,
+		Will:         &Will{Topic: "nodes/1", Message: []byte("lost"), QoS: QoS1, Retain: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish(ctx, Topic{Name: "sensors/temp"}, QoS1, false, []byte("21.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, granted, err := client.Subscribe(ctx, Topic{Name: "cmd/led"}, QoS1)
+	if err != nil || id != 6 || granted != QoS1 {
+		t.Fatalf("Subscribe = %d, %d, %v", id, granted, err)
+	}
+	err = client.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received, "cmd/led:on:q1", "cmd/reset:now:q2")
+
+	err = client.Sleep(ctx, 60)
+	if err != nil || !client.IsAsleep() {
+		t.Fatalf("Sleep: %v, asleep=%v", err, client.IsAsleep())
+	}
+	err = client.Awake(ctx)
+	if err != nil || !client.IsAsleep() {
+		t.Fatalf("Awake: %v, asleep=%v", err, client.IsAsleep())
+	}
+	expectReceived(t, received, "t1:buffered:q0", "config/interval:10s:q0")
+
+	err = client.Disconnect(ctx)
+	if err != nil || client.IsConnected() {
+		t.Fatalf("Disconnect: %v, connected=%v", err, client.IsConnected())
+	}
+	gw.wait()
+}
+
+func TestClientNoResponse(t *testing.T) {
+	gw := newGateway(t)
+	client := NewClient(ClientConfig{RetryInterval: 10 * time.Millisecond, MaxRetries: 2})
+	conn := listenUDP(t)
+	go gw.run(func() {
+		gw.expect(MsgConnect)
+		gw.send(&Message{Type: MsgConnack})
+		// Gateway goes silent.
+		for i := 0; i < 3; i++ {
+			gw.expect(MsgPingreq)
+		}
+		// QoS -1 needs no response.
+		shortID, _ := ShortTopic("t1")
+		if pub := gw.expect(MsgPublish); pub.Flags.QoS() != QoSMinus1 || pub.TopicID != shortID {
+			gw.errorf("unexpected PUBLISH %+v", pub)
+		}
+	})
+	ctx := context.Background()
+	err := client.Connect(ctx, conn, gw.addr(), &ConnectOptions{ClientID: "node-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Ping(ctx)
+	if !errors.Is(err, errNoResponse) || client.IsConnected() {
+		t.Errorf("got error %v, connected=%v after gateway went silent", err, client.IsConnected())
+	}
+	err = PublishMinus1(conn, gw.addr(), Topic{Type: TopicShort, Name: "t1"}, false, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.wait()
+}
+
+func TestClientRejected(t *testing.T) {
+	gw := newGateway(t)
+	client := NewClient(ClientConfig{RetryInterval: time.Second})
+	conn := listenUDP(t)
+	go gw.run(func() {
+		gw.expect(MsgConnect)
+		gw.send(&Message{Type: MsgConnack, ReturnCode: ReturnCodeCongestion})
+	})
+	err := client.Connect(context.Background(), conn, gw.addr(), &ConnectOptions{ClientID: "node-3"})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || !errors.Is(err, ReturnCodeCongestion) {
+		t.Errorf("got error %v, want congestion", err)
+	}
+	gw.wait()
+}
+
+func expectReceived(t *testing.T, received chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Errorf("received %q, want %q", got, w)
+			}
+		default:
+			t.Errorf("did not receive %q", w)
+		}
+	}
+}
+
+// gateway is a scripted MQTT-SN gateway for testing clients.
+type gateway struct {
+	t      *testing.T
+	conn   net.PacketConn
+	client net.Addr
+	buf    []byte
+	done   chan struct{}
+}
+
+func newGateway(t *testing.T) *gateway {
+	return &gateway{t: t, conn: listenUDP(t), buf: make([]byte, 1500), done: make(chan struct{})}
+}
+
+func (g *gateway) addr() net.Addr { return g.conn.LocalAddr() }
+
+// run runs script in the calling goroutine, which must not be the test goroutine.
+func (g *gateway) run(script func()) {
+	defer close(g.done)
+	defer func() {
+		if r := recover(); r != nil && r != errScriptFailed {
+			panic(r)
+		}
+	}()
+	g.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	script()
+}
+
+func (g *gateway) wait() { <-g.done }
+
+var errScriptFailed = errors.New("gateway script failed")
+
+func (g *gateway) errorf(format string, args ...any) {
+	g.t.Errorf("gateway: "+format, args...)
+}
+
+func (g *gateway) expect(tp MessageType) Message {
+	n, addr, err := g.conn.ReadFrom(g.buf)
+	if err != nil {
+		g.errorf("expecting %s: %v", tp, err)
+		panic(errScriptFailed)
+	}
+	g.client = addr
+	var m Message
+	err = m.Decode(append([]byte(nil), g.buf[:n]...))
+	if err != nil {
+		g.errorf("decoding: %v", err)
+		panic(errScriptFailed)
+	}
+	if m.Type != tp {
+		g.errorf("got %s, expected %s", m.Type, tp)
+		panic(errScriptFailed)
+	}
+	return m
+}
+
+func (g *gateway) send(m *Message) {
+	b, err := m.Append(nil)
+	if err == nil {
+		_, err = g.conn.WriteTo(b, g.client)
+	}
+	if err != nil {
+		g.errorf("sending %s: %v", m.Type, err)
+		panic(errScriptFailed)
+	}
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// messageEqual compares messages treating nil and empty byte slices as equal.
+func messageEqual(a, b *Message) bool {
+	norm := func(m Message) Message {
+		for _, p := range []*[]byte{&m.ClientID, &m.TopicName, &m.Data} {
+			if len(*p) == 0 {
+				*p = nil
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(norm(*a), norm(*b))
+}
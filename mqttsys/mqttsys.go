@@ -0,0 +1,213 @@
+// Package mqttsys publishes the statistics of an MQTT server built on natiu-mqtt
+// under the $SYS topic tree, following the layout used by most brokers:
+//
+//	$SYS/broker/version
+//	$SYS/broker/uptime
+//	$SYS/broker/clients/connected
+//	$SYS/broker/clients/maximum
+//	$SYS/broker/messages/received
+//	$SYS/broker/load/messages/received/1min
+//	...
+//
+// Topics starting with '$' are not matched by filters starting with a wildcard
+// as per MQTT-4.7.2-1, so clients must subscribe to $SYS/# explicitly.
+package mqttsys
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is the publishing interval used when Config.Interval is zero.
+const DefaultInterval = 10 * time.Second
+
+// Stats are the counters of a server. Counters are cumulative since the server
+// started while ClientsConnected, Subscriptions and Retained are current values.
+type Stats struct {
+	// ClientsConnected is the number of currently connected clients.
+	ClientsConnected int
+	// Connections is the number of accepted connections.
+	Connections uint64
+	// MessagesReceived and MessagesSent count MQTT control packets of all types.
+	MessagesReceived, MessagesSent uint64
+	// PublishReceived and PublishSent count PUBLISH packets.
+	PublishReceived, PublishSent uint64
+	// BytesReceived and BytesSent count bytes on the wire.
+	BytesReceived, BytesSent uint64
+	// Subscriptions is the number of active subscriptions.
+	Subscriptions int
+	// Retained is the number of retained messages stored by the server.
+	Retained int
+}
+
+// Config configures a Publisher.
+type Config struct {
+	// Stats returns the current counters of the server. Required.
+	Stats func() Stats
+	// Publish delivers a message to the server's subscribers of topic and
+	// stores it as the retained message of topic. payload is only valid during
+	// the call. Required.
+	Publish func(topic string, payload []byte) error
+	// Interval between publications. Defaults to DefaultInterval.
+	Interval time.Duration
+	// Version is published to $SYS/broker/version. Not published if empty.
+	Version string
+	// Started is the time the server started, used for $SYS/broker/uptime.
+	// Defaults to the time NewPublisher is called.
+	Started time.Time
+}
+
+// Publisher periodically publishes server statistics under $SYS.
+// Load averages are exponentially weighted moving averages of the per-minute
+// rate of each counter over 1, 5 and 15 minutes.
+type Publisher struct {
+	cfg Config
+
+	mu         sync.Mutex
+	last       Stats
+	lastTime   time.Time
+	maxClients int
+	loads      [len(loadTopics)][len(loadPeriods)]float64
+	buf        []byte
+}
+
+var (
+	errNoStats   = errors.New("nil Config.Stats")
+	errNoPublish = errors.New("nil Config.Publish")
+)
+
+// loadPeriods are the periods of the load averages in minutes.
+var loadPeriods = [...]float64{1, 5, 15}
+
+// loadTopics are the $SYS/broker/load topics without the period level, in the
+// order of the counters returned by loadCounters.
+var loadTopics = [...]string{
+	"$SYS/broker/load/connections/",
+	"$SYS/broker/load/messages/received/",
+	"$SYS/broker/load/messages/sent/",
+	"$SYS/broker/load/publish/received/",
+	"$SYS/broker/load/publish/sent/",
+	"$SYS/broker/load/bytes/received/",
+	"$SYS/broker/load/bytes/sent/",
+}
+
+var loadPeriodLevels = [len(loadPeriods)]string{"1min", "5min", "15min"}
+
+func loadCounters(s Stats) [len(loadTopics)]uint64 {
+	return [...]uint64{s.Connections, s.MessagesReceived, s.MessagesSent,
+		s.PublishReceived, s.PublishSent, s.BytesReceived, s.BytesSent}
+}
+
+// NewPublisher returns a Publisher configured with cfg.
+func NewPublisher(cfg Config) (*Publisher, error) {
+	if cfg.Stats == nil {
+		return nil, errNoStats
+	} else if cfg.Publish == nil {
+		return nil, errNoPublish
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Started.IsZero() {
+		cfg.Started = time.Now()
+	}
+	return &Publisher{cfg: cfg}, nil
+}
+
+// Run publishes statistics immediately and then every Config.Interval until ctx
+// is done or Config.Publish returns an error. It returns the error that stopped it.
+func (p *Publisher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	err := p.PublishAt(time.Now())
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			err = p.PublishAt(now)
+		}
+	}
+	return err
+}
+
+// PublishAt updates load averages with the counters sampled at now and
+// publishes all statistics once. It is called by Run and exported for servers
+// that drive publication from their own event loop.
+func (p *Publisher) PublishAt(now time.Time) error {
+	stats := p.cfg.Stats()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updateLoads(stats, now)
+	if stats.ClientsConnected > p.maxClients {
+		p.maxClients = stats.ClientsConnected
+	}
+	if p.cfg.Version != "" {
+		if err := p.cfg.Publish("$SYS/broker/version", []byte(p.cfg.Version)); err != nil {
+			return err
+		}
+	}
+	uptime := int64(now.Sub(p.cfg.Started) / time.Second)
+	p.buf = append(strconv.AppendInt(p.buf[:0], uptime, 10), " seconds"...)
+	if err := p.cfg.Publish("$SYS/broker/uptime", p.buf); err != nil {
+		return err
+	}
+	for _, v := range []struct {
+		topic string
+		value uint64
+	}{
+		{"$SYS/broker/clients/connected", uint64(stats.ClientsConnected)},
+		{"$SYS/broker/clients/maximum", uint64(p.maxClients)},
+		{"$SYS/broker/clients/total", stats.Connections},
+		{"$SYS/broker/messages/received", stats.MessagesReceived},
+		{"$SYS/broker/messages/sent", stats.MessagesSent},
+		{"$SYS/broker/publish/messages/received", stats.PublishReceived},
+		{"$SYS/broker/publish/messages/sent", stats.PublishSent},
+		{"$SYS/broker/bytes/received", stats.BytesReceived},
+		{"$SYS/broker/bytes/sent", stats.BytesSent},
+		{"$SYS/broker/subscriptions/count", uint64(stats.Subscriptions)},
+		{"$SYS/broker/retained messages/count", uint64(stats.Retained)},
+	} {
+		p.buf = strconv.AppendUint(p.buf[:0], v.value, 10)
+		if err := p.cfg.Publish(v.topic, p.buf); err != nil {
+			return err
+		}
+	}
+	for i, topic := range loadTopics {
+		for j, level := range loadPeriodLevels {
+			p.buf = strconv.AppendFloat(p.buf[:0], p.loads[i][j], 'f', 2, 64)
+			if err := p.cfg.Publish(topic+level, p.buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateLoads folds the per-minute rate of each counter since the last sample
+// into the load averages. The first sample only sets the baseline.
+func (p *Publisher) updateLoads(stats Stats, now time.Time) {
+	elapsed := now.Sub(p.lastTime).Minutes()
+	if !p.lastTime.IsZero() && elapsed > 0 {
+		last, current := loadCounters(p.last), loadCounters(stats)
+		for i := range current {
+			delta := current[i] - last[i]
+			if current[i] < last[i] {
+				delta = current[i] // Counters were reset.
+			}
+			rate := float64(delta) / elapsed
+			for j, period := range loadPeriods {
+				decay := math.Exp(-elapsed / period)
+				p.loads[i][j] = rate + decay*(p.loads[i][j]-rate)
+			}
+		}
+	}
+	if p.lastTime.IsZero() || elapsed > 0 {
+		p.last = stats
+		p.lastTime = now
+	}
+}
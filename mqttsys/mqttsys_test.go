@@ -0,0 +1,146 @@
+package mqttsys
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestPublisher(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stats := Stats{ClientsConnected: 3, Connections: 3, MessagesReceived: 100, Subscriptions: 2}
+	retained := make(map[string]string)
+	p, err := NewPublisher(Config{
+		Stats: func() Stats { return stats },
+		Publish: func(topic string, payload []byte) error {
+			retained[topic] = string(payload)
+			return nil
+		},
+		Version: "natiu-mqtt test",
+		Started: started,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PublishAt(started.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	stats.ClientsConnected = 1
+	stats.MessagesReceived += 600
+	if err := p.PublishAt(started.Add(time.Minute + time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string]string{
+		"$SYS/broker/version":                      "natiu-mqtt test",
+		"$SYS/broker/uptime":                       "61 seconds",
+		"$SYS/broker/clients/connected":            "1",
+		"$SYS/broker/clients/maximum":              "3",
+		"$SYS/broker/messages/received":            "700",
+		"$SYS/broker/subscriptions/count":          "2",
+		"$SYS/broker/load/messages/received/1min":  "379.27",
+		"$SYS/broker/load/messages/received/5min":  "108.76",
+		"$SYS/broker/load/messages/received/15min": "38.70",
+		"$SYS/broker/load/connections/1min":        "0.00",
+		"$SYS/broker/load/publish/sent/15min":      "0.00",
+		"$SYS/broker/retained messages/count":      "0",
+		"$SYS/broker/publish/messages/received":    "0",
+		"$SYS/broker/load/bytes/received/5min":     "0.00",
+		"$SYS/broker/load/messages/sent/1min":      "0.00",
+		"$SYS/broker/load/publish/received/1min":   "0.00",
+		"$SYS/broker/load/bytes/sent/15min":        "0.00",
+	} {
+		if got := retained[topic]; got != want {
+			t.Errorf("%s: got %q, want %q", topic, got, want)
+		}
+	}
+
+	_, err = NewPublisher(Config{Stats: func() Stats { return stats }})
+	if err != errNoPublish {
+		t.Errorf("got %v creating publisher without Publish", err)
+	}
+}
+
+func TestPublisherRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var b mqtttest.Broker
+	defer b.Close()
+	sys := observe(t, ctx, &b, "sys", "$SYS/broker/clients/connected")
+	all := observe(t, ctx, &b, "all", "#")
+	p, err := NewPublisher(Config{
+		Stats: func() Stats { return Stats{ClientsConnected: len(b.Clients())} },
+		Publish: func(topic string, payload []byte) error {
+			b.Publish(topic, payload)
+			return nil
+		},
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- p.Run(runCtx) }()
+	expect(t, sys, "$SYS/broker/clients/connected 2")
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v", err)
+	}
+	// Wildcard subscription at first level does not receive $SYS topics.
+	b.Publish("after/sys", []byte("x"))
+	expect(t, all, "after/sys x")
+}
+
+// observe subscribes a new client of b to filter and returns the received
+// messages formatted as "topic payload".
+func observe(t *testing.T, ctx context.Context, b *mqtttest.Broker, clientID, filter string) <-chan string {
+	t.Helper()
+	msgs := make(chan string, 64)
+	c := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			msgs <- string(vp.TopicName) + " " + string(payload)
+			return err
+		},
+	})
+	var vc mqtt.VariablesConnect
+	vc.SetDefaultMQTT([]byte(clientID))
+	err := c.Connect(ctx, b.Dial(), &vc)
+	if err == nil {
+		err = c.Subscribe(ctx, mqtt.VariablesSubscribe{
+			PacketIdentifier: 1,
+			TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte(filter)}},
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for c.IsConnected() {
+			c.HandleNext()
+		}
+	}()
+	t.Cleanup(func() {
+		if c.IsConnected() {
+			c.Disconnect(errors.New("done"))
+		}
+	})
+	return msgs
+}
+
+func expect(t *testing.T, msgs <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-msgs:
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not receive %q", want)
+	}
+}
@@ -0,0 +1,560 @@
+// Package mqtttest provides an in-memory MQTT v3.1.1 broker for testing
+// MQTT clients without a network or an external broker.
+//
+// Broker behaviour can be scripted with [Broker.SetBehavior] to exercise error
+// paths such as refused connections, slow SUBACKs or missing PINGRESPs, and
+// PUBLISH packets can be injected into connected clients with [Broker.Publish].
+package mqtttest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqttsession"
+)
+
+// Behavior scripts how a Broker responds to clients. The zero value
+// is a well behaved broker.
+type Behavior struct {
+	// ConnectReturnCode is sent in the CONNACK in response to every CONNECT.
+	// If not ReturnCodeConnAccepted the connection is closed after sending the CONNACK.
+	ConnectReturnCode mqtt.ConnectReturnCode
+	// SubackDelay delays SUBACK responses. Other packets may be sent by the
+	// broker while a SUBACK is delayed.
+	SubackDelay time.Duration
+	// DropPingresp makes the broker ignore PINGREQ packets.
+	DropPingresp bool
+	// ShareStrategy selects the member of each shared subscription group that
+	// receives a message. Messages are in flight to a member until written to
+	// its connection, which acknowledges QoS0 delivery.
+	ShareStrategy mqtt.ShareStrategy
+	// NoLocal makes the broker not send messages back to the client that
+	// published them, as Mosquitto does for bridges with try_private set.
+	// Shared subscriptions are not affected.
+	NoLocal bool
+}
+
+// Broker is an in-memory MQTT v3.1.1 broker meant for tests. It routes
+// PUBLISH packets between connected clients with QoS0 delivery and grants
+// QoS0 to all subscriptions. Shared subscriptions of the form
+// "$share/{ShareName}/{filter}" are balanced among the members of each group
+// as selected by Behavior.ShareStrategy, round robin by default. Persistent
+// sessions are kept if enabled with [Broker.SetSessions]. It does not keep
+// retained messages or will messages. The zero value is ready for use and safe
+// for concurrent use.
+type Broker struct {
+	mu       sync.Mutex
+	behavior Behavior
+	conns    map[*conn]struct{}
+	// shared members are identified by connection key, not client identifier,
+	// so a connection taken over leaves the membership of the new one be.
+	shared   mqtt.SharedGroups
+	nextKey  uint64
+	sessions *mqttsession.Manager
+	closed   bool
+}
+
+// SetBehavior sets the behavior of the broker for all packets received after the call.
+func (b *Broker) SetBehavior(behavior Behavior) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.behavior = behavior
+	b.shared.Strategy = behavior.ShareStrategy // Only accessed with b.mu held.
+}
+
+// Behavior returns the current behavior of the broker.
+func (b *Broker) Behavior() Behavior {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.behavior
+}
+
+// SetSessions keeps the sessions of clients connecting with CleanSession set to
+// false in m, which is nil by default. Subscriptions of persistent sessions are
+// restored on reconnection, CONNACK sets Session Present and queued messages
+// are delivered after the CONNACK. Queued messages are removed from the
+// session once all of them are written to the connection. Since the broker grants QoS0, messages are
+// only queued for disconnected clients if m is configured with QueueQoS0.
+// Connections are also attached to m, which closes connections exceeding their
+// keep alive and connections taken over by a new connection with the same client
+// identifier. SetSessions should be called before clients connect.
+func (b *Broker) SetSessions(m *mqttsession.Manager) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions = m
+}
+
+func (b *Broker) sessionManager() *mqttsession.Manager {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sessions
+}
+
+// Dial returns the client end of an in-memory connection to the broker.
+// The broker end is served in a separate goroutine.
+func (b *Broker) Dial() net.Conn {
+	client, server := net.Pipe()
+	go b.ServeConn(server)
+	return client
+}
+
+// Listen listens on the TCP network address addr, i.e: "127.0.0.1:0", and serves
+// accepted connections in a separate goroutine until the returned listener is closed.
+func (b *Broker) Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go b.Serve(l)
+	return l, nil
+}
+
+// Serve accepts connections on l and serves each in a separate goroutine.
+// It returns when l.Accept fails, i.e: after l is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go b.ServeConn(c)
+	}
+}
+
+var (
+	errBrokerClosed = errors.New("mqtttest: broker closed")
+	errNotConnected = errors.New("mqtttest: first packet was not CONNECT")
+	errClientDisc   = errors.New("mqtttest: client disconnected")
+)
+
+// ServeConn serves a single MQTT connection and blocks until it is closed
+// by either end. It returns nil if the client disconnected gracefully.
+func (b *Broker) ServeConn(rwc net.Conn) error {
+	c := &conn{
+		b:    b,
+		rwc:  rwc,
+		out:  make(chan outgoing, 256),
+		done: make(chan struct{}),
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		rwc.Close()
+		return errBrokerClosed
+	}
+	if b.conns == nil {
+		b.conns = make(map[*conn]struct{})
+	}
+	b.nextKey++
+	c.key = strconv.FormatUint(b.nextKey, 10)
+	b.conns[c] = struct{}{}
+	b.mu.Unlock()
+
+	c.rx.SetRxTransport(rwc)
+	c.rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 4*1024)})
+	c.rx.Strict = true
+	c.rx.RxCallbacks = mqtt.RxCallbacks{
+		OnConnect: c.onConnect,
+		OnPub:     c.onPub,
+		OnSub:     c.onSub,
+		OnUnsub:   c.onUnsub,
+		OnOther:   c.onOther,
+	}
+	c.tx.SetTxTransport(rwc)
+	go c.writeLoop()
+
+	var err error
+	for err == nil {
+		_, err = c.rx.ReadNextPacket()
+		if err == nil && c.link != nil {
+			c.link.Touch()
+		}
+	}
+	close(c.done)
+	rwc.Close()
+	if c.link != nil {
+		// Following messages are queued in the session. A connection taken over
+		// by a new connection with the same client identifier leaves it be.
+		c.link.Close()
+	}
+	// Following messages to shared subscriptions go to remaining group members.
+	b.shared.Remove(c.key)
+	c.mu.Lock()
+	c.shared = nil
+	c.mu.Unlock()
+	b.mu.Lock()
+	delete(b.conns, c)
+	b.mu.Unlock()
+	// Messages still queued are not delivered.
+	for len(c.out) > 0 {
+		c.finish(<-c.out)
+	}
+	if errors.Is(err, errClientDisc) || errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
+
+// Publish injects a QoS0 PUBLISH packet with the given topic and payload into
+// all connected clients with a matching subscription. It returns the number of
+// clients the packet was queued for. Publish does not block on client reads;
+// clients with a full queue of pending packets do not receive the packet.
+func (b *Broker) Publish(topic string, payload []byte) int {
+	return b.route(nil, topic, payload, mqtt.QoS0)
+}
+
+// Clients returns the client identifiers of connected clients.
+func (b *Broker) Clients() (clientIDs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		if c.isConnected() {
+			clientIDs = append(clientIDs, c.clientID())
+		}
+	}
+	return clientIDs
+}
+
+// DropConnections abruptly closes all connections without sending any packets,
+// simulating a network failure. It returns the number of connections closed.
+func (b *Broker) DropConnections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.rwc.Close()
+	}
+	return len(b.conns)
+}
+
+// Close drops all connections and refuses new ones. Listeners passed to Serve
+// or returned by Listen must be closed separately.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.DropConnections()
+	return nil
+}
+
+// route queues a QoS0 PUBLISH for all connections subscribed to topic and for
+// one member of each shared subscription group matching topic. Being QoS0
+// the packet is dropped for connections with a full queue. The message is
+// also queued for matching persistent sessions of disconnected clients. from is
+// the connection the message was published by, nil if injected with Publish.
+func (b *Broker) route(from *conn, topic string, payload []byte, qos mqtt.QoSLevel) (n int) {
+	pkt := mqtt.Packet{
+		Publish: mqtt.VariablesPublish{TopicName: []byte(topic)},
+		Payload: append([]byte{}, payload...),
+	}
+	pkt.Header, _ = mqtt.NewHeader(mqtt.PacketPublish, 0, 0)
+	// Queue in sessions before checking subscriptions so a client resuming its
+	// session meanwhile gets the message either queued or on its restored
+	// subscriptions. Not done under b.mu since queueing may sync to disk.
+	if sessions := b.sessionManager(); sessions != nil {
+		sessions.Publish(topic, payload, qos)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	picked := b.shared.Pick(topic, nil)
+	for c := range b.conns {
+		o := outgoing{pkt: pkt}
+		for _, member := range picked {
+			o.shared = o.shared || member == c.key
+		}
+		if !o.shared && (c == from && b.behavior.NoLocal || !c.subscribed(topic)) {
+			continue
+		}
+		select {
+		case c.out <- o:
+			n++
+		default:
+			c.finish(o)
+		}
+	}
+	return n
+}
+
+// outgoing is a packet queued for writing by a conn's write loop.
+type outgoing struct {
+	pkt mqtt.Packet
+	// closeAfter closes the connection after writing pkt.
+	closeAfter bool
+	// shared is set for a PUBLISH to a shared subscription, which is in flight until written.
+	shared bool
+	// delivered is the number of queued session messages delivered once pkt is written.
+	delivered int
+}
+
+// conn is a single client connection to a Broker.
+type conn struct {
+	b   *Broker
+	rwc net.Conn
+	// key identifies the connection in the broker's shared subscription groups.
+	key string
+	rx  mqtt.Rx // Only accessed by ServeConn's goroutine.
+	tx  mqtt.Tx // Only accessed by writeLoop.
+
+	out  chan outgoing
+	done chan struct{}
+	// link is the connection attached to the session manager. Only accessed by ServeConn's goroutine.
+	link *mqttsession.Link
+
+	mu        sync.Mutex
+	id        string
+	connected bool
+	subs      []string
+	// shared are the shared subscription topic filters of the connection.
+	shared []string
+}
+
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case o := <-c.out:
+			err := c.tx.WritePacket(&o.pkt)
+			c.finish(o)
+			if err == nil && o.delivered > 0 {
+				// Queued QoS0 messages are delivered once written. c.link is
+				// set before the messages are sent to c.out.
+				c.link.Delivered(o.delivered)
+			}
+			if err != nil || o.closeAfter {
+				c.rwc.Close()
+				return
+			}
+		}
+	}
+}
+
+// send queues a packet for writing. It drops the packet if the connection is closed.
+func (c *conn) send(o outgoing) {
+	select {
+	case c.out <- o:
+	case <-c.done:
+	}
+}
+
+// finish ends the delivery of o, which was either written or discarded.
+func (c *conn) finish(o outgoing) {
+	if o.shared {
+		c.b.shared.Done(c.key)
+	}
+}
+
+func (c *conn) clientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+func (c *conn) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, filter := range c.subs {
+		if mqtt.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) isConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *conn) onConnect(rx *mqtt.Rx, vc *mqtt.VariablesConnect) error {
+	rc := c.b.Behavior().ConnectReturnCode
+	if vc.ProtocolLevel != mqtt.DefaultProtocolLevel {
+		rc = mqtt.ReturnCodeUnnaceptableProtocol // MQTT-3.1.2-2.
+	}
+	var session mqttsession.Session
+	var present bool
+	sessions := c.b.sessionManager()
+	c.mu.Lock()
+	// Session is resumed with the connection locked so messages routed meanwhile
+	// are either queued in the session or sent to the restored subscriptions.
+	if sessions != nil && rc == mqtt.ReturnCodeConnAccepted {
+		var err error
+		if len(vc.ClientID) == 0 && !vc.CleanSession {
+			rc = mqtt.ReturnCodeIdentifierRejected // MQTT-3.1.3-8.
+		} else {
+			session, present, err = sessions.Connect(string(vc.ClientID), vc.CleanSession)
+			if err != nil {
+				rc = mqtt.ReturnCodeServerUnavailable
+			} else {
+				// A refused CONNECT leaves the connection attached for the client identifier be.
+				c.link = sessions.Attach(string(vc.ClientID), vc.KeepAlive, c.rwc)
+			}
+		}
+	}
+	c.id = string(vc.ClientID)
+	c.connected = rc == mqtt.ReturnCodeConnAccepted
+	for _, sub := range session.Subscriptions {
+		c.subscribe(sub.Filter)
+	}
+	c.mu.Unlock()
+	pkt := mqtt.Packet{Connack: mqtt.VariablesConnack{ReturnCode: rc}}
+	if present && rc == mqtt.ReturnCodeConnAccepted {
+		pkt.Connack.AckFlags = 1 // Session Present.
+	}
+	pkt.Header, _ = mqtt.NewHeader(mqtt.PacketConnack, 0, 0)
+	c.send(outgoing{pkt: pkt, closeAfter: rc != mqtt.ReturnCodeConnAccepted})
+	if rc != mqtt.ReturnCodeConnAccepted {
+		return nil
+	}
+	for i, msg := range session.Queue {
+		pub := mqtt.Packet{
+			Publish: mqtt.VariablesPublish{TopicName: []byte(msg.Topic)},
+			Payload: msg.Payload,
+		}
+		pub.Header, _ = mqtt.NewHeader(mqtt.PacketPublish, 0, 0) // Delivered with granted QoS0.
+		o := outgoing{pkt: pub}
+		if i == len(session.Queue)-1 {
+			// Queue is removed from the session once completely written.
+			o.delivered = len(session.Queue)
+		}
+		c.send(o)
+	}
+	return nil
+}
+
+func (c *conn) onPub(rx *mqtt.Rx, vp mqtt.VariablesPublish, r io.Reader) error {
+	if !c.isConnected() {
+		return errNotConnected
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch rx.LastReceivedHeader.Flags().QoS() {
+	case mqtt.QoS1:
+		c.send(outgoing{pkt: identified(mqtt.PacketPuback, vp.PacketIdentifier)})
+	case mqtt.QoS2:
+		c.send(outgoing{pkt: identified(mqtt.PacketPubrec, vp.PacketIdentifier)})
+	}
+	c.b.route(c, string(vp.TopicName), payload, rx.LastReceivedHeader.Flags().QoS())
+	return nil
+}
+
+func (c *conn) onSub(rx *mqtt.Rx, vs mqtt.VariablesSubscribe) error {
+	if !c.isConnected() {
+		return errNotConnected
+	}
+	pkt := mqtt.Packet{Suback: mqtt.VariablesSuback{
+		PacketIdentifier: vs.PacketIdentifier,
+		ReturnCodes:      make([]mqtt.QoSLevel, len(vs.TopicFilters)), // All granted QoS0.
+	}}
+	pkt.Header, _ = mqtt.NewHeader(mqtt.PacketSuback, 0, 0)
+	var granted []mqttsession.Subscription
+	c.mu.Lock()
+	for i, sub := range vs.TopicFilters {
+		filter := string(sub.TopicFilter)
+		if c.subscribe(filter) {
+			granted = append(granted, mqttsession.Subscription{Filter: filter, QoS: mqtt.QoS0})
+		} else {
+			pkt.Suback.ReturnCodes[i] = mqtt.QoSSubfail
+		}
+	}
+	id := c.id
+	c.mu.Unlock()
+	if sessions := c.b.sessionManager(); sessions != nil {
+		sessions.Subscribe(id, granted...)
+	}
+	if delay := c.b.Behavior().SubackDelay; delay > 0 {
+		time.AfterFunc(delay, func() { c.send(outgoing{pkt: pkt}) })
+	} else {
+		c.send(outgoing{pkt: pkt})
+	}
+	return nil
+}
+
+// subscribe adds filter to the subscriptions of the connection and returns
+// false if filter is an invalid shared subscription. c.mu must be held.
+func (c *conn) subscribe(filter string) bool {
+	_, shared, err := mqtt.ParseSharedFilter(filter)
+	switch {
+	case err != nil:
+		return false
+	case shared:
+		c.b.shared.Subscribe(filter, c.key)
+		c.shared = append(c.shared, filter)
+	default:
+		c.subs = append(c.subs, filter)
+	}
+	return true
+}
+
+func (c *conn) onUnsub(rx *mqtt.Rx, vu mqtt.VariablesUnsubscribe) error {
+	if !c.isConnected() {
+		return errNotConnected
+	}
+	c.mu.Lock()
+	subs := c.subs[:0]
+	for _, filter := range c.subs {
+		remove := false
+		for _, topic := range vu.Topics {
+			remove = remove || filter == string(topic)
+		}
+		if !remove {
+			subs = append(subs, filter)
+		}
+	}
+	c.subs = subs
+	shared := c.shared[:0]
+	for _, filter := range c.shared {
+		remove := false
+		for _, topic := range vu.Topics {
+			remove = remove || filter == string(topic)
+		}
+		if remove {
+			c.b.shared.Unsubscribe(filter, c.key)
+		} else {
+			shared = append(shared, filter)
+		}
+	}
+	c.shared = shared
+	id := c.id
+	c.mu.Unlock()
+	if sessions := c.b.sessionManager(); sessions != nil {
+		filters := make([]string, len(vu.Topics))
+		for i, topic := range vu.Topics {
+			filters[i] = string(topic)
+		}
+		sessions.Unsubscribe(id, filters...)
+	}
+	c.send(outgoing{pkt: identified(mqtt.PacketUnsuback, vu.PacketIdentifier)})
+	return nil
+}
+
+func (c *conn) onOther(rx *mqtt.Rx, packetIdentifier uint16) error {
+	if !c.isConnected() {
+		return errNotConnected
+	}
+	switch rx.LastReceivedHeader.Type() {
+	case mqtt.PacketDisconnect:
+		return errClientDisc
+	case mqtt.PacketPingreq:
+		if !c.b.Behavior().DropPingresp {
+			pkt := mqtt.Packet{}
+			pkt.Header, _ = mqtt.NewHeader(mqtt.PacketPingresp, 0, 0)
+			c.send(outgoing{pkt: pkt})
+		}
+	case mqtt.PacketPubrel:
+		c.send(outgoing{pkt: identified(mqtt.PacketPubcomp, packetIdentifier)})
+	}
+	return nil
+}
+
+func identified(tp mqtt.PacketType, packetIdentifier uint16) mqtt.Packet {
+	h, _ := mqtt.NewHeader(tp, 0, 2)
+	return mqtt.Packet{Header: h, PacketIdentifier: packetIdentifier}
+}
@@ -0,0 +1,516 @@
+package mqtttest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqttsession"
+)
+
+func TestBrokerPublish(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	received := make(chan string, 1)
+	client := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			received <- string(vp.TopicName) + ":" + string(payload)
+			return err
+		},
+	})
+	conn := connect(t, &b, client, "salamanca")
+	subscribe(t, client, "sensors/+/temp")
+	if ids := b.Clients(); len(ids) != 1 || ids[0] != "salamanca" {
+		t.Errorf("unexpected clients %q", ids)
+	}
+	if n := b.Publish("sensors/1/humidity", []byte("no match")); n != 0 {
+		t.Errorf("expected no subscribers, got %d", n)
+	}
+	if n := b.Publish("sensors/1/temp", []byte("25")); n != 1 {
+		t.Fatalf("expected one subscriber, got %d", n)
+	}
+	handleUntil(t, client, conn, func() bool { return len(received) > 0 })
+	if got := <-received; got != "sensors/1/temp:25" {
+		t.Errorf("got %q", got)
+	}
+
+	// Client publishes to itself through broker.
+	err := client.PublishPayload(0, mqtt.VariablesPublish{TopicName: []byte("sensors/2/temp"), PacketIdentifier: 1}, []byte("26"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUntil(t, client, conn, func() bool { return len(received) > 0 })
+	if got := <-received; got != "sensors/2/temp:26" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBrokerRefuseConnect(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	b.SetBehavior(Behavior{ConnectReturnCode: mqtt.ReturnCodeUnauthorized})
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, b.Dial(), &varConn)
+	var rc mqtt.ConnectReturnCode
+	if !errors.As(err, &rc) || rc != mqtt.ReturnCodeUnauthorized {
+		t.Fatal("expected unauthorized connect error, got", err)
+	}
+	if len(b.Clients()) != 0 {
+		t.Error("refused client listed as connected")
+	}
+}
+
+func TestBrokerSubackDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var b Broker
+	defer b.Close()
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	connect(t, &b, client, "salamanca")
+	b.SetBehavior(Behavior{SubackDelay: delay})
+	start := time.Now()
+	subscribe(t, client, "a/b")
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("SUBACK arrived after %s, expected at least %s", elapsed, delay)
+	}
+}
+
+func TestBrokerDropPingresp(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	b.SetBehavior(Behavior{DropPingresp: true})
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	conn := connect(t, &b, client, "salamanca")
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := client.Ping(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected ping to time out, got", err)
+	}
+	if !client.AwaitingPingresp() {
+		t.Error("expected client to be awaiting PINGRESP")
+	}
+}
+
+func TestBrokerReconnect(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	conn := connect(t, &b, client, "salamanca")
+	if n := b.DropConnections(); n != 1 {
+		t.Fatalf("expected 1 dropped connection, got %d", n)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	err := client.HandleNext()
+	if err == nil || client.IsConnected() {
+		t.Fatal("expected client to disconnect after dropped connection, got", err)
+	}
+	connect(t, &b, client, "salamanca")
+	if m := client.Metrics(); m.Reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %d", m.Reconnects)
+	}
+}
+
+func TestBrokerListen(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	l, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	err = client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal("connect failed:", err)
+	}
+	err = client.Ping(ctx)
+	if err != nil {
+		t.Fatal("ping failed:", err, "with disconnect reason:", client.Err())
+	}
+	err = client.Disconnect(errors.New("end of test"))
+	if err != nil {
+		t.Error("disconnect failed:", err)
+	}
+}
+
+func TestBrokerSharedSubscription(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	type subscriber struct {
+		client   *mqtt.Client
+		conn     net.Conn
+		received []string
+	}
+	newSubscriber := func(clientID, filter string) *subscriber {
+		s := &subscriber{}
+		s.client = mqtt.NewClient(mqtt.ClientConfig{
+			OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+				s.received = append(s.received, string(vp.TopicName))
+				return nil
+			},
+		})
+		s.conn = connect(t, &b, s.client, clientID)
+		subscribe(t, s.client, filter)
+		return s
+	}
+	worker1 := newSubscriber("worker1", "$share/workers/jobs/#")
+	worker2 := newSubscriber("worker2", "$share/workers/jobs/#")
+	observer := newSubscriber("observer", "jobs/#")
+	for _, topic := range []string{"jobs/1", "jobs/2", "jobs/3", "jobs/4"} {
+		if n := b.Publish(topic, nil); n != 2 {
+			t.Fatalf("expected one worker and observer to receive %s, got %d", topic, n)
+		}
+	}
+	for _, s := range []*subscriber{worker1, worker2, observer} {
+		handleUntil(t, s.client, s.conn, func() bool { return len(s.received) >= 2 })
+	}
+	handleUntil(t, observer.client, observer.conn, func() bool { return len(observer.received) == 4 })
+	if got := strings.Join(worker1.received, ","); got != "jobs/1,jobs/3" {
+		t.Errorf("worker1 got %q", got)
+	}
+	if got := strings.Join(worker2.received, ","); got != "jobs/2,jobs/4" {
+		t.Errorf("worker2 got %q", got)
+	}
+
+	// Remaining worker receives all messages after the other disconnects.
+	worker1.client.Disconnect(errors.New("done"))
+	deadline := time.Now().Add(time.Second)
+	for len(b.shared.Members("$share/workers/jobs/#")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker1 still member of shared subscription")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	worker2.received = worker2.received[:0]
+	b.Publish("jobs/5", nil)
+	b.Publish("jobs/6", nil)
+	handleUntil(t, worker2.client, worker2.conn, func() bool { return len(worker2.received) == 2 })
+	if got := strings.Join(worker2.received, ","); got != "jobs/5,jobs/6" {
+		t.Errorf("worker2 got %q", got)
+	}
+}
+
+func TestBrokerShareLeastInFlight(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	b.SetBehavior(Behavior{ShareStrategy: mqtt.ShareLeastInFlight})
+	const filter = "$share/workers/jobs/#"
+	slow, _ := rawConnect(t, &b, "slow", true)
+	rawSubscribe(t, slow, filter)
+	fast, _ := rawConnect(t, &b, "fast", true)
+	rawSubscribe(t, fast, filter)
+	members := b.shared.Members(filter)
+	if len(members) != 2 {
+		t.Fatalf("got members %q", members)
+	}
+	// slow does not read so jobs/1 stays in flight until the end of the test.
+	b.Publish("jobs/1", nil)
+	for _, topic := range []string{"jobs/2", "jobs/3", "jobs/4"} {
+		b.Publish(topic, nil)
+		if pkt := readPacket(t, fast); string(pkt.Publish.TopicName) != topic {
+			t.Fatalf("fast got %q, want %q", pkt.Publish.TopicName, topic)
+		}
+		deadline := time.Now().Add(time.Second)
+		for b.shared.InFlight(members[1]) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("written message still in flight")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if n := b.shared.InFlight(members[0]); n != 1 {
+		t.Errorf("slow has %d messages in flight, want 1", n)
+	}
+	if pkt := readPacket(t, slow); string(pkt.Publish.TopicName) != "jobs/1" {
+		t.Errorf("slow got %q", pkt.Publish.TopicName)
+	}
+	slow.conn.Close()
+	fast.conn.Close()
+}
+
+func TestBrokerShareTakeover(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	b.SetSessions(mqttsession.NewManager(mqttsession.Config{}))
+	const filter = "$share/workers/jobs/#"
+	old, _ := rawConnect(t, &b, "worker", false)
+	rawSubscribe(t, old, filter)
+	// Clean session takeover does not keep the shared subscription of the old connection.
+	rxtx, _ := rawConnect(t, &b, "worker", true)
+	deadline := time.Now().Add(time.Second)
+	for len(b.shared.Members(filter)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale members %q after takeover", b.shared.Members(filter))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := b.Publish("jobs/1", nil); n != 0 {
+		t.Errorf("published to %d clients, want 0", n)
+	}
+	rxtx.conn.Close()
+}
+
+func TestBrokerSessions(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	store := &mqttsession.MemoryStore{}
+	b.SetSessions(mqttsession.NewManager(mqttsession.Config{Store: store, QueueQoS0: true}))
+	rxtx, connack := rawConnect(t, &b, "persistent", false)
+	if connack.SessionPresent() {
+		t.Error("session present on first connection")
+	}
+	err := rxtx.WriteSubscribe(mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte("jobs/#")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := readPacket(t, rxtx); pkt.Header.Type() != mqtt.PacketSuback {
+		t.Fatalf("got %s, want SUBACK", pkt.Header.Type())
+	}
+	rxtx.WriteSimple(mqtt.PacketDisconnect)
+	waitNoClients(t, &b)
+
+	if n := b.Publish("jobs/1", []byte("queued")); n != 0 {
+		t.Errorf("published to %d clients while disconnected", n)
+	}
+	rxtx, connack = rawConnect(t, &b, "persistent", false)
+	if !connack.SessionPresent() {
+		t.Error("session not present on reconnection")
+	}
+	pkt := readPacket(t, rxtx)
+	if pkt.Header.Type() != mqtt.PacketPublish || string(pkt.Publish.TopicName) != "jobs/1" || string(pkt.Payload) != "queued" {
+		t.Errorf("got %s %q %q, want queued PUBLISH", pkt.Header.Type(), pkt.Publish.TopicName, pkt.Payload)
+	}
+	// Delivered messages are removed from the session.
+	deadline := time.Now().Add(time.Second)
+	for s, _ := store.Load("persistent"); len(s.Queue) != 0; s, _ = store.Load("persistent") {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue %+v after delivery", s.Queue)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Subscription is restored without subscribing again.
+	if n := b.Publish("jobs/2", []byte("live")); n != 1 {
+		t.Fatalf("published to %d clients, want 1", n)
+	}
+	if pkt := readPacket(t, rxtx); string(pkt.Publish.TopicName) != "jobs/2" {
+		t.Errorf("got %s %q", pkt.Header.Type(), pkt.Publish.TopicName)
+	}
+	rxtx.conn.Close()
+	waitNoClients(t, &b)
+
+	// Clean session discards the stored session.
+	rxtx, connack = rawConnect(t, &b, "persistent", true)
+	if connack.SessionPresent() {
+		t.Error("session present with clean session")
+	}
+	if n := b.Publish("jobs/3", nil); n != 0 {
+		t.Errorf("published to %d clients after clean session", n)
+	}
+	rxtx.conn.Close()
+}
+
+func TestBrokerSessionTakeover(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	b.SetSessions(mqttsession.NewManager(mqttsession.Config{}))
+	old, _ := rawConnect(t, &b, "dup", false)
+	err := old.WriteSubscribe(mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte("jobs/#")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readPacket(t, old) // SUBACK.
+
+	rxtx, connack := rawConnect(t, &b, "dup", false)
+	if !connack.SessionPresent() {
+		t.Error("session not present on takeover")
+	}
+	old.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var pkt mqtt.Packet
+	if _, err := old.ReadPacket(&pkt); !errors.Is(err, io.EOF) {
+		t.Errorf("old connection got %v, want EOF", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(b.Clients()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("clients %q after takeover", b.Clients())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Closing the old connection does not end the session of the new one.
+	if n := b.Publish("jobs/1", nil); n != 1 {
+		t.Fatalf("published to %d clients, want 1", n)
+	}
+	if pkt := readPacket(t, rxtx); string(pkt.Publish.TopicName) != "jobs/1" {
+		t.Errorf("got %s %q", pkt.Header.Type(), pkt.Publish.TopicName)
+	}
+	rxtx.conn.Close()
+}
+
+func TestBrokerSessionUnavailable(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	store := &failingStore{}
+	b.SetSessions(mqttsession.NewManager(mqttsession.Config{Store: store}))
+	old, _ := rawConnect(t, &b, "dup", false)
+
+	// CONNECT refused due to session store failure leaves the existing connection be.
+	store.fail = true
+	rxtx, connack := rawConnect(t, &b, "dup", false)
+	if connack.ReturnCode != mqtt.ReturnCodeServerUnavailable {
+		t.Fatalf("got return code %s, want server unavailable", connack.ReturnCode)
+	}
+	rxtx.conn.Close()
+	err := old.WriteSimple(mqtt.PacketPingreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := readPacket(t, old); pkt.Header.Type() != mqtt.PacketPingresp {
+		t.Fatalf("got %s, want PINGRESP", pkt.Header.Type())
+	}
+	old.conn.Close()
+}
+
+// failingStore is a session store whose Save fails once fail is set.
+type failingStore struct {
+	mqttsession.MemoryStore
+	fail bool
+}
+
+func (fs *failingStore) Save(s mqttsession.Session) error {
+	if fs.fail {
+		return errors.New("store unavailable")
+	}
+	return fs.MemoryStore.Save(s)
+}
+
+func connect(t *testing.T, b *Broker, client *mqtt.Client, clientID string) net.Conn {
+	t.Helper()
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte(clientID))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn := b.Dial()
+	err := client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func subscribe(t *testing.T, client *mqtt.Client, filter string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Subscribe(ctx, mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte(filter), QoS: mqtt.QoS0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handleUntil calls HandleNext until cond returns true or a second passes.
+func handleUntil(t *testing.T, client *mqtt.Client, conn net.Conn, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	conn.SetReadDeadline(deadline)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		err := client.HandleNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rawConn is a connection to a Broker without client logic.
+type rawConn struct {
+	mqtt.Rx
+	mqtt.Tx
+	conn net.Conn
+}
+
+// rawConnect connects to b with a rawConn and returns the received CONNACK.
+func rawConnect(t *testing.T, b *Broker, clientID string, cleanSession bool) (*rawConn, mqtt.VariablesConnack) {
+	t.Helper()
+	rxtx := &rawConn{conn: b.Dial()}
+	rxtx.SetRxTransport(rxtx.conn)
+	rxtx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 1024)})
+	rxtx.SetTxTransport(rxtx.conn)
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte(clientID))
+	varConn.CleanSession = cleanSession
+	err := rxtx.WriteConnect(&varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, rxtx)
+	if pkt.Header.Type() != mqtt.PacketConnack {
+		t.Fatalf("got %s, want CONNACK", pkt.Header.Type())
+	}
+	return rxtx, pkt.Connack
+}
+
+// rawSubscribe subscribes rxtx to filter and waits for the SUBACK.
+func rawSubscribe(t *testing.T, rxtx *rawConn, filter string) {
+	t.Helper()
+	err := rxtx.WriteSubscribe(mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte(filter)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := readPacket(t, rxtx); pkt.Header.Type() != mqtt.PacketSuback {
+		t.Fatalf("got %s, want SUBACK", pkt.Header.Type())
+	}
+}
+
+func readPacket(t *testing.T, rxtx *rawConn) (pkt mqtt.Packet) {
+	t.Helper()
+	rxtx.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := rxtx.ReadPacket(&pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func waitNoClients(t *testing.T, b *Broker) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(b.Clients()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("clients %q still connected", b.Clients())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,225 @@
+package mqtttest
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fault is a kind of fault injected by a FaultTransport.
+type Fault uint8
+
+const (
+	// FaultShortRead makes Read fill only part of the buffer.
+	FaultShortRead Fault = iota + 1
+	// FaultPartialWrite makes Write write only part of the buffer and return io.ErrShortWrite.
+	FaultPartialWrite
+	// FaultCorrupt flips a random bit of the data returned by Read.
+	FaultCorrupt
+	// FaultLatency delays a Read or Write by up to FaultConfig.MaxLatency.
+	FaultLatency
+	// FaultEOF makes Read return io.EOF without reading from the underlying transport.
+	FaultEOF
+	// FaultClosed closes the underlying transport and returns net.ErrClosed from
+	// the Read or Write call and all following calls.
+	FaultClosed
+	// FaultTimeout makes Read return zero bytes and os.ErrDeadlineExceeded, which
+	// reports itself as a timeout, without reading from the underlying transport.
+	FaultTimeout
+	numFaults
+)
+
+// String returns a pretty-string representation of f, i.e: "short read". Does not allocate memory.
+func (f Fault) String() (s string) {
+	switch f {
+	case FaultShortRead:
+		s = "short read"
+	case FaultPartialWrite:
+		s = "partial write"
+	case FaultCorrupt:
+		s = "corrupt"
+	case FaultLatency:
+		s = "latency"
+	case FaultEOF:
+		s = "EOF"
+	case FaultClosed:
+		s = "closed"
+	case FaultTimeout:
+		s = "timeout"
+	default:
+		s = "undefined fault"
+	}
+	return s
+}
+
+// FaultConfig configures the faults injected by a FaultTransport. Probabilities
+// range from 0 (never) to 1 (every call) and apply independently on each call to
+// Read or Write. At most one of FaultEOF, FaultClosed and FaultTimeout is injected per call.
+type FaultConfig struct {
+	// Seed seeds the fault schedule. Read and Write faults are drawn from separate
+	// sources so the schedule of each is deterministic even when Read and Write
+	// are called concurrently.
+	Seed int64
+	// ShortRead is the probability of a FaultShortRead.
+	ShortRead float64
+	// PartialWrite is the probability of a FaultPartialWrite.
+	PartialWrite float64
+	// Corrupt is the probability of a FaultCorrupt.
+	Corrupt float64
+	// Latency is the probability of a FaultLatency.
+	Latency float64
+	// MaxLatency is the maximum delay added by a FaultLatency.
+	MaxLatency time.Duration
+	// EOF is the probability of a FaultEOF.
+	EOF float64
+	// Closed is the probability of a FaultClosed.
+	Closed float64
+	// Timeout is the probability of a FaultTimeout.
+	Timeout float64
+}
+
+// FaultTransport wraps an io.ReadWriteCloser and injects faults into Read and
+// Write calls on a deterministic schedule given by FaultConfig. It is meant to be
+// placed between a Client and its transport to exercise error handling.
+// FaultTransport is safe for one concurrent reader and writer.
+type FaultTransport struct {
+	rwc io.ReadWriteCloser
+
+	// cmu guards the configuration and fault schedule. It is never held
+	// while calling the underlying transport so SetConfig does not block on
+	// an idle connection.
+	cmu  sync.Mutex
+	cfg  FaultConfig
+	rrng *rand.Rand
+	wrng *rand.Rand
+
+	mu       sync.Mutex
+	closed   bool
+	injected [numFaults]int
+}
+
+var _ io.ReadWriteCloser = (*FaultTransport)(nil)
+
+// NewFaultTransport returns a FaultTransport that injects faults into rwc as configured by cfg.
+func NewFaultTransport(rwc io.ReadWriteCloser, cfg FaultConfig) *FaultTransport {
+	return &FaultTransport{
+		rwc:  rwc,
+		cfg:  cfg,
+		rrng: rand.New(rand.NewSource(cfg.Seed)),
+		wrng: rand.New(rand.NewSource(cfg.Seed + 1)),
+	}
+}
+
+// Read reads from the underlying transport, possibly injecting a fault.
+func (ft *FaultTransport) Read(p []byte) (int, error) {
+	if ft.isClosed() {
+		return 0, net.ErrClosed
+	}
+	ft.cmu.Lock()
+	cfg, rng := ft.cfg, ft.rrng
+	ft.cmu.Unlock()
+	ft.maybeDelay(cfg, rng)
+	switch {
+	case ft.roll(rng, cfg.EOF, FaultEOF):
+		return 0, io.EOF
+	case ft.roll(rng, cfg.Timeout, FaultTimeout):
+		return 0, os.ErrDeadlineExceeded
+	case ft.roll(rng, cfg.Closed, FaultClosed):
+		ft.close()
+		return 0, net.ErrClosed
+	}
+	if len(p) > 1 && ft.roll(rng, cfg.ShortRead, FaultShortRead) {
+		p = p[:1+rng.Intn(len(p)-1)]
+	}
+	n, err := ft.rwc.Read(p)
+	if n > 0 && ft.roll(rng, cfg.Corrupt, FaultCorrupt) {
+		p[rng.Intn(n)] ^= 1 << rng.Intn(8)
+	}
+	return n, err
+}
+
+// Write writes to the underlying transport, possibly injecting a fault.
+func (ft *FaultTransport) Write(p []byte) (int, error) {
+	if ft.isClosed() {
+		return 0, net.ErrClosed
+	}
+	ft.cmu.Lock()
+	cfg, rng := ft.cfg, ft.wrng
+	ft.cmu.Unlock()
+	ft.maybeDelay(cfg, rng)
+	if ft.roll(rng, cfg.Closed, FaultClosed) {
+		ft.close()
+		return 0, net.ErrClosed
+	}
+	if len(p) > 1 && ft.roll(rng, cfg.PartialWrite, FaultPartialWrite) {
+		n, err := ft.rwc.Write(p[:1+rng.Intn(len(p)-1)])
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, err
+	}
+	return ft.rwc.Write(p)
+}
+
+// SetConfig replaces the fault configuration and restarts the fault schedule
+// from cfg.Seed. Useful for injecting faults only after a connection is established.
+// A Read or Write blocked on the underlying transport completes with the previous
+// configuration; SetConfig does not wait for it.
+func (ft *FaultTransport) SetConfig(cfg FaultConfig) {
+	ft.cmu.Lock()
+	defer ft.cmu.Unlock()
+	ft.cfg = cfg
+	ft.rrng = rand.New(rand.NewSource(cfg.Seed))
+	ft.wrng = rand.New(rand.NewSource(cfg.Seed + 1))
+}
+
+// Close closes the underlying transport.
+func (ft *FaultTransport) Close() error {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.closed = true
+	return ft.rwc.Close()
+}
+
+// Injected returns the number of times fault f has been injected.
+func (ft *FaultTransport) Injected(f Fault) int {
+	if f >= numFaults {
+		return 0
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.injected[f]
+}
+
+// roll returns true and records the fault with probability prob.
+func (ft *FaultTransport) roll(rng *rand.Rand, prob float64, f Fault) bool {
+	if rng.Float64() >= prob {
+		return false
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.injected[f]++
+	return true
+}
+
+func (ft *FaultTransport) maybeDelay(cfg FaultConfig, rng *rand.Rand) {
+	if ft.roll(rng, cfg.Latency, FaultLatency) && cfg.MaxLatency > 0 {
+		time.Sleep(time.Duration(1 + rng.Int63n(int64(cfg.MaxLatency))))
+	}
+}
+
+func (ft *FaultTransport) isClosed() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.closed
+}
+
+func (ft *FaultTransport) close() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.closed = true
+	ft.rwc.Close()
+}
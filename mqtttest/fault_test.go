@@ -0,0 +1,163 @@
+package mqtttest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+func TestFaultTransportShortReads(t *testing.T) {
+	var b Broker
+	defer b.Close()
+	received := make(chan string, 1)
+	client := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			received <- string(vp.TopicName) + ":" + string(payload)
+			return err
+		},
+	})
+	conn := b.Dial()
+	ft := NewFaultTransport(conn, FaultConfig{Seed: 1, ShortRead: 1, Latency: 0.5, MaxLatency: time.Millisecond})
+	connectTransport(t, client, ft)
+	subscribe(t, client, "a/very/long/topic/name/to/split/over/many/reads")
+	b.Publish("a/very/long/topic/name/to/split/over/many/reads", []byte("short reads are not errors"))
+	handleUntil(t, client, conn, func() bool { return len(received) > 0 })
+	if got := <-received; got != "a/very/long/topic/name/to/split/over/many/reads:short reads are not errors" {
+		t.Errorf("got %q", got)
+	}
+	if ft.Injected(FaultShortRead) == 0 {
+		t.Error("no short reads injected")
+	}
+}
+
+func TestFaultTransportHandleNext(t *testing.T) {
+	for _, test := range []struct {
+		fault         Fault
+		cfg           FaultConfig
+		wantErr       error
+		wantConnected bool
+	}{
+		{fault: FaultTimeout, cfg: FaultConfig{Timeout: 1}, wantErr: nil, wantConnected: true},
+		{fault: FaultEOF, cfg: FaultConfig{EOF: 1}, wantErr: io.EOF, wantConnected: false},
+		{fault: FaultClosed, cfg: FaultConfig{Closed: 1}, wantErr: net.ErrClosed, wantConnected: false},
+	} {
+		t.Run(test.fault.String(), func(t *testing.T) {
+			var b Broker
+			defer b.Close()
+			client := mqtt.NewClient(mqtt.ClientConfig{})
+			ft := NewFaultTransport(b.Dial(), FaultConfig{})
+			connectTransport(t, client, ft)
+			ft.SetConfig(test.cfg)
+			err := client.HandleNext()
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+			if client.IsConnected() != test.wantConnected {
+				t.Errorf("got connected %v, want %v", client.IsConnected(), test.wantConnected)
+			}
+			if ft.Injected(test.fault) != 1 {
+				t.Errorf("expected fault to be injected once, got %d", ft.Injected(test.fault))
+			}
+		})
+	}
+}
+
+func TestFaultTransportSetConfigDuringRead(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	blocked := &blockedConn{Conn: conn, reading: make(chan struct{}, 1)}
+	ft := NewFaultTransport(blocked, FaultConfig{})
+	defer ft.Close()
+	read := make(chan error, 1)
+	go func() {
+		_, err := ft.Read(make([]byte, 1))
+		read <- err
+	}()
+	<-blocked.reading
+	set := make(chan struct{})
+	go func() {
+		ft.SetConfig(FaultConfig{EOF: 1})
+		close(set)
+	}()
+	select {
+	case <-set:
+	case <-time.After(time.Second):
+		t.Fatal("SetConfig blocked by idle Read")
+	}
+	peer.Write([]byte{0})
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ft.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v after SetConfig, want EOF", err)
+	}
+}
+
+// blockedConn signals when Read is called on the underlying connection.
+type blockedConn struct {
+	net.Conn
+	reading chan struct{}
+}
+
+func (bc *blockedConn) Read(b []byte) (int, error) {
+	select {
+	case bc.reading <- struct{}{}:
+	default:
+	}
+	return bc.Conn.Read(b)
+}
+
+func TestFaultTransportSoak(t *testing.T) {
+	cfg := FaultConfig{
+		ShortRead:    0.2,
+		PartialWrite: 0.02,
+		Corrupt:      0.02,
+		Latency:      0.1,
+		MaxLatency:   time.Millisecond,
+		EOF:          0.01,
+		Closed:       0.01,
+		Timeout:      0.05,
+	}
+	var b Broker
+	defer b.Close()
+	for seed := int64(0); seed < 20; seed++ {
+		cfg.Seed = seed
+		client := mqtt.NewClient(mqtt.ClientConfig{})
+		conn := b.Dial()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		ft := NewFaultTransport(conn, cfg)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var varConn mqtt.VariablesConnect
+		varConn.SetDefaultMQTT([]byte("salamanca"))
+		err := client.Connect(ctx, ft, &varConn)
+		for i := 0; err == nil && i < 10; i++ {
+			err = client.Ping(ctx)
+		}
+		cancel()
+		if client.IsConnected() {
+			client.Disconnect(errors.New("end of soak"))
+		}
+		if client.Err() == nil {
+			t.Errorf("seed %d: expected disconnected client to have non-nil Err", seed)
+		}
+		ft.Close()
+	}
+}
+
+func connectTransport(t *testing.T, client *mqtt.Client, rwc io.ReadWriteCloser) {
+	t.Helper()
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, rwc, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,543 @@
+// Package mqttws implements MQTT over WebSocket as specified in section 6 of
+// MQTT v3.1.1 with a dependency free implementation of RFC 6455 framing.
+//
+// Clients connect with [Dial] and servers accept browser and native clients
+// with [Handler]. Both sides negotiate the "mqtt" subprotocol and exchange
+// MQTT packets in binary frames. A [Conn] presents the frames as a byte stream
+// so MQTT packets may be split across frames or share a frame, as permitted
+// by MQTT-6.0.0-2.
+package mqttws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soypat/natiu-mqtt/transport"
+)
+
+// Subprotocol is the WebSocket subprotocol negotiated for MQTT as per MQTT-6.0.0-3.
+const Subprotocol = "mqtt"
+
+// Default ports of ws:// and wss:// URLs.
+const (
+	DefaultPort    = 80
+	DefaultTLSPort = 443
+)
+
+// acceptGUID is appended to Sec-WebSocket-Key to calculate Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes as defined in RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close status codes as defined in RFC 6455 section 7.4.1.
+const (
+	closeNormal           = 1000
+	closeProtocolError    = 1002
+	closeUnsupportedData  = 1003
+	closeNoStatusReceived = 1005
+)
+
+// maxControlPayload is the largest payload of a control frame.
+const maxControlPayload = 125
+
+var (
+	errTextFrame         = errors.New("mqttws: received text frame, MQTT requires binary frames (MQTT-6.0.0-1)")
+	errReservedBits      = errors.New("mqttws: reserved bits set in frame header")
+	errUnknownOpcode     = errors.New("mqttws: unknown frame opcode")
+	errBadControlFrame   = errors.New("mqttws: fragmented or oversized control frame")
+	errUnexpectedMask    = errors.New("mqttws: masked frame received from server")
+	errMissingMask       = errors.New("mqttws: unmasked frame received from client")
+	errBadContinuation   = errors.New("mqttws: continuation frame without a fragmented message")
+	errUnfinishedMessage = errors.New("mqttws: new message started before fragmented message finished")
+)
+
+// Conn is a WebSocket connection carrying MQTT packets. It implements
+// net.Conn so it can be passed to [mqtt.Client.Connect] and used with deadlines.
+// Each call to Write is sent as a single binary frame. Read returns the payload
+// of binary frames as a stream and answers ping and close frames.
+// Read and Write may be called concurrently.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// client is true for the client end of the connection which must mask frames.
+	client bool
+
+	// Read state, only accessed by the reading goroutine.
+	remaining  uint64  // Unread payload bytes of current frame.
+	mask       [4]byte // Masking key of current frame.
+	masked     bool
+	maskPos    int
+	fragmented bool // A fragmented message is being received.
+	readErr    error
+
+	// wmu guards writes to conn which happen from Write, Close and Read when
+	// answering control frames.
+	wmu        sync.Mutex
+	closeSent  bool
+	writeFrame []byte // Scratch buffer for encoding frames.
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{conn: conn, br: br, client: client}
+}
+
+// Read reads the payload of binary frames. It returns io.EOF after the peer
+// closes the WebSocket connection. Errors other than a timeout before the start
+// of a frame header are returned on all subsequent calls to Read.
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	for c.remaining == 0 {
+		// Bytes of a frame header are not consumed until the first two are buffered,
+		// so a read deadline reached before that may be retried.
+		_, err := c.br.Peek(2)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return 0, err
+		}
+		if err == io.EOF && c.br.Buffered() > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = c.nextFrame()
+		}
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until the start of a data frame's payload,
+// handling control frames on the way.
+func (c *Conn) nextFrame() error {
+	var hdr [2]byte
+	_, err := io.ReadFull(c.br, hdr[:])
+	if err != nil {
+		return err
+	}
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0f
+	if hdr[0]&0x70 != 0 {
+		return c.fail(closeProtocolError, errReservedBits)
+	}
+	c.masked = hdr[1]&0x80 != 0
+	if c.masked && c.client {
+		return c.fail(closeProtocolError, errUnexpectedMask)
+	} else if !c.masked && !c.client {
+		return c.fail(closeProtocolError, errMissingMask)
+	}
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err == nil && c.masked {
+		_, err = io.ReadFull(c.br, c.mask[:])
+	}
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	c.maskPos = 0
+	switch opcode {
+	case opBinary, opContinuation:
+		if opcode == opContinuation && !c.fragmented {
+			return c.fail(closeProtocolError, errBadContinuation)
+		} else if opcode == opBinary && c.fragmented {
+			return c.fail(closeProtocolError, errUnfinishedMessage)
+		}
+		c.fragmented = !fin
+		c.remaining = length
+		return nil
+	case opText:
+		return c.fail(closeUnsupportedData, errTextFrame)
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlPayload {
+			return c.fail(closeProtocolError, errBadControlFrame)
+		}
+	default:
+		return c.fail(closeProtocolError, errUnknownOpcode)
+	}
+	var payload [maxControlPayload]byte
+	_, err = io.ReadFull(c.br, payload[:length])
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	c.unmask(payload[:length])
+	switch opcode {
+	case opPing:
+		return c.writeControl(opPong, payload[:length])
+	case opClose:
+		// Echo status code back as per RFC 6455 section 5.5.1.
+		code := uint16(closeNoStatusReceived)
+		if length >= 2 {
+			code = binary.BigEndian.Uint16(payload[:2])
+		}
+		c.sendClose(code)
+		return io.EOF
+	}
+	return nil // Unsolicited pong.
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// fail sends a close frame with code and returns err.
+func (c *Conn) fail(code uint16, err error) error {
+	c.sendClose(code)
+	return err
+}
+
+func (c *Conn) sendClose(code uint16) {
+	if code == closeNoStatusReceived {
+		c.writeControl(opClose, nil) // 1005 must not be sent in a close frame.
+		return
+	}
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.writeControl(opClose, payload[:])
+}
+
+func (c *Conn) writeControl(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return nil // No frames may be sent after a close frame.
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.write(opcode, payload)
+}
+
+// Write sends b in a single binary frame.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return 0, net.ErrClosed
+	}
+	err := c.write(opBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// write writes a single frame with FIN set. Caller must hold wmu.
+func (c *Conn) write(opcode byte, payload []byte) error {
+	var hdr [14]byte
+	hdr[0] = 0x80 | opcode
+	n := 2
+	switch {
+	case len(payload) <= 125:
+		hdr[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(payload)))
+		n += 8
+	}
+	var mask [4]byte
+	if c.client {
+		hdr[1] |= 0x80
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		n += copy(hdr[n:], mask[:])
+	}
+	// Frame is written in a single call so it is not split across TCP segments
+	// unnecessarily. Masked payload is copied to avoid modifying the caller's buffer.
+	c.writeFrame = append(c.writeFrame[:0], hdr[:n]...)
+	if c.client {
+		for i, b := range payload {
+			c.writeFrame = append(c.writeFrame, b^mask[i&3])
+		}
+	} else {
+		c.writeFrame = append(c.writeFrame, payload...)
+	}
+	_, err := c.conn.Write(c.writeFrame)
+	if cap(c.writeFrame) > 64*1024 {
+		c.writeFrame = nil // Don't hold on to large buffers.
+	}
+	return err
+}
+
+// Close sends a close frame and closes the underlying connection.
+func (c *Conn) Close() error {
+	c.sendClose(closeNormal)
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (c *Conn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// Dial connects to the MQTT over WebSocket server at rawURL, i.e:
+// "ws://localhost:8080/mqtt" or "wss://broker.example.com/mqtt". TCP and TLS
+// settings are taken from cfg, see [transport.Config].
+func Dial(ctx context.Context, rawURL string, cfg transport.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var ep transport.Endpoint
+	port := DefaultPort
+	switch strings.ToLower(u.Scheme) {
+	case "ws":
+	case "wss":
+		ep.TLS = true
+		port = DefaultTLSPort
+	default:
+		return nil, errors.New("mqttws: unsupported URL scheme " + strconv.Quote(u.Scheme) + ", expected ws or wss")
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("mqttws: missing host in " + strconv.Quote(rawURL))
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil || port == 0 || port > 0xffff {
+			return nil, errors.New("mqttws: invalid port " + strconv.Quote(u.Port()))
+		}
+	}
+	ep.Addr = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	conn, err := transport.DialEndpoint(ctx, ep, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	br, err := handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newConn(conn, br, true), nil
+}
+
+// handshake performs the client opening handshake of RFC 6455 section 4.1.
+func handshake(conn net.Conn, u *url.URL) (*bufio.Reader, error) {
+	var nonce [16]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-Websocket-Key":      {key},
+			"Sec-Websocket-Version":  {"13"},
+			"Sec-Websocket-Protocol": {Subprotocol},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, errors.New("mqttws: handshake failed with status " + resp.Status)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !hasToken(resp.Header, "Connection", "upgrade"):
+		return nil, errors.New("mqttws: server did not upgrade connection to WebSocket")
+	case resp.Header.Get("Sec-Websocket-Accept") != acceptKey(key):
+		return nil, errors.New("mqttws: invalid Sec-WebSocket-Accept")
+	case resp.Header.Get("Sec-Websocket-Protocol") != Subprotocol:
+		return nil, errors.New("mqttws: server did not select mqtt subprotocol (MQTT-6.0.0-4)")
+	}
+	return br, nil
+}
+
+// Handler upgrades HTTP requests to MQTT over WebSocket connections.
+type Handler struct {
+	// ServeConn serves an upgraded connection, i.e: [mqtttest.Broker.ServeConn].
+	// It is called in the goroutine of the HTTP request and the connection is
+	// closed after it returns.
+	ServeConn func(conn net.Conn) error
+	// CheckOrigin reports whether a request from a browser's Origin is allowed.
+	// If nil only requests without an Origin header, i.e: from native clients,
+	// or with an Origin host equal to the request Host are allowed. Setting it
+	// to AllowAnyOrigin lets dashboards served from other hosts connect, but
+	// also any web page a user visits, with the user's network access.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// AllowAnyOrigin is a Handler.CheckOrigin that allows requests from every origin.
+func AllowAnyOrigin(r *http.Request) bool { return true }
+
+// sameOrigin is the default Handler.CheckOrigin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// ServeHTTP performs the server opening handshake of RFC 6455 section 4.2 and
+// calls ServeConn with the upgraded connection.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "WebSocket handshake requires GET", http.StatusMethodNotAllowed)
+		return
+	case !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !hasToken(r.Header, "Connection", "upgrade"):
+		http.Error(w, "expected WebSocket upgrade", http.StatusUpgradeRequired)
+		return
+	case r.Header.Get("Sec-Websocket-Version") != "13":
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	case err != nil || len(nonce) != 16:
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	case !hasToken(r.Header, "Sec-Websocket-Protocol", Subprotocol):
+		http.Error(w, "client must offer mqtt subprotocol (MQTT-6.0.0-3)", http.StatusBadRequest)
+		return
+	case !checkOrigin(r):
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support hijacking", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{}) // Clear deadlines set by the HTTP server.
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + Subprotocol + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		return
+	}
+	wsConn := newConn(conn, rw.Reader, false)
+	defer wsConn.Close()
+	h.ServeConn(wsConn)
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken reports whether the comma separated header values contain token
+// ignoring case.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
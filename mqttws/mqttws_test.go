@@ -0,0 +1,313 @@
+package mqttws
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+	"github.com/soypat/natiu-mqtt/transport"
+)
+
+func TestBrokerOverWebSocket(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	srv := httptest.NewServer(&Handler{ServeConn: b.ServeConn})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/mqtt", transport.Config{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub(t, conn)
+}
+
+func TestBrokerOverTLS(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	srv := httptest.NewTLSServer(&Handler{ServeConn: b.ServeConn})
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+	conn, err := Dial(context.Background(), url, transport.Config{Timeout: time.Second, RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub(t, conn)
+
+	_, err = Dial(context.Background(), url, transport.Config{Timeout: time.Second})
+	if err == nil {
+		t.Error("expected error verifying self signed certificate")
+	}
+}
+
+// pubSub subscribes and publishes to a topic through a broker over conn.
+func pubSub(t *testing.T, conn *Conn) {
+	t.Helper()
+	defer conn.Close()
+	received := make(chan string, 1)
+	client := mqtt.NewClient(mqtt.ClientConfig{
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			received <- string(vp.TopicName) + ":" + string(payload)
+			return err
+		},
+	})
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("dashboard"))
+	conn.SetDeadline(time.Now().Add(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe(ctx, mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     []mqtt.SubscribeRequest{{TopicFilter: []byte("sensors/#")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PublishPayload(0, mqtt.VariablesPublish{TopicName: []byte("sensors/temp"), PacketIdentifier: 1}, []byte("25"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(received) == 0 {
+		err = client.HandleNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := <-received; got != "sensors/temp:25" {
+		t.Errorf("got %q", got)
+	}
+	client.Disconnect(errors.New("done"))
+}
+
+func TestPacketSplitAcrossFrames(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	server := newConn(serverEnd, nil, false)
+	defer server.Close()
+
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte("salamanca"))
+	var packet bytes.Buffer
+	var tx mqtt.Tx
+	tx.SetTxTransport(nopCloser{&packet})
+	err := tx.WriteConnect(&varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := packet.Bytes()
+	go func() {
+		clientEnd.Write(frame(false, opBinary, raw[:3], true))
+		clientEnd.Write(frame(true, opPing, []byte("hi"), true)) // Control frames may be interleaved.
+		clientEnd.Write(frame(false, opContinuation, raw[3:10], true))
+		clientEnd.Write(frame(true, opContinuation, raw[10:], true))
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := clientEnd.Read(buf)
+		pong <- buf[:n]
+	}()
+
+	var rx mqtt.Rx
+	rx.SetRxTransport(server)
+	rx.SetDecoder(mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 64)})
+	var pkt mqtt.Packet
+	serverEnd.SetDeadline(time.Now().Add(time.Second))
+	_, err = rx.ReadPacket(&pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Header.Type() != mqtt.PacketConnect || string(pkt.Connect.ClientID) != "salamanca" {
+		t.Errorf("got %s with client identifier %q", pkt.Header.Type(), pkt.Connect.ClientID)
+	}
+	if got, want := <-pong, frame(true, opPong, []byte("hi"), false); !bytes.Equal(got, want) {
+		t.Errorf("got pong frame %x, want %x", got, want)
+	}
+}
+
+func TestReadAfterTimeout(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	server := newConn(serverEnd, nil, false)
+	defer server.Close()
+	defer clientEnd.Close() // Close first so the server's close frame is not blocked.
+
+	buf := make([]byte, 8)
+	serverEnd.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := server.Read(buf)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("expected timeout error, got", err)
+	}
+	go clientEnd.Write(frame(true, opBinary, []byte{0xc0, 0}, true))
+	serverEnd.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal("read after timeout failed:", err)
+	}
+	if !bytes.Equal(buf[:n], []byte{0xc0, 0}) {
+		t.Errorf("got payload %x, want c000", buf[:n])
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		frame     []byte
+		wantErr   error
+		wantClose uint16
+	}{
+		{name: "text", frame: frame(true, opText, []byte("{}"), true), wantErr: errTextFrame, wantClose: closeUnsupportedData},
+		{name: "unmasked", frame: frame(true, opBinary, []byte{0xc0, 0}, false), wantErr: errMissingMask, wantClose: closeProtocolError},
+		{name: "continuation", frame: frame(true, opContinuation, []byte{0xc0, 0}, true), wantErr: errBadContinuation, wantClose: closeProtocolError},
+		{name: "fragmented ping", frame: frame(false, opPing, nil, true), wantErr: errBadControlFrame, wantClose: closeProtocolError},
+		{name: "close", frame: frame(true, opClose, []byte{0x03, 0xe8}, true), wantErr: io.EOF, wantClose: closeNormal},
+	} {
+		clientEnd, serverEnd := net.Pipe()
+		server := newConn(serverEnd, nil, false)
+		go clientEnd.Write(test.frame)
+		closeFrame := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, 64)
+			n, _ := clientEnd.Read(buf)
+			closeFrame <- buf[:n]
+		}()
+		serverEnd.SetDeadline(time.Now().Add(time.Second))
+		_, err := server.Read(make([]byte, 8))
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+		got := <-closeFrame
+		if len(got) != 4 || got[0] != 0x80|opClose || binary.BigEndian.Uint16(got[2:]) != test.wantClose {
+			t.Errorf("%s: got close frame %x, want status %d", test.name, got, test.wantClose)
+		}
+		clientEnd.Close()
+		server.Close()
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	srv := httptest.NewServer(&Handler{
+		ServeConn:   func(net.Conn) error { return nil },
+		CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") != "http://evil.example" },
+	})
+	defer srv.Close()
+	for _, test := range []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{name: "no subprotocol", header: map[string]string{"Sec-WebSocket-Protocol": ""}, want: http.StatusBadRequest},
+		{name: "wrong subprotocol", header: map[string]string{"Sec-WebSocket-Protocol": "wamp"}, want: http.StatusBadRequest},
+		{name: "no upgrade", header: map[string]string{"Upgrade": ""}, want: http.StatusUpgradeRequired},
+		{name: "old version", header: map[string]string{"Sec-WebSocket-Version": "8"}, want: http.StatusUpgradeRequired},
+		{name: "bad key", header: map[string]string{"Sec-WebSocket-Key": "short"}, want: http.StatusBadRequest},
+		{name: "origin", header: map[string]string{"Origin": "http://evil.example"}, want: http.StatusForbidden},
+		{name: "accepted", header: map[string]string{"Sec-WebSocket-Protocol": "mqttv3.1, mqtt"}, want: http.StatusSwitchingProtocols},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Protocol", Subprotocol)
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// Example values from RFC 6455 section 1.3.
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("%s: got Sec-WebSocket-Accept %q", test.name, got)
+			}
+		}
+	}
+}
+
+func TestHandshakeOrigin(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		checkOrigin func(*http.Request) bool
+		origin      string
+		want        int
+	}{
+		{name: "native client", want: http.StatusSwitchingProtocols},
+		{name: "same origin", origin: "http://{host}", want: http.StatusSwitchingProtocols},
+		{name: "cross origin", origin: "http://dashboard.example", want: http.StatusForbidden},
+		{name: "malformed origin", origin: "://{host}", want: http.StatusForbidden},
+		{name: "any origin", checkOrigin: AllowAnyOrigin, origin: "http://dashboard.example", want: http.StatusSwitchingProtocols},
+	} {
+		srv := httptest.NewServer(&Handler{ServeConn: func(net.Conn) error { return nil }, CheckOrigin: test.checkOrigin})
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Protocol", Subprotocol)
+		if test.origin != "" {
+			req.Header.Set("Origin", strings.Replace(test.origin, "{host}", req.Host, 1))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp.Body.Close()
+		srv.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+	}
+}
+
+// frame returns an encoded WebSocket frame with payload. Masked frames use
+// a fixed masking key.
+func frame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode, byte(len(payload))}
+	if fin {
+		b[0] |= 0x80
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b[1] |= 0x80
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i&3])
+	}
+	return b
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
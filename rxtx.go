@@ -29,6 +29,30 @@ type Rx struct {
 	ScratchBuf []byte
 	// LastReceivedHeader contains the last correctly read header.
 	LastReceivedHeader Header
+	// MaxPacketSize is the maximum size of a received packet, including the fixed header.
+	// Packets exceeding it are rejected with ErrPacketTooLarge right after the fixed
+	// header is decoded, before reading the rest of the packet. LastReceivedHeader is
+	// set to the rejected packet's header. If zero there is no limit other than that
+	// imposed by the MQTT specification.
+	MaxPacketSize uint32
+	// Strict enables validation of received packets against MQTT v3.1.1 normative
+	// statements beyond what is needed to decode them, such as UTF-8 string
+	// validity, wildcards in PUBLISH topic names or a second CONNECT packet
+	// over the same transport. Violations are returned as a *ProtocolError.
+	Strict bool
+	// Logger is used to log errors encountered while reading packets. May be nil.
+	Logger Logger
+	// Tracer is called with every successfully decoded packet before it is handed
+	// to RxCallbacks. The raw bytes passed to the Tracer do not include the PUBLISH
+	// payload since it is streamed to OnPub. May be nil.
+	Tracer Tracer
+	// traceRec records the bytes of the packet being read when Tracer is set.
+	traceRec recordReader
+	// strictRec records the CONNECT variable header when Strict is set so its
+	// flags can be checked regardless of the Decoder.
+	strictRec recordReader
+	// connectRxed is set after a CONNECT is received over the current transport.
+	connectRxed bool
 	// LimitedReader field prevents a heap allocation in ReadNext since passing
 	// a stack allocated LimitedReader into RxCallbacks.OnPub will escape inconditionally.
 	packetLimitReader io.LimitedReader
@@ -64,11 +88,21 @@ type RxCallbacks struct {
 // SetRxTransport sets the rx's reader.
 func (rx *Rx) SetRxTransport(transport io.ReadCloser) {
 	rx.rxTrp = transport
+	rx.connectRxed = false
+}
+
+// SetDecoder sets the Decoder used to decode the variable headers of received packets.
+// It must be set before reading packets.
+func (rx *Rx) SetDecoder(decoder Decoder) {
+	rx.userDecoder = decoder
 }
 
 // Close closes the underlying transport.
 func (rx *Rx) CloseRx() error { return rx.rxTrp.Close() }
 func (rx *Rx) rxErrHandler(err error) {
+	if rx.Logger != nil {
+		rx.Logger.Log(LevelDebug, "rx failed", "packet", rx.LastReceivedHeader.Type().String(), "err", err)
+	}
 	if rx.RxCallbacks.OnRxError != nil {
 		rx.RxCallbacks.OnRxError(rx, err)
 	} else {
@@ -79,11 +113,38 @@ func (rx *Rx) rxErrHandler(err error) {
 // ReadNextPacket reads the next packet in the transport. If it fails after reading a
 // non-zero amount of bytes it closes the transport and the underlying transport must be reset.
 func (rx *Rx) ReadNextPacket() (int, error) {
+	return rx.readNext(nil)
+}
+
+// ReadPacket reads the next packet in the transport and stores its contents in pkt
+// instead of calling the packet callbacks in RxCallbacks. OnRxError is still called on error.
+// The PUBLISH Application Message is read into pkt.Payload, which is reused if it has
+// enough capacity. Strings decoded into pkt are owned by the Decoder and may be invalidated
+// on the next call to ReadPacket or ReadNextPacket.
+// Unlike ReadNextPacket the returned byte count includes the PUBLISH payload.
+func (rx *Rx) ReadPacket(pkt *Packet) (int, error) {
+	if pkt == nil {
+		return 0, ErrNilPacket
+	}
+	*pkt = Packet{Payload: pkt.Payload[:0]}
+	return rx.readNext(pkt)
+}
+
+// readNext reads the next packet in the transport. If pkt is nil then the
+// packet is handed to the RxCallbacks, else it is stored in pkt.
+func (rx *Rx) readNext(pkt *Packet) (int, error) {
 	if rx.rxTrp == nil {
-		return 0, errors.New("nil transport")
+		return 0, ErrNilTransport
 	}
 	rx.LastReceivedHeader = Header{}
-	hdr, n, err := DecodeHeader(rx.rxTrp)
+	var r io.Reader = rx.rxTrp
+	if rx.Tracer != nil {
+		// Record packet bytes for tracing.
+		rx.traceRec.r = rx.rxTrp
+		rx.traceRec.rec = rx.traceRec.rec[:0]
+		r = &rx.traceRec
+	}
+	hdr, n, err := DecodeHeader(r)
 	if err != nil {
 		if n > 0 {
 			rx.rxErrHandler(err)
@@ -91,6 +152,13 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 		return n, err
 	}
 	rx.LastReceivedHeader = hdr
+	if rx.MaxPacketSize != 0 && uint64(n)+uint64(hdr.RemainingLength) > uint64(rx.MaxPacketSize) {
+		rx.rxErrHandler(ErrPacketTooLarge)
+		return n, ErrPacketTooLarge
+	}
+	if pkt != nil {
+		pkt.Header = hdr
+	}
 	var (
 		packetType       = hdr.Type()
 		ngot             int
@@ -101,36 +169,58 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 		packetFlags := hdr.Flags()
 		qos := packetFlags.QoS()
 		var vp VariablesPublish
-		vp, ngot, err = rx.userDecoder.DecodePublish(rx.rxTrp, qos)
+		vp, ngot, err = rx.userDecoder.DecodePublish(r, qos)
 		n += ngot
 		if err != nil {
 			break
 		}
+		if rx.Strict {
+			if err = strictPublish(qos, vp); err != nil {
+				break
+			}
+		}
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, vp, rx.traceRec.rec)
+		}
 		payloadLen := int(hdr.RemainingLength) - ngot
 		rx.packetLimitReader = io.LimitedReader{R: rx.rxTrp, N: int64(payloadLen)}
-		if rx.RxCallbacks.OnPub != nil {
+		if pkt != nil {
+			pkt.Publish = vp
+			pkt.Payload, ngot, err = readPayload(&rx.packetLimitReader, pkt.Payload, payloadLen)
+			n += ngot
+		} else if rx.RxCallbacks.OnPub != nil {
 			err = rx.RxCallbacks.OnPub(rx, vp, &rx.packetLimitReader)
 		} else {
 			err = rx.exhaustReader(&rx.packetLimitReader)
 		}
 
 		if rx.packetLimitReader.N != 0 && err == nil {
-			err = errors.New("expected OnPub to completely read payload")
+			err = ErrUnreadPayload
 			break
 		}
 
 	case PacketConnack:
 		if hdr.RemainingLength != 2 {
-			err = ErrBadRemainingLen
+			err = &ProtocolError{Packet: packetType, Err: ErrBadRemainingLen}
 			break
 		}
 		var vc VariablesConnack
-		vc, ngot, err = decodeConnack(rx.rxTrp)
+		vc, ngot, err = decodeConnack(r)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnConnack != nil {
+		if rx.Strict {
+			if err = strictConnack(vc); err != nil {
+				break
+			}
+		}
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, vc, rx.traceRec.rec)
+		}
+		if pkt != nil {
+			pkt.Connack = vc
+		} else if rx.RxCallbacks.OnConnack != nil {
 			err = rx.RxCallbacks.OnConnack(rx, vc)
 		}
 
@@ -140,74 +230,133 @@ func (rx *Rx) ReadNextPacket() (int, error) {
 		// 	break
 		// }
 		var vc VariablesConnect
-		vc, ngot, err = rx.userDecoder.DecodeConnect(rx.rxTrp)
+		cr := r
+		if rx.Strict {
+			rx.strictRec.r = r
+			rx.strictRec.rec = rx.strictRec.rec[:0]
+			cr = &rx.strictRec
+		}
+		vc, ngot, err = rx.userDecoder.DecodeConnect(cr)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnConnect != nil {
+		if rx.Strict {
+			if err = rx.strictConnect(&vc, rx.strictRec.rec); err != nil {
+				break
+			}
+		}
+		rx.connectRxed = true
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, &vc, rx.traceRec.rec)
+		}
+		if pkt != nil {
+			pkt.Connect = vc
+		} else if rx.RxCallbacks.OnConnect != nil {
 			err = rx.RxCallbacks.OnConnect(rx, &vc)
 		}
 
 	case PacketSuback:
 		if hdr.RemainingLength < 2 {
-			err = ErrBadRemainingLen
+			err = &ProtocolError{Packet: packetType, Err: ErrBadRemainingLen}
 			break
 		}
 		var vsbck VariablesSuback
-		vsbck, ngot, err = decodeSuback(rx.rxTrp, hdr.RemainingLength)
+		vsbck, ngot, err = decodeSuback(r, hdr.RemainingLength)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnSuback != nil {
+		if rx.Strict {
+			if err = strictSuback(vsbck); err != nil {
+				break
+			}
+		}
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, vsbck, rx.traceRec.rec)
+		}
+		if pkt != nil {
+			pkt.Suback = vsbck
+		} else if rx.RxCallbacks.OnSuback != nil {
 			err = rx.RxCallbacks.OnSuback(rx, vsbck)
 		}
 
 	case PacketSubscribe:
 		var vsbck VariablesSubscribe
-		vsbck, ngot, err = rx.userDecoder.DecodeSubscribe(rx.rxTrp, hdr.RemainingLength)
+		vsbck, ngot, err = rx.userDecoder.DecodeSubscribe(r, hdr.RemainingLength)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnSub != nil {
+		if rx.Strict {
+			if err = strictSubscribe(vsbck); err != nil {
+				break
+			}
+		}
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, vsbck, rx.traceRec.rec)
+		}
+		if pkt != nil {
+			pkt.Subscribe = vsbck
+		} else if rx.RxCallbacks.OnSub != nil {
 			err = rx.RxCallbacks.OnSub(rx, vsbck)
 		}
 
 	case PacketUnsubscribe:
 		var vunsub VariablesUnsubscribe
-		vunsub, ngot, err = rx.userDecoder.DecodeUnsubscribe(rx.rxTrp, hdr.RemainingLength)
+		vunsub, ngot, err = rx.userDecoder.DecodeUnsubscribe(r, hdr.RemainingLength)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnUnsub != nil {
+		if rx.Strict {
+			if err = strictUnsubscribe(vunsub); err != nil {
+				break
+			}
+		}
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, vunsub, rx.traceRec.rec)
+		}
+		if pkt != nil {
+			pkt.Unsubscribe = vunsub
+		} else if rx.RxCallbacks.OnUnsub != nil {
 			err = rx.RxCallbacks.OnUnsub(rx, vunsub)
 		}
 
 	case PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback:
 		if hdr.RemainingLength != 2 {
-			err = ErrBadRemainingLen
+			err = &ProtocolError{Packet: packetType, Err: ErrBadRemainingLen}
 			break
 		}
 		// Only PI, no payload.
-		packetIdentifier, ngot, err = decodeUint16(rx.rxTrp)
+		packetIdentifier, ngot, err = decodeUint16(r)
 		n += ngot
 		if err != nil {
 			break
 		}
-		if rx.RxCallbacks.OnOther != nil {
+		if rx.Strict && packetIdentifier == 0 {
+			err = newProtocolError(packetType, "MQTT-2.3.1-1", "zero packet identifier")
+			break
+		}
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, packetIdentifier, rx.traceRec.rec)
+		}
+		if pkt != nil {
+			pkt.PacketIdentifier = packetIdentifier
+		} else if rx.RxCallbacks.OnOther != nil {
 			err = rx.RxCallbacks.OnOther(rx, packetIdentifier)
 		}
 
 	case PacketDisconnect, PacketPingreq, PacketPingresp:
 		if hdr.RemainingLength != 0 {
-			err = ErrBadRemainingLen
+			err = &ProtocolError{Packet: packetType, Err: ErrBadRemainingLen}
 			break
 		}
 		// No payload or variable header.
-		if rx.RxCallbacks.OnOther != nil {
+		if rx.Tracer != nil {
+			rx.Tracer.TracePacket(TraceRx, hdr, nil, rx.traceRec.rec)
+		}
+		if pkt == nil && rx.RxCallbacks.OnOther != nil {
 			err = rx.RxCallbacks.OnOther(rx, packetIdentifier)
 		}
 
@@ -246,6 +395,45 @@ func (rx *Rx) exhaustReader(r io.Reader) (err error) {
 	return err
 }
 
+// payloadChunkSize is the initial capacity of a payload buffer grown by readPayload.
+const payloadChunkSize = 512
+
+// readPayload reads payloadLen bytes from r into buf, reusing buf's memory
+// if it has enough capacity. Otherwise buf is grown as bytes arrive so a peer
+// advertising a large RemainingLength can't make Rx allocate it up front.
+// Errors are the same as those returned by io.ReadFull.
+func readPayload(r io.Reader, buf []byte, payloadLen int) ([]byte, int, error) {
+	if cap(buf) >= payloadLen {
+		buf = buf[:payloadLen]
+		n, err := io.ReadFull(r, buf)
+		return buf[:n], n, err
+	}
+	if cap(buf) < payloadChunkSize {
+		buf = make([]byte, 0, payloadChunkSize)
+	}
+	buf = buf[:0]
+	var err error
+	for len(buf) < payloadLen && err == nil {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		end := cap(buf)
+		if end > payloadLen {
+			end = payloadLen
+		}
+		var n int
+		n, err = r.Read(buf[len(buf):end])
+		buf = buf[:len(buf)+n]
+	}
+	switch {
+	case len(buf) == payloadLen:
+		err = nil
+	case len(buf) > 0 && err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, len(buf), err
+}
+
 // Tx implements a bare minimum MQTT v3.1.1 protocol transport layer handler for transmitting packets.
 // If there is an error during read/write of a packet the transport is closed
 // and a new transport must be set with [Tx.SetTxTransport].
@@ -256,7 +444,19 @@ func (rx *Rx) exhaustReader(r io.Reader) (err error) {
 type Tx struct {
 	txTrp       io.WriteCloser
 	TxCallbacks TxCallbacks
-	buffer      bytes.Buffer
+	// MaxPacketSize is the maximum size of an encoded packet, including the fixed header,
+	// that Tx will write. Writes of larger packets fail with ErrPacketTooLarge before
+	// any byte is written. It should be set to the maximum packet size the peer accepts.
+	// If zero there is no limit other than that imposed by the MQTT specification.
+	MaxPacketSize uint32
+	// Logger is used to log errors encountered while writing packets. May be nil.
+	Logger Logger
+	// Tracer is called with every packet successfully written to the transport. May be nil.
+	Tracer Tracer
+	// LastSentHeader contains the header of the last packet successfully written
+	// to the transport. It is set before OnSuccessfulTx is called.
+	LastSentHeader Header
+	buffer         bytes.Buffer
 }
 
 // TxCallbacks groups functionality executed on transmission success or failure
@@ -266,6 +466,7 @@ type TxCallbacks struct {
 	// then it becomes the responsibility of the callback to close Tx's transport.
 	OnTxError func(*Tx, error)
 	// OnSuccessfulTx is called after a MQTT packet is fully written to the underlying transport.
+	// The packet's header is available via Tx.LastSentHeader.
 	OnSuccessfulTx func(*Tx)
 }
 
@@ -282,11 +483,14 @@ func (tx *Tx) SetTxTransport(transport io.WriteCloser) {
 // WriteConnack writes a CONNECT packet over the transport.
 func (tx *Tx) WriteConnect(varConn *VariablesConnect) error {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
 	h := newHeader(PacketConnect, 0, uint32(varConn.Size()))
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	_, err := h.Encode(buffer)
 	if err != nil {
 		return err
@@ -295,11 +499,18 @@ func (tx *Tx) WriteConnect(varConn *VariablesConnect) error {
 	if err != nil {
 		return err
 	}
+	raw := buffer.Bytes()
 	n, err := buffer.WriteTo(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, varConn, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -307,11 +518,14 @@ func (tx *Tx) WriteConnect(varConn *VariablesConnect) error {
 // WriteConnack writes a CONNACK packet over the transport.
 func (tx *Tx) WriteConnack(varConnack VariablesConnack) error {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
 	h := newHeader(PacketConnack, 0, uint32(varConnack.Size()))
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	_, err := h.Encode(buffer)
 	if err != nil {
 		return err
@@ -320,11 +534,18 @@ func (tx *Tx) WriteConnack(varConnack VariablesConnack) error {
 	if err != nil {
 		return err
 	}
+	raw := buffer.Bytes()
 	n, err := buffer.WriteTo(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, varConnack, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -333,12 +554,18 @@ func (tx *Tx) WriteConnack(varConnack VariablesConnack) error {
 // Application Message in the payload. payload can be zero-length.
 func (tx *Tx) WritePublishPayload(h Header, varPub VariablesPublish, payload []byte) error {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
+	}
+	qos := h.Flags().QoS()
+	if qos != QoS0 && varPub.PacketIdentifier == 0 {
+		return zeroPIError(PacketPublish)
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
-	qos := h.Flags().QoS()
 	h.RemainingLength = uint32(varPub.Size(qos) + len(payload))
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	_, err := h.Encode(buffer)
 	if err != nil {
 		return err
@@ -351,11 +578,19 @@ func (tx *Tx) WritePublishPayload(h Header, varPub VariablesPublish, payload []b
 	if err != nil {
 		return err
 	}
+	raw := buffer.Bytes()
+	raw = raw[:len(raw)-len(payload)] // Payload is not traced, same as Rx.
 	n, err := buffer.WriteTo(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, varPub, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -363,11 +598,14 @@ func (tx *Tx) WritePublishPayload(h Header, varPub VariablesPublish, payload []b
 // WriteSubscribe writes an SUBSCRIBE packet over the transport.
 func (tx *Tx) WriteSubscribe(varSub VariablesSubscribe) error {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
 	h := newHeader(PacketSubscribe, PacketFlagsPubrelSubUnsub, uint32(varSub.Size()))
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	_, err := h.Encode(buffer)
 	if err != nil {
 		return err
@@ -376,11 +614,18 @@ func (tx *Tx) WriteSubscribe(varSub VariablesSubscribe) error {
 	if err != nil {
 		return err
 	}
+	raw := buffer.Bytes()
 	n, err := buffer.WriteTo(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, varSub, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -388,7 +633,7 @@ func (tx *Tx) WriteSubscribe(varSub VariablesSubscribe) error {
 // WriteSuback writes an UNSUBACK packet over the transport.
 func (tx *Tx) WriteSuback(varSub VariablesSuback) error {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	if err := varSub.Validate(); err != nil {
 		return err
@@ -396,6 +641,9 @@ func (tx *Tx) WriteSuback(varSub VariablesSuback) error {
 	buffer := &tx.buffer
 	buffer.Reset()
 	h := newHeader(PacketSuback, 0, uint32(varSub.Size()))
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	_, err := h.Encode(buffer)
 	if err != nil {
 		return err
@@ -404,11 +652,18 @@ func (tx *Tx) WriteSuback(varSub VariablesSuback) error {
 	if err != nil {
 		return err
 	}
+	raw := buffer.Bytes()
 	n, err := buffer.WriteTo(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, varSub, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -416,11 +671,14 @@ func (tx *Tx) WriteSuback(varSub VariablesSuback) error {
 // WriteUnsubscribe writes an UNSUBSCRIBE packet over the transport.
 func (tx *Tx) WriteUnsubscribe(varUnsub VariablesUnsubscribe) error {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	buffer := &tx.buffer
 	buffer.Reset()
 	h := newHeader(PacketUnsubscribe, PacketFlagsPubrelSubUnsub, uint32(varUnsub.Size()))
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	_, err := h.Encode(buffer)
 	if err != nil {
 		return err
@@ -429,11 +687,18 @@ func (tx *Tx) WriteUnsubscribe(varUnsub VariablesUnsubscribe) error {
 	if err != nil {
 		return err
 	}
+	raw := buffer.Bytes()
 	n, err := buffer.WriteTo(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, varUnsub, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -442,27 +707,37 @@ func (tx *Tx) WriteUnsubscribe(varUnsub VariablesUnsubscribe) error {
 // It automatically sets the RemainingLength field to 2.
 func (tx *Tx) WriteIdentified(packetType PacketType, packetIdentifier uint16) (err error) {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	if packetIdentifier == 0 {
-		return errGotZeroPI
+		return zeroPIError(packetType)
 	}
 	// This packet has special QoS1 flag.
 	isPubrelSubUnsub := packetType == PacketPubrel
 	if !(isPubrelSubUnsub || packetType == PacketPuback || packetType == PacketPubrec ||
 		packetType == PacketPubcomp || packetType == PacketUnsuback) {
-		return errors.New("expected a packet type from PUBACK|PUBREL|PUBCOMP|UNSUBACK")
+		return ErrInvalidPacketType
 	}
 
+	h := newHeader(packetType, PacketFlags(b2u8(isPubrelSubUnsub)<<1), 2)
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
 	var buf [5 + 2]byte
-	n := newHeader(packetType, PacketFlags(b2u8(isPubrelSubUnsub)<<1), 2).Put(buf[:])
+	n := h.Put(buf[:])
 	binary.BigEndian.PutUint16(buf[n:], packetIdentifier)
-	n, err = writeFull(tx.txTrp, buf[:n+2])
-
+	raw := buf[:n+2]
+	n, err = writeFull(tx.txTrp, raw)
+	if err == nil && tx.Tracer != nil {
+		tx.Tracer.TracePacket(TraceTx, h, packetIdentifier, raw)
+	}
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
@@ -472,25 +747,75 @@ func (tx *Tx) WriteIdentified(packetType PacketType, packetIdentifier uint16) (e
 // It also returns an error with encoding step if there was one.
 func (tx *Tx) WriteSimple(packetType PacketType) (err error) {
 	if tx.txTrp == nil {
-		return errors.New("nil transport")
+		return ErrNilTransport
 	}
 	isValid := packetType == PacketDisconnect || packetType == PacketPingreq || packetType == PacketPingresp
 	if !isValid {
-		return errors.New("expected packet type from PINGREQ|PINGRESP|DISCONNECT")
+		return ErrInvalidPacketType
+	}
+	h := newHeader(packetType, 0, 0)
+	if err := tx.checkSize(h); err != nil {
+		return err
+	}
+	n, err := h.Encode(tx.txTrp)
+	if err == nil && tx.Tracer != nil {
+		var buf [5]byte
+		tx.Tracer.TracePacket(TraceTx, h, nil, buf[:h.Put(buf[:])])
 	}
-	n, err := newHeader(packetType, 0, 0).Encode(tx.txTrp)
 	if err != nil && n > 0 {
 		tx.prepClose(err)
-	} else if tx.TxCallbacks.OnSuccessfulTx != nil && err == nil {
-		tx.TxCallbacks.OnSuccessfulTx(tx)
+	} else if err == nil {
+		tx.LastSentHeader = h
+		if tx.TxCallbacks.OnSuccessfulTx != nil {
+			tx.TxCallbacks.OnSuccessfulTx(tx)
+		}
 	}
 	return err
 }
 
+// WritePacket writes pkt over the transport by calling the Write method corresponding
+// to pkt's packet type. Only the variable header field matching the packet type is used.
+// The RemainingLength and flags of non-PUBLISH packets are set automatically.
+func (tx *Tx) WritePacket(pkt *Packet) error {
+	if pkt == nil {
+		return ErrNilPacket
+	}
+	switch tp := pkt.Header.Type(); tp {
+	case PacketConnect:
+		return tx.WriteConnect(&pkt.Connect)
+	case PacketConnack:
+		return tx.WriteConnack(pkt.Connack)
+	case PacketPublish:
+		return tx.WritePublishPayload(pkt.Header, pkt.Publish, pkt.Payload)
+	case PacketSubscribe:
+		return tx.WriteSubscribe(pkt.Subscribe)
+	case PacketSuback:
+		return tx.WriteSuback(pkt.Suback)
+	case PacketUnsubscribe:
+		return tx.WriteUnsubscribe(pkt.Unsubscribe)
+	case PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp, PacketUnsuback:
+		return tx.WriteIdentified(tp, pkt.PacketIdentifier)
+	case PacketDisconnect, PacketPingreq, PacketPingresp:
+		return tx.WriteSimple(tp)
+	}
+	return ErrInvalidPacketType
+}
+
+// checkSize returns ErrPacketTooLarge if the packet with header h exceeds MaxPacketSize.
+func (tx *Tx) checkSize(h Header) error {
+	if tx.MaxPacketSize != 0 && uint64(h.Size())+uint64(h.RemainingLength) > uint64(tx.MaxPacketSize) {
+		return ErrPacketTooLarge
+	}
+	return nil
+}
+
 // Close closes the underlying tranport and returns an error if any.
 func (tx *Tx) CloseTx() error { return tx.txTrp.Close() }
 
 func (tx *Tx) prepClose(err error) {
+	if tx.Logger != nil {
+		tx.Logger.Log(LevelError, "tx failed", "err", err)
+	}
 	if tx.TxCallbacks.OnTxError != nil {
 		tx.TxCallbacks.OnTxError(tx, err)
 	} else {
@@ -0,0 +1,220 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// shareLevel is the first topic level of shared subscription topic filters.
+const shareLevel = "$share"
+
+var errNotShared = errors.New("topic filter is not a shared subscription")
+
+// SharedFilter is a shared subscription topic filter of the form
+// "$share/{ShareName}/{Filter}". Shared subscriptions are defined by MQTT v5
+// and supported by many MQTT v3.1.1 servers. Every PUBLISH matching Filter is
+// sent to only one of the clients subscribed with the same ShareName.
+type SharedFilter struct {
+	// ShareName identifies the group of clients sharing the subscription.
+	ShareName string
+	// Filter is the topic filter of the subscription, which may contain wildcards.
+	Filter string
+}
+
+// ParseSharedFilter parses a shared subscription topic filter. ok is false
+// if filter is not a shared subscription, in which case err is nil.
+func ParseSharedFilter(filter string) (sf SharedFilter, ok bool, err error) {
+	parts := strings.Split(filter, "/")
+	if !isShared(parts) {
+		return SharedFilter{}, false, nil
+	}
+	if err := validateWildcards(parts); err != nil {
+		return SharedFilter{}, true, err
+	}
+	return SharedFilter{ShareName: parts[1], Filter: strings.Join(parts[2:], "/")}, true, nil
+}
+
+// String returns the shared subscription topic filter i.e: "$share/workers/jobs/#".
+func (sf SharedFilter) String() string {
+	return shareLevel + "/" + sf.ShareName + "/" + sf.Filter
+}
+
+// ShareStrategy selects the member of a shared subscription group that receives a PUBLISH.
+type ShareStrategy uint8
+
+const (
+	// ShareRoundRobin sends to the members of a group in turn.
+	ShareRoundRobin ShareStrategy = iota
+	// ShareLeastInFlight sends to the member of a group with the least messages
+	// in flight, in turn among members with as many. Messages are in flight from
+	// the time they are picked until SharedGroups.Done is called.
+	ShareLeastInFlight
+)
+
+// SharedGroups keeps the members of the shared subscriptions of a server and
+// picks which member of each group receives a PUBLISH. Members are identified
+// by client identifier. The zero value is ready for use, balances with
+// ShareRoundRobin and is safe for concurrent use.
+//
+// Servers call Subscribe and Unsubscribe for topic filters of SUBSCRIBE and
+// UNSUBSCRIBE packets that parse with ParseSharedFilter, Remove when a client
+// disconnects, and Pick for every PUBLISH to route.
+type SharedGroups struct {
+	// Strategy must be set before calling other methods.
+	Strategy ShareStrategy
+
+	mu       sync.Mutex
+	groups   map[SharedFilter]*shareGroup
+	inFlight map[string]int
+}
+
+// shareGroup is the set of clients subscribed with the same share name and filter.
+type shareGroup struct {
+	members []string
+	// next is the index of the next member in turn.
+	next int
+}
+
+// Subscribe adds clientID to the group of the shared subscription topic filter.
+// Subscribing again to a group is not an error.
+func (sg *SharedGroups) Subscribe(filter, clientID string) error {
+	sf, ok, err := ParseSharedFilter(filter)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errNotShared
+	}
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if sg.groups == nil {
+		sg.groups = make(map[SharedFilter]*shareGroup)
+		sg.inFlight = make(map[string]int)
+	}
+	g := sg.groups[sf]
+	if g == nil {
+		g = &shareGroup{}
+		sg.groups[sf] = g
+	}
+	if g.index(clientID) < 0 {
+		g.members = append(g.members, clientID)
+	}
+	return nil
+}
+
+// Unsubscribe removes clientID from the group of the shared subscription topic
+// filter. It returns false if clientID was not a member.
+func (sg *SharedGroups) Unsubscribe(filter, clientID string) (bool, error) {
+	sf, ok, err := ParseSharedFilter(filter)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return false, errNotShared
+	}
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.unsubscribe(sf, clientID), nil
+}
+
+// Remove removes clientID from all groups, i.e: when its connection ends, so
+// that following messages are shared among the remaining members. Messages in
+// flight to clientID that the server redelivers should be passed to Pick again.
+func (sg *SharedGroups) Remove(clientID string) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	for sf := range sg.groups {
+		sg.unsubscribe(sf, clientID)
+	}
+	delete(sg.inFlight, clientID)
+}
+
+// Pick appends to dst the client identifier of the member chosen in each group
+// with a topic filter matching topic and returns the extended slice. The
+// in-flight count of the chosen members is incremented.
+func (sg *SharedGroups) Pick(topic string, dst []string) []string {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	for sf, g := range sg.groups {
+		if !MatchTopic(sf.Filter, topic) {
+			continue
+		}
+		clientID := g.pick(sg.Strategy, sg.inFlight)
+		sg.inFlight[clientID]++
+		dst = append(dst, clientID)
+	}
+	return dst
+}
+
+// Done decrements the in-flight count of a message picked for clientID. It
+// should be called when the message is acknowledged, or written for QoS0.
+func (sg *SharedGroups) Done(clientID string) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if sg.inFlight[clientID] > 0 {
+		sg.inFlight[clientID]--
+	}
+}
+
+// InFlight returns the number of messages picked for clientID and not yet done.
+func (sg *SharedGroups) InFlight(clientID string) int {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.inFlight[clientID]
+}
+
+// Members returns the client identifiers in the group of the shared
+// subscription topic filter.
+func (sg *SharedGroups) Members(filter string) []string {
+	sf, _, _ := ParseSharedFilter(filter)
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	g := sg.groups[sf]
+	if g == nil {
+		return nil
+	}
+	return append([]string{}, g.members...)
+}
+
+// unsubscribe removes clientID from the group of sf. sg.mu must be held.
+func (sg *SharedGroups) unsubscribe(sf SharedFilter, clientID string) bool {
+	g := sg.groups[sf]
+	if g == nil {
+		return false
+	}
+	i := g.index(clientID)
+	if i < 0 {
+		return false
+	}
+	g.members = append(g.members[:i], g.members[i+1:]...)
+	if i < g.next {
+		g.next-- // Keep the turn of the following member.
+	}
+	if len(g.members) == 0 {
+		delete(sg.groups, sf)
+	}
+	return true
+}
+
+func (g *shareGroup) index(clientID string) int {
+	for i, member := range g.members {
+		if member == clientID {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick returns the member that receives the next message. g must have members.
+func (g *shareGroup) pick(strategy ShareStrategy, inFlight map[string]int) string {
+	chosen := g.next % len(g.members)
+	if strategy == ShareLeastInFlight {
+		for i := 1; i < len(g.members); i++ {
+			j := (g.next + i) % len(g.members)
+			if inFlight[g.members[j]] < inFlight[g.members[chosen]] {
+				chosen = j
+			}
+		}
+	}
+	g.next = (chosen + 1) % len(g.members)
+	return g.members[chosen]
+}
@@ -0,0 +1,160 @@
+package mqtt
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// Strict mode validation of received packets. These checks are only performed
+// when Rx.Strict is set since they are not needed for decoding and add processing
+// time to each received packet. Each violation is reported as a *ProtocolError.
+
+// strictConnect checks a decoded CONNECT variable header. raw holds the bytes
+// read by the Decoder, from which the connect flags are checked since they are
+// not all kept in vc.
+func (rx *Rx) strictConnect(vc *VariablesConnect, raw []byte) error {
+	if rx.connectRxed {
+		return newProtocolError(PacketConnect, "MQTT-3.1.0-2", "second CONNECT received over network connection")
+	}
+	if string(vc.Protocol) != DefaultProtocol {
+		return newProtocolError(PacketConnect, "MQTT-3.1.2-1", "protocol name is not \"MQTT\"")
+	}
+	// Connect flags follow the protocol name and level.
+	if i := 2 + len(vc.Protocol) + 1; i < len(raw) {
+		flags := raw[i]
+		if flags&1 != 0 {
+			return newProtocolError(PacketConnect, "MQTT-3.1.2-3", "reserved bit set in CONNECT flag")
+		}
+		if flags&(1<<6) != 0 && flags&(1<<7) == 0 {
+			return newProtocolError(PacketConnect, "MQTT-3.1.2-22", "password flag set without username flag")
+		}
+	}
+	if !vc.WillFlag() {
+		if vc.WillQoS != QoS0 {
+			return newProtocolError(PacketConnect, "MQTT-3.1.2-13", "will QoS set with will flag unset")
+		}
+		if vc.WillRetain {
+			return newProtocolError(PacketConnect, "MQTT-3.1.2-15", "will retain set with will flag unset")
+		}
+	} else if vc.WillQoS > QoS2 {
+		return newProtocolError(PacketConnect, "MQTT-3.1.2-14", "will QoS is 3")
+	}
+	for _, s := range [...][]byte{vc.ClientID, vc.WillTopic, vc.Username} {
+		if err := strictString(PacketConnect, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strictConnack checks a decoded CONNACK variable header.
+func strictConnack(vc VariablesConnack) error {
+	if vc.SessionPresent() && vc.ReturnCode != ReturnCodeConnAccepted {
+		return newProtocolError(PacketConnack, "MQTT-3.2.2-4", "session present set with non-zero return code")
+	}
+	return nil
+}
+
+// strictPublish checks a decoded PUBLISH variable header.
+func strictPublish(qos QoSLevel, vp VariablesPublish) error {
+	if qos != QoS0 && vp.PacketIdentifier == 0 {
+		return zeroPIError(PacketPublish)
+	}
+	if err := strictString(PacketPublish, vp.TopicName); err != nil {
+		return err
+	}
+	if bytes.IndexByte(vp.TopicName, '#') >= 0 || bytes.IndexByte(vp.TopicName, '+') >= 0 {
+		return errWildcardTopic
+	}
+	return nil
+}
+
+// strictSubscribe checks a decoded SUBSCRIBE variable header.
+func strictSubscribe(vs VariablesSubscribe) error {
+	if vs.PacketIdentifier == 0 {
+		return zeroPIError(PacketSubscribe)
+	}
+	if len(vs.TopicFilters) == 0 {
+		return errNoSubscribeFilters
+	}
+	for _, sub := range vs.TopicFilters {
+		if sub.QoS > QoS2 {
+			return errInvalidSubscribeQoS
+		}
+		if err := strictTopicFilter(PacketSubscribe, sub.TopicFilter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strictSuback checks a decoded SUBACK variable header.
+func strictSuback(vs VariablesSuback) error {
+	if vs.PacketIdentifier == 0 {
+		return zeroPIError(PacketSuback)
+	}
+	for _, rc := range vs.ReturnCodes {
+		if !rc.IsValid() && rc != QoSSubfail {
+			return newProtocolError(PacketSuback, "MQTT-3.9.3-2", "return code not 0x00, 0x01, 0x02 or 0x80")
+		}
+	}
+	return nil
+}
+
+// strictUnsubscribe checks a decoded UNSUBSCRIBE variable header.
+func strictUnsubscribe(vu VariablesUnsubscribe) error {
+	if vu.PacketIdentifier == 0 {
+		return zeroPIError(PacketUnsubscribe)
+	}
+	if len(vu.Topics) == 0 {
+		return errNoUnsubscribeTopics
+	}
+	for _, filter := range vu.Topics {
+		if err := strictTopicFilter(PacketUnsubscribe, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strictTopicFilter checks a SUBSCRIBE or UNSUBSCRIBE topic filter is a non-empty,
+// well formed UTF-8 string and that wildcards occupy entire topic levels.
+func strictTopicFilter(pt PacketType, filter []byte) error {
+	if len(filter) == 0 {
+		if pt == PacketSubscribe {
+			return errEmptyTopicFilter
+		}
+		return newProtocolError(pt, "MQTT-4.7.3-1", "empty topic filter")
+	}
+	if err := strictString(pt, filter); err != nil {
+		return err
+	}
+	for len(filter) > 0 {
+		level := filter
+		idx := bytes.IndexByte(filter, '/')
+		if idx >= 0 {
+			level, filter = filter[:idx], filter[idx+1:]
+		} else {
+			filter = nil
+		}
+		multi := bytes.IndexByte(level, '#')
+		if multi >= 0 && (len(level) != 1 || idx >= 0) {
+			return newProtocolError(pt, "MQTT-4.7.1-2", "multi-level wildcard not alone in last topic level")
+		}
+		if bytes.IndexByte(level, '+') >= 0 && len(level) != 1 {
+			return newProtocolError(pt, "MQTT-4.7.1-3", "single-level wildcard not alone in topic level")
+		}
+	}
+	return nil
+}
+
+// strictString checks an MQTT UTF-8 encoded string.
+func strictString(pt PacketType, s []byte) error {
+	if !utf8.Valid(s) {
+		return newProtocolError(pt, "MQTT-1.5.3-1", "ill-formed UTF-8 string")
+	}
+	if bytes.IndexByte(s, 0) >= 0 {
+		return newProtocolError(pt, "MQTT-1.5.3-2", "null character in UTF-8 string")
+	}
+	return nil
+}
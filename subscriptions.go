@@ -1,7 +1,6 @@
 package mqtt
 
 import (
-	"errors"
 	"strings"
 )
 
@@ -37,7 +36,7 @@ type subscriptionsMap map[string]struct{}
 func (sm subscriptionsMap) Subscribe(topic []byte) error {
 	tp := string(topic)
 	if _, ok := sm[tp]; ok {
-		return errors.New("topic already exists in subscriptions")
+		return errTopicExists
 	}
 	sm[tp] = struct{}{}
 	return nil
@@ -57,6 +56,7 @@ func (sm subscriptionsMap) match(topicFilter string, userBuffer []byte, deleteMa
 	if err := validateWildcards(filterParts); err != nil {
 		return nil, err
 	}
+	filter := strings.Join(unshare(filterParts), "/")
 
 	_, hasNonWildSub := sm[topicFilter]
 	if hasNonWildSub {
@@ -72,8 +72,7 @@ func (sm subscriptionsMap) match(topicFilter string, userBuffer []byte, deleteMa
 	}
 
 	for k := range sm {
-		parts := strings.Split(k, "/")
-		if matches(filterParts, parts) {
+		if MatchTopic(filter, k) {
 			if len(k) > len(userBuffer) {
 				return matched, ErrUserBufferFull
 			}
@@ -88,26 +87,32 @@ func (sm subscriptionsMap) match(topicFilter string, userBuffer []byte, deleteMa
 	return matched, nil
 }
 
-func matches(filter, topicParts []string) bool {
-	i := 0
-	for i < len(topicParts) {
-		// topic is longer, no match
-		if i >= len(filter) {
-			return false
-		}
-		// matched up to here, and now the wildcard says "all others will match"
-		if filter[i] == "#" {
+// MatchTopic reports whether topic matches the topic filter, which may contain
+// the '+' and '#' wildcards. Filters starting with a wildcard do not match topics
+// starting with '$' as per MQTT-4.7.2-1. The "$share/{ShareName}/" prefix of
+// shared subscriptions must be removed beforehand, i.e: with ParseSharedFilter.
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "#") || strings.HasPrefix(filter, "+")) {
+		return false
+	}
+	for {
+		flevel, frest, fmore := strings.Cut(filter, "/")
+		if flevel == "#" {
 			return true
 		}
-		// text does not match, and there wasn't a + to excuse it
-		if topicParts[i] != filter[i] && filter[i] != "+" {
+		tlevel, trest, tmore := strings.Cut(topic, "/")
+		switch {
+		case flevel != "+" && flevel != tlevel:
+			return false
+		case !tmore:
+			// make finance/stock/ibm/# match finance/stock/ibm
+			return !fmore || frest == "#"
+		case !fmore:
+			// topic is longer, no match
 			return false
 		}
-		i++
+		filter, topic = frest, trest
 	}
-
-	// make finance/stock/ibm/# match finance/stock/ibm
-	return i == len(filter)-1 && filter[len(filter)-1] == "#" || i == len(filter)
 }
 
 func isWildcard(topic string) bool {
@@ -115,16 +120,41 @@ func isWildcard(topic string) bool {
 }
 
 func validateWildcards(wildcards []string) error {
+	if isShared(wildcards) {
+		// Shared subscription of the form $share/{ShareName}/{filter}.
+		if len(wildcards) < 3 || len(wildcards) == 3 && wildcards[2] == "" {
+			return newProtocolError(PacketSubscribe, "", "shared subscription without topic filter")
+		} else if wildcards[1] == "" || isWildcard(wildcards[1]) {
+			return newProtocolError(PacketSubscribe, "", "shared subscription share name must be non-empty without wildcards")
+		}
+		wildcards = wildcards[2:]
+	}
 	for i, part := range wildcards {
 		// catch things like finance#
-		if isWildcard(part) && len(part) != 1 {
-			return errors.New("malformed wildcard of style \"finance#\"")
+		if strings.IndexByte(part, '#') >= 0 && part != "#" {
+			return newProtocolError(PacketSubscribe, "MQTT-4.7.1-2", "malformed wildcard of style \"finance#\"")
+		} else if strings.IndexByte(part, '+') >= 0 && part != "+" {
+			return newProtocolError(PacketSubscribe, "MQTT-4.7.1-3", "malformed wildcard of style \"finance+\"")
 		}
 		isSingle := len(part) == 1 && part[0] == '#'
 		// # can only occur as the last part
 		if isSingle && i != len(wildcards)-1 {
-			return errors.New("last wildcard is single \"#\"")
+			return newProtocolError(PacketSubscribe, "MQTT-4.7.1-2", "multi-level wildcard \"#\" is not last")
 		}
 	}
 	return nil
 }
+
+// isShared returns true if the topic filter levels are those of a shared subscription.
+func isShared(filterParts []string) bool {
+	return len(filterParts) > 1 && filterParts[0] == shareLevel
+}
+
+// unshare returns the levels of the topic filter of a shared subscription,
+// or filterParts if not a shared subscription.
+func unshare(filterParts []string) []string {
+	if isShared(filterParts) && len(filterParts) > 2 {
+		return filterParts[2:]
+	}
+	return filterParts
+}
@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// TraceDirection indicates whether a traced packet was received or transmitted.
+type TraceDirection uint8
+
+const (
+	// TraceRx marks a packet read by Rx.
+	TraceRx TraceDirection = iota + 1
+	// TraceTx marks a packet written by Tx.
+	TraceTx
+)
+
+// String returns "Received" for TraceRx and "Sending" for TraceTx. Does not allocate memory.
+func (dir TraceDirection) String() (s string) {
+	switch dir {
+	case TraceRx:
+		s = "Received"
+	case TraceTx:
+		s = "Sending"
+	default:
+		s = "undefined trace direction"
+	}
+	return s
+}
+
+// Tracer is implemented by types that observe packets as they are read by Rx and written by Tx.
+// Tracing is disabled by leaving the Tracer field of Rx and Tx nil, which incurs no cost.
+//
+// vars is the packet's variable header as passed to RxCallbacks: *VariablesConnect,
+// VariablesConnack, VariablesPublish, VariablesSubscribe, VariablesSuback or VariablesUnsubscribe.
+// vars is the packet identifier as a uint16 for PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK
+// packets and nil for PINGREQ, PINGRESP and DISCONNECT packets.
+// raw contains the packet bytes as seen on the wire excluding the PUBLISH payload.
+// raw and the strings in vars must not be retained after TracePacket returns.
+type Tracer interface {
+	TracePacket(dir TraceDirection, hdr Header, vars any, raw []byte)
+}
+
+var _ Tracer = (*TextTracer)(nil)
+
+// TextTracer is a Tracer that writes a human readable line for every packet
+// in the style of mosquitto's debug output, i.e:
+//
+//	Sending PUBLISH (d0, q1, r0, m12, 'a/b', ... (5 bytes))
+//
+// TextTracer is safe for concurrent use by Rx and Tx. Each packet is written
+// to W with a single call to Write and calls to Write are not concurrent.
+type TextTracer struct {
+	// W is where trace lines are written to.
+	W io.Writer
+	// Prefix is written at the start of every line, i.e: "Client salamanca ".
+	Prefix string
+	// HexDump enables writing a hex dump of the raw packet bytes after every line.
+	HexDump bool
+	mu      sync.Mutex
+	buf     []byte
+}
+
+// TracePacket implements the [Tracer] interface.
+func (tt *TextTracer) TracePacket(dir TraceDirection, hdr Header, vars any, raw []byte) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	b := append(tt.buf[:0], tt.Prefix...)
+	b = append(b, dir.String()...)
+	b = append(b, ' ')
+	b = appendTrace(b, hdr, vars)
+	b = append(b, '\n')
+	if tt.HexDump && len(raw) > 0 {
+		b = append(b, hex.Dump(raw)...)
+	}
+	tt.buf = b
+	tt.W.Write(b)
+}
+
+// appendTrace appends the mosquitto-style representation of a packet to b.
+func appendTrace(b []byte, hdr Header, vars any) []byte {
+	b = append(b, hdr.Type().String()...)
+	switch v := vars.(type) {
+	case *VariablesConnect:
+		b = append(b, " (c"...)
+		b = strconv.AppendUint(b, uint64(b2u8(v.CleanSession)), 10)
+		b = append(b, ", k"...)
+		b = strconv.AppendUint(b, uint64(v.KeepAlive), 10)
+		b = append(b, ", u"...)
+		b = strconv.AppendUint(b, uint64(b2u8(len(v.Username) != 0)), 10)
+		b = append(b, ", p"...)
+		b = strconv.AppendUint(b, uint64(b2u8(len(v.Password) != 0)), 10)
+		b = append(b, ", w"...)
+		b = strconv.AppendUint(b, uint64(b2u8(v.WillFlag())), 10)
+		b = append(b, ", '"...)
+		b = append(b, v.ClientID...)
+		b = append(b, "')"...)
+
+	case VariablesConnack:
+		b = append(b, " ("...)
+		b = strconv.AppendUint(b, uint64(v.ReturnCode), 10)
+		b = append(b, ')')
+
+	case VariablesPublish:
+		flags := hdr.Flags()
+		qos := flags.QoS()
+		b = append(b, " (d"...)
+		b = strconv.AppendUint(b, uint64(b2u8(flags.Dup())), 10)
+		b = append(b, ", q"...)
+		b = strconv.AppendUint(b, uint64(qos), 10)
+		b = append(b, ", r"...)
+		b = strconv.AppendUint(b, uint64(b2u8(flags.Retain())), 10)
+		b = append(b, ", m"...)
+		b = strconv.AppendUint(b, uint64(v.PacketIdentifier), 10)
+		b = append(b, ", '"...)
+		b = append(b, v.TopicName...)
+		b = append(b, "', ... ("...)
+		b = strconv.AppendInt(b, int64(hdr.RemainingLength)-int64(v.Size(qos)), 10)
+		b = append(b, " bytes))"...)
+
+	case VariablesSubscribe:
+		b = append(b, " (Mid: "...)
+		b = strconv.AppendUint(b, uint64(v.PacketIdentifier), 10)
+		for _, sub := range v.TopicFilters {
+			b = append(b, ", Topic: "...)
+			b = append(b, sub.TopicFilter...)
+			b = append(b, ", QoS: "...)
+			b = strconv.AppendUint(b, uint64(sub.QoS), 10)
+		}
+		b = append(b, ')')
+
+	case VariablesSuback:
+		b = append(b, " (Mid: "...)
+		b = strconv.AppendUint(b, uint64(v.PacketIdentifier), 10)
+		for i, rc := range v.ReturnCodes {
+			if i == 0 {
+				b = append(b, ", Return codes: "...)
+			} else {
+				b = append(b, ", "...)
+			}
+			b = strconv.AppendUint(b, uint64(rc), 10)
+		}
+		b = append(b, ')')
+
+	case VariablesUnsubscribe:
+		b = append(b, " (Mid: "...)
+		b = strconv.AppendUint(b, uint64(v.PacketIdentifier), 10)
+		for _, topic := range v.Topics {
+			b = append(b, ", Topic: "...)
+			b = append(b, topic...)
+		}
+		b = append(b, ')')
+
+	case uint16:
+		b = append(b, " (m"...)
+		b = strconv.AppendUint(b, uint64(v), 10)
+		b = append(b, ')')
+	}
+	return b
+}
+
+// recordReader records all bytes read through it. Used by Rx for tracing.
+type recordReader struct {
+	r   io.Reader
+	rec []byte
+}
+
+func (rr *recordReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	rr.rec = append(rr.rec, b[:n]...)
+	return n, err
+}
@@ -0,0 +1,181 @@
+// Package transport dials MQTT servers over TCP and TLS given a server URL.
+//
+// Supported URL schemes are mqtt:// and tcp:// for plain TCP connections on
+// port 1883 by default, and mqtts:// and ssl:// for TLS connections on port 8883
+// by default. The returned connection is ready to be passed to [mqtt.Client.Connect]:
+//
+//	conn, err := transport.Dial(ctx, "mqtts://broker.example.com", transport.Config{})
+//	if err != nil {
+//		return err
+//	}
+//	err = client.Connect(ctx, conn, &varConn)
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default ports of MQTT servers as registered with IANA.
+const (
+	DefaultPort    = 1883
+	DefaultTLSPort = 8883
+)
+
+// Endpoint is an MQTT server address parsed from a URL.
+type Endpoint struct {
+	// Addr is the host and port of the server, i.e: "broker.example.com:8883".
+	Addr string
+	// TLS is true for mqtts:// and ssl:// URLs.
+	TLS bool
+}
+
+// ParseURL parses an MQTT server URL such as "mqtt://localhost" or
+// "mqtts://broker.example.com:8884". The default port of the scheme is used
+// if the URL has no port.
+func ParseURL(rawURL string) (Endpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	var ep Endpoint
+	port := DefaultPort
+	switch strings.ToLower(u.Scheme) {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl":
+		ep.TLS = true
+		port = DefaultTLSPort
+	case "":
+		return Endpoint{}, errors.New("missing URL scheme in " + strconv.Quote(rawURL))
+	default:
+		return Endpoint{}, errors.New("unsupported URL scheme " + strconv.Quote(u.Scheme) + ", expected mqtt, tcp, mqtts or ssl")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return Endpoint{}, errors.New("missing host in " + strconv.Quote(rawURL))
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil || port == 0 || port > 0xffff {
+			return Endpoint{}, errors.New("invalid port " + strconv.Quote(u.Port()))
+		}
+	}
+	ep.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	return ep, nil
+}
+
+// Config configures how connections are dialed. The zero value dials with
+// Go's default TCP settings and verifies TLS servers against the system roots.
+type Config struct {
+	// Timeout limits the time taken to establish the connection, including
+	// the TLS handshake. Zero means no timeout other than the context deadline.
+	Timeout time.Duration
+	// KeepAlive is the period between TCP keep-alive probes. Zero uses
+	// Go's default period and a negative value disables keep-alive probes.
+	// TCP keep-alive is independent of the MQTT Keep Alive of CONNECT.
+	KeepAlive time.Duration
+	// Delay enables Nagle's algorithm which coalesces small writes. By default
+	// TCP_NODELAY is set so packets such as PINGREQ are sent immediately.
+	Delay bool
+
+	// TLS is the base TLS configuration for mqtts:// and ssl:// URLs. It is
+	// cloned before use and may be nil. Fields below override it when set.
+	TLS *tls.Config
+	// Certificates are presented to the server for mutual TLS authentication.
+	Certificates []tls.Certificate
+	// RootCAs verify the server certificate. If nil the system pool is used.
+	RootCAs *x509.CertPool
+	// ServerName is sent in the TLS Server Name Indication extension and
+	// used to verify the server certificate. Defaults to the URL host.
+	ServerName string
+}
+
+// Dial connects to the MQTT server at rawURL. See [ParseURL] for supported URLs.
+// The returned connection can be passed to [mqtt.Client.Connect].
+func Dial(ctx context.Context, rawURL string, cfg Config) (net.Conn, error) {
+	ep, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return DialEndpoint(ctx, ep, cfg)
+}
+
+// DialEndpoint connects to the MQTT server at ep.
+func DialEndpoint(ctx context.Context, ep Endpoint, cfg Config) (net.Conn, error) {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	dialer := net.Dialer{KeepAlive: cfg.KeepAlive}
+	conn, err := dialer.DialContext(ctx, "tcp", ep.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Delay {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			err = tcp.SetNoDelay(false)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	if !ep.TLS {
+		return conn, nil
+	}
+	host, _, _ := net.SplitHostPort(ep.Addr)
+	tlsConn := tls.Client(conn, cfg.tlsConfig(host))
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsConfig returns the TLS configuration for a connection to host.
+func (cfg *Config) tlsConfig(host string) *tls.Config {
+	var tc *tls.Config
+	if cfg.TLS != nil {
+		tc = cfg.TLS.Clone()
+	} else {
+		tc = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if cfg.Certificates != nil {
+		tc.Certificates = cfg.Certificates
+	}
+	if cfg.RootCAs != nil {
+		tc.RootCAs = cfg.RootCAs
+	}
+	if cfg.ServerName != "" {
+		tc.ServerName = cfg.ServerName
+	} else if tc.ServerName == "" {
+		tc.ServerName = host
+	}
+	return tc
+}
+
+// LoadCertPool returns a certificate pool with the PEM encoded certificates in files.
+// It is useful to set [Config.RootCAs] to the certificate authority of a private broker.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no PEM certificates found in " + file)
+		}
+	}
+	return pool, nil
+}
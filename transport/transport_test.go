@@ -0,0 +1,218 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/natiu-mqtt/mqtttest"
+)
+
+func TestParseURL(t *testing.T) {
+	for _, test := range []struct {
+		url     string
+		want    Endpoint
+		wantErr bool
+	}{
+		{url: "mqtt://localhost", want: Endpoint{Addr: "localhost:1883"}},
+		{url: "tcp://10.0.0.1:1884", want: Endpoint{Addr: "10.0.0.1:1884"}},
+		{url: "mqtts://broker.example.com", want: Endpoint{Addr: "broker.example.com:8883", TLS: true}},
+		{url: "SSL://[::1]:8884", want: Endpoint{Addr: "[::1]:8884", TLS: true}},
+		{url: "ws://localhost", wantErr: true},
+		{url: "localhost:1883", wantErr: true},
+		{url: "mqtt://:1883", wantErr: true},
+		{url: "mqtt://localhost:0", wantErr: true},
+		{url: "mqtt://localhost:65536", wantErr: true},
+	} {
+		got, err := ParseURL(test.url)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseURL(%q) error = %v, want error %v", test.url, err, test.wantErr)
+		} else if got != test.want {
+			t.Errorf("ParseURL(%q) = %+v, want %+v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestDialTCP(t *testing.T) {
+	var b mqtttest.Broker
+	defer b.Close()
+	l, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := Dial(context.Background(), "mqtt://"+l.Addr().String(), Config{Timeout: time.Second, KeepAlive: -1, Delay: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect(t, conn, "tcp")
+}
+
+func TestDialMutualTLS(t *testing.T) {
+	ca := newCA(t)
+	serverCert := ca.issue(t, "broker.test", x509.ExtKeyUsageServerAuth)
+	clientCert := ca.issue(t, "salamanca", x509.ExtKeyUsageClientAuth)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := LoadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverNames := make(chan string, 4)
+	var b mqtttest.Broker
+	defer b.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go b.Serve(l)
+	url := "mqtts://" + l.Addr().String()
+
+	cfg := Config{
+		Timeout:      time.Second,
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      roots,
+		ServerName:   "broker.test",
+	}
+	conn, err := Dial(context.Background(), url, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-serverNames; got != "broker.test" {
+		t.Errorf("server got SNI %q, want broker.test", got)
+	}
+	connect(t, conn, "salamanca")
+
+	// Server certificate is not valid for the URL host by default.
+	cfg.ServerName = ""
+	_, err = Dial(context.Background(), url, cfg)
+	if err == nil {
+		t.Error("expected error verifying server certificate for 127.0.0.1")
+	}
+	// Server requires a client certificate.
+	cfg.ServerName = "broker.test"
+	cfg.Certificates = nil
+	conn, err = Dial(context.Background(), url, cfg)
+	if err == nil {
+		// TLS 1.3 client handshake completes before the server verifies the client.
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("expected error connecting without client certificate")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "empty.pem")
+	err := os.WriteFile(file, []byte("not a certificate"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadCertPool(file)
+	if err == nil {
+		t.Error("expected error loading file without certificates")
+	}
+	_, err = LoadCertPool(file + ".missing")
+	if err == nil {
+		t.Error("expected error loading missing file")
+	}
+}
+
+// connect performs the MQTT connection handshake over conn.
+func connect(t *testing.T, conn net.Conn, clientID string) {
+	t.Helper()
+	defer conn.Close()
+	client := mqtt.NewClient(mqtt.ClientConfig{})
+	var varConn mqtt.VariablesConnect
+	varConn.SetDefaultMQTT([]byte(clientID))
+	conn.SetDeadline(time.Now().Add(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.Connect(ctx, conn, &varConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect(errors.New("done"))
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "natiu test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate signed by ca for name.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}